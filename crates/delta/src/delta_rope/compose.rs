@@ -70,6 +70,7 @@ impl<V: DeltaValue, Attr: DeltaAttr> DeltaRope<V, Attr> {
     ) {
         let mut should_insert = this_value.rle_len() > 0;
         let mut left_del_len = delete;
+        let mut over_replace = false;
         if delete > 0 {
             assert!(*index < self.len());
             let range = *index..(*index + left_del_len).min(self.len());
@@ -80,7 +81,7 @@ impl<V: DeltaValue, Attr: DeltaAttr> DeltaRope<V, Attr> {
                 should_insert = false;
                 left_del_len = 0;
             } else {
-                self._replace_batch_leaves(from, to, &mut left_del_len);
+                over_replace = self._replace_batch_leaves(from, to, &mut left_del_len);
             }
         }
 
@@ -92,7 +93,11 @@ impl<V: DeltaValue, Attr: DeltaAttr> DeltaRope<V, Attr> {
                     Default::default()
                 },
                 attr: if should_insert {
-                    this_attr.clone()
+                    let mut attr = this_attr.clone();
+                    if over_replace {
+                        attr.compose_over_replace();
+                    }
+                    attr
                 } else {
                     Default::default()
                 },
@@ -104,12 +109,14 @@ impl<V: DeltaValue, Attr: DeltaAttr> DeltaRope<V, Attr> {
         *index += this_value.rle_len();
     }
 
+    /// Returns whether any of the deleted items is a replace
     fn _replace_batch_leaves(
         &mut self,
         from: generic_btree::QueryResult,
         to: generic_btree::QueryResult,
         left_del_len: &mut usize,
-    ) {
+    ) -> bool {
+        let mut over_replace = false;
         self.tree.update(from.cursor..to.cursor, &mut |item| {
             // This method will split the leaf node before calling this closure.
             // So it's guaranteed that the item is contained in the range.
@@ -133,6 +140,7 @@ impl<V: DeltaValue, Attr: DeltaAttr> DeltaRope<V, Attr> {
                     })
                 }
                 DeltaItem::Replace { value, attr, .. } => {
+                    over_replace = true;
                     if *left_del_len >= value.rle_len() {
                         let diff = value.rle_len() as isize;
                         *left_del_len -= value.rle_len();
@@ -148,6 +156,7 @@ impl<V: DeltaValue, Attr: DeltaAttr> DeltaRope<V, Attr> {
                 }
             }
         });
+        over_replace
     }
 
     fn _replace_on_single_leaf(
@@ -193,9 +202,11 @@ impl<V: DeltaValue, Attr: DeltaAttr> DeltaRope<V, Attr> {
                 }
 
                 let (l, r) = item.update_with_split(value_start..value_end, |item| {
+                    let mut attr = this_attr.clone();
+                    attr.compose_over_replace();
                     *item = DeltaItem::Replace {
                         value: this_value.clone(),
-                        attr: this_attr.clone(),
+                        attr,
                         delete: 0,
                     };
                 });
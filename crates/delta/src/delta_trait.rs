@@ -10,6 +10,9 @@ pub trait DeltaValue:
 pub trait DeltaAttr: Clone + PartialEq + Debug + Default {
     fn compose(&mut self, other: &Self);
     fn attr_is_empty(&self) -> bool;
+    /// Called on the attr of a replace when it's composed onto the values that are
+    /// inserted or deleted by the previous delta. It does nothing by default.
+    fn compose_over_replace(&mut self) {}
 }
 
 mod implementations {
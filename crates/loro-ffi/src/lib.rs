@@ -1,8 +1,11 @@
 #![allow(clippy::missing_safety_doc)]
 
-use std::ffi::{c_char, CStr, CString};
+use std::{
+    ffi::{c_char, c_void, CStr, CString},
+    io::Write,
+};
 
-use loro_internal::{LoroDoc, TextHandler};
+use loro_internal::{LoroDoc, TextHandler, VersionVector};
 
 /// create Loro with a random unique client id
 #[no_mangle]
@@ -57,3 +60,69 @@ pub unsafe extern "C" fn text_value(text: *mut TextHandler) -> *mut c_char {
     let value = text.get_value().as_string().unwrap().to_string();
     CString::new(value).unwrap().into_raw()
 }
+
+/// Export the snapshot of the doc and pass it to `callback` chunk by chunk.
+///
+/// `user_data` is passed back to `callback` untouched. Returns false if the
+/// export is interrupted by a write error.
+#[no_mangle]
+pub unsafe extern "C" fn loro_export_snapshot_stream(
+    loro: *const LoroDoc,
+    callback: extern "C" fn(*const u8, usize, *mut c_void),
+    user_data: *mut c_void,
+) -> bool {
+    assert!(!loro.is_null());
+    let loro = loro.as_ref().unwrap();
+    let mut writer = CallbackWriter {
+        callback,
+        user_data,
+    };
+    loro.export_snapshot_to(&mut writer).is_ok()
+}
+
+/// Export the updates that are not included in the version vector `vv` and pass
+/// them to `callback` chunk by chunk.
+///
+/// `vv` is an encoded version vector of `vv_len` bytes. If it's null, all the
+/// updates are exported. Returns false if `vv` can't be decoded or the export is
+/// interrupted by a write error.
+#[no_mangle]
+pub unsafe extern "C" fn loro_export_from_stream(
+    loro: *const LoroDoc,
+    vv: *const u8,
+    vv_len: usize,
+    callback: extern "C" fn(*const u8, usize, *mut c_void),
+    user_data: *mut c_void,
+) -> bool {
+    assert!(!loro.is_null());
+    let loro = loro.as_ref().unwrap();
+    let vv = if vv.is_null() {
+        VersionVector::new()
+    } else {
+        match VersionVector::decode(std::slice::from_raw_parts(vv, vv_len)) {
+            Ok(vv) => vv,
+            Err(_) => return false,
+        }
+    };
+    let mut writer = CallbackWriter {
+        callback,
+        user_data,
+    };
+    loro.export_from_to(&vv, &mut writer).is_ok()
+}
+
+struct CallbackWriter {
+    callback: extern "C" fn(*const u8, usize, *mut c_void),
+    user_data: *mut c_void,
+}
+
+impl Write for CallbackWriter {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        (self.callback)(buf.as_ptr(), buf.len(), self.user_data);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
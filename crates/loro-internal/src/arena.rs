@@ -35,6 +35,8 @@ struct InnerSharedArena {
     container_id_to_idx: Mutex<FxHashMap<ContainerID, ContainerIdx>>,
     /// The parent of each container.
     parents: Mutex<FxHashMap<ContainerIdx, Option<ContainerIdx>>>,
+    /// The children of each container, the reverse of `parents`
+    children: Mutex<FxHashMap<ContainerIdx, Vec<ContainerIdx>>>,
     values: Mutex<Vec<LoroValue>>,
     root_c_idx: Mutex<Vec<ContainerIdx>>,
     str: Mutex<StrArena>,
@@ -74,6 +76,7 @@ impl SharedArena {
                     self.inner.container_id_to_idx.lock().unwrap().clone(),
                 ),
                 parents: Mutex::new(self.inner.parents.lock().unwrap().clone()),
+                children: Mutex::new(self.inner.children.lock().unwrap().clone()),
                 values: Mutex::new(self.inner.values.lock().unwrap().clone()),
                 root_c_idx: Mutex::new(self.inner.root_c_idx.lock().unwrap().clone()),
                 str: Mutex::new(self.inner.str.lock().unwrap().clone()),
@@ -81,6 +84,32 @@ impl SharedArena {
         }
     }
 
+    /// Replace the content of the arena with the content of `other`.
+    ///
+    /// `other` should be forked from this arena, and this arena should not be changed since
+    /// then. So the container indexes allocated by this arena are still valid.
+    pub(crate) fn replace_with(&self, other: SharedArena) {
+        let inner = match Arc::try_unwrap(other.inner) {
+            Ok(inner) => inner,
+            Err(inner) => Arc::try_unwrap(SharedArena { inner }.fork().inner).unwrap(),
+        };
+        *self.inner.container_idx_to_id.lock().unwrap() =
+            inner.container_idx_to_id.into_inner().unwrap();
+        *self.inner.depth.lock().unwrap() = inner.depth.into_inner().unwrap();
+        *self.inner.container_id_to_idx.lock().unwrap() =
+            inner.container_id_to_idx.into_inner().unwrap();
+        *self.inner.parents.lock().unwrap() = inner.parents.into_inner().unwrap();
+        *self.inner.children.lock().unwrap() = inner.children.into_inner().unwrap();
+        *self.inner.values.lock().unwrap() = inner.values.into_inner().unwrap();
+        *self.inner.root_c_idx.lock().unwrap() = inner.root_c_idx.into_inner().unwrap();
+        *self.inner.str.lock().unwrap() = inner.str.into_inner().unwrap();
+    }
+
+    /// The number of the registered containers
+    pub(crate) fn len_containers(&self) -> usize {
+        self.inner.container_idx_to_id.lock().unwrap().len()
+    }
+
     pub fn register_container(&self, id: &ContainerID) -> ContainerIdx {
         let mut container_id_to_idx = self.inner.container_id_to_idx.lock().unwrap();
         if let Some(&idx) = container_id_to_idx.get(id) {
@@ -165,7 +194,18 @@ impl SharedArena {
     #[inline]
     pub fn set_parent(&self, child: ContainerIdx, parent: Option<ContainerIdx>) {
         let parents = &mut self.inner.parents.lock().unwrap();
-        parents.insert(child, parent);
+        let old_parent = parents.insert(child, parent).flatten();
+        if old_parent != parent {
+            let mut children = self.inner.children.lock().unwrap();
+            if let Some(old) = old_parent {
+                if let Some(siblings) = children.get_mut(&old) {
+                    siblings.retain(|x| *x != child);
+                }
+            }
+            if let Some(p) = parent {
+                children.entry(p).or_default().push(child);
+            }
+        }
         let mut depth = self.inner.depth.lock().unwrap();
 
         match parent {
@@ -182,6 +222,20 @@ impl SharedArena {
         }
     }
 
+    /// Remove the link between `child` and its parent, e.g. when the op creating `child` is
+    /// rolled back. The depth of `child` becomes unknown.
+    pub(crate) fn remove_parent(&self, child: ContainerIdx) {
+        let parents = &mut self.inner.parents.lock().unwrap();
+        if let Some(Some(old)) = parents.remove(&child) {
+            let mut children = self.inner.children.lock().unwrap();
+            if let Some(siblings) = children.get_mut(&old) {
+                siblings.retain(|x| *x != child);
+            }
+        }
+
+        self.inner.depth.lock().unwrap()[child.to_index() as usize] = None;
+    }
+
     pub fn log_hierarchy(&self) {
         if cfg!(debug_assertions) {
             for (c, p) in self.inner.parents.lock().unwrap().iter() {
@@ -225,6 +279,20 @@ impl SharedArena {
             .flatten()
     }
 
+    /// Get the descendants of `container`, not including `container` itself.
+    pub(crate) fn get_descendants(&self, container: ContainerIdx) -> Vec<ContainerIdx> {
+        let children = self.inner.children.lock().unwrap();
+        let mut ans = Vec::new();
+        let mut stack = vec![container];
+        while let Some(c) = stack.pop() {
+            if let Some(c_children) = children.get(&c) {
+                ans.extend_from_slice(c_children);
+                stack.extend_from_slice(c_children);
+            }
+        }
+        ans
+    }
+
     /// Call `f` on each ancestor of `container`, including `container` itself.
     ///
     /// f(ContainerIdx, is_first)
@@ -423,6 +491,20 @@ impl SharedArena {
             .collect()
     }
 
+    /// The approximate memory usage of the arena in bytes.
+    pub(crate) fn estimate_size(&self) -> usize {
+        let containers = self.inner.container_idx_to_id.lock().unwrap().len();
+        let values = self.inner.values.lock().unwrap().len();
+        let str = self.inner.str.lock().unwrap().len_bytes();
+        // Each container has an id, a depth, a reverse mapping, a parent and a child entry
+        containers
+            * (2 * std::mem::size_of::<ContainerID>()
+                + std::mem::size_of::<Option<NonZeroU16>>()
+                + 4 * std::mem::size_of::<ContainerIdx>())
+            + values * std::mem::size_of::<LoroValue>()
+            + str
+    }
+
     #[inline]
     pub fn root_containers(&self) -> Vec<ContainerIdx> {
         self.inner.root_c_idx.lock().unwrap().clone()
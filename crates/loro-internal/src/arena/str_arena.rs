@@ -26,7 +26,6 @@ impl StrArena {
     }
 
     #[inline]
-    #[allow(dead_code)]
     pub fn len_bytes(&self) -> usize {
         self.len.bytes as usize
     }
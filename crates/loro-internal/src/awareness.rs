@@ -1,20 +1,64 @@
+use std::sync::Arc;
+
 use fxhash::FxHashMap;
 use loro_common::{LoroValue, PeerID};
 use serde::{Deserialize, Serialize};
 
-use crate::change::get_sys_timestamp;
+use crate::{change::get_sys_timestamp, obs::SubID};
 
 /// `Awareness` is a structure that tracks the ephemeral state of peers.
 ///
 /// It can be used to synchronize cursor positions, selections, and the names of the peers.
+/// It's not part of the document, so the states never appear in the history or the exports.
 ///
-/// The state of a specific peer is expected to be removed after a specified timeout. Use
-/// `remove_outdated` to eliminate outdated states.
-#[derive(Debug, Clone)]
+/// The state of a specific peer is expected to be removed after a specified timeout.
+/// The outdated states are removed whenever the awareness is updated by `apply` or
+/// `set_local_state`. Use `remove_outdated` to eliminate them at other times.
 pub struct Awareness {
     peer: PeerID,
     peers: FxHashMap<PeerID, PeerInfo>,
     timeout: i64,
+    subscribers: Vec<(SubID, AwarenessSubscriber)>,
+    next_sub_id: u32,
+}
+
+/// The peers whose states are added, updated or removed by a change of the [Awareness].
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct AwarenessChange {
+    pub added: Vec<PeerID>,
+    pub updated: Vec<PeerID>,
+    pub removed: Vec<PeerID>,
+}
+
+impl AwarenessChange {
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.updated.is_empty() && self.removed.is_empty()
+    }
+}
+
+pub type AwarenessSubscriber = Arc<dyn Fn(&AwarenessChange) + Send + Sync>;
+
+impl Clone for Awareness {
+    /// The clone has the same states, but none of the subscriptions.
+    fn clone(&self) -> Self {
+        Awareness {
+            peer: self.peer,
+            peers: self.peers.clone(),
+            timeout: self.timeout,
+            subscribers: Vec::new(),
+            next_sub_id: 0,
+        }
+    }
+}
+
+impl std::fmt::Debug for Awareness {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Awareness")
+            .field("peer", &self.peer)
+            .field("peers", &self.peers)
+            .field("timeout", &self.timeout)
+            .finish()
+    }
 }
 
 #[derive(Debug, Clone)]
@@ -38,6 +82,33 @@ impl Awareness {
             peer,
             timeout,
             peers: FxHashMap::default(),
+            subscribers: Vec::new(),
+            next_sub_id: 0,
+        }
+    }
+
+    /// Subscribe to the changes of the states, including the removal of the outdated states.
+    pub fn subscribe(&mut self, callback: AwarenessSubscriber) -> SubID {
+        let id = SubID::from_u32(self.next_sub_id);
+        self.next_sub_id += 1;
+        self.subscribers.push((id, callback));
+        id
+    }
+
+    /// Returns false if the subscription doesn't exist.
+    pub fn unsubscribe(&mut self, id: SubID) -> bool {
+        let len = self.subscribers.len();
+        self.subscribers.retain(|(x, _)| *x != id);
+        self.subscribers.len() != len
+    }
+
+    fn emit(&self, change: &AwarenessChange) {
+        if change.is_empty() {
+            return;
+        }
+
+        for (_, callback) in self.subscribers.iter() {
+            callback(change);
         }
     }
 
@@ -110,6 +181,11 @@ impl Awareness {
             }
         }
 
+        self.emit(&AwarenessChange {
+            added: added_peers.clone(),
+            updated: changed_peers.clone(),
+            removed: self.take_outdated(),
+        });
         (changed_peers, added_peers)
     }
 
@@ -118,15 +194,30 @@ impl Awareness {
     }
 
     fn _set_local_state(&mut self, value: LoroValue) {
-        let peer = self.peers.entry(self.peer).or_insert_with(|| PeerInfo {
-            state: Default::default(),
-            counter: 0,
-            timestamp: 0,
+        let mut added = false;
+        let peer = self.peers.entry(self.peer).or_insert_with(|| {
+            added = true;
+            PeerInfo {
+                state: Default::default(),
+                counter: 0,
+                timestamp: 0,
+            }
         });
 
         peer.state = value;
         peer.counter += 1;
         peer.timestamp = get_sys_timestamp();
+        let mut change = AwarenessChange {
+            removed: self.take_outdated(),
+            ..Default::default()
+        };
+        if added {
+            change.added.push(self.peer);
+        } else {
+            change.updated.push(self.peer);
+        }
+
+        self.emit(&change);
     }
 
     pub fn get_local_state(&self) -> Option<LoroValue> {
@@ -134,6 +225,16 @@ impl Awareness {
     }
 
     pub fn remove_outdated(&mut self) -> Vec<PeerID> {
+        let removed = self.take_outdated();
+        self.emit(&AwarenessChange {
+            removed: removed.clone(),
+            ..Default::default()
+        });
+        removed
+    }
+
+    /// Remove the outdated states without notifying the subscribers.
+    fn take_outdated(&mut self) -> Vec<PeerID> {
         let now = get_sys_timestamp();
         let mut removed = Vec::new();
         self.peers.retain(|id, v| {
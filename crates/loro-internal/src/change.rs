@@ -15,6 +15,7 @@ use loro_common::{HasCounter, HasCounterSpan, PeerID};
 use num::traits::AsPrimitive;
 use rle::{HasIndex, HasLength, Mergable, RleVec, Sliceable};
 use smallvec::SmallVec;
+use std::sync::Arc;
 
 pub type Timestamp = i64;
 pub type Lamport = u32;
@@ -36,6 +37,10 @@ pub struct Change<O = Op> {
     pub(crate) timestamp: Timestamp,
     /// if it has dependents, it cannot merge with new changes
     pub(crate) has_dependents: bool,
+    /// The message attached to the commit that created the change
+    pub(crate) commit_msg: Option<Arc<str>>,
+    /// The author set by [crate::loro::CommitOptions::author]
+    pub(crate) author: Option<Arc<str>>,
 }
 
 impl<O> Change<O> {
@@ -53,6 +58,8 @@ impl<O> Change<O> {
             lamport,
             timestamp,
             has_dependents: false,
+            commit_msg: None,
+            author: None,
         }
     }
 
@@ -86,6 +93,18 @@ impl<O> Change<O> {
         self.id
     }
 
+    /// The message attached by [crate::loro::CommitOptions::commit_msg].
+    #[inline]
+    pub fn message(&self) -> Option<&Arc<str>> {
+        self.commit_msg.as_ref()
+    }
+
+    /// The author set by [crate::loro::CommitOptions::author].
+    #[inline]
+    pub fn author(&self) -> Option<&Arc<str>> {
+        self.author.as_ref()
+    }
+
     #[inline]
     pub fn deps_on_self(&self) -> bool {
         self.deps.len() == 1 && self.deps[0].peer == self.id.peer
@@ -191,6 +210,8 @@ impl<O: Mergable + HasLength + HasIndex + Sliceable + HasCounter + Debug> Slicea
             lamport: self.lamport + from as Lamport,
             timestamp: self.timestamp,
             has_dependents: self.has_dependents,
+            commit_msg: self.commit_msg.clone(),
+            author: self.author.clone(),
         }
     }
 }
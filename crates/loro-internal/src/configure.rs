@@ -1,3 +1,5 @@
+use loro_common::PeerID;
+
 pub use crate::container::richtext::config::{StyleConfig, StyleConfigMap};
 
 #[derive(Clone, Debug)]
@@ -7,6 +9,33 @@ pub struct Configure {
     merge_interval: Arc<AtomicI64>,
     /// do not use `jitter` by default
     pub(crate) tree_position_jitter: Arc<AtomicU8>,
+    /// whether the doc can be edited in detached mode
+    detached_editing: Arc<AtomicBool>,
+    /// The deterministic peer id generator. Random peer ids are used if it's `None`.
+    ///
+    /// It's shared by the forked docs so that they get different peer ids.
+    peer_id_seed: Arc<Mutex<Option<PeerIdSeed>>>,
+}
+
+/// Derive a sequence of distinct peer ids from a seed
+#[derive(Clone, Copy, Debug)]
+struct PeerIdSeed {
+    seed: u64,
+    count: u64,
+}
+
+impl PeerIdSeed {
+    /// It uses the SplitMix64 mixer. Every step of it is a bijection on u64, so the ids are
+    /// distinct until the counter overflows.
+    fn next(&mut self) -> PeerID {
+        self.count = self.count.wrapping_add(1);
+        let mut z = self
+            .seed
+            .wrapping_add(self.count.wrapping_mul(0x9E3779B97F4A7C15));
+        z = (z ^ (z >> 30)).wrapping_mul(0xBF58476D1CE4E5B9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94D049BB133111EB);
+        z ^ (z >> 31)
+    }
 }
 
 impl Default for Configure {
@@ -16,6 +45,8 @@ impl Default for Configure {
             record_timestamp: Arc::new(AtomicBool::new(false)),
             merge_interval: Arc::new(AtomicI64::new(1000 * 1000)),
             tree_position_jitter: Arc::new(AtomicU8::new(0)),
+            detached_editing: Arc::new(AtomicBool::new(false)),
+            peer_id_seed: Arc::new(Mutex::new(None)),
         }
     }
 }
@@ -38,6 +69,11 @@ impl Configure {
                 self.tree_position_jitter
                     .load(std::sync::atomic::Ordering::Relaxed),
             )),
+            detached_editing: Arc::new(AtomicBool::new(
+                self.detached_editing
+                    .load(std::sync::atomic::Ordering::Relaxed),
+            )),
+            peer_id_seed: self.peer_id_seed.clone(),
         }
     }
 
@@ -69,6 +105,29 @@ impl Configure {
         self.merge_interval
             .store(interval, std::sync::atomic::Ordering::Relaxed);
     }
+
+    pub fn detached_editing(&self) -> bool {
+        self.detached_editing
+            .load(std::sync::atomic::Ordering::Relaxed)
+    }
+
+    pub fn set_detached_editing(&self, enable: bool) {
+        self.detached_editing
+            .store(enable, std::sync::atomic::Ordering::Relaxed);
+    }
+
+    /// Derive the following generated peer ids from `seed` deterministically.
+    pub fn set_peer_id_seed(&self, seed: u64) {
+        *self.peer_id_seed.lock().unwrap() = Some(PeerIdSeed { seed, count: 0 });
+    }
+
+    /// Generate a new peer id, which is random unless a seed is set by [Configure::set_peer_id_seed].
+    pub fn gen_peer_id(&self) -> PeerID {
+        match self.peer_id_seed.lock().unwrap().as_mut() {
+            Some(seed) => seed.next(),
+            None => DefaultRandom.next_u64(),
+        }
+    }
 }
 
 #[derive(Debug)]
@@ -78,7 +137,7 @@ pub struct DefaultRandom;
 use std::sync::atomic::AtomicU64;
 use std::sync::{
     atomic::{AtomicBool, AtomicI64, AtomicU8},
-    Arc, RwLock,
+    Arc, Mutex, RwLock,
 };
 #[cfg(test)]
 static mut TEST_RANDOM: AtomicU64 = AtomicU64::new(0);
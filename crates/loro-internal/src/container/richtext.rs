@@ -5,6 +5,7 @@
 //! - Unicode index: the index of a unicode code point in the text.
 //! - Entity index: unicode index + style anchor index. Each unicode code point or style anchor is an entity.
 //! - Utf16 index
+//! - Utf8 index: the byte offset in the UTF-8 encoded text
 //!
 //! In [crate::op::Op], we always use entity index to persist richtext ops.
 //!
@@ -158,7 +159,7 @@ const ALIVE_MASK: u8 = 0b1000_0000;
 /// - After: when inserting new text after this style, the new text should inherit this style.
 /// - Both: when inserting new text before or after this style, the new text should inherit this style.
 /// - None: when inserting new text before or after this style, the new text should **not** inherit this style.
-#[derive(Clone, Copy, Eq, PartialEq, Debug, Hash)]
+#[derive(Clone, Copy, Eq, PartialEq, Debug, Hash, serde::Serialize, serde::Deserialize)]
 pub enum ExpandType {
     Before,
     After,
@@ -166,6 +167,30 @@ pub enum ExpandType {
     None,
 }
 
+/// The unit of a text index. See the [module level docs](self) for the details.
+#[derive(Clone, Copy, Eq, PartialEq, Debug, Hash)]
+pub enum IndexType {
+    /// Unicode code points and style anchors
+    Entity,
+    /// Bytes of the UTF-8 encoding
+    Utf8,
+    /// Code units of the UTF-16 encoding
+    Utf16,
+    /// Unicode code points
+    Unicode,
+}
+
+impl From<IndexType> for richtext_state::PosType {
+    fn from(value: IndexType) -> Self {
+        match value {
+            IndexType::Entity => Self::Entity,
+            IndexType::Utf8 => Self::Bytes,
+            IndexType::Utf16 => Self::Utf16,
+            IndexType::Unicode => Self::Unicode,
+        }
+    }
+}
+
 #[derive(
     Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Debug, Hash, serde::Serialize, serde::Deserialize,
 )]
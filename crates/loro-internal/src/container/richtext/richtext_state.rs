@@ -4,11 +4,11 @@ use generic_btree::{
     rle::{CanRemove, HasLength, Mergeable, Sliceable, TryInsert},
     BTree, BTreeTrait, Cursor,
 };
-use loro_common::{Counter, IdFull, IdLpSpan, IdSpan, Lamport, LoroValue, ID};
+use loro_common::{Counter, IdFull, IdLpSpan, IdSpan, InternalString, Lamport, LoroValue, ID};
 use serde::{ser::SerializeStruct, Serialize};
 use std::{
     fmt::{Display, Formatter},
-    ops::{Bound, RangeBounds},
+    ops::{Bound, ControlFlow, RangeBounds},
 };
 use std::{
     ops::{Add, AddAssign, Range, Sub},
@@ -26,14 +26,14 @@ use crate::{
 use self::{
     cursor_cache::CursorCache,
     query::{
-        EntityQuery, EntityQueryT, EventIndexQuery, EventIndexQueryT, UnicodeQuery, UnicodeQueryT,
-        Utf16Query, Utf16QueryT,
+        BytesQuery, EntityQuery, EntityQueryT, EventIndexQuery, EventIndexQueryT, UnicodeQuery,
+        UnicodeQueryT, Utf16Query, Utf16QueryT,
     },
 };
 
 use super::{
     style_range_map::{IterAnchorItem, StyleRangeMap, Styles},
-    AnchorType, RichtextSpan, StyleOp,
+    AnchorType, ExpandType, RichtextSpan, StyleOp,
 };
 
 pub(crate) use query::PosType;
@@ -102,6 +102,11 @@ mod text_chunk {
             self.id.id()
         }
 
+        #[inline]
+        pub fn id_full(&self) -> IdFull {
+            self.id
+        }
+
         #[inline]
         pub fn bytes(&self) -> &BytesSlice {
             &self.bytes
@@ -668,6 +673,25 @@ fn pos_to_unicode_index(s: &str, pos: usize, kind: PosType) -> Option<usize> {
     }
 }
 
+/// The length of the first `entity_offset` entities of the chunk in the unit of `pos_type`
+fn chunk_prefix_len(chunk: &RichtextStateChunk, entity_offset: usize, pos_type: PosType) -> usize {
+    match chunk {
+        RichtextStateChunk::Text(s) => {
+            let chars = || s.as_str().chars().take(entity_offset);
+            match pos_type {
+                PosType::Unicode | PosType::Entity => entity_offset,
+                PosType::Bytes => chars().map(|c| c.len_utf8()).sum(),
+                PosType::Utf16 => chars().map(|c| c.len_utf16()).sum(),
+                PosType::Event => s.convert_unicode_offset_to_event_offset(entity_offset),
+            }
+        }
+        RichtextStateChunk::Style { .. } => match pos_type {
+            PosType::Entity => entity_offset,
+            _ => 0,
+        },
+    }
+}
+
 #[derive(Clone, Debug, Copy, PartialEq, Eq, Default)]
 pub(crate) struct PosCache {
     pub(super) unicode_len: i32,
@@ -685,7 +709,6 @@ impl PosCache {
         }
     }
 
-    #[allow(unused)]
     fn get_len(&self, pos_type: PosType) -> i32 {
         match pos_type {
             PosType::Bytes => self.bytes,
@@ -827,7 +850,6 @@ mod query {
 
     #[derive(Debug, Clone, Copy, PartialEq, Eq)]
     pub(crate) enum PosType {
-        #[allow(unused)]
         Bytes,
         #[allow(unused)]
         Unicode,
@@ -922,6 +944,48 @@ mod query {
         }
     }
 
+    pub(super) struct BytesQueryT;
+    pub(super) type BytesQuery = IndexQuery<BytesQueryT, RichtextTreeTrait>;
+
+    impl QueryByLen<RichtextTreeTrait> for BytesQueryT {
+        fn get_cache_len(cache: &<RichtextTreeTrait as BTreeTrait>::Cache) -> usize {
+            cache.bytes as usize
+        }
+
+        fn get_elem_len(elem: &<RichtextTreeTrait as BTreeTrait>::Elem) -> usize {
+            match elem {
+                RichtextStateChunk::Text(s) => s.bytes().len(),
+                RichtextStateChunk::Style { .. } => 0,
+            }
+        }
+
+        fn get_offset_and_found(
+            left: usize,
+            elem: &<RichtextTreeTrait as BTreeTrait>::Elem,
+        ) -> (usize, bool) {
+            match elem {
+                RichtextStateChunk::Text(s) => {
+                    if left == 0 {
+                        return (0, true);
+                    }
+
+                    // Fallback to the last char boundary if left is not at a char boundary
+                    let offset = s
+                        .as_str()
+                        .char_indices()
+                        .take_while(|(i, c)| i + c.len_utf8() <= left)
+                        .count();
+                    (offset, true)
+                }
+                RichtextStateChunk::Style { .. } => (1, false),
+            }
+        }
+
+        fn get_cache_entity_len(cache: &<RichtextTreeTrait as BTreeTrait>::Cache) -> usize {
+            cache.entity_len as usize
+        }
+    }
+
     pub(super) struct EntityQueryT;
     pub(super) type EntityQuery = IndexQuery<EntityQueryT, RichtextTreeTrait>;
 
@@ -1902,6 +1966,52 @@ impl RichtextState {
         self.cursor_to_event_index(cursor.cursor)
     }
 
+    /// Convert `index` in the unit of `from` to the unit of `to`.
+    ///
+    /// Style anchors take entity indexes but no text. If there are style anchors at
+    /// the given text position, the entity index after them is returned.
+    ///
+    /// Returns `None` if `index` is out of bound or not at a char boundary.
+    pub(crate) fn convert_index(&self, index: usize, from: PosType, to: PosType) -> Option<usize> {
+        if index > self.len(from) {
+            return None;
+        }
+
+        if self.tree.is_empty() {
+            return Some(0);
+        }
+
+        let cursor = match from {
+            PosType::Bytes => self.tree.query::<BytesQuery>(&index),
+            PosType::Unicode => self.tree.query::<UnicodeQuery>(&index),
+            PosType::Utf16 => self.tree.query::<Utf16Query>(&index),
+            PosType::Entity => self.tree.query::<EntityQuery>(&index),
+            PosType::Event => self.tree.query::<EventIndexQuery>(&index),
+        }?
+        .cursor;
+
+        let mut from_index = 0;
+        let mut to_index = 0;
+        self.tree
+            .visit_previous_caches(cursor, |cache| match cache {
+                generic_btree::PreviousCache::NodeCache(c) => {
+                    from_index += c.get_len(from) as usize;
+                    to_index += c.get_len(to) as usize;
+                }
+                generic_btree::PreviousCache::PrevSiblingElem(elem) => {
+                    from_index += chunk_prefix_len(elem, elem.rle_len(), from);
+                    to_index += chunk_prefix_len(elem, elem.rle_len(), to);
+                }
+                generic_btree::PreviousCache::ThisElemAndOffset { elem, offset } => {
+                    from_index += chunk_prefix_len(elem, offset, from);
+                    to_index += chunk_prefix_len(elem, offset, to);
+                }
+            });
+
+        // The query falls back to the previous char boundary
+        (from_index == index).then_some(to_index)
+    }
+
     pub fn event_index_to_unicode_index(&self, index: usize) -> usize {
         if !cfg!(feature = "wasm") {
             return index;
@@ -1986,11 +2096,202 @@ impl RichtextState {
         })
     }
 
+    /// Get the text runs with the key, the value and the expand type of each of their styles.
+    ///
+    /// Unlike [RichtextState::iter], the text runs are not merged.
+    #[allow(clippy::type_complexity)]
+    pub(crate) fn get_runs_with_expand(
+        &self,
+    ) -> Vec<(String, Vec<(InternalString, LoroValue, ExpandType)>)> {
+        let mut ans = Vec::new();
+        let mut entity_index = 0;
+        let mut style_range_iter: Box<dyn Iterator<Item = (Range<usize>, &Styles)>> =
+            match &self.style_ranges {
+                Some(s) => Box::new(s.iter()),
+                None => Box::new(Some((0..usize::MAX / 2, &*EMPTY_STYLES)).into_iter()),
+            };
+        let mut cur_style_range = style_range_iter.next();
+        for chunk in self.tree.iter() {
+            let s = match chunk {
+                RichtextStateChunk::Text(s) => s,
+                RichtextStateChunk::Style { .. } => {
+                    entity_index += 1;
+                    continue;
+                }
+            };
+
+            let mut styles = Vec::new();
+            while let Some((range, range_styles)) = cur_style_range.as_ref() {
+                if entity_index < range.start {
+                    break;
+                }
+
+                if entity_index < range.end {
+                    styles = range_styles
+                        .iter()
+                        .filter_map(|(key, value)| {
+                            let op = value.get()?;
+                            Some((key.key().clone(), op.to_value(), op.info.expand_type()))
+                        })
+                        .collect();
+                    break;
+                }
+
+                cur_style_range = style_range_iter.next();
+            }
+
+            entity_index += s.rle_len();
+            ans.push((s.as_str().to_string(), styles));
+        }
+
+        ans
+    }
+
     #[inline]
     pub fn iter_chunk(&self) -> impl Iterator<Item = &RichtextStateChunk> {
         self.tree.iter()
     }
 
+    /// Get the spans inside the given event index range that have a non-null style with `key`.
+    ///
+    /// The spans are in event index, sorted, and adjacent spans are merged.
+    pub(crate) fn get_style_spans_in_event_range(
+        &self,
+        range: Range<usize>,
+        key: &InternalString,
+    ) -> Vec<(usize, usize)> {
+        let mut ans: Vec<(usize, usize)> = Vec::new();
+        let mut index = 0;
+        for span in self.iter() {
+            if index >= range.end {
+                break;
+            }
+
+            let len = span.text.len_event();
+            let start = index.max(range.start);
+            let end = (index + len).min(range.end);
+            index += len;
+            if start >= end || !matches!(span.attributes.get(key), Some(v) if !v.is_null()) {
+                continue;
+            }
+
+            match ans.last_mut() {
+                Some(last) if last.1 == start => last.1 = end,
+                _ => ans.push((start, end)),
+            }
+        }
+
+        ans
+    }
+
+    /// Call `f` with the styled runs inside the given event index range, in order.
+    ///
+    /// Runs that cross the range boundaries are cut at the boundaries, and adjacent
+    /// pieces sharing the same styles are joined. The iteration stops once `f`
+    /// returns [ControlFlow::Break].
+    pub(crate) fn iter_styled_runs_in_event_range(
+        &mut self,
+        range: Range<usize>,
+        f: &mut dyn FnMut(&str, &StyleMeta) -> ControlFlow<()>,
+    ) {
+        if range.start >= range.end {
+            return;
+        }
+
+        let start = self.get_entity_index_for_text_insert(range.start, PosType::Event);
+        let end = self.get_entity_index_for_text_insert(range.end, PosType::Event);
+        if start >= end {
+            return;
+        }
+
+        let mut text = String::new();
+        let mut cur_styles: Option<&Styles> = None;
+        for IterRangeItem {
+            chunk,
+            styles,
+            entity_start,
+            entity_len,
+            ..
+        } in self.iter_range(start..end)
+        {
+            let s = match chunk {
+                RichtextStateChunk::Text(s) => s.as_str(),
+                RichtextStateChunk::Style { .. } => continue,
+            };
+
+            if let Some(last) = cur_styles {
+                if last != styles && !text.is_empty() {
+                    if f(&text, &StyleMeta::from(last)).is_break() {
+                        return;
+                    }
+
+                    text.clear();
+                }
+            }
+
+            cur_styles = Some(styles);
+            let from = unicode_to_utf8_index(s, entity_start).unwrap();
+            let to = unicode_to_utf8_index(s, entity_start + entity_len).unwrap();
+            text.push_str(&s[from..to]);
+        }
+
+        if let Some(last) = cur_styles {
+            if !text.is_empty() {
+                let _ = f(&text, &StyleMeta::from(last));
+            }
+        }
+    }
+
+    /// Get the ids of the chars inside the given event index range.
+    ///
+    /// Each item is the event index range of a run of chars with consecutive ids, i.e. the
+    /// chars inserted continuously by the same peer, and the id of the first char of the run.
+    /// The style anchors are skipped, so the runs are not split by the marks.
+    pub(crate) fn get_text_id_runs_in_event_range(
+        &mut self,
+        range: Range<usize>,
+    ) -> Vec<(Range<usize>, IdFull)> {
+        // The last item is the unicode length of the run
+        let mut ans: Vec<(Range<usize>, IdFull, i32)> = Vec::new();
+        if range.start >= range.end {
+            return Vec::new();
+        }
+
+        let start = self.get_entity_index_for_text_insert(range.start, PosType::Event);
+        let end = self.get_entity_index_for_text_insert(range.end, PosType::Event);
+        let mut index = range.start;
+        for IterRangeItem {
+            chunk,
+            entity_start,
+            entity_len,
+            event_len,
+            ..
+        } in self.iter_range(start..end)
+        {
+            let RichtextStateChunk::Text(s) = chunk else {
+                continue;
+            };
+
+            let id = s.id_full().inc(entity_start as i32);
+            let next = index + event_len;
+            match ans.last_mut() {
+                Some((last_range, last_id, last_len))
+                    if last_id.peer == id.peer
+                        && last_id.counter + *last_len == id.counter
+                        && last_id.lamport + *last_len as Lamport == id.lamport =>
+                {
+                    last_range.end = next;
+                    *last_len += entity_len as i32;
+                }
+                _ => ans.push((index..next, id, entity_len as i32)),
+            }
+
+            index = next;
+        }
+
+        ans.into_iter().map(|(range, id, _)| (range, id)).collect()
+    }
+
     pub fn get_richtext_value(&self) -> LoroValue {
         let mut ans: Vec<LoroValue> = Vec::new();
         let mut last_attributes: Option<LoroValue> = None;
@@ -2229,6 +2530,7 @@ impl RichtextState {
             let iter_chunk = chunk.as_ref()?;
 
             let styles = cur_style;
+            let entity_start = offset;
             let iter_len;
             let event_range;
             if chunk_left_len >= style_left_len {
@@ -2261,6 +2563,7 @@ impl RichtextState {
             Some(IterRangeItem {
                 chunk: iter_chunk.elem,
                 styles,
+                entity_start,
                 entity_len: iter_len,
                 event_len: event_range.len(),
             })
@@ -2306,6 +2609,8 @@ pub(crate) struct DrainInfo {
 pub(crate) struct IterRangeItem<'a> {
     pub(crate) chunk: &'a RichtextStateChunk,
     pub(crate) styles: &'a Styles,
+    /// The entity offset of this item inside `chunk`
+    pub(crate) entity_start: usize,
     pub(crate) entity_len: usize,
     pub(crate) event_len: usize,
 }
@@ -2849,4 +3154,41 @@ mod test {
             }])
         );
     }
+
+    #[test]
+    fn bytes_query_falls_back_to_the_last_char_boundary() {
+        let mut wrapper = SimpleWrapper::default();
+        wrapper.insert(0, "你好a😀");
+        let offset = |pos: usize| {
+            wrapper
+                .state
+                .tree
+                .query::<BytesQuery>(&pos)
+                .unwrap()
+                .cursor
+                .offset
+        };
+        assert_eq!(offset(0), 0);
+        assert_eq!(offset(2), 0);
+        assert_eq!(offset(3), 1);
+        assert_eq!(offset(5), 1);
+        assert_eq!(offset(7), 3);
+        assert_eq!(offset(10), 3);
+        assert_eq!(offset(11), 4);
+
+        let state = &wrapper.state;
+        assert_eq!(
+            state.convert_index(6, PosType::Bytes, PosType::Unicode),
+            Some(2)
+        );
+        assert_eq!(
+            state.convert_index(4, PosType::Bytes, PosType::Unicode),
+            None
+        );
+        assert_eq!(state.convert_index(9, PosType::Bytes, PosType::Utf16), None);
+        assert_eq!(
+            state.convert_index(11, PosType::Bytes, PosType::Utf16),
+            Some(5)
+        );
+    }
 }
@@ -76,6 +76,10 @@ impl Tracker {
         &self.applied_vv
     }
 
+    pub(crate) fn estimate_size(&self) -> usize {
+        self.rope.estimate_size() + self.id_to_cursor.estimate_size()
+    }
+
     #[inline]
     pub fn current_vv(&self) -> &VersionVector {
         &self.current_vv
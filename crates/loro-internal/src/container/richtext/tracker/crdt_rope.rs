@@ -313,6 +313,10 @@ impl CrdtRope {
         })]
     }
 
+    pub(super) fn estimate_size(&self) -> usize {
+        self.tree.node_len() * std::mem::size_of::<FugueSpan>()
+    }
+
     #[allow(unused)]
     pub(crate) fn diagnose(&self) {
         println!("crdt_rope number of tree nodes = {}", self.tree.node_len());
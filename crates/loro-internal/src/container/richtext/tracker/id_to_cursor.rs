@@ -21,6 +21,10 @@ pub(super) struct IdToCursor {
 
 static EMPTY_VEC: Vec<Fragment> = vec![];
 impl IdToCursor {
+    pub fn estimate_size(&self) -> usize {
+        self.map.values().map(|x| x.len()).sum::<usize>() * std::mem::size_of::<Fragment>()
+    }
+
     pub fn insert(&mut self, id: ID, cursor: Cursor) {
         let list = self.map.entry(id.peer).or_default();
         if let Some(last) = list.last_mut() {
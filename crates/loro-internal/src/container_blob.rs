@@ -0,0 +1,579 @@
+//! Export a container with its descendants as a portable blob, and graft it into another doc.
+//!
+//! The blob only contains the current state of the containers, not their history.
+//! When it's imported, the containers are recreated by new ops in the target doc, so they
+//! get new ids there. The references between them, i.e. the child containers of maps and
+//! lists and the metadata of tree nodes, point to the recreated containers.
+//!
+//! [LoroDoc::merge_foreign] uses the same way to combine a doc that shares no history
+//! with this doc, so the ids of the two docs never collide.
+use fxhash::FxHashMap;
+use loro_common::{ContainerID, ContainerType, LoroError, LoroResult, LoroValue, TreeID};
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    container::richtext::ExpandType,
+    handler::{Handler, ValueOrHandler},
+    txn::Transaction,
+    LoroDoc, MapHandler,
+};
+
+const MAGIC: &[u8; 4] = b"lcnt";
+
+/// How [LoroDoc::merge_foreign] handles a root container of the other doc whose name is
+/// already used in this doc.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum ForeignMergeStrategy {
+    /// Copy it to a new name with a numeric suffix, e.g. `notes_1`
+    #[default]
+    Rename,
+    /// Append its content to the existing container if they have the same type, and
+    /// rename it otherwise. The entries of maps override the existing ones.
+    Merge,
+    /// Keep the existing one and skip it
+    Skip,
+}
+
+#[derive(Serialize, Deserialize)]
+enum PortableValue {
+    Value(LoroValue),
+    Container(PortableContainer),
+}
+
+#[derive(Serialize, Deserialize)]
+enum PortableContainer {
+    Map(Vec<(String, PortableValue)>),
+    List(Vec<PortableValue>),
+    MovableList(Vec<PortableValue>),
+    /// The text and the key, value and expand type of each style of each styled run
+    Text(Vec<(String, Vec<(String, LoroValue, ExpandType)>)>),
+    /// The nodes in BFS order, so the parent of a node is always before it
+    Tree(Vec<PortableTreeNode>),
+    /// The exact integral part and the fractional part of the value
+    Counter {
+        int: i128,
+        float: f64,
+    },
+}
+
+#[derive(Serialize, Deserialize)]
+struct PortableTreeNode {
+    /// The index of the parent node in the list
+    parent: Option<usize>,
+    meta: Vec<(String, PortableValue)>,
+}
+
+impl PortableContainer {
+    fn from_handler(handler: &Handler) -> LoroResult<Self> {
+        Ok(match handler {
+            Handler::Map(m) => PortableContainer::Map(map_entries(m)?),
+            Handler::List(l) => {
+                let mut items = Vec::new();
+                l.for_each(|(_, v)| items.push(v));
+                PortableContainer::List(to_portable_values(items)?)
+            }
+            Handler::MovableList(l) => {
+                let mut items = Vec::new();
+                l.for_each(|v| items.push(v));
+                PortableContainer::MovableList(to_portable_values(items)?)
+            }
+            Handler::Text(t) => {
+                let mut runs: Vec<(String, Vec<_>)> = Vec::new();
+                for (text, styles) in t.get_runs_with_expand() {
+                    // The null values only cancel the earlier marks, which are not copied
+                    let mut styles: Vec<_> = styles
+                        .into_iter()
+                        .filter(|(_, value, _)| !value.is_null())
+                        .map(|(key, value, expand)| (key.to_string(), value, expand))
+                        .collect();
+                    styles.sort_by(|a, b| a.0.cmp(&b.0));
+                    match runs.last_mut() {
+                        Some(last) if last.1 == styles => last.0.push_str(&text),
+                        _ => runs.push((text, styles)),
+                    }
+                }
+                PortableContainer::Text(runs)
+            }
+            Handler::Tree(t) => {
+                let mut nodes = Vec::new();
+                let mut queue: std::collections::VecDeque<(TreeID, Option<usize>)> = t
+                    .children(None)
+                    .unwrap_or_default()
+                    .into_iter()
+                    .map(|x| (x, None))
+                    .collect();
+                while let Some((id, parent)) = queue.pop_front() {
+                    let index = nodes.len();
+                    nodes.push(PortableTreeNode {
+                        parent,
+                        meta: map_entries(&t.get_meta(id)?)?,
+                    });
+                    for child in t.children(Some(id)).unwrap_or_default() {
+                        queue.push_back((child, Some(index)));
+                    }
+                }
+                PortableContainer::Tree(nodes)
+            }
+            #[cfg(feature = "counter")]
+            Handler::Counter(c) => {
+                let sum = c.get_sum();
+                PortableContainer::Counter {
+                    int: sum.int,
+                    float: sum.float,
+                }
+            }
+            Handler::Unknown(_) => {
+                return Err(LoroError::ArgErr(
+                    "Cannot export a container of unknown type".into(),
+                ))
+            }
+        })
+    }
+
+    fn kind(&self) -> LoroResult<ContainerType> {
+        Ok(match self {
+            PortableContainer::Map(_) => ContainerType::Map,
+            PortableContainer::List(_) => ContainerType::List,
+            PortableContainer::MovableList(_) => ContainerType::MovableList,
+            PortableContainer::Text(_) => ContainerType::Text,
+            PortableContainer::Tree(_) => ContainerType::Tree,
+            #[cfg(feature = "counter")]
+            PortableContainer::Counter { .. } => ContainerType::Counter,
+            #[cfg(not(feature = "counter"))]
+            PortableContainer::Counter { .. } => {
+                return Err(LoroError::NotImplemented(
+                    "Counter container requires the counter feature",
+                ))
+            }
+        })
+    }
+
+    fn is_empty(&self) -> bool {
+        match self {
+            PortableContainer::Map(entries) => entries.is_empty(),
+            PortableContainer::List(items) | PortableContainer::MovableList(items) => {
+                items.is_empty()
+            }
+            PortableContainer::Text(runs) => runs.is_empty(),
+            PortableContainer::Tree(nodes) => nodes.is_empty(),
+            PortableContainer::Counter { int, float } => *int == 0 && *float == 0.,
+        }
+    }
+
+    /// Fill the attached `handler` with the content.
+    ///
+    /// If `handler` is not empty, the content is appended to it, and the entries of maps
+    /// override the existing ones.
+    fn graft(&self, txn: &mut Transaction, handler: &Handler) -> LoroResult<()> {
+        match (self, handler) {
+            (PortableContainer::Map(entries), Handler::Map(m)) => graft_map(txn, m, entries),
+            (PortableContainer::List(items), Handler::List(l)) => {
+                let start = l.len();
+                for (i, item) in items.iter().enumerate() {
+                    let i = start + i;
+                    match item {
+                        PortableValue::Value(v) => l.insert_with_txn(txn, i, v.clone())?,
+                        PortableValue::Container(c) => {
+                            let child = l.insert_container_with_txn(
+                                txn,
+                                i,
+                                Handler::new_unattached(c.kind()?),
+                            )?;
+                            c.graft(txn, &child)?;
+                        }
+                    }
+                }
+                Ok(())
+            }
+            (PortableContainer::MovableList(items), Handler::MovableList(l)) => {
+                let start = l.len();
+                for (i, item) in items.iter().enumerate() {
+                    let i = start + i;
+                    match item {
+                        PortableValue::Value(v) => l.insert_with_txn(txn, i, v.clone())?,
+                        PortableValue::Container(c) => {
+                            let child = l.insert_container_with_txn(
+                                txn,
+                                i,
+                                Handler::new_unattached(c.kind()?),
+                            )?;
+                            c.graft(txn, &child)?;
+                        }
+                    }
+                }
+                Ok(())
+            }
+            (PortableContainer::Text(runs), Handler::Text(t)) => {
+                // The styles are marked after all the text is inserted, like
+                // `apply_delta`, but with the expand types in the blob
+                let mut marks = Vec::new();
+                for (insert, styles) in runs.iter() {
+                    let start = t.len_event();
+                    let attributes: FxHashMap<String, LoroValue> = styles
+                        .iter()
+                        .map(|(key, value, _)| (key.clone(), value.clone()))
+                        .collect();
+                    let (_, override_styles) =
+                        t.insert_with_txn_and_attr(txn, start, insert, Some(&attributes))?;
+                    let end = t.len_event();
+                    for (key, value) in override_styles {
+                        let expand = styles
+                            .iter()
+                            .find(|(k, ..)| k.as_str() == key.as_str())
+                            .map(|(_, _, expand)| *expand);
+                        marks.push((start, end, key, value, expand));
+                    }
+                }
+
+                for (start, end, key, value, expand) in marks {
+                    if start == end {
+                        continue;
+                    }
+
+                    // A null value removes the style inherited from the existing text
+                    let is_delete = value.is_null();
+                    t.mark_with_txn_and_expand(txn, start, end, key, value, is_delete, expand)?;
+                }
+                Ok(())
+            }
+            (PortableContainer::Tree(nodes), Handler::Tree(t)) => {
+                let mut ids: Vec<TreeID> = Vec::with_capacity(nodes.len());
+                let mut children_num: FxHashMap<Option<usize>, usize> = FxHashMap::default();
+                children_num.insert(None, t.children_num(None).unwrap_or(0));
+                for node in nodes.iter() {
+                    let parent = match node.parent {
+                        Some(p) if p >= ids.len() => {
+                            return Err(LoroError::DecodeError(
+                                "Invalid parent of tree node".into(),
+                            ))
+                        }
+                        p => p,
+                    };
+                    let index = children_num.entry(parent).or_default();
+                    let id = t.create_with_txn(txn, parent.map(|p| ids[p]), *index)?;
+                    *index += 1;
+                    ids.push(id);
+                    graft_map(txn, &t.get_meta(id)?, &node.meta)?;
+                }
+                Ok(())
+            }
+            #[cfg(feature = "counter")]
+            (PortableContainer::Counter { int, float }, Handler::Counter(c)) => c
+                .apply_sum_with_txn(
+                    txn,
+                    crate::state::CounterSum {
+                        int: *int,
+                        float: *float,
+                    },
+                ),
+            _ => unreachable!(),
+        }
+    }
+}
+
+/// Whether the content of `handler` is empty, like [PortableContainer::is_empty], without
+/// copying the content.
+fn is_handler_empty(handler: &Handler) -> bool {
+    match handler {
+        Handler::Map(m) => m.is_empty(),
+        Handler::List(l) => l.is_empty(),
+        Handler::MovableList(l) => l.is_empty(),
+        Handler::Text(t) => t.is_empty(),
+        Handler::Tree(t) => t.roots().is_empty(),
+        #[cfg(feature = "counter")]
+        Handler::Counter(c) => {
+            let sum = c.get_sum();
+            sum.int == 0 && sum.float == 0.
+        }
+        // It can't be copied, so it doesn't block the name
+        Handler::Unknown(_) => true,
+    }
+}
+
+fn map_entries(map: &MapHandler) -> LoroResult<Vec<(String, PortableValue)>> {
+    let mut entries = Vec::new();
+    map.for_each(|k, v| entries.push((k.to_string(), v)));
+    entries.sort_by(|a, b| a.0.cmp(&b.0));
+    entries
+        .into_iter()
+        .map(|(k, v)| Ok((k, to_portable_value(v)?)))
+        .collect()
+}
+
+fn to_portable_values(values: Vec<ValueOrHandler>) -> LoroResult<Vec<PortableValue>> {
+    values.into_iter().map(to_portable_value).collect()
+}
+
+fn to_portable_value(v: ValueOrHandler) -> LoroResult<PortableValue> {
+    Ok(match v {
+        ValueOrHandler::Value(v) => PortableValue::Value(v),
+        ValueOrHandler::Handler(h) => {
+            PortableValue::Container(PortableContainer::from_handler(&h)?)
+        }
+    })
+}
+
+fn graft_map(
+    txn: &mut Transaction,
+    map: &MapHandler,
+    entries: &[(String, PortableValue)],
+) -> LoroResult<()> {
+    for (key, value) in entries.iter() {
+        match value {
+            PortableValue::Value(v) => map.insert_with_txn(txn, key, v.clone())?,
+            PortableValue::Container(c) => {
+                let child =
+                    map.insert_container_with_txn(txn, key, Handler::new_unattached(c.kind()?))?;
+                c.graft(txn, &child)?;
+            }
+        }
+    }
+    Ok(())
+}
+
+impl LoroDoc {
+    /// Export the current state of the container and its descendants as a portable blob.
+    ///
+    /// The blob can be imported into any doc by [LoroDoc::import_container_as].
+    pub fn export_container(&self, id: &ContainerID) -> LoroResult<Vec<u8>> {
+        if !self.has_container(id) {
+            return Err(LoroError::NotFoundError(
+                format!("Container {} is not found", id).into_boxed_str(),
+            ));
+        }
+
+        let container = PortableContainer::from_handler(&self.get_handler(id.clone()))?;
+        let mut ans = MAGIC.to_vec();
+        ans.extend(postcard::to_allocvec(&container).unwrap());
+        Ok(ans)
+    }
+
+    /// Import the blob exported by [LoroDoc::export_container] as a new container at
+    /// `key` of the map `parent`, and return the id of the new container.
+    ///
+    /// The container and its descendants are created by new ops, so they get new ids.
+    /// It requires auto commit to be enabled. The pending changes are committed first, and
+    /// nothing is imported if it fails.
+    pub fn import_container_as(
+        &self,
+        blob: &[u8],
+        parent: &ContainerID,
+        key: &str,
+    ) -> LoroResult<ContainerID> {
+        let container: PortableContainer = match blob.strip_prefix(MAGIC.as_slice()) {
+            Some(body) => postcard::from_bytes(body).map_err(|e| {
+                LoroError::DecodeError(format!("Invalid container blob: {}", e).into_boxed_str())
+            })?,
+            None => return Err(LoroError::DecodeError("Invalid container blob".into())),
+        };
+        if parent.container_type() != ContainerType::Map || !self.has_container(parent) {
+            return Err(LoroError::ArgErr(
+                format!("Parent {} is not an existing map container", parent).into_boxed_str(),
+            ));
+        }
+
+        let map = self.get_handler(parent.clone()).into_map().unwrap();
+        self.with_own_txn(|txn| {
+            let child = map.insert_container_with_txn(
+                txn,
+                key,
+                Handler::new_unattached(container.kind()?),
+            )?;
+            container.graft(txn, &child)?;
+            Ok(child.id())
+        })
+    }
+
+    /// Copy the root containers of `other`, a doc that doesn't share history with this doc,
+    /// into this doc, and return the ids of the copied roots with the ids of where they
+    /// are copied to.
+    ///
+    /// If `mount` is a map, each root becomes a child container of the map at the key of
+    /// its name. Otherwise they become the root containers with the same names. `strategy`
+    /// decides what to do when a name is already used.
+    ///
+    /// The content is recreated by new ops of this doc, so its ids are remapped and never
+    /// collide with the ids of this doc. The history of `other` is not copied. Empty roots
+    /// are skipped. It requires auto commit to be enabled. The pending changes are committed
+    /// first, and nothing is copied if it fails.
+    pub fn merge_foreign(
+        &self,
+        other: &LoroDoc,
+        mount: Option<&ContainerID>,
+        strategy: ForeignMergeStrategy,
+    ) -> LoroResult<Vec<(ContainerID, ContainerID)>> {
+        let mount = match mount {
+            Some(id) => {
+                if id.container_type() != ContainerType::Map || !self.has_container(id) {
+                    return Err(LoroError::ArgErr(
+                        format!("Mount point {} is not an existing map container", id)
+                            .into_boxed_str(),
+                    ));
+                }
+                Some(self.get_handler(id.clone()).into_map().unwrap())
+            }
+            None => None,
+        };
+
+        let mut roots: Vec<(String, ContainerType)> = {
+            let state = other.app_state().lock().unwrap();
+            state
+                .arena
+                .root_containers()
+                .into_iter()
+                .filter_map(|idx| match state.arena.idx_to_id(idx)? {
+                    ContainerID::Root {
+                        name,
+                        container_type,
+                    } => Some((name.to_string(), container_type)),
+                    ContainerID::Normal { .. } => None,
+                })
+                .collect()
+        };
+        roots.sort();
+        let mut containers = Vec::with_capacity(roots.len());
+        for (name, kind) in roots {
+            let id = ContainerID::new_root(&name, kind);
+            let container = PortableContainer::from_handler(&other.get_handler(id.clone()))?;
+            if !container.is_empty() {
+                containers.push((name, id, container));
+            }
+        }
+
+        self.with_own_txn(|txn| self.graft_foreign(txn, containers, mount.as_ref(), strategy))
+    }
+
+    fn graft_foreign(
+        &self,
+        txn: &mut Transaction,
+        containers: Vec<(String, ContainerID, PortableContainer)>,
+        mount: Option<&MapHandler>,
+        strategy: ForeignMergeStrategy,
+    ) -> LoroResult<Vec<(ContainerID, ContainerID)>> {
+        let mut ans = Vec::with_capacity(containers.len());
+        for (name, id, container) in containers {
+            let kind = id.container_type();
+            let target = match self.get_foreign_merge_target(mount, &name) {
+                None => name,
+                Some(_) if strategy == ForeignMergeStrategy::Skip => continue,
+                Some(Some(existing))
+                    if strategy == ForeignMergeStrategy::Merge && existing.c_type() == kind =>
+                {
+                    container.graft(txn, &existing)?;
+                    ans.push((id, existing.id()));
+                    continue;
+                }
+                Some(_) => (1..)
+                    .map(|i| format!("{}_{}", name, i))
+                    .find(|name| self.get_foreign_merge_target(mount, name).is_none())
+                    .unwrap(),
+            };
+
+            let handler = match mount {
+                Some(map) => {
+                    map.insert_container_with_txn(txn, &target, Handler::new_unattached(kind))?
+                }
+                None => self.get_handler(ContainerID::new_root(&target, kind)),
+            };
+            container.graft(txn, &handler)?;
+            ans.push((id, handler.id()));
+        }
+
+        Ok(ans)
+    }
+
+    /// Run `f` in a transaction of its own, so its ops are discarded as a whole if it fails.
+    ///
+    /// The pending changes are committed before it.
+    fn with_own_txn<T>(&self, f: impl FnOnce(&mut Transaction) -> LoroResult<T>) -> LoroResult<T> {
+        self.commit_then_renew();
+        let txn = self.get_global_txn().upgrade().unwrap();
+        let mut txn = txn.try_lock().unwrap();
+        let Some(inner) = txn.as_mut() else {
+            return Err(LoroError::AutoCommitNotStarted);
+        };
+        let ans = f(inner);
+        if ans.is_err() {
+            txn.take().unwrap().abort();
+            drop(txn);
+            self.renew_txn_if_auto_commit();
+        }
+
+        ans
+    }
+
+    /// Find what uses `name` in `mount`, or in the root containers if `mount` is `None`.
+    ///
+    /// It returns `None` if the name is free, and `Some(None)` if it's used by a value
+    /// instead of a container. An empty root container doesn't use its name.
+    fn get_foreign_merge_target(
+        &self,
+        mount: Option<&MapHandler>,
+        name: &str,
+    ) -> Option<Option<Handler>> {
+        match mount {
+            Some(map) => match map.get_(name)? {
+                ValueOrHandler::Value(_) => Some(None),
+                ValueOrHandler::Handler(h) => Some(Some(h)),
+            },
+            None => ContainerType::ALL_TYPES.iter().find_map(|t| {
+                let id = ContainerID::new_root(name, *t);
+                // Don't register the absent roots
+                self.app_state().lock().unwrap().arena.id_to_idx(&id)?;
+
+                let handler = self.get_handler(id);
+                (!is_handler_empty(&handler)).then_some(Some(handler))
+            }),
+        }
+    }
+
+    fn has_container(&self, id: &ContainerID) -> bool {
+        id.is_root()
+            || self
+                .app_state()
+                .lock()
+                .unwrap()
+                .arena
+                .id_to_idx(id)
+                .is_some()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn failed_import_discards_its_ops() {
+        let doc = LoroDoc::new_auto_commit();
+        let map = doc.get_map("map");
+        map.insert("a", 1).unwrap();
+        doc.commit_then_renew();
+        let vv = doc.oplog_vv();
+        let value = doc.get_deep_value();
+
+        // The second node points to a parent after it, so the graft fails after the
+        // first node and its meta map are created
+        let container = PortableContainer::Tree(vec![
+            PortableTreeNode {
+                parent: None,
+                meta: vec![("k".into(), PortableValue::Value(1.into()))],
+            },
+            PortableTreeNode {
+                parent: Some(5),
+                meta: Vec::new(),
+            },
+        ]);
+        let mut blob = MAGIC.to_vec();
+        blob.extend(postcard::to_allocvec(&container).unwrap());
+        assert!(doc.import_container_as(&blob, &map.id(), "tree").is_err());
+        doc.commit_then_renew();
+        assert_eq!(doc.oplog_vv(), vv);
+        assert_eq!(doc.get_deep_value(), value);
+
+        // The doc can still be edited after the rollback
+        map.insert("b", 2).unwrap();
+        doc.commit_then_renew();
+        assert_eq!(map.get("b"), Some(2.into()));
+    }
+}
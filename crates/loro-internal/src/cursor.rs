@@ -43,6 +43,28 @@ impl Side {
 pub struct PosQueryResult {
     pub update: Option<Cursor>,
     pub current: AbsolutePosition,
+    /// Whether the anchored element of the cursor is still there
+    pub status: CursorStatus,
+}
+
+/// How the position of a cursor is resolved
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum CursorStatus {
+    /// The anchored element is found at the position where the cursor was created
+    Exact,
+    /// The anchored element is found, but other edits have shifted its position
+    Shifted,
+    /// The anchored element was deleted, so the position falls back to where it used to be.
+    ///
+    /// In this case, [PosQueryResult::update] is a new cursor anchored at the neighbor.
+    Deleted,
+}
+
+impl CursorStatus {
+    /// Whether the anchored element was removed
+    pub fn is_deleted(&self) -> bool {
+        matches!(self, CursorStatus::Deleted)
+    }
 }
 
 #[derive(Debug, Clone, PartialEq, Eq)]
@@ -106,6 +106,10 @@ impl StyleMeta {
         self.map.contains_key(key)
     }
 
+    pub(crate) fn get(&self, key: &InternalString) -> Option<&LoroValue> {
+        self.map.get(key).map(|x| &x.value)
+    }
+
     pub(crate) fn to_value(&self) -> LoroValue {
         LoroValue::Map(Arc::new(self.to_map_without_null_value()))
     }
@@ -69,6 +69,17 @@ impl DiffCalculator {
         self.calculators.get(&container).map(|(_, c)| c)
     }
 
+    /// The approximate memory usage of the cached calculators in bytes.
+    pub(crate) fn estimate_size(&self) -> usize {
+        self.calculators
+            .values()
+            .map(|(_, c)| {
+                std::mem::size_of::<(ContainerIdx, (Option<NonZeroU16>, ContainerDiffCalculator))>()
+                    + c.estimate_size()
+            })
+            .sum()
+    }
+
     // PERF: if the causal order is linear, we can skip some of the calculation
     #[allow(unused)]
     pub(crate) fn calc_diff(
@@ -379,6 +390,29 @@ pub(crate) enum ContainerDiffCalculator {
     Unknown(UnknownDiffCalculator),
 }
 
+impl ContainerDiffCalculator {
+    /// The approximate size of the data owned by the calculator in bytes.
+    fn estimate_size(&self) -> usize {
+        match self {
+            ContainerDiffCalculator::Map(m) => {
+                m.changed_key.len() * std::mem::size_of::<InternalString>()
+            }
+            ContainerDiffCalculator::List(l) => l.tracker.estimate_size(),
+            ContainerDiffCalculator::Richtext(r) => {
+                r.tracker.estimate_size() + r.styles.len() * std::mem::size_of::<StyleOp>()
+            }
+            ContainerDiffCalculator::Tree(_) => 0,
+            ContainerDiffCalculator::MovableList(m) => {
+                m.changed_elements.len() * std::mem::size_of::<IdLp>()
+                    + m.list.tracker.estimate_size()
+            }
+            #[cfg(feature = "counter")]
+            ContainerDiffCalculator::Counter(c) => c.estimate_size(),
+            ContainerDiffCalculator::Unknown(_) => 0,
+        }
+    }
+}
+
 #[derive(Debug)]
 pub(crate) struct MapDiffCalculator {
     container_idx: ContainerIdx,
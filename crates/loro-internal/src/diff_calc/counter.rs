@@ -2,14 +2,16 @@ use std::collections::BTreeMap;
 
 use loro_common::{ContainerID, ID};
 
-use crate::{container::idx::ContainerIdx, event::InternalDiff, OpLog};
+use crate::{
+    container::idx::ContainerIdx, event::InternalDiff, op::CounterDelta, state::CounterSum, OpLog,
+};
 
 use super::DiffCalculatorTrait;
 
 #[derive(Debug)]
 pub(crate) struct CounterDiffCalculator {
     idx: ContainerIdx,
-    ops: BTreeMap<ID, f64>,
+    ops: BTreeMap<ID, CounterDelta>,
 }
 
 impl CounterDiffCalculator {
@@ -19,6 +21,10 @@ impl CounterDiffCalculator {
             ops: BTreeMap::new(),
         }
     }
+
+    pub(crate) fn estimate_size(&self) -> usize {
+        self.ops.len() * std::mem::size_of::<(ID, CounterDelta)>()
+    }
 }
 
 impl DiffCalculatorTrait for CounterDiffCalculator {
@@ -46,17 +52,17 @@ impl DiffCalculatorTrait for CounterDiffCalculator {
         to: &crate::VersionVector,
         _on_new_container: impl FnMut(&ContainerID),
     ) -> InternalDiff {
-        let mut diff = 0.;
+        let mut diff = CounterSum::default();
         let (b, a) = from.diff_iter(to);
 
         for sub in b {
             for (_, c) in self.ops.range(sub.norm_id_start()..sub.norm_id_end()) {
-                diff -= c;
+                diff.sub(*c);
             }
         }
         for sub in a {
             for (_, c) in self.ops.range(sub.norm_id_start()..sub.norm_id_end()) {
-                diff += c;
+                diff.add(*c);
             }
         }
         InternalDiff::Counter(diff)
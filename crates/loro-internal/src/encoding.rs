@@ -2,16 +2,21 @@ mod arena;
 mod encode_reordered;
 pub(crate) mod json_schema;
 mod value;
+pub(crate) use encode_reordered::DecodedSnapshot;
 pub(crate) use value::OwnedValue;
 
 use crate::op::OpWithId;
+use crate::state::ContainerState;
 use crate::version::Frontiers;
-use crate::LoroDoc;
 use crate::{oplog::OpLog, LoroError, VersionVector};
-use loro_common::{IdLpSpan, LoroResult, PeerID};
+use crate::{DocState, LoroDoc};
+use fxhash::FxHashMap;
+use loro_common::{ContainerID, Counter, IdLpSpan, IdSpan, LoroResult, LoroValue, PeerID};
 use num_traits::{FromPrimitive, ToPrimitive};
 use rle::{HasLength, Sliceable};
 use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::io::Write;
 const MAGIC_BYTES: [u8; 4] = *b"loro";
 
 #[derive(Clone, Copy, Debug, PartialEq, Eq)]
@@ -152,6 +157,103 @@ pub(crate) fn encode_oplog(oplog: &OpLog, vv: &VersionVector, mode: EncodeMode)
     encode_header_and_body(mode, body)
 }
 
+/// Encode the ops in `spans` into the blobs of updates.
+///
+/// A blob can only contain one contiguous span of each peer, so the spans of the same peer
+/// are merged and put into different blobs if they are not contiguous.
+/// The parts of the spans that are not in the oplog are ignored.
+pub(crate) fn encode_oplog_spans(oplog: &OpLog, spans: &[IdSpan]) -> Vec<Vec<u8>> {
+    let mut peer_spans: BTreeMap<PeerID, Vec<(Counter, Counter)>> = BTreeMap::new();
+    for span in spans {
+        let start = span.counter.min();
+        let end = span
+            .counter
+            .norm_end()
+            .min(oplog.vv().get(&span.peer).copied().unwrap_or(0));
+        if start < end {
+            peer_spans.entry(span.peer).or_default().push((start, end));
+        }
+    }
+
+    for spans in peer_spans.values_mut() {
+        spans.sort_unstable();
+        let mut merged: Vec<(Counter, Counter)> = Vec::with_capacity(spans.len());
+        for &(start, end) in spans.iter() {
+            match merged.last_mut() {
+                Some(last) if start <= last.1 => last.1 = last.1.max(end),
+                _ => merged.push((start, end)),
+            }
+        }
+
+        *spans = merged;
+    }
+
+    let layers = peer_spans.values().map(|x| x.len()).max().unwrap_or(0);
+    (0..layers)
+        .map(|i| {
+            let spans: Vec<IdSpan> = peer_spans
+                .iter()
+                .filter_map(|(&peer, spans)| {
+                    spans
+                        .get(i)
+                        .map(|&(start, end)| IdSpan::new(peer, start, end))
+                })
+                .collect();
+            let body = encode_reordered::encode_updates_in_spans(oplog, &spans);
+            encode_header_and_body(EncodeMode::Rle, body)
+        })
+        .collect()
+}
+
+/// Encode the oplog like [encode_oplog], but write the result into `writer`
+/// instead of returning a new `Vec<u8>`.
+pub(crate) fn encode_oplog_to(
+    oplog: &OpLog,
+    vv: &VersionVector,
+    mode: EncodeMode,
+    writer: &mut dyn Write,
+) -> std::io::Result<()> {
+    let mode = match mode {
+        EncodeMode::Auto => EncodeMode::Rle,
+        mode => mode,
+    };
+
+    let mut body =
+        match &mode {
+            EncodeMode::Rle => encode_reordered::encode_updates_body(oplog, vv),
+            EncodeMode::Snapshot | EncodeMode::Auto => return Err(std::io::Error::new(
+                std::io::ErrorKind::InvalidInput,
+                "a snapshot can't be encoded from the oplog alone, use export_snapshot_to instead",
+            )),
+        };
+
+    write_header_and_body(mode, &mut body, writer)
+}
+
+/// Encode the ops between `from` and `to` into one blob of updates and write it into `writer`.
+///
+/// The ops that are not in the oplog are ignored.
+pub(crate) fn encode_oplog_range_to(
+    oplog: &OpLog,
+    from: &VersionVector,
+    to: &VersionVector,
+    writer: &mut dyn Write,
+) -> std::io::Result<()> {
+    // There is at most one span of each peer between two versions, so they fit in one blob
+    let spans: Vec<IdSpan> = to
+        .sub_iter(from)
+        .filter_map(|span| {
+            let end = span
+                .counter
+                .norm_end()
+                .min(oplog.vv().get(&span.peer).copied().unwrap_or(0));
+            (span.counter.min() < end).then(|| IdSpan::new(span.peer, span.counter.min(), end))
+        })
+        .collect();
+    let mut body = encode_reordered::encode_updates_in_spans_body(oplog, &spans);
+    write_header_and_body(EncodeMode::Rle, &mut body, writer)
+}
+
 pub(crate) fn decode_oplog(
     oplog: &mut OpLog,
     parsed: ParsedHeaderAndBody,
@@ -163,6 +265,14 @@ pub(crate) fn decode_oplog(
     }
 }
 
+pub(crate) use encode_reordered::ChangeHeader;
+
+/// Decode the headers of the changes in the updates or snapshot `body`, without decoding
+/// their ops.
+pub(crate) fn decode_change_headers(body: &[u8]) -> LoroResult<Vec<ChangeHeader>> {
+    encode_reordered::decode_change_headers(body)
+}
+
 pub(crate) struct ParsedHeaderAndBody<'a> {
     pub checksum: [u8; 16],
     pub checksum_body: &'a [u8],
@@ -223,6 +333,32 @@ fn encode_header_and_body(mode: EncodeMode, body: Vec<u8>) -> Vec<u8> {
     ans
 }
 
+/// Write the same bytes as [encode_header_and_body] into `writer`.
+///
+/// The checksum in the header covers the whole body, so the columns of the body are
+/// serialized twice: once into the checksum and once into `writer`. Either way only one
+/// serialized column is in memory at a time, but the unserialized columns are still
+/// built for the whole doc, because each column holds the values of all the ops.
+fn write_header_and_body(
+    mode: EncodeMode,
+    body: &mut encode_reordered::EncodedBody,
+    writer: &mut dyn Write,
+) -> std::io::Result<()> {
+    let mode_bytes = mode.to_bytes();
+    let mut ctx = md5::Context::new();
+    ctx.consume(mode_bytes);
+    body.write_parts(&mut |bytes| {
+        ctx.consume(bytes);
+        Ok(())
+    })?;
+    let checksum = ctx.compute().0;
+    writer.write_all(&MAGIC_BYTES)?;
+    writer.write_all(&checksum)?;
+    writer.write_all(&mode_bytes)?;
+    body.write_parts(&mut |bytes| writer.write_all(bytes))?;
+    writer.flush()
+}
+
 pub(crate) fn export_snapshot(doc: &LoroDoc) -> Vec<u8> {
     let body = encode_reordered::encode_snapshot(
         &doc.oplog().try_lock().unwrap(),
@@ -233,6 +369,16 @@ pub(crate) fn export_snapshot(doc: &LoroDoc) -> Vec<u8> {
     encode_header_and_body(EncodeMode::Snapshot, body)
 }
 
+pub(crate) fn export_snapshot_to(doc: &LoroDoc, writer: &mut dyn Write) -> std::io::Result<()> {
+    let mut body = encode_reordered::encode_snapshot_body(
+        &doc.oplog().try_lock().unwrap(),
+        &doc.app_state().try_lock().unwrap(),
+        &Default::default(),
+    );
+
+    write_header_and_body(EncodeMode::Snapshot, &mut body, writer)
+}
+
 pub(crate) fn decode_snapshot(
     doc: &LoroDoc,
     mode: EncodeMode,
@@ -244,6 +390,22 @@ pub(crate) fn decode_snapshot(
     }
 }
 
+/// Decode the snapshot into the empty `oplog` and `state`, without loading the states.
+/// See [encode_reordered::decode_snapshot_without_loading].
+pub(crate) fn decode_snapshot_without_loading(
+    oplog: &mut OpLog,
+    state: &mut DocState,
+    mode: EncodeMode,
+    body: &[u8],
+) -> LoroResult<DecodedSnapshot> {
+    match mode {
+        EncodeMode::Snapshot => {
+            encode_reordered::decode_snapshot_without_loading(oplog, state, body, None)
+        }
+        _ => unreachable!(),
+    }
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct ImportBlobMetadata {
     /// The partial start version vector.
@@ -265,9 +427,33 @@ pub struct ImportBlobMetadata {
     pub is_snapshot: bool,
 }
 
+/// The metadata of a blob and the values of some of its containers, returned by [LoroDoc::peek].
+#[derive(Debug, Clone)]
+pub struct DocMeta {
+    /// The versions and timestamps of the blob
+    pub meta: ImportBlobMetadata,
+    /// The number of the containers in the blob
+    pub container_num: usize,
+    /// The shallow values of the requested containers that have states in the snapshot.
+    ///
+    /// It's empty if the blob is not a snapshot.
+    pub previews: FxHashMap<ContainerID, LoroValue>,
+}
+
 impl LoroDoc {
     /// Decodes the metadata for an imported blob from the provided bytes.
     pub fn decode_import_blob_meta(blob: &[u8]) -> LoroResult<ImportBlobMetadata> {
         encode_reordered::decode_import_blob_meta(blob)
     }
+
+    /// Decode the metadata of the blob and the values of the `previews` containers
+    /// without importing it.
+    ///
+    /// Only the states of `previews` are built from the snapshot, and the changes are not
+    /// imported unless a movable list is requested, so it's much cheaper than importing it.
+    /// The values are shallow, so the nested containers are represented by their ids.
+    pub fn peek(blob: &[u8], previews: &[ContainerID]) -> LoroResult<DocMeta> {
+        let parsed = parse_header_and_body(blob)?;
+        encode_reordered::peek(parsed.mode, parsed.body, previews)
+    }
 }
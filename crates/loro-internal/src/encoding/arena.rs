@@ -13,6 +13,7 @@ pub(super) fn encode_arena(
     registers: EncodedRegisters,
     dep_arena: DepsArena,
     state_blob_arena: &[u8],
+    change_meta_arena: ChangeMetaArena,
 ) -> Vec<u8> {
     let EncodedRegisters {
         peer: mut peer_register,
@@ -48,6 +49,7 @@ pub(super) fn encode_arena(
         position_arena: &position_arena.encode(),
         tree_id_arena: &tree_id_arena.encode(),
         state_blob_arena,
+        change_meta_arena: &change_meta_arena.encode(),
     };
 
     encoded.encode_arenas()
@@ -82,6 +84,7 @@ pub struct DecodedArenas<'a> {
     pub(super) positions: PositionArena<'a>,
     pub(super) tree_ids: TreeIDArena,
     pub state_blob_arena: &'a [u8],
+    pub(super) change_meta: ChangeMetaArena,
 }
 
 pub fn decode_arena(bytes: &[u8]) -> LoroResult<DecodedArenas> {
@@ -94,6 +97,7 @@ pub fn decode_arena(bytes: &[u8]) -> LoroResult<DecodedArenas> {
         positions: PositionArena::decode(arenas.position_arena)?,
         tree_ids: TreeIDArena::decode(arenas.tree_id_arena)?,
         state_blob_arena: arenas.state_blob_arena,
+        change_meta: ChangeMetaArena::decode(arenas.change_meta_arena)?,
     })
 }
 
@@ -105,6 +109,7 @@ struct EncodedArenas<'a> {
     position_arena: &'a [u8],
     tree_id_arena: &'a [u8],
     state_blob_arena: &'a [u8],
+    change_meta_arena: &'a [u8],
 }
 
 impl EncodedArenas<'_> {
@@ -116,6 +121,7 @@ impl EncodedArenas<'_> {
                 + self.deps_arena.len()
                 + self.position_arena.len()
                 + self.tree_id_arena.len()
+                + self.change_meta_arena.len()
                 + 4 * 4,
         );
 
@@ -126,6 +132,10 @@ impl EncodedArenas<'_> {
         write_arena(&mut ans, self.position_arena);
         write_arena(&mut ans, self.tree_id_arena);
         write_arena(&mut ans, self.state_blob_arena);
+        // It's the last arena, so it's ignored by the old versions
+        if !self.change_meta_arena.is_empty() {
+            write_arena(&mut ans, self.change_meta_arena);
+        }
         ans
     }
 
@@ -136,7 +146,13 @@ impl EncodedArenas<'_> {
         let (deps_arena, rest) = read_arena(rest)?;
         let (position_arena, rest) = read_arena(rest)?;
         let (tree_id_arena, rest) = read_arena(rest)?;
-        let (state_blob_arena, _) = read_arena(rest)?;
+        let (state_blob_arena, rest) = read_arena(rest)?;
+        // It's missing in the data encoded by the old versions
+        let change_meta_arena = if rest.is_empty() {
+            rest
+        } else {
+            read_arena(rest)?.0
+        };
         Ok(EncodedArenas {
             peer_id_arena,
             container_arena,
@@ -145,6 +161,7 @@ impl EncodedArenas<'_> {
             position_arena,
             tree_id_arena,
             state_blob_arena,
+            change_meta_arena,
         })
     }
 }
@@ -370,6 +387,39 @@ impl KeyArena {
     }
 }
 
+/// The commit messages and authors of the encoded changes.
+///
+/// The length of each message is stored in the `msg_len` of the change.
+#[derive(Serialize, Deserialize, Default)]
+pub(super) struct ChangeMetaArena {
+    /// The concatenated commit messages of the changes
+    pub(super) messages: String,
+    /// The distinct authors
+    pub(super) authors: Vec<String>,
+    /// The index of the author of each change plus one, or 0 if it has no author.
+    ///
+    /// It's empty if no change has an author.
+    pub(super) change_authors: Vec<u32>,
+}
+
+impl ChangeMetaArena {
+    pub fn encode(&self) -> Vec<u8> {
+        if self.messages.is_empty() && self.authors.is_empty() {
+            return Vec::new();
+        }
+
+        serde_columnar::to_vec(&self).unwrap()
+    }
+
+    pub fn decode(bytes: &[u8]) -> LoroResult<Self> {
+        if bytes.is_empty() {
+            return Ok(Self::default());
+        }
+
+        Ok(serde_columnar::from_bytes(bytes)?)
+    }
+}
+
 #[derive(Clone, Hash, PartialEq, Eq, Debug)]
 #[columnar(vec, ser, de, iterable)]
 pub struct EncodedTreeID {
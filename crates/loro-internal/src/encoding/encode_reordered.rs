@@ -5,9 +5,9 @@ use generic_btree::rle::Sliceable;
 use itertools::Itertools;
 use loro_common::{
     ContainerID, ContainerType, Counter, HasCounterSpan, HasId, HasIdSpan, HasLamportSpan, IdLp,
-    LoroError, LoroResult, PeerID, ID,
+    IdSpan, LoroError, LoroResult, PeerID, ID,
 };
-use rle::HasLength;
+use rle::{HasLength, RleCollection};
 use serde_columnar::{columnar, ColumnarError};
 use tracing::instrument;
 
@@ -17,7 +17,7 @@ use crate::{
     container::{idx::ContainerIdx, list::list_op::DeleteSpanWithId, richtext::TextStyleInfoFlag},
     encoding::StateSnapshotDecodeContext,
     op::{FutureInnerContent, Op, OpWithId, SliceRange},
-    state::ContainerState,
+    state::{ContainerState, State},
     version::Frontiers,
     DocState, LoroDoc, OpLog, VersionVector,
 };
@@ -29,7 +29,7 @@ use super::{
     arena::*,
     parse_header_and_body,
     value::{Value, ValueKind, ValueReader, ValueWriter},
-    ImportBlobMetadata,
+    DocMeta, EncodeMode, ImportBlobMetadata,
 };
 
 #[allow(unused_imports)]
@@ -43,6 +43,12 @@ pub(super) const MAX_DECODED_SIZE: usize = 1 << 30;
 pub(super) const MAX_COLLECTION_SIZE: usize = 1 << 28;
 
 pub(crate) fn encode_updates(oplog: &OpLog, vv: &VersionVector) -> Vec<u8> {
+    encode_updates_body(oplog, vv).to_vec()
+}
+
+/// Encode the ops like [encode_updates], but keep the columns so that the body can be
+/// serialized part by part, see [EncodedBody::write_parts].
+pub(crate) fn encode_updates_body(oplog: &OpLog, vv: &VersionVector) -> EncodedBody {
     // skip the ops that current oplog does not have
     let actual_start_vv: VersionVector = vv
         .iter()
@@ -63,6 +69,74 @@ pub(crate) fn encode_updates(oplog: &OpLog, vv: &VersionVector) -> Vec<u8> {
     let vv = &actual_start_vv;
     let mut peer_register: ValueRegister<PeerID> = ValueRegister::new();
     let (start_counters, diff_changes) = init_encode(oplog, vv, &mut peer_register);
+    let start_frontiers = oplog.dag.vv_to_frontiers(&actual_start_vv);
+    encode_diff_changes(
+        oplog,
+        peer_register,
+        start_counters,
+        diff_changes,
+        &start_frontiers,
+    )
+}
+
+/// Encode the ops in `spans`. The spans should be included in the oplog, and there should be
+/// at most one span for each peer.
+///
+/// The changes split by the spans are sliced, and the deps of the sliced parts point to
+/// the previous op in the same change. So the result can be imported in any order.
+pub(crate) fn encode_updates_in_spans(oplog: &OpLog, spans: &[IdSpan]) -> Vec<u8> {
+    encode_updates_in_spans_body(oplog, spans).to_vec()
+}
+
+/// Encode the ops in `spans` like [encode_updates_in_spans], but keep the columns so that
+/// the body can be serialized part by part.
+pub(crate) fn encode_updates_in_spans_body(oplog: &OpLog, spans: &[IdSpan]) -> EncodedBody {
+    let mut peer_register: ValueRegister<PeerID> = ValueRegister::new();
+    let mut start_counters = Vec::new();
+    let mut start_vv = VersionVector::new();
+    let mut diff_changes: Vec<Cow<'_, Change>> = Vec::new();
+    for span in spans {
+        let peer = span.peer;
+        let start = span.counter.min();
+        let end = span.counter.norm_end();
+        debug_assert!(!peer_register.contains(&peer));
+        peer_register.register(&peer);
+        start_counters.push(start);
+        start_vv.insert(peer, start);
+        let peer_changes = oplog.changes().get(&peer).unwrap();
+        let index = peer_changes.search_atom_index(start);
+        for change in peer_changes[index..]
+            .iter()
+            .take_while(|x| x.ctr_start() < end)
+        {
+            if change.ctr_start() >= start && change.ctr_end() <= end {
+                diff_changes.push(Cow::Borrowed(change));
+            } else {
+                let from = (start - change.ctr_start()).max(0) as usize;
+                let to = (end.min(change.ctr_end()) - change.ctr_start()) as usize;
+                diff_changes.push(Cow::Owned(rle::Sliceable::slice(change, from, to)));
+            }
+        }
+    }
+
+    diff_changes.sort_by_key(|x| x.lamport);
+    let start_frontiers = oplog.dag.vv_to_frontiers(&start_vv);
+    encode_diff_changes(
+        oplog,
+        peer_register,
+        start_counters,
+        diff_changes,
+        &start_frontiers,
+    )
+}
+
+fn encode_diff_changes(
+    oplog: &OpLog,
+    peer_register: ValueRegister<PeerID>,
+    start_counters: Vec<Counter>,
+    diff_changes: Vec<Cow<'_, Change>>,
+    start_frontiers: &Frontiers,
+) -> EncodedBody {
     let ExtractedContainer {
         containers,
         cid_idx_pairs: _,
@@ -83,12 +157,14 @@ pub(crate) fn encode_updates(oplog: &OpLog, vv: &VersionVector) -> Vec<u8> {
         position: either::Left(FxHashSet::default()),
     };
     let mut dep_arena = DepsArena::default();
+    let mut change_meta = ChangeMetaArena::default();
     let mut value_writer = ValueWriter::new();
     let mut ops: Vec<TempOp> = Vec::new();
     let arena = &oplog.arena;
     let changes = encode_changes(
         &diff_changes,
         &mut dep_arena,
+        &mut change_meta,
         &mut |op| ops.push(op),
         &container2index,
         &mut registers,
@@ -105,9 +181,7 @@ pub(crate) fn encode_updates(oplog: &OpLog, vv: &VersionVector) -> Vec<u8> {
 
     let (encoded_ops, del_starts) = encode_ops(&ops, arena, &mut value_writer, &mut registers);
 
-    let frontiers = oplog
-        .dag
-        .vv_to_frontiers(&actual_start_vv)
+    let frontiers = start_frontiers
         .iter()
         .map(|x| (registers.peer.register(&x.peer), x.counter))
         .collect();
@@ -118,11 +192,11 @@ pub(crate) fn encode_updates(oplog: &OpLog, vv: &VersionVector) -> Vec<u8> {
         states: Vec::new(),
         start_counters,
         raw_values: Cow::Owned(value_writer.finish()),
-        arenas: Cow::Owned(encode_arena(registers, dep_arena, &[])),
+        arenas: Cow::Owned(encode_arena(registers, dep_arena, &[], change_meta)),
         start_frontiers: frontiers,
     };
 
-    serde_columnar::to_vec(&doc).unwrap()
+    EncodedBody(doc)
 }
 
 #[instrument(skip_all)]
@@ -142,9 +216,17 @@ pub(crate) fn decode_updates(oplog: &mut OpLog, bytes: &[u8]) -> LoroResult<()>
         peer_ids,
         deps,
         state_blob_arena: _,
+        change_meta,
         ..
     } = arenas;
-    let changes = decode_changes(iter.changes, iter.start_counters, &peer_ids, deps, ops_map)?;
+    let changes = decode_changes(
+        iter.changes,
+        iter.start_counters,
+        &peer_ids,
+        deps,
+        &change_meta,
+        ops_map,
+    )?;
     let (latest_ids, pending_changes) = import_changes_to_oplog(changes, oplog)?;
     if oplog.try_apply_pending(latest_ids).should_update && !oplog.batch_importing {
         oplog.dag.refresh_frontiers();
@@ -210,6 +292,272 @@ pub fn decode_import_blob_meta(bytes: &[u8]) -> LoroResult<ImportBlobMetadata> {
     })
 }
 
+/// The id span, the deps and the timestamp of an encoded change, without its ops.
+pub(crate) struct ChangeHeader {
+    pub span: IdSpan,
+    pub deps: Frontiers,
+    pub timestamp: Timestamp,
+}
+
+/// Decode the headers of the changes in `body` without decoding their ops.
+pub(crate) fn decode_change_headers(body: &[u8]) -> LoroResult<Vec<ChangeHeader>> {
+    let iter = serde_columnar::iter_from_bytes::<EncodedDoc>(body)?;
+    let DecodedArenas {
+        peer_ids, mut deps, ..
+    } = decode_arena(&iter.arenas)?;
+    decode_change_headers_from(iter.changes, iter.start_counters, &peer_ids, &mut deps)
+}
+
+fn decode_change_headers_from(
+    encoded_changes: IterableEncodedChange<'_>,
+    mut counters: Vec<i32>,
+    peer_ids: &PeerIdArena,
+    deps: &mut dyn Iterator<Item = Result<EncodedDep, ColumnarError>>,
+) -> LoroResult<Vec<ChangeHeader>> {
+    let mut ans = Vec::new();
+    for encoded_change in encoded_changes {
+        let EncodedChange {
+            peer_idx,
+            len,
+            timestamp,
+            deps_len,
+            dep_on_self,
+            ..
+        } = encoded_change?;
+        if peer_ids.peer_ids.len() <= peer_idx || counters.len() <= peer_idx {
+            return Err(LoroError::DecodeDataCorruptionError);
+        }
+
+        let counter = counters[peer_idx];
+        counters[peer_idx] += len as Counter;
+        let peer = peer_ids.peer_ids[peer_idx];
+        let mut change_deps = Frontiers::default();
+        if dep_on_self {
+            if counter <= 0 {
+                return Err(LoroError::DecodeDataCorruptionError);
+            }
+
+            change_deps.push(ID::new(peer, counter - 1));
+        }
+
+        for _ in 0..deps_len {
+            let dep = deps.next().ok_or(LoroError::DecodeDataCorruptionError)??;
+            change_deps.push(ID::new(peer_ids.peer_ids[dep.peer_idx], dep.counter));
+        }
+
+        ans.push(ChangeHeader {
+            span: IdSpan::new(peer, counter, counter + len as Counter),
+            deps: change_deps,
+            timestamp,
+        });
+    }
+
+    Ok(ans)
+}
+
+/// Calculate the lamports of the changes from their deps, without building the dag.
+///
+/// It returns the start counter and the lamport of the changes of each peer, sorted by counter.
+fn calc_change_lamports(
+    headers: &[ChangeHeader],
+) -> LoroResult<FxHashMap<PeerID, Vec<(Counter, Lamport)>>> {
+    let mut by_peer: FxHashMap<PeerID, Vec<usize>> = FxHashMap::default();
+    for (i, h) in headers.iter().enumerate() {
+        by_peer.entry(h.span.peer).or_default().push(i);
+    }
+    for list in by_peer.values_mut() {
+        list.sort_by_key(|&i| headers[i].span.counter.start);
+    }
+
+    let find = |id: ID| -> LoroResult<usize> {
+        let list = by_peer
+            .get(&id.peer)
+            .ok_or(LoroError::DecodeDataCorruptionError)?;
+        let pos = list.partition_point(|&i| headers[i].span.counter.start <= id.counter);
+        match pos.checked_sub(1).map(|p| list[p]) {
+            Some(i) if id.counter < headers[i].span.counter.end => Ok(i),
+            _ => Err(LoroError::DecodeDataCorruptionError),
+        }
+    };
+
+    let mut lamports: Vec<Option<Lamport>> = vec![None; headers.len()];
+    let mut visiting = vec![false; headers.len()];
+    for i in 0..headers.len() {
+        // The stack is a path of the changes waiting for the lamport of their deps
+        let mut stack = vec![i];
+        visiting[i] = true;
+        while let Some(&c) = stack.last() {
+            let mut lamport = 0;
+            let mut unknown_dep = None;
+            for dep in headers[c].deps.iter() {
+                let j = find(*dep)?;
+                match lamports[j] {
+                    Some(l) => {
+                        let offset = (dep.counter - headers[j].span.counter.start) as Lamport;
+                        lamport = lamport.max(l + offset + 1);
+                    }
+                    None => {
+                        unknown_dep = Some(j);
+                        break;
+                    }
+                }
+            }
+
+            match unknown_dep {
+                Some(j) if visiting[j] => return Err(LoroError::DecodeDataCorruptionError),
+                Some(j) => {
+                    visiting[j] = true;
+                    stack.push(j);
+                }
+                None => {
+                    lamports[c] = Some(lamport);
+                    visiting[c] = false;
+                    stack.pop();
+                }
+            }
+        }
+    }
+
+    Ok(by_peer
+        .into_iter()
+        .map(|(peer, list)| {
+            let changes = list
+                .into_iter()
+                .map(|i| (headers[i].span.counter.start, lamports[i].unwrap()))
+                .collect();
+            (peer, changes)
+        })
+        .collect())
+}
+
+/// Decode the metadata, the number of the containers and the shallow values of the `previews`
+/// containers of the blob, decoding the arenas only once.
+///
+/// The states are decoded without importing the changes into an oplog; the lamports of the
+/// ops are calculated from the deps of the changes instead. The movable lists need the history
+/// to decode their states, so the changes are imported if one of them is requested.
+pub(crate) fn peek(mode: EncodeMode, body: &[u8], previews: &[ContainerID]) -> LoroResult<DocMeta> {
+    let iter = serde_columnar::iter_from_bytes::<EncodedDoc>(body)?;
+    let mut arenas = decode_arena(&iter.arenas)?;
+    let container_num = arenas.containers.len();
+    let peers = arenas.peer_ids.peer_ids.clone();
+    let start_counters = iter.start_counters;
+    let start_frontiers: Frontiers = iter
+        .start_frontiers
+        .iter()
+        .map(|x| ID::new(peers[x.0], x.1))
+        .collect();
+    let mut deps = std::mem::replace(&mut arenas.deps, Box::new(std::iter::empty()));
+    let headers = decode_change_headers_from(
+        iter.changes,
+        start_counters.clone(),
+        &arenas.peer_ids,
+        &mut deps,
+    )?;
+
+    let mut end_counters: FxHashMap<PeerID, Counter> = FxHashMap::default();
+    let mut start_timestamp = Timestamp::MAX;
+    let mut end_timestamp = Timestamp::MIN;
+    for h in headers.iter() {
+        end_counters.insert(h.span.peer, h.span.counter.end);
+        start_timestamp = start_timestamp.min(h.timestamp);
+        end_timestamp = end_timestamp.max(h.timestamp);
+    }
+    let meta = ImportBlobMetadata {
+        is_snapshot: mode.is_snapshot(),
+        start_frontiers,
+        partial_start_vv: start_counters
+            .iter()
+            .enumerate()
+            .filter(|(_, counter)| **counter != 0)
+            .map(|(peer_idx, counter)| ID::new(peers[peer_idx], *counter - 1))
+            .collect(),
+        partial_end_vv: start_counters
+            .iter()
+            .enumerate()
+            .map(|(peer_idx, counter)| {
+                let peer = peers[peer_idx];
+                ID::new(peer, end_counters.get(&peer).unwrap_or(counter) - 1)
+            })
+            .collect(),
+        start_timestamp,
+        end_timestamp,
+        change_num: headers.len() as u32,
+    };
+
+    let mut values = FxHashMap::default();
+    if !mode.is_snapshot() || previews.is_empty() {
+        return Ok(DocMeta {
+            meta,
+            container_num,
+            previews: values,
+        });
+    }
+
+    let only: FxHashSet<ContainerID> = previews.iter().cloned().collect();
+    let doc = LoroDoc::new();
+    let mut oplog = doc.oplog().lock().unwrap();
+    let mut state = doc.app_state().lock().unwrap();
+    let mut states = if only
+        .iter()
+        .any(|id| id.container_type() == ContainerType::MovableList)
+    {
+        decode_snapshot_without_loading(&mut oplog, &mut state, body, Some(&only))?.states
+    } else {
+        let ExtractedOps {
+            mut ops,
+            containers,
+            ..
+        } = extract_ops(
+            &iter.raw_values,
+            iter.ops,
+            iter.delete_starts,
+            &oplog.arena,
+            &mut arenas,
+            true,
+        )?;
+        let lamports = calc_change_lamports(&headers)?;
+        for op in ops.iter_mut() {
+            let changes = lamports
+                .get(&op.peer)
+                .ok_or(LoroError::DecodeDataCorruptionError)?;
+            let pos = changes.partition_point(|(start, _)| *start <= op.op.counter);
+            let (start, lamport) = pos
+                .checked_sub(1)
+                .map(|p| changes[p])
+                .ok_or(LoroError::DecodeDataCorruptionError)?;
+            op.lamport = Some(lamport + (op.op.counter - start) as Lamport);
+        }
+
+        decode_snapshot_states(
+            &mut state,
+            iter.states,
+            containers,
+            arenas.state_blob_arena,
+            ops,
+            &oplog,
+            &arenas.peer_ids,
+            Some(&only),
+        )?;
+        take(&mut state.states)
+    };
+
+    for id in previews {
+        let Some(idx) = oplog.arena.id_to_idx(id) else {
+            continue;
+        };
+        if let Some(s) = states.get_mut(&idx) {
+            values.insert(id.clone(), s.get_value());
+        }
+    }
+
+    Ok(DocMeta {
+        meta,
+        container_num,
+        previews: values,
+    })
+}
+
 pub(crate) fn import_changes_to_oplog(
     changes: Vec<Change>,
     oplog: &mut OpLog,
@@ -257,6 +605,7 @@ fn decode_changes<'a>(
     mut counters: Vec<i32>,
     peer_ids: &PeerIdArena,
     mut deps: impl Iterator<Item = Result<EncodedDep, ColumnarError>> + 'a,
+    change_meta: &ChangeMetaArena,
     mut ops_map: std::collections::HashMap<
         u64,
         Vec<Op>,
@@ -264,19 +613,43 @@ fn decode_changes<'a>(
     >,
 ) -> LoroResult<Vec<Change>> {
     let mut changes = Vec::with_capacity(encoded_changes.size_hint().0);
-    for encoded_change in encoded_changes {
+    let mut msg_start = 0;
+    for (i, encoded_change) in encoded_changes.enumerate() {
         let EncodedChange {
             peer_idx,
             mut len,
             timestamp,
             deps_len,
             dep_on_self,
-            msg_len: _,
+            msg_len,
         } = encoded_change?;
         if peer_ids.peer_ids.len() <= peer_idx || counters.len() <= peer_idx {
             return Err(LoroError::DecodeDataCorruptionError);
         }
 
+        let commit_msg = if msg_len > 0 {
+            let msg_end = msg_start + msg_len as usize;
+            let msg = change_meta
+                .messages
+                .get(msg_start..msg_end)
+                .ok_or(LoroError::DecodeDataCorruptionError)?;
+            msg_start = msg_end;
+            Some(msg.into())
+        } else {
+            None
+        };
+        let author = match change_meta.change_authors.get(i).copied().unwrap_or(0) {
+            0 => None,
+            index => Some(
+                change_meta
+                    .authors
+                    .get(index as usize - 1)
+                    .ok_or(LoroError::DecodeDataCorruptionError)?
+                    .as_str()
+                    .into(),
+            ),
+        };
+
         let counter = counters[peer_idx];
         counters[peer_idx] += len as Counter;
         let peer = peer_ids.peer_ids[peer_idx];
@@ -287,6 +660,8 @@ fn decode_changes<'a>(
             lamport: 0,
             timestamp,
             has_dependents: false,
+            commit_msg,
+            author,
         };
 
         if dep_on_self {
@@ -404,6 +779,16 @@ fn extract_ops(
 }
 
 pub(crate) fn encode_snapshot(oplog: &OpLog, state: &DocState, vv: &VersionVector) -> Vec<u8> {
+    encode_snapshot_body(oplog, state, vv).to_vec()
+}
+
+/// Encode the snapshot like [encode_snapshot], but keep the columns so that the body can be
+/// serialized part by part.
+pub(crate) fn encode_snapshot_body(
+    oplog: &OpLog,
+    state: &DocState,
+    vv: &VersionVector,
+) -> EncodedBody {
     assert!(!state.is_in_txn());
     assert_eq!(oplog.frontiers(), &state.frontiers);
 
@@ -452,9 +837,11 @@ pub(crate) fn encode_snapshot(oplog: &OpLog, state: &DocState, vv: &VersionVecto
         Ok(r) => r.into_inner(),
         Err(_) => unreachable!(),
     };
+    let mut change_meta = ChangeMetaArena::default();
     let changes = encode_changes(
         &diff_changes,
         &mut dep_arena,
+        &mut change_meta,
         &mut |op| {
             origin_ops.push(op);
         },
@@ -476,11 +863,16 @@ pub(crate) fn encode_snapshot(oplog: &OpLog, state: &DocState, vv: &VersionVecto
         states,
         start_counters,
         raw_values: Cow::Owned(value_writer.finish()),
-        arenas: Cow::Owned(encode_arena(registers, dep_arena, &state_bytes)),
+        arenas: Cow::Owned(encode_arena(
+            registers,
+            dep_arena,
+            &state_bytes,
+            change_meta,
+        )),
         start_frontiers: Vec::new(),
     };
 
-    serde_columnar::to_vec(&doc).unwrap()
+    EncodedBody(doc)
 }
 
 #[derive(Clone, Copy, PartialEq, Debug, Eq)]
@@ -620,6 +1012,55 @@ pub(crate) fn decode_snapshot(doc: &LoroDoc, bytes: &[u8]) -> LoroResult<()> {
         )
     })?;
 
+    let DecodedSnapshot {
+        states,
+        frontiers,
+        unknown_containers,
+        new_ids,
+    } = decode_snapshot_without_loading(&mut oplog, &mut state, bytes, None)?;
+    state.init_with_states_and_version(states, frontiers, &oplog, unknown_containers);
+    // we cannot assert this because frontiers of oplog is not updated yet when batch_importing
+    // assert_eq!(&state.frontiers, oplog.frontiers());
+    if !oplog.pending_changes.is_empty() {
+        drop(oplog);
+        drop(state);
+        // TODO: Fix this origin value
+        doc.update_oplog_and_apply_delta_to_state_if_needed(
+            |oplog| {
+                if oplog.try_apply_pending(new_ids).should_update && !oplog.batch_importing {
+                    oplog.dag.refresh_frontiers();
+                }
+
+                Ok(())
+            },
+            "".into(),
+        )?;
+    }
+
+    Ok(())
+}
+
+/// The container states decoded from a snapshot, which are not loaded into the doc state yet.
+///
+/// They should be loaded by [DocState::init_with_states_and_version].
+pub(crate) struct DecodedSnapshot {
+    pub states: FxHashMap<ContainerIdx, State>,
+    pub frontiers: Frontiers,
+    pub unknown_containers: Vec<ContainerIdx>,
+    /// The last ids of the imported changes
+    pub new_ids: Vec<ID>,
+}
+
+/// Decode the snapshot into the empty `oplog`, and build the container states with the empty `state`.
+/// If `only` is set, the states of the other containers are skipped.
+///
+/// This is the expensive part of the snapshot import, and it doesn't touch the doc.
+pub(crate) fn decode_snapshot_without_loading(
+    oplog: &mut OpLog,
+    state: &mut DocState,
+    bytes: &[u8],
+    only: Option<&FxHashSet<ContainerID>>,
+) -> LoroResult<DecodedSnapshot> {
     if !oplog.is_empty() {
         unimplemented!("You can only import snapshot to a empty loro doc now");
     }
@@ -645,49 +1086,45 @@ pub(crate) fn decode_snapshot(doc: &LoroDoc, bytes: &[u8]) -> LoroResult<()> {
         peer_ids,
         deps,
         state_blob_arena,
+        change_meta,
         ..
     } = arenas;
 
-    let changes = decode_changes(iter.changes, iter.start_counters, &peer_ids, deps, ops_map)?;
-    let (new_ids, pending_changes) = import_changes_to_oplog(changes, &mut oplog)?;
+    let changes = decode_changes(
+        iter.changes,
+        iter.start_counters,
+        &peer_ids,
+        deps,
+        &change_meta,
+        ops_map,
+    )?;
+    let (new_ids, pending_changes) = import_changes_to_oplog(changes, oplog)?;
 
     for op in ops.iter_mut() {
         // update op's lamport
         op.lamport = oplog.get_lamport_at(op.id());
     }
 
-    decode_snapshot_states(
-        &mut state,
-        oplog.frontiers().clone(),
+    let frontiers = oplog.frontiers().clone();
+    let unknown_containers = decode_snapshot_states(
+        state,
         iter.states,
         containers,
         state_blob_arena,
         ops,
-        &oplog,
+        oplog,
         &peer_ids,
+        only,
     )
     .unwrap();
 
     assert!(pending_changes.is_empty());
-    // we cannot assert this because frontiers of oplog is not updated yet when batch_importing
-    // assert_eq!(&state.frontiers, oplog.frontiers());
-    if !oplog.pending_changes.is_empty() {
-        drop(oplog);
-        drop(state);
-        // TODO: Fix this origin value
-        doc.update_oplog_and_apply_delta_to_state_if_needed(
-            |oplog| {
-                if oplog.try_apply_pending(new_ids).should_update && !oplog.batch_importing {
-                    oplog.dag.refresh_frontiers();
-                }
-
-                Ok(())
-            },
-            "".into(),
-        )?;
-    }
-
-    Ok(())
+    Ok(DecodedSnapshot {
+        states: take(&mut state.states),
+        frontiers,
+        unknown_containers,
+        new_ids,
+    })
 }
 
 fn encode_snapshot_states(
@@ -785,16 +1222,17 @@ fn encode_snapshot_states(
 }
 
 #[allow(clippy::too_many_arguments)]
+/// Build the container states in `state`. It returns the containers that are encoded as unknown.
 fn decode_snapshot_states(
     state: &mut DocState,
-    frontiers: Frontiers,
     encoded_state_iter: IterableEncodedStateInfo<'_>,
     containers: Vec<ContainerID>,
     state_blob_arena: &[u8],
     ops: Vec<OpWithId>,
-    oplog: &std::sync::MutexGuard<'_, OpLog>,
+    oplog: &OpLog,
     peers: &PeerIdArena,
-) -> LoroResult<()> {
+    only: Option<&FxHashSet<ContainerID>>,
+) -> LoroResult<Vec<ContainerIdx>> {
     let mut state_blob_index: usize = 0;
     let mut ops_index: usize = 0;
     let mut unknown_containers = Vec::new();
@@ -856,6 +1294,12 @@ fn decode_snapshot_states(
             })
             .cloned();
 
+        if only.is_some_and(|only| !only.contains(container_id)) {
+            // Skip the ops of the container
+            next_ops.for_each(drop);
+            continue;
+        }
+
         state.init_container(
             container_id.clone(),
             StateSnapshotDecodeContext {
@@ -868,9 +1312,7 @@ fn decode_snapshot_states(
         )?;
     }
 
-    let s = take(&mut state.states);
-    state.init_with_states_and_version(s, frontiers, oplog, unknown_containers);
-    Ok(())
+    Ok(unknown_containers)
 }
 
 mod encode {
@@ -1002,11 +1444,13 @@ mod encode {
     pub(super) fn encode_changes<'p, 'a: 'p>(
         diff_changes: &'a [Cow<'a, Change>],
         dep_arena: &mut super::DepsArena,
+        change_meta: &mut super::ChangeMetaArena,
         push_op: &mut impl FnMut(TempOp<'a>),
         container_idx2index: &FxHashMap<ContainerIdx, usize>,
         registers: &mut EncodedRegisters<'p>,
     ) -> Vec<EncodedChange> {
         let mut changes: Vec<EncodedChange> = Vec::with_capacity(diff_changes.len());
+        let mut author_indexes: FxHashMap<&str, u32> = FxHashMap::default();
         for change in diff_changes.iter() {
             let mut dep_on_self = false;
             let mut deps_len = 0;
@@ -1019,6 +1463,21 @@ mod encode {
                 }
             }
 
+            let msg_len = match &change.commit_msg {
+                Some(msg) => {
+                    change_meta.messages.push_str(msg);
+                    msg.len() as i32
+                }
+                None => 0,
+            };
+            let author = match &change.author {
+                Some(author) => *author_indexes.entry(&**author).or_insert_with(|| {
+                    change_meta.authors.push(author.to_string());
+                    change_meta.authors.len() as u32
+                }),
+                None => 0,
+            };
+            change_meta.change_authors.push(author);
             let peer_idx = registers.peer.register(&change.id.peer);
             changes.push(EncodedChange {
                 dep_on_self,
@@ -1026,7 +1485,7 @@ mod encode {
                 peer_idx,
                 len: change.atom_len(),
                 timestamp: change.timestamp,
-                msg_len: 0,
+                msg_len,
             });
 
             for op in change.ops().iter() {
@@ -1041,6 +1500,10 @@ mod encode {
                 });
             }
         }
+
+        if change_meta.authors.is_empty() {
+            change_meta.change_authors.clear();
+        }
         changes
     }
 
@@ -1272,14 +1735,17 @@ mod encode {
             }
             crate::op::InnerContent::Future(f) => match f {
                 #[cfg(feature = "counter")]
-                FutureInnerContent::Counter(c) => {
-                    let c_abs = c.abs();
-                    if c_abs.fract() < std::f64::EPSILON && (c_abs as i64) < (2 << 26) {
-                        Value::I64(*c as i64)
-                    } else {
-                        Value::F64(*c)
+                FutureInnerContent::Counter(d) => match d {
+                    crate::op::CounterDelta::Int(c) => Value::I64(*c),
+                    crate::op::CounterDelta::Float(c) => {
+                        let c_abs = c.abs();
+                        if c_abs.fract() < std::f64::EPSILON && (c_abs as i64) < (2 << 26) {
+                            Value::I64(*c as i64)
+                        } else {
+                            Value::F64(*c)
+                        }
                     }
-                }
+                },
                 FutureInnerContent::Unknown { prop: _, value } => Value::from_owned(value),
             },
         };
@@ -1454,8 +1920,12 @@ fn decode_op(
         }
         #[cfg(feature = "counter")]
         ContainerType::Counter => match value {
-            Value::F64(c) => crate::op::InnerContent::Future(FutureInnerContent::Counter(c)),
-            Value::I64(c) => crate::op::InnerContent::Future(FutureInnerContent::Counter(c as f64)),
+            Value::F64(c) => crate::op::InnerContent::Future(FutureInnerContent::Counter(
+                crate::op::CounterDelta::Float(c),
+            )),
+            Value::I64(c) => crate::op::InnerContent::Future(FutureInnerContent::Counter(
+                crate::op::CounterDelta::Int(c),
+            )),
             _ => unreachable!(),
         },
         // NOTE: The future container type need also try to parse the unknown type
@@ -1558,11 +2028,112 @@ struct EncodedDoc<'a> {
     /// - `key_arena`
     /// - `deps_arena`
     /// - `state_arena`
+    /// - `change_meta_arena`, omitted if no change has a commit message or an author
     /// - `others`, left for future use
     #[columnar(borrow)]
     arenas: Cow<'a, [u8]>,
 }
 
+/// An encoded body whose columns are not serialized yet.
+pub(crate) struct EncodedBody(EncodedDoc<'static>);
+
+impl EncodedBody {
+    pub(crate) fn to_vec(&self) -> Vec<u8> {
+        serde_columnar::to_vec(&self.0).unwrap()
+    }
+
+    /// Serialize the body into `write` part by part.
+    ///
+    /// The fields of a struct are serialized one after another without any separator, so
+    /// serializing the fields of [EncodedDoc] one at a time gives the same bytes as
+    /// [EncodedBody::to_vec]. Only one serialized column is in memory at a time.
+    pub(crate) fn write_parts(
+        &mut self,
+        write: &mut dyn FnMut(&[u8]) -> std::io::Result<()>,
+    ) -> std::io::Result<()> {
+        let doc = &mut self.0;
+        let part = EncodedOpsPart {
+            ops: std::mem::take(&mut doc.ops),
+        };
+        let bytes = serde_columnar::to_vec(&part).unwrap();
+        doc.ops = part.ops;
+        write(&bytes)?;
+        drop(bytes);
+
+        let part = EncodedChangesPart {
+            changes: std::mem::take(&mut doc.changes),
+        };
+        let bytes = serde_columnar::to_vec(&part).unwrap();
+        doc.changes = part.changes;
+        write(&bytes)?;
+        drop(bytes);
+
+        let part = EncodedDeleteStartsPart {
+            delete_starts: std::mem::take(&mut doc.delete_starts),
+        };
+        let bytes = serde_columnar::to_vec(&part).unwrap();
+        doc.delete_starts = part.delete_starts;
+        write(&bytes)?;
+        drop(bytes);
+
+        let part = EncodedStatesPart {
+            states: std::mem::take(&mut doc.states),
+        };
+        let bytes = serde_columnar::to_vec(&part).unwrap();
+        doc.states = part.states;
+        write(&bytes)?;
+        drop(bytes);
+
+        let part = EncodedTailPart {
+            start_counters: std::mem::take(&mut doc.start_counters),
+            start_frontiers: std::mem::take(&mut doc.start_frontiers),
+            raw_values: Cow::Borrowed(&doc.raw_values),
+            arenas: Cow::Borrowed(&doc.arenas),
+        };
+        let bytes = serde_columnar::to_vec(&part).unwrap();
+        doc.start_counters = part.start_counters;
+        doc.start_frontiers = part.start_frontiers;
+        write(&bytes)
+    }
+}
+
+// The parts of [EncodedDoc] in the order of its fields. They must keep the attributes of the
+// fields of [EncodedDoc], so that they are serialized into the same bytes.
+
+#[columnar(ser)]
+struct EncodedOpsPart {
+    #[columnar(class = "vec", iter = "EncodedOp")]
+    ops: Vec<EncodedOp>,
+}
+
+#[columnar(ser)]
+struct EncodedChangesPart {
+    #[columnar(class = "vec", iter = "EncodedChange")]
+    changes: Vec<EncodedChange>,
+}
+
+#[columnar(ser)]
+struct EncodedDeleteStartsPart {
+    #[columnar(class = "vec", iter = "EncodedDeleteStartId")]
+    delete_starts: Vec<EncodedDeleteStartId>,
+}
+
+#[columnar(ser)]
+struct EncodedStatesPart {
+    #[columnar(class = "vec", iter = "EncodedStateInfo")]
+    states: Vec<EncodedStateInfo>,
+}
+
+#[columnar(ser)]
+struct EncodedTailPart<'a> {
+    start_counters: Vec<Counter>,
+    start_frontiers: Vec<(PeerIdx, Counter)>,
+    #[columnar(borrow)]
+    raw_values: Cow<'a, [u8]>,
+    #[columnar(borrow)]
+    arenas: Cow<'a, [u8]>,
+}
+
 #[columnar(vec, ser, de, iterable)]
 #[derive(Debug, Clone)]
 struct EncodedOp {
@@ -379,7 +379,10 @@ fn encode_changes(
                         FutureInnerContent::Counter(x) => {
                             JsonOpContent::Future(op::FutureOpWrapper {
                                 prop: 0,
-                                value: op::FutureOp::Counter(super::OwnedValue::F64(*x)),
+                                value: op::FutureOp::Counter(match x {
+                                    crate::op::CounterDelta::Float(x) => super::OwnedValue::F64(*x),
+                                    crate::op::CounterDelta::Int(x) => super::OwnedValue::I64(*x),
+                                }),
                             })
                         }
                         _ => unreachable!(),
@@ -402,7 +405,8 @@ fn encode_changes(
                 .collect(),
             lamport: change.lamport,
             timestamp: change.timestamp,
-            msg: None,
+            msg: change.commit_msg.as_ref().map(|x| x.to_string()),
+            author: change.author.as_ref().map(|x| x.to_string()),
         };
         changes.push(c);
     }
@@ -417,7 +421,8 @@ fn decode_changes(json: JsonSchema, arena: &SharedArena) -> LoroResult<Vec<Chang
         timestamp,
         deps,
         lamport,
-        msg: _,
+        msg,
+        author,
         ops: json_ops,
     } in changes
     {
@@ -434,6 +439,8 @@ fn decode_changes(json: JsonSchema, arena: &SharedArena) -> LoroResult<Vec<Chang
             lamport,
             ops,
             has_dependents: false,
+            commit_msg: msg.map(|x| x.into()),
+            author: author.map(|x| x.into()),
         };
         ans.push(change);
     }
@@ -623,13 +630,13 @@ fn decode_op(op: op::JsonOp, arena: &SharedArena, peers: &[PeerID]) -> LoroResul
             use crate::encoding::OwnedValue;
             match value {
                 op::FutureOp::Counter(OwnedValue::F64(c))
-                | op::FutureOp::Unknown(OwnedValue::F64(c)) => {
-                    InnerContent::Future(FutureInnerContent::Counter(c))
-                }
+                | op::FutureOp::Unknown(OwnedValue::F64(c)) => InnerContent::Future(
+                    FutureInnerContent::Counter(crate::op::CounterDelta::Float(c)),
+                ),
                 op::FutureOp::Counter(OwnedValue::I64(c))
-                | op::FutureOp::Unknown(OwnedValue::I64(c)) => {
-                    InnerContent::Future(FutureInnerContent::Counter(c as f64))
-                }
+                | op::FutureOp::Unknown(OwnedValue::I64(c)) => InnerContent::Future(
+                    FutureInnerContent::Counter(crate::op::CounterDelta::Int(c)),
+                ),
                 _ => unreachable!(),
             }
         } // Note: The Future Type need try to parse Op from the unknown content
@@ -692,6 +699,8 @@ pub mod op {
         pub deps: SmallVec<[ID; 2]>,
         pub lamport: Lamport,
         pub msg: Option<String>,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub author: Option<String>,
         pub ops: Vec<JsonOp>,
     }
 
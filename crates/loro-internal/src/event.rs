@@ -228,7 +228,7 @@ pub(crate) enum InternalDiff {
     Tree(TreeDelta),
     MovableList(MovableListInnerDelta),
     #[cfg(feature = "counter")]
-    Counter(f64),
+    Counter(crate::state::CounterSum),
     Unknown,
 }
 
@@ -248,11 +248,18 @@ pub struct ListDeltaMeta {
     /// have this flag, because the insert content may not
     /// be moved from a deletion in the same delta.
     pub from_move: bool,
+    /// Whether the content of the insert replaces the values of the
+    /// deleted elements in place, so **the elements keep their identities**.
+    ///
+    /// It's only created by the set ops of movable lists, and it's only
+    /// meaningful when the number of the inserted values equals the number
+    /// of the deleted elements of the same item.
+    pub from_set: bool,
 }
 
 impl Meta for ListDeltaMeta {
     fn is_empty(&self) -> bool {
-        !self.from_move
+        !self.from_move && !self.from_set
     }
 
     fn compose(
@@ -267,10 +274,11 @@ impl Meta for ListDeltaMeta {
         }
 
         self.from_move = self.from_move || other.from_move;
+        self.from_set = self.from_set || other.from_set;
     }
 
     fn is_mergeable(&self, other: &Self) -> bool {
-        self.from_move == other.from_move
+        self.from_move == other.from_move && self.from_set == other.from_set
     }
 
     fn merge(&mut self, _other: &Self) {}
@@ -279,10 +287,16 @@ impl Meta for ListDeltaMeta {
 impl DeltaAttr for ListDeltaMeta {
     fn compose(&mut self, other: &Self) {
         self.from_move = self.from_move || other.from_move;
+        self.from_set = self.from_set || other.from_set;
     }
 
     fn attr_is_empty(&self) -> bool {
-        !self.from_move
+        !self.from_move && !self.from_set
+    }
+
+    fn compose_over_replace(&mut self) {
+        // The values don't replace the original elements any more
+        self.from_set = false;
     }
 }
 
@@ -333,7 +347,7 @@ impl InternalDiff {
             InternalDiff::Tree(t) => t.is_empty(),
             InternalDiff::MovableList(t) => t.is_empty(),
             #[cfg(feature = "counter")]
-            InternalDiff::Counter(c) => c.abs() < f64::EPSILON,
+            InternalDiff::Counter(c) => c.is_zero(),
             InternalDiff::Unknown => true,
         }
     }
@@ -42,6 +42,50 @@ impl OpGroups {
         }
     }
 
+    /// Make the groups use `arena`, which should have the same content as the current arena.
+    pub(crate) fn set_arena(&mut self, arena: SharedArena) {
+        for group in self.groups.values_mut() {
+            if let OpGroup::MovableList(m) = group {
+                m.arena = arena.clone();
+            }
+        }
+
+        self.arena = arena;
+    }
+
+    /// The approximate memory usage of the groups in bytes.
+    pub(crate) fn estimate_size(&self) -> usize {
+        self.groups
+            .values()
+            .map(|group| {
+                std::mem::size_of::<(ContainerIdx, OpGroup)>()
+                    + match group {
+                        OpGroup::Map(m) => m
+                            .ops
+                            .iter()
+                            .map(|(key, set)| {
+                                std::mem::size_of::<InternalString>()
+                                    + key.len()
+                                    + set.iter().count() * std::mem::size_of::<GroupedMapOpInfo>()
+                            })
+                            .sum(),
+                        OpGroup::Tree(t) => t
+                            .ops
+                            .values()
+                            .map(|ops| {
+                                std::mem::size_of::<Lamport>()
+                                    + ops.len() * std::mem::size_of::<GroupedTreeOpInfo>()
+                            })
+                            .sum(),
+                        OpGroup::MovableList(m) => {
+                            m.elem_mappings.len() * std::mem::size_of::<(IdLp, MovableListTarget)>()
+                                + m.pos_to_elem.len() * std::mem::size_of::<(IdLp, IdLp)>()
+                        }
+                    }
+            })
+            .sum()
+    }
+
     pub(crate) fn insert_by_change(&mut self, change: &Change) {
         for op in change.ops.iter() {
             if matches!(
@@ -4,7 +4,9 @@ use crate::{
     container::{
         idx::ContainerIdx,
         list::list_op::{DeleteSpan, DeleteSpanWithId, ListOp},
-        richtext::{richtext_state::PosType, RichtextState, StyleOp, TextStyleInfoFlag},
+        richtext::{
+            self, richtext_state::PosType, ExpandType, RichtextState, StyleOp, TextStyleInfoFlag,
+        },
     },
     cursor::{Cursor, Side},
     delta::{DeltaItem, StyleMeta, TreeExternalDiff},
@@ -16,7 +18,7 @@ use crate::{
 };
 use append_only_bytes::BytesSlice;
 use enum_as_inner::EnumAsInner;
-use fxhash::FxHashMap;
+use fxhash::{FxHashMap, FxHashSet};
 use generic_btree::rle::HasLength;
 use loro_common::{
     ContainerID, ContainerType, IdFull, InternalString, LoroError, LoroResult, LoroValue, ID,
@@ -25,7 +27,7 @@ use serde::{Deserialize, Serialize};
 use std::{
     borrow::Cow,
     fmt::Debug,
-    ops::Deref,
+    ops::{ControlFlow, Deref, Range},
     sync::{Arc, Mutex, Weak},
 };
 use tracing::{error, info, instrument};
@@ -659,6 +661,35 @@ impl std::fmt::Debug for MovableListHandler {
     }
 }
 
+/// The number of values that [ListIter] reads from the state at a time.
+const LIST_ITER_CHUNK_SIZE: usize = 256;
+
+/// A lazy iterator over the values of a list, created by [ListHandler::iter].
+///
+/// It reads the values chunk by chunk, so it doesn't clone the whole list up front.
+/// Editing the list invalidates it, see [ListHandler::iter].
+#[derive(Debug)]
+pub struct ListIter {
+    handler: ListHandler,
+    /// The index of the next value to read from the state
+    pos: usize,
+    buffer: std::vec::IntoIter<ValueOrHandler>,
+}
+
+impl Iterator for ListIter {
+    type Item = ValueOrHandler;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        if self.buffer.as_slice().is_empty() {
+            let chunk = self.handler.get_values_from(self.pos, LIST_ITER_CHUNK_SIZE);
+            self.pos += chunk.len();
+            self.buffer = chunk.into_iter();
+        }
+
+        self.buffer.next()
+    }
+}
+
 impl std::fmt::Debug for ListHandler {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         match &self.inner {
@@ -1212,6 +1243,198 @@ impl TextHandler {
         }
     }
 
+    /// Call `f` with each styled run in `start..end`, in order, without building the
+    /// delta of the whole text.
+    ///
+    /// `start` and `end` are [Event Index]s. `f` receives the text of the run and its
+    /// attributes as a map value. Runs crossing the boundaries are cut at `start` and
+    /// `end`. The iteration stops once `f` returns [ControlFlow::Break].
+    ///
+    /// `f` must not access the document, since the state is locked during the iteration.
+    pub fn iter_styled_runs(
+        &self,
+        start: usize,
+        end: usize,
+        f: &mut dyn FnMut(&str, &LoroValue) -> ControlFlow<()>,
+    ) -> LoroResult<()> {
+        if start > end {
+            return Err(loro_common::LoroError::ArgErr(
+                "Start must be less than or equal to end"
+                    .to_string()
+                    .into_boxed_str(),
+            ));
+        }
+
+        let len = self.len_event();
+        if end > len {
+            return Err(LoroError::OutOfBound { pos: end, len });
+        }
+
+        let mut on_run = |s: &str, styles: &StyleMeta| f(s, &styles.to_value());
+        match &self.inner {
+            MaybeDetached::Detached(t) => {
+                let mut t = t.try_lock().unwrap();
+                t.value
+                    .iter_styled_runs_in_event_range(start..end, &mut on_run);
+            }
+            MaybeDetached::Attached(a) => a.with_state(|state| {
+                state
+                    .as_richtext_state_mut()
+                    .unwrap()
+                    .iter_styled_runs_in_event_range(start..end, &mut on_run)
+            }),
+        }
+
+        Ok(())
+    }
+
+    /// Find the non-overlapping occurrences of `pattern`, from the start to the end.
+    ///
+    /// The text is scanned run by run, so the whole string is not built. The returned ranges
+    /// are [Event Index]s, which always start and end at char boundaries. An empty pattern
+    /// matches nothing.
+    pub fn search(&self, pattern: &str) -> Vec<Range<usize>> {
+        let pattern: Vec<char> = pattern.chars().collect();
+        if pattern.is_empty() {
+            return Vec::new();
+        }
+
+        // The KMP failure function of `pattern`
+        let mut fail = vec![0; pattern.len()];
+        let mut k = 0;
+        for i in 1..pattern.len() {
+            while k > 0 && pattern[i] != pattern[k] {
+                k = fail[k - 1];
+            }
+            if pattern[i] == pattern[k] {
+                k += 1;
+            }
+            fail[i] = k;
+        }
+
+        let mut ans = Vec::new();
+        // The start positions of the chars matched so far
+        let mut starts = std::collections::VecDeque::with_capacity(pattern.len());
+        let mut pos = 0;
+        let mut matched = 0;
+        let len = self.len_event();
+        self.iter_styled_runs(0, len, &mut |run, _| {
+            for c in run.chars() {
+                while matched > 0 && pattern[matched] != c {
+                    matched = fail[matched - 1];
+                }
+                if pattern[matched] == c {
+                    matched += 1;
+                }
+
+                starts.push_back(pos);
+                while starts.len() > matched {
+                    starts.pop_front();
+                }
+                pos += if cfg!(feature = "wasm") {
+                    c.len_utf16()
+                } else {
+                    1
+                };
+                if matched == pattern.len() {
+                    ans.push(starts[0]..pos);
+                    starts.clear();
+                    matched = 0;
+                }
+            }
+            ControlFlow::Continue(())
+        })
+        .unwrap();
+        ans
+    }
+
+    /// Get the authors of the text in `start..end`.
+    ///
+    /// `start` and `end` are [Event Index]s. Each item is the event index range of a run of
+    /// chars inserted continuously by the same peer, and the id of the op that inserted the
+    /// first char of the run. The marks on the text don't affect the result.
+    pub fn blame(&self, start: usize, end: usize) -> LoroResult<Vec<(Range<usize>, IdFull)>> {
+        if start > end {
+            return Err(loro_common::LoroError::ArgErr(
+                "Start must be less than or equal to end"
+                    .to_string()
+                    .into_boxed_str(),
+            ));
+        }
+
+        let len = self.len_event();
+        if end > len {
+            return Err(LoroError::OutOfBound { pos: end, len });
+        }
+
+        Ok(match &self.inner {
+            MaybeDetached::Detached(t) => {
+                let mut t = t.try_lock().unwrap();
+                t.value.get_text_id_runs_in_event_range(start..end)
+            }
+            MaybeDetached::Attached(a) => a.with_state(|state| {
+                state
+                    .as_richtext_state_mut()
+                    .unwrap()
+                    .get_text_id_runs_in_event_range(start..end)
+            }),
+        })
+    }
+
+    /// Replace the text in `range` with `s`.
+    ///
+    /// `range` is in [Event Index]s. The new text is inserted at the end of the range
+    /// before the old text is deleted, so it inherits the styles of the replaced text
+    /// that expand after it, and both ops are in the same transaction.
+    pub fn replace(&self, range: Range<usize>, s: &str) -> LoroResult<()> {
+        if range.start > range.end {
+            return Err(LoroError::ArgErr(
+                "Start must be less than or equal to end"
+                    .to_string()
+                    .into_boxed_str(),
+            ));
+        }
+
+        let len = self.len_event();
+        if range.end > len {
+            return Err(LoroError::OutOfBound {
+                pos: range.end,
+                len,
+            });
+        }
+
+        self.insert(range.end, s)?;
+        self.delete(range.start, range.len())
+    }
+
+    /// Convert a text index between the units of [richtext::IndexType].
+    ///
+    /// Style anchors take entity indexes but no text. If there are style anchors at
+    /// the given text position, the entity index after them is returned.
+    ///
+    /// Returns `None` if `pos` is out of bound or not at a char boundary.
+    pub fn index_convert(
+        &self,
+        pos: usize,
+        from: richtext::IndexType,
+        to: richtext::IndexType,
+    ) -> Option<usize> {
+        match &self.inner {
+            MaybeDetached::Detached(t) => {
+                t.try_lock()
+                    .unwrap()
+                    .value
+                    .convert_index(pos, from.into(), to.into())
+            }
+            MaybeDetached::Attached(a) => a.with_state(|state| {
+                state
+                    .as_richtext_state_mut()
+                    .unwrap()
+                    .convert_index(pos, from.into(), to.into())
+            }),
+        }
+    }
+
     pub fn is_empty(&self) -> bool {
         match &self.inner {
             MaybeDetached::Detached(t) => t.try_lock().unwrap().value.is_empty(),
@@ -1286,20 +1509,41 @@ impl TextHandler {
     ///
     /// This method requires auto_commit to be enabled.
     pub fn insert(&self, pos: usize, s: &str) -> LoroResult<()> {
+        self.insert_with_result(pos, s)?;
+        Ok(())
+    }
+
+    /// Insert the string like [`TextHandler::insert`], and return the range of entity
+    /// indices the inserted content occupies in the local state at the time of the insertion.
+    ///
+    /// The range is not updated by the later changes, so it may not be where the content is
+    /// after the concurrent insertions at the same position are merged. If `s` is empty,
+    /// nothing is inserted, and the range is empty at the entity index where `s` would be
+    /// inserted.
+    ///
+    /// This method requires auto_commit to be enabled.
+    pub fn insert_with_result(&self, pos: usize, s: &str) -> LoroResult<Range<usize>> {
         match &self.inner {
             MaybeDetached::Detached(t) => {
                 let mut t = t.try_lock().unwrap();
                 let index = t
                     .value
                     .get_entity_index_for_text_insert(pos, PosType::Event);
+                if s.is_empty() {
+                    return Ok(index..index);
+                }
+
                 t.value.insert_at_entity_index(
                     index,
                     BytesSlice::from_bytes(s.as_bytes()),
                     IdFull::NONE_ID,
                 );
-                Ok(())
+                Ok(index..index + s.chars().count())
             }
-            MaybeDetached::Attached(a) => a.with_txn(|txn| self.insert_with_txn(txn, pos, s)),
+            MaybeDetached::Attached(a) => a.with_txn(|txn| {
+                let (range, _) = self.insert_with_txn_and_attr(txn, pos, s, None)?;
+                Ok(range)
+            }),
         }
     }
 
@@ -1314,17 +1558,16 @@ impl TextHandler {
 
     /// If attr is specified, it will be used as the attribute of the inserted text.
     /// It will override the existing attribute of the text.
-    fn insert_with_txn_and_attr(
+    ///
+    /// Returns the entity range of the inserted text and the styles that need to be overridden.
+    #[allow(clippy::type_complexity)]
+    pub(crate) fn insert_with_txn_and_attr(
         &self,
         txn: &mut Transaction,
         pos: usize,
         s: &str,
         attr: Option<&FxHashMap<String, LoroValue>>,
-    ) -> Result<Vec<(InternalString, LoroValue)>, LoroError> {
-        if s.is_empty() {
-            return Ok(Vec::new());
-        }
-
+    ) -> Result<(Range<usize>, Vec<(InternalString, LoroValue)>), LoroError> {
         if pos > self.len_event() {
             return Err(LoroError::OutOfBound {
                 pos,
@@ -1339,6 +1582,9 @@ impl TextHandler {
             let styles = richtext_state.get_styles_at_entity_index(pos);
             (pos, styles)
         });
+        if s.is_empty() {
+            return Ok((entity_index..entity_index, Vec::new()));
+        }
 
         let mut override_styles = Vec::new();
         if let Some(attr) = attr {
@@ -1388,7 +1634,7 @@ impl TextHandler {
             &inner.state,
         )?;
 
-        Ok(override_styles)
+        Ok((entity_index..entity_index + unicode_len, override_styles))
     }
 
     /// `pos` is a Event Index:
@@ -1477,15 +1723,54 @@ impl TextHandler {
         value: LoroValue,
     ) -> LoroResult<()> {
         match &self.inner {
-            MaybeDetached::Detached(t) => {
-                self.mark_for_detached(&mut t.lock().unwrap().value, key, &value, start, end, false)
-            }
+            MaybeDetached::Detached(t) => self.mark_for_detached(
+                &mut t.lock().unwrap().value,
+                key,
+                &value,
+                start,
+                end,
+                false,
+                ExpandType::After,
+            ),
             MaybeDetached::Attached(a) => {
                 a.with_txn(|txn| self.mark_with_txn(txn, start, end, key, value, false))
             }
         }
     }
 
+    /// Mark the range like [`TextHandler::mark`], but with the given expand type instead of
+    /// the one configured for the key.
+    ///
+    /// The expand type is stored in the style op, so the inserts at the boundaries of this
+    /// mark, including the concurrent ones from other peers, follow it no matter how the other
+    /// marks with the same key are expanded.
+    ///
+    /// This method requires auto_commit to be enabled.
+    pub fn mark_with_expand(
+        &self,
+        start: usize,
+        end: usize,
+        key: impl Into<InternalString>,
+        value: LoroValue,
+        expand: ExpandType,
+    ) -> LoroResult<()> {
+        match &self.inner {
+            MaybeDetached::Detached(t) => self.mark_for_detached(
+                &mut t.lock().unwrap().value,
+                key,
+                &value,
+                start,
+                end,
+                false,
+                expand,
+            ),
+            MaybeDetached::Attached(a) => a.with_txn(|txn| {
+                self.mark_with_txn_and_expand(txn, start, end, key, value, false, Some(expand))
+            }),
+        }
+    }
+
+    #[allow(clippy::too_many_arguments)]
     fn mark_for_detached(
         &self,
         state: &mut RichtextState,
@@ -1494,9 +1779,10 @@ impl TextHandler {
         start: usize,
         end: usize,
         is_delete: bool,
+        expand: ExpandType,
     ) -> Result<(), LoroError> {
         let key: InternalString = key.into();
-        let len = self.len_event();
+        let len = state.len_event();
         if start >= end {
             return Err(loro_common::LoroError::ArgErr(
                 "Start must be less than end".to_string().into_boxed_str(),
@@ -1522,9 +1808,9 @@ impl TextHandler {
             value: value.clone(),
             // TODO: describe this behavior in the document
             info: if is_delete {
-                TextStyleInfoFlag::BOLD.to_delete()
+                TextStyleInfoFlag::new(expand).to_delete()
             } else {
-                TextStyleInfoFlag::BOLD
+                TextStyleInfoFlag::new(expand)
             },
         });
         state.mark_with_entity_index(entity_range, style_op);
@@ -1536,24 +1822,41 @@ impl TextHandler {
     /// - if feature="wasm", pos is a UTF-16 index
     /// - if feature!="wasm", pos is a Unicode index
     ///
+    /// It returns the spans, in [Event Index]s, that had a style with `key`
+    /// before this call and are unmarked by it. Adjacent spans are merged.
+    ///
     /// This method requires auto_commit to be enabled.
     pub fn unmark(
         &self,
         start: usize,
         end: usize,
         key: impl Into<InternalString>,
-    ) -> LoroResult<()> {
+    ) -> LoroResult<Vec<(usize, usize)>> {
+        let key: InternalString = key.into();
         match &self.inner {
-            MaybeDetached::Detached(t) => self.mark_for_detached(
-                &mut t.lock().unwrap().value,
-                key,
-                &LoroValue::Null,
-                start,
-                end,
-                true,
-            ),
+            MaybeDetached::Detached(t) => {
+                let mut t = t.lock().unwrap();
+                let spans = t.value.get_style_spans_in_event_range(start..end, &key);
+                self.mark_for_detached(
+                    &mut t.value,
+                    key,
+                    &LoroValue::Null,
+                    start,
+                    end,
+                    true,
+                    ExpandType::After,
+                )?;
+                Ok(spans)
+            }
             MaybeDetached::Attached(a) => {
-                a.with_txn(|txn| self.mark_with_txn(txn, start, end, key, LoroValue::Null, true))
+                let spans = a.with_state(|state| {
+                    state
+                        .as_richtext_state_mut()
+                        .unwrap()
+                        .get_style_spans_in_event_range(start..end, &key)
+                });
+                a.with_txn(|txn| self.mark_with_txn(txn, start, end, key, LoroValue::Null, true))?;
+                Ok(spans)
             }
         }
     }
@@ -1570,6 +1873,21 @@ impl TextHandler {
         key: impl Into<InternalString>,
         value: LoroValue,
         is_delete: bool,
+    ) -> LoroResult<()> {
+        self.mark_with_txn_and_expand(txn, start, end, key, value, is_delete, None)
+    }
+
+    /// If `expand` is `None`, the expand type configured for the key is used.
+    #[allow(clippy::too_many_arguments)]
+    pub(crate) fn mark_with_txn_and_expand(
+        &self,
+        txn: &mut Transaction,
+        start: usize,
+        end: usize,
+        key: impl Into<InternalString>,
+        value: LoroValue,
+        is_delete: bool,
+        expand: Option<ExpandType>,
     ) -> LoroResult<()> {
         if start >= end {
             return Err(loro_common::LoroError::ArgErr(
@@ -1609,18 +1927,23 @@ impl TextHandler {
 
         let entity_start = entity_range.start;
         let entity_end = entity_range.end;
-        let style_config = doc_state.config.text_style_config.try_read().unwrap();
-        let flag = if is_delete {
-            style_config
-                .get_style_flag_for_unmark(&key)
-                .ok_or_else(|| LoroError::StyleConfigMissing(key.clone()))?
-        } else {
-            style_config
-                .get_style_flag(&key)
-                .ok_or_else(|| LoroError::StyleConfigMissing(key.clone()))?
+        let flag = match expand {
+            Some(expand) if is_delete => TextStyleInfoFlag::new(expand).to_delete(),
+            Some(expand) => TextStyleInfoFlag::new(expand),
+            None => {
+                let style_config = doc_state.config.text_style_config.try_read().unwrap();
+                if is_delete {
+                    style_config
+                        .get_style_flag_for_unmark(&key)
+                        .ok_or_else(|| LoroError::StyleConfigMissing(key.clone()))?
+                } else {
+                    style_config
+                        .get_style_flag(&key)
+                        .ok_or_else(|| LoroError::StyleConfigMissing(key.clone()))?
+                }
+            }
         };
 
-        drop(style_config);
         drop(doc_state);
         txn.apply_local_op(
             inner.container_idx,
@@ -1682,13 +2005,14 @@ impl TextHandler {
         txn: &mut Transaction,
         delta: &[TextDelta],
     ) -> LoroResult<()> {
+        self.check_delta(delta)?;
         let mut index = 0;
         let mut marks = Vec::new();
         for d in delta {
             match d {
                 TextDelta::Insert { insert, attributes } => {
                     let end = index + event_len(insert.as_str());
-                    let override_styles = self.insert_with_txn_and_attr(
+                    let (_, override_styles) = self.insert_with_txn_and_attr(
                         txn,
                         index,
                         insert.as_str(),
@@ -1723,10 +2047,87 @@ impl TextHandler {
         for (start, end, key, value) in marks {
             if start >= len {
                 self.insert_with_txn(txn, len, &"\n".repeat(start - len + 1))?;
-                len = start;
+                len = start + 1;
+            }
+
+            if start == end {
+                continue;
+            }
+
+            // A null attribute removes the style, like `unmark`
+            let is_delete = matches!(value, LoroValue::Null);
+            self.mark_with_txn(txn, start, end, key.deref(), value, is_delete)?;
+        }
+
+        Ok(())
+    }
+
+    /// Check the positions and the style configs used by the delta before applying it,
+    /// so that an invalid delta doesn't leave a half-applied change in the transaction.
+    fn check_delta(&self, delta: &[TextDelta]) -> LoroResult<()> {
+        let mut len = self.len_event();
+        let mut index = 0;
+        let mut keys = Vec::new();
+        let mut marks = Vec::new();
+        for d in delta {
+            match d {
+                TextDelta::Insert { insert, attributes } => {
+                    if index > len {
+                        return Err(LoroError::OutOfBound { pos: index, len });
+                    }
+
+                    let insert_len = event_len(insert.as_str());
+                    index += insert_len;
+                    len += insert_len;
+                    keys.extend(attributes.iter().flatten());
+                }
+                TextDelta::Delete { delete } => {
+                    if index + *delete > len {
+                        return Err(LoroError::OutOfBound {
+                            pos: index + *delete,
+                            len,
+                        });
+                    }
+
+                    len -= *delete;
+                }
+                TextDelta::Retain { retain, attributes } => {
+                    if matches!(attributes, Some(attr) if !attr.is_empty()) {
+                        marks.push((index, index + *retain));
+                    }
+
+                    index += *retain;
+                    keys.extend(attributes.iter().flatten());
+                }
             }
+        }
+
+        // The marks are applied after the content, padding the text with `\n`
+        // when a mark starts at or after the end
+        for (start, end) in marks {
+            if start >= len {
+                len = start + 1;
+            }
+
+            if start != end && end > len {
+                return Err(LoroError::OutOfBound { pos: end, len });
+            }
+        }
 
-            self.mark_with_txn(txn, start, end, key.deref(), value, false)?;
+        let inner = self.inner.try_attached_state()?;
+        let mutex = &inner.state.upgrade().unwrap();
+        let doc_state = mutex.lock().unwrap();
+        let style_config = doc_state.config.text_style_config.try_read().unwrap();
+        for (key, value) in keys {
+            let key: InternalString = key.as_str().into();
+            let flag = if matches!(value, LoroValue::Null) {
+                style_config.get_style_flag_for_unmark(&key)
+            } else {
+                style_config.get_style_flag(&key)
+            };
+            if flag.is_none() {
+                return Err(LoroError::StyleConfigMissing(key));
+            }
         }
 
         Ok(())
@@ -1824,13 +2225,109 @@ impl TextHandler {
         }
     }
 
-    fn get_delta(&self) -> Vec<TextDelta> {
+    pub(crate) fn get_delta(&self) -> Vec<TextDelta> {
         self.with_state(|state| {
             let state = state.as_richtext_state_mut().unwrap();
             Ok(state.get_delta())
         })
         .unwrap()
     }
+
+    /// Get the text runs with the key, the value and the expand type of each of their styles.
+    #[allow(clippy::type_complexity)]
+    pub(crate) fn get_runs_with_expand(
+        &self,
+    ) -> Vec<(String, Vec<(InternalString, LoroValue, ExpandType)>)> {
+        self.with_state(|state| {
+            let state = state.as_richtext_state_mut().unwrap();
+            Ok(state.get_runs_with_expand())
+        })
+        .unwrap()
+    }
+}
+
+/// Get the original index of each element after applying `moves` to a list with `len` elements.
+fn calc_order_after_moves(len: usize, moves: &[(usize, usize)]) -> LoroResult<Vec<usize>> {
+    let mut order: Vec<usize> = (0..len).collect();
+    for &(from, to) in moves {
+        if from >= len {
+            return Err(LoroError::OutOfBound { pos: from, len });
+        }
+
+        if to >= len {
+            return Err(LoroError::OutOfBound { pos: to, len });
+        }
+
+        let v = order.remove(from);
+        order.insert(to, v);
+    }
+
+    Ok(order)
+}
+
+/// Calculate the moves that turn `0..order.len()` into `order`.
+///
+/// The elements on the longest increasing subsequence of `order` stay in place,
+/// so the number of moves is minimal.
+fn calc_minimal_moves(order: &[usize]) -> Vec<(usize, usize)> {
+    let stable = longest_increasing_subsequence_mask(order);
+    let mut cur: Vec<usize> = (0..order.len()).collect();
+    let mut ans = Vec::new();
+    for (i, &elem) in order.iter().enumerate() {
+        if stable[i] {
+            continue;
+        }
+
+        // Put the element right after its predecessor in the final order,
+        // which is either stable or has already been placed
+        let from = cur.iter().position(|&x| x == elem).unwrap();
+        let to = if i == 0 {
+            0
+        } else {
+            let pred = cur.iter().position(|&x| x == order[i - 1]).unwrap();
+            if from < pred {
+                pred
+            } else {
+                pred + 1
+            }
+        };
+
+        if from != to {
+            let v = cur.remove(from);
+            cur.insert(to, v);
+            ans.push((from, to));
+        }
+    }
+
+    debug_assert_eq!(cur, order);
+    ans
+}
+
+fn longest_increasing_subsequence_mask(arr: &[usize]) -> Vec<bool> {
+    // `tails[k]` is the index of the smallest tail of the increasing subsequences of length `k + 1`
+    let mut tails: Vec<usize> = Vec::new();
+    let mut prev: Vec<Option<usize>> = vec![None; arr.len()];
+    for i in 0..arr.len() {
+        let k = tails.partition_point(|&j| arr[j] < arr[i]);
+        if k > 0 {
+            prev[i] = Some(tails[k - 1]);
+        }
+
+        if k == tails.len() {
+            tails.push(i);
+        } else {
+            tails[k] = i;
+        }
+    }
+
+    let mut mask = vec![false; arr.len()];
+    let mut cur = tails.last().copied();
+    while let Some(i) = cur {
+        mask[i] = true;
+        cur = prev[i];
+    }
+
+    mask
 }
 
 fn event_len(s: &str) -> usize {
@@ -1841,6 +2338,107 @@ fn event_len(s: &str) -> usize {
     }
 }
 
+/// The list operations a splice is made of. It's shared by [ListHandler] and
+/// [MovableListHandler].
+trait SpliceList {
+    fn list_len(&self) -> usize;
+    fn get_value(&self, index: usize) -> Option<ValueOrHandler>;
+    fn delete_range(&self, txn: &mut Transaction, pos: usize, len: usize) -> LoroResult<()>;
+    fn insert_value(&self, txn: &mut Transaction, pos: usize, v: LoroValue) -> LoroResult<()>;
+}
+
+impl SpliceList for ListHandler {
+    fn list_len(&self) -> usize {
+        self.len()
+    }
+
+    fn get_value(&self, index: usize) -> Option<ValueOrHandler> {
+        self.get_(index)
+    }
+
+    fn delete_range(&self, txn: &mut Transaction, pos: usize, len: usize) -> LoroResult<()> {
+        self.delete_with_txn(txn, pos, len)
+    }
+
+    fn insert_value(&self, txn: &mut Transaction, pos: usize, v: LoroValue) -> LoroResult<()> {
+        self.insert_with_txn(txn, pos, v)
+    }
+}
+
+impl SpliceList for MovableListHandler {
+    fn list_len(&self) -> usize {
+        self.len()
+    }
+
+    fn get_value(&self, index: usize) -> Option<ValueOrHandler> {
+        self.get_(index)
+    }
+
+    fn delete_range(&self, txn: &mut Transaction, pos: usize, len: usize) -> LoroResult<()> {
+        self.delete_with_txn(txn, pos, len)
+    }
+
+    fn insert_value(&self, txn: &mut Transaction, pos: usize, v: LoroValue) -> LoroResult<()> {
+        self.insert_with_txn(txn, pos, v)
+    }
+}
+
+/// Get the range of the `len` items at `pos` in a list with `list_len` items.
+fn splice_range(pos: usize, len: usize, list_len: usize) -> LoroResult<Range<usize>> {
+    match pos.checked_add(len) {
+        Some(end) if end <= list_len => Ok(pos..end),
+        end => Err(LoroError::OutOfBound {
+            pos: end.unwrap_or(usize::MAX),
+            len: list_len,
+        }),
+    }
+}
+
+fn splice_detached(
+    list: &mut Vec<ValueOrHandler>,
+    pos: usize,
+    len: usize,
+    values: &[LoroValue],
+) -> LoroResult<Vec<LoroValue>> {
+    let range = splice_range(pos, len, list.len())?;
+    let removed = list
+        .splice(
+            range,
+            values.iter().map(|v| ValueOrHandler::Value(v.clone())),
+        )
+        .map(|v| v.to_deep_value())
+        .collect();
+    Ok(removed)
+}
+
+fn splice_list_with_txn(
+    list: &impl SpliceList,
+    txn: &mut Transaction,
+    pos: usize,
+    len: usize,
+    values: &[LoroValue],
+) -> LoroResult<Vec<LoroValue>> {
+    let range = splice_range(pos, len, list.list_len())?;
+    // Check the values before deleting anything, so a failed splice has no effect
+    if values.iter().any(|v| v.is_container()) {
+        return Err(LoroError::ArgErr(
+            INSERT_CONTAINER_VALUE_ARG_ERROR
+                .to_string()
+                .into_boxed_str(),
+        ));
+    }
+
+    let removed = range
+        .map(|i| list.get_value(i).unwrap().to_deep_value())
+        .collect();
+    list.delete_range(txn, pos, len)?;
+    for (i, v) in values.iter().enumerate() {
+        list.insert_value(txn, pos + i, v.clone())?;
+    }
+
+    Ok(removed)
+}
+
 impl ListHandler {
     /// Create a new container that is detached from the document.
     /// The edits on a detached container will not be persisted.
@@ -2025,6 +2623,37 @@ impl ListHandler {
         Ok(())
     }
 
+    /// Delete `len` items at `pos`, and insert `values` there.
+    ///
+    /// It returns the deep values of the deleted items before the splice.
+    /// The deletion and the insertion are in the same transaction.
+    pub fn splice(
+        &self,
+        pos: usize,
+        len: usize,
+        values: &[LoroValue],
+    ) -> LoroResult<Vec<LoroValue>> {
+        match &self.inner {
+            MaybeDetached::Detached(l) => {
+                let mut list = l.try_lock().unwrap();
+                splice_detached(&mut list.value, pos, len, values)
+            }
+            MaybeDetached::Attached(a) => {
+                a.with_txn(|txn| self.splice_with_txn(txn, pos, len, values))
+            }
+        }
+    }
+
+    pub fn splice_with_txn(
+        &self,
+        txn: &mut Transaction,
+        pos: usize,
+        len: usize,
+        values: &[LoroValue],
+    ) -> LoroResult<Vec<LoroValue>> {
+        splice_list_with_txn(self, txn, pos, len, values)
+    }
+
     pub fn get_child_handler(&self, index: usize) -> LoroResult<Handler> {
         match &self.inner {
             MaybeDetached::Detached(l) => {
@@ -2120,6 +2749,44 @@ impl ListHandler {
         }
     }
 
+    /// Iterate over the values of the list lazily. The nested containers are yielded as
+    /// handlers.
+    ///
+    /// Unlike [ListHandler::for_each], the state is not locked between the steps. But the
+    /// chunks are read by index, so an edit of the list during the iteration invalidates the
+    /// iterator: the later elements may be skipped or repeated. Create a new iterator after
+    /// editing the list.
+    pub fn iter(&self) -> ListIter {
+        ListIter {
+            handler: self.clone(),
+            pos: 0,
+            buffer: Vec::new().into_iter(),
+        }
+    }
+
+    /// Get the values in `start..start + len`, or fewer if the list is shorter.
+    fn get_values_from(&self, start: usize, len: usize) -> Vec<ValueOrHandler> {
+        match &self.inner {
+            MaybeDetached::Detached(l) => {
+                let l = l.try_lock().unwrap();
+                l.value.iter().skip(start).take(len).cloned().collect()
+            }
+            MaybeDetached::Attached(inner) => {
+                let values = inner
+                    .with_state(|state| state.as_list_state().unwrap().get_values_from(start, len));
+                values
+                    .into_iter()
+                    .map(|v| match v {
+                        LoroValue::Container(c) => {
+                            ValueOrHandler::Handler(create_handler(inner, c))
+                        }
+                        value => ValueOrHandler::Value(value),
+                    })
+                    .collect()
+            }
+        }
+    }
+
     pub fn for_each<I>(&self, mut f: I)
     where
         I: FnMut((usize, ValueOrHandler)),
@@ -2380,6 +3047,37 @@ impl MovableListHandler {
         )
     }
 
+    /// Apply a batch of moves within a single transaction.
+    ///
+    /// Each `(from, to)` pair is interpreted against the list produced by the previous
+    /// pairs, as if [MovableListHandler::mov] were called for each of them. Only the
+    /// minimal set of move ops that leads to the final order is emitted.
+    pub fn move_batch(&self, moves: &[(usize, usize)]) -> LoroResult<()> {
+        match &self.inner {
+            MaybeDetached::Detached(d) => {
+                let mut d = d.lock().unwrap();
+                let order = calc_order_after_moves(d.value.len(), moves)?;
+                let mut old: Vec<_> = std::mem::take(&mut d.value).into_iter().map(Some).collect();
+                d.value = order.into_iter().map(|i| old[i].take().unwrap()).collect();
+                Ok(())
+            }
+            MaybeDetached::Attached(a) => a.with_txn(|txn| self.move_batch_with_txn(txn, moves)),
+        }
+    }
+
+    pub fn move_batch_with_txn(
+        &self,
+        txn: &mut Transaction,
+        moves: &[(usize, usize)],
+    ) -> LoroResult<()> {
+        let order = calc_order_after_moves(self.len(), moves)?;
+        for (from, to) in calc_minimal_moves(&order) {
+            self.move_with_txn(txn, from, to)?;
+        }
+
+        Ok(())
+    }
+
     pub fn push(&self, v: LoroValue) -> LoroResult<()> {
         match &self.inner {
             MaybeDetached::Detached(d) => {
@@ -2645,6 +3343,37 @@ impl MovableListHandler {
         Ok(())
     }
 
+    /// Delete `len` items at `pos`, and insert `values` there.
+    ///
+    /// It returns the deep values of the deleted items before the splice.
+    /// The deletion and the insertion are in the same transaction.
+    pub fn splice(
+        &self,
+        pos: usize,
+        len: usize,
+        values: &[LoroValue],
+    ) -> LoroResult<Vec<LoroValue>> {
+        match &self.inner {
+            MaybeDetached::Detached(l) => {
+                let mut list = l.lock().unwrap();
+                splice_detached(&mut list.value, pos, len, values)
+            }
+            MaybeDetached::Attached(a) => {
+                a.with_txn(|txn| self.splice_with_txn(txn, pos, len, values))
+            }
+        }
+    }
+
+    pub fn splice_with_txn(
+        &self,
+        txn: &mut Transaction,
+        pos: usize,
+        len: usize,
+        values: &[LoroValue],
+    ) -> LoroResult<Vec<LoroValue>> {
+        splice_list_with_txn(self, txn, pos, len, values)
+    }
+
     pub fn get_child_handler(&self, index: usize) -> LoroResult<Handler> {
         match &self.inner {
             MaybeDetached::Detached(l) => {
@@ -2878,6 +3607,31 @@ impl MovableListHandler {
                         loro_delta::DeltaItem::Retain { len, .. } => {
                             index += len;
                         }
+                        loro_delta::DeltaItem::Replace {
+                            value,
+                            delete,
+                            attr,
+                        } if attr.from_set && value.len() == *delete => {
+                            // Update the values in place, so the elements keep their identities
+                            for v in value.iter() {
+                                match v {
+                                    ValueOrHandler::Value(v) => {
+                                        self.set(index, v.clone())?;
+                                    }
+                                    ValueOrHandler::Handler(h) => {
+                                        let old_id = h.id();
+                                        let new_h = self.set_container(
+                                            index,
+                                            Handler::new_unattached(old_id.container_type()),
+                                        )?;
+                                        let new_id = new_h.id();
+                                        on_container_remap(old_id, new_id);
+                                    }
+                                }
+
+                                index += 1;
+                            }
+                        }
                         loro_delta::DeltaItem::Replace {
                             value,
                             delete,
@@ -3008,6 +3762,70 @@ impl MapHandler {
         )
     }
 
+    /// Insert all the `entries` in the same transaction. The keys absent from `entries`
+    /// are left untouched.
+    pub fn update(&self, entries: impl IntoIterator<Item = (String, LoroValue)>) -> LoroResult<()> {
+        self.update_entries(entries.into_iter().collect(), false)
+    }
+
+    /// Like [MapHandler::update], but the keys absent from `entries` are deleted.
+    pub fn replace_all(
+        &self,
+        entries: impl IntoIterator<Item = (String, LoroValue)>,
+    ) -> LoroResult<()> {
+        self.update_entries(entries.into_iter().collect(), true)
+    }
+
+    fn update_entries(
+        &self,
+        mut entries: Vec<(String, LoroValue)>,
+        delete_absent: bool,
+    ) -> LoroResult<()> {
+        if entries.iter().any(|(_, v)| v.is_container()) {
+            return Err(LoroError::ArgErr(
+                INSERT_CONTAINER_VALUE_ARG_ERROR
+                    .to_string()
+                    .into_boxed_str(),
+            ));
+        }
+
+        // Sort the entries so that the ops don't depend on the iteration order of the input.
+        // The sort is stable, so the last one of the duplicated keys wins.
+        entries.sort_by(|a, b| a.0.cmp(&b.0));
+        let mut absent = Vec::new();
+        if delete_absent {
+            let keys: FxHashSet<&str> = entries.iter().map(|(k, _)| k.as_str()).collect();
+            self.for_each(|k, _| {
+                if !keys.contains(k) {
+                    absent.push(k.to_string());
+                }
+            });
+            absent.sort();
+        }
+
+        match &self.inner {
+            MaybeDetached::Detached(m) => {
+                let mut m = m.try_lock().unwrap();
+                for key in absent {
+                    m.value.remove(&key);
+                }
+                for (key, value) in entries {
+                    m.value.insert(key, ValueOrHandler::Value(value));
+                }
+                Ok(())
+            }
+            MaybeDetached::Attached(a) => a.with_txn(|txn| {
+                for key in absent {
+                    self.delete_with_txn(txn, &key)?;
+                }
+                for (key, value) in entries {
+                    self.insert_with_txn(txn, &key, value)?;
+                }
+                Ok(())
+            }),
+        }
+    }
+
     pub fn insert_container<T: HandlerTrait>(&self, key: &str, handler: T) -> LoroResult<T> {
         match &self.inner {
             MaybeDetached::Detached(m) => {
@@ -3199,6 +4017,41 @@ impl MapHandler {
         self.insert_container(key, child)
     }
 
+    /// Get the container at `key`, or insert a new container of type `ty` if the key is empty.
+    ///
+    /// The lookup and the insertion happen in the same transaction. If several peers
+    /// concurrently create containers at the same key, the key converges to one of them
+    /// by last-writer-wins, and calling this method after syncing returns the surviving
+    /// container on every peer.
+    ///
+    /// It returns an error if the key holds a value or a container of another type.
+    pub fn get_or_insert_container(&self, key: &str, ty: ContainerType) -> LoroResult<Handler> {
+        if matches!(ty, ContainerType::Unknown(_)) {
+            return Err(LoroError::ArgErr(
+                format!("Cannot create a container of type {}", ty).into_boxed_str(),
+            ));
+        }
+
+        let get_existing = || match self.get_(key) {
+            Some(ValueOrHandler::Handler(h)) if h.c_type() == ty => Ok(Some(h)),
+            Some(other) => Err(LoroError::ArgErr(
+                format!("Expected value type {} but found {:?}", ty, other).into_boxed_str(),
+            )),
+            None => Ok(None),
+        };
+
+        match &self.inner {
+            MaybeDetached::Detached(_) => match get_existing()? {
+                Some(h) => Ok(h),
+                None => self.insert_container(key, Handler::new_unattached(ty)),
+            },
+            MaybeDetached::Attached(a) => a.with_txn(|txn| match get_existing()? {
+                Some(h) => Ok(h),
+                None => self.insert_container_with_txn(txn, key, Handler::new_unattached(ty)),
+            }),
+        }
+    }
+
     pub fn len(&self) -> usize {
         match &self.inner {
             MaybeDetached::Detached(m) => m.try_lock().unwrap().value.len(),
@@ -3230,7 +4083,8 @@ pub mod counter {
     use loro_common::LoroResult;
 
     use crate::{
-        state::ContainerState,
+        op::CounterDelta,
+        state::{ContainerState, CounterSum},
         txn::{EventHint, Transaction},
         HandlerTrait,
     };
@@ -3239,47 +4093,86 @@ pub mod counter {
 
     #[derive(Clone)]
     pub struct CounterHandler {
-        pub(super) inner: MaybeDetached<f64>,
+        pub(super) inner: MaybeDetached<CounterSum>,
     }
 
     impl CounterHandler {
         pub fn new_detached() -> Self {
             Self {
-                inner: MaybeDetached::new_detached(0.),
+                inner: MaybeDetached::new_detached(CounterSum::default()),
             }
         }
 
         pub fn increment(&self, n: f64) -> LoroResult<()> {
-            match &self.inner {
-                MaybeDetached::Detached(d) => {
-                    let d = &mut d.try_lock().unwrap().value;
-                    *d += n;
-                    Ok(())
-                }
-                MaybeDetached::Attached(a) => a.with_txn(|txn| self.increment_with_txn(txn, n)),
-            }
+            self.apply_delta(CounterDelta::Float(n))
         }
 
         pub fn decrement(&self, n: f64) -> LoroResult<()> {
+            self.apply_delta(CounterDelta::Float(-n))
+        }
+
+        /// Increment the counter by an integer, which is summed up exactly.
+        pub fn increment_int(&self, n: i64) -> LoroResult<()> {
+            self.apply_delta(CounterDelta::Int(n))
+        }
+
+        fn apply_delta(&self, delta: CounterDelta) -> LoroResult<()> {
             match &self.inner {
                 MaybeDetached::Detached(d) => {
-                    let d = &mut d.try_lock().unwrap().value;
-                    *d -= n;
+                    d.try_lock().unwrap().value.add(delta);
                     Ok(())
                 }
-                MaybeDetached::Attached(a) => a.with_txn(|txn| self.increment_with_txn(txn, -n)),
+                MaybeDetached::Attached(a) => {
+                    a.with_txn(|txn| self.apply_delta_with_txn(txn, delta))
+                }
             }
         }
 
-        fn increment_with_txn(&self, txn: &mut Transaction, n: f64) -> LoroResult<()> {
+        pub fn increment_with_txn(&self, txn: &mut Transaction, n: f64) -> LoroResult<()> {
+            self.apply_delta_with_txn(txn, CounterDelta::Float(n))
+        }
+
+        pub fn apply_delta_with_txn(
+            &self,
+            txn: &mut Transaction,
+            delta: CounterDelta,
+        ) -> LoroResult<()> {
             let inner = self.inner.try_attached_state()?;
             txn.apply_local_op(
                 inner.container_idx,
-                crate::op::RawOpContent::Counter(n),
-                EventHint::Counter(n),
+                crate::op::RawOpContent::Counter(delta),
+                EventHint::Counter(delta),
                 &inner.state,
             )
         }
+
+        /// Get the exact value of the counter.
+        ///
+        /// Returns `None` if the fractional amounts don't add up to an integer, or if the
+        /// sum overflowed `i128`.
+        pub fn get_int_value(&self) -> Option<i128> {
+            self.get_sum().to_int()
+        }
+
+        pub(crate) fn get_sum(&self) -> CounterSum {
+            match &self.inner {
+                MaybeDetached::Detached(d) => d.try_lock().unwrap().value,
+                MaybeDetached::Attached(a) => {
+                    a.with_state(|state| state.as_counter_state_mut().unwrap().get_sum())
+                }
+            }
+        }
+
+        pub(crate) fn apply_sum_with_txn(
+            &self,
+            txn: &mut Transaction,
+            sum: CounterSum,
+        ) -> LoroResult<()> {
+            for delta in sum.to_deltas() {
+                self.apply_delta_with_txn(txn, delta)?;
+            }
+            Ok(())
+        }
     }
 
     impl std::fmt::Debug for CounterHandler {
@@ -3304,7 +4197,7 @@ pub mod counter {
             match &self.inner {
                 MaybeDetached::Detached(t) => {
                     let t = t.try_lock().unwrap();
-                    t.value.into()
+                    t.value.to_f64().into()
                 }
                 MaybeDetached::Attached(a) => {
                     a.with_state(|state| state.as_counter_state_mut().unwrap().get_value())
@@ -3343,7 +4236,7 @@ pub mod counter {
                     let inner = create_handler(parent, self_id);
                     let c = inner.into_counter().unwrap();
 
-                    c.increment_with_txn(txn, v.value)?;
+                    c.apply_sum_with_txn(txn, v.value)?;
 
                     v.attached = c.attached_handler().cloned();
                     Ok(c)
@@ -3351,8 +4244,7 @@ pub mod counter {
                 MaybeDetached::Attached(a) => {
                     let new_inner = create_handler(a, self_id);
                     let ans = new_inner.into_counter().unwrap();
-                    let delta = *self.get_value().as_double().unwrap();
-                    ans.increment_with_txn(txn, delta)?;
+                    ans.apply_sum_with_txn(txn, self.get_sum())?;
                     Ok(ans)
                 }
             }
@@ -3621,4 +4513,22 @@ mod test {
             ])
         )
     }
+
+    #[test]
+    fn minimal_moves_for_batch() {
+        let order = super::calc_order_after_moves(4, &[(3, 0)]).unwrap();
+        assert_eq!(order, vec![3, 0, 1, 2]);
+        assert_eq!(super::calc_minimal_moves(&order), vec![(3, 0)]);
+
+        let order = super::calc_order_after_moves(5, &[(0, 4), (0, 3), (4, 0)]).unwrap();
+        let moves = super::calc_minimal_moves(&order);
+        let mut cur: Vec<usize> = (0..5).collect();
+        for &(from, to) in moves.iter() {
+            let v = cur.remove(from);
+            cur.insert(to, v);
+        }
+        assert_eq!(cur, order);
+        assert_eq!(moves, vec![(1, 4)]);
+        assert!(super::calc_order_after_moves(2, &[(0, 2)]).is_err());
+    }
 }
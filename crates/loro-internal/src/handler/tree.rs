@@ -63,11 +63,30 @@ impl TreeInner {
     }
 
     fn mov(&mut self, target: TreeID, new_parent: Option<TreeID>, index: usize) -> LoroResult<()> {
-        let old_parent = self
+        let old_parent = *self
             .parent_links
-            .get_mut(&target)
+            .get(&target)
             .ok_or(LoroTreeError::TreeNodeNotExist(target))?;
-        let children = self.children_links.get_mut(old_parent).unwrap();
+        if let Some(parent) = new_parent {
+            if !self.parent_links.contains_key(&parent) {
+                return Err(LoroTreeError::TreeNodeParentNotFound(parent).into());
+            }
+        }
+
+        if self.is_ancestor_of(target, new_parent) {
+            return Err(LoroTreeError::CyclicMoveError.into());
+        }
+
+        let mut len = self.children_num(new_parent).unwrap_or(0);
+        if old_parent == new_parent {
+            len -= 1;
+        }
+
+        if index > len {
+            return Err(LoroTreeError::IndexOutOfBound { len, index }.into());
+        }
+
+        let children = self.children_links.get_mut(&old_parent).unwrap();
         children.retain(|x| x != &target);
         self.parent_links.insert(target, new_parent);
         let children = self.children_links.entry(new_parent).or_default();
@@ -75,6 +94,19 @@ impl TreeInner {
         Ok(())
     }
 
+    /// Whether `maybe_ancestor` is `node` itself or one of the ancestors of `node`
+    fn is_ancestor_of(&self, maybe_ancestor: TreeID, mut node: Option<TreeID>) -> bool {
+        while let Some(id) = node {
+            if id == maybe_ancestor {
+                return true;
+            }
+
+            node = self.parent_links.get(&id).copied().flatten();
+        }
+
+        false
+    }
+
     fn delete(&mut self, id: TreeID) -> LoroResult<()> {
         self.map.remove(&id);
         let parent = self
@@ -474,6 +506,11 @@ impl TreeHandler {
     ) -> LoroResult<()> {
         let parent = parent.into();
         let inner = self.inner.try_attached_state()?;
+        // check it before touching the positions, so the tree stays untouched on error
+        if self.is_ancestor_of(target, parent) {
+            return Err(LoroTreeError::CyclicMoveError.into());
+        }
+
         let mut children_len = self.children_num(parent).unwrap_or(0);
         let mut already_in_parent = false;
         // check the input is valid
@@ -614,6 +651,23 @@ impl TreeHandler {
         }
     }
 
+    /// Get the path from the root to the node. Each item is a node on the path and its index
+    /// among its siblings. The last item is the node itself.
+    ///
+    /// If the node or one of its ancestors is deleted, or the node does not exist, return None
+    pub fn get_path(&self, target: &TreeID) -> Option<Vec<(TreeID, usize)>> {
+        let mut path = Vec::new();
+        let mut node = Some(*target);
+        while let Some(n) = node {
+            let parent = self.get_node_parent(&n)?;
+            path.push((n, self.get_index_by_tree_id(&n)?));
+            node = parent;
+        }
+
+        path.reverse();
+        Some(path)
+    }
+
     // TODO: iterator
     pub fn children(&self, parent: Option<TreeID>) -> Option<Vec<TreeID>> {
         match &self.inner {
@@ -681,6 +735,20 @@ impl TreeHandler {
         }
     }
 
+    /// Whether `maybe_ancestor` is `node` itself or one of the ancestors of `node`
+    fn is_ancestor_of(&self, maybe_ancestor: TreeID, node: Option<TreeID>) -> bool {
+        match &self.inner {
+            MaybeDetached::Detached(t) => {
+                let t = t.try_lock().unwrap();
+                t.value.is_ancestor_of(maybe_ancestor, node)
+            }
+            MaybeDetached::Attached(a) => a.with_state(|state| {
+                let a = state.as_tree_state().unwrap();
+                a.is_ancestor_of(&maybe_ancestor, &TreeParentId::from(node))
+            }),
+        }
+    }
+
     pub fn nodes(&self) -> Vec<TreeID> {
         match &self.inner {
             MaybeDetached::Detached(t) => {
@@ -0,0 +1,175 @@
+//! Step through the historical versions of a doc.
+//!
+//! [HistoryIter] walks the versions in causal order on its own copy of the doc state,
+//! so each step only calculates the diff from the previous version.
+use loro_common::{IdSpan, LoroResult, LoroValue, ID};
+use rle::HasLength;
+
+use crate::{undo::DiffBatch, version::Frontiers, LoroDoc, VersionVector};
+
+/// How far [HistoryIter] goes in each step.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum HistoryGranularity {
+    /// Each step applies a whole change.
+    ///
+    /// The consecutive commits of a peer may be merged into one change.
+    #[default]
+    Change,
+    /// Each step applies an op, e.g. an insertion of a string or a map update.
+    Op,
+}
+
+/// A version visited by [HistoryIter].
+#[derive(Debug, Clone)]
+pub struct HistoryStep {
+    /// The number of steps applied to reach this version, starting from 1
+    pub index: usize,
+    /// The version after this step
+    pub frontiers: Frontiers,
+    /// The diff from the previous version to this version
+    pub diff: DiffBatch,
+}
+
+/// An iterator over the historical versions of a doc, created by [LoroDoc::history_iter].
+///
+/// It starts from the empty version. The versions are visited in causal order, and each
+/// item contains the diff from the previous version, which can be applied to a renderer
+/// incrementally. [HistoryIter::seek] jumps to any step.
+///
+/// The history is captured when the iterator is created. The later changes of the doc
+/// are not included.
+#[derive(Debug)]
+pub struct HistoryIter {
+    doc: LoroDoc,
+    /// The ops applied by each step
+    steps: Vec<IdSpan>,
+    /// The number of the applied steps
+    pos: usize,
+    vv: VersionVector,
+}
+
+impl LoroDoc {
+    /// Create an iterator that steps through the historical versions of the doc.
+    ///
+    /// The iterator owns a copy of the oplog and its own state, so this doc is not affected.
+    pub fn history_iter(&self, granularity: HistoryGranularity) -> HistoryIter {
+        self.commit_then_stop();
+        let (doc, steps) = {
+            let oplog = self.oplog().lock().unwrap();
+            let mut steps = Vec::new();
+            for change in oplog.changes().values().flat_map(|x| x.iter()) {
+                let peer = change.peer();
+                match granularity {
+                    HistoryGranularity::Change => steps.push((
+                        change.lamport(),
+                        IdSpan::new(
+                            peer,
+                            change.id.counter,
+                            change.id.counter + change.atom_len() as i32,
+                        ),
+                    )),
+                    HistoryGranularity::Op => {
+                        for op in change.ops().iter() {
+                            let offset = (op.counter - change.id.counter) as u32;
+                            steps.push((
+                                change.lamport() + offset,
+                                IdSpan::new(peer, op.counter, op.counter + op.atom_len() as i32),
+                            ));
+                        }
+                    }
+                }
+            }
+
+            // The deps of an op always have smaller lamports
+            steps.sort_by_key(|(lamport, span)| (*lamport, span.peer));
+            let forked = oplog.fork(oplog.arena.fork(), oplog.configure.fork());
+            (
+                LoroDoc::from_oplog(forked),
+                steps.into_iter().map(|(_, span)| span).collect(),
+            )
+        };
+        self.renew_txn_if_auto_commit();
+        doc.detach();
+        HistoryIter {
+            doc,
+            steps,
+            pos: 0,
+            vv: Default::default(),
+        }
+    }
+}
+
+impl HistoryIter {
+    /// The number of steps from the empty version to the latest version.
+    pub fn len(&self) -> usize {
+        self.steps.len()
+    }
+
+    /// Whether the doc has no history.
+    pub fn is_empty(&self) -> bool {
+        self.steps.is_empty()
+    }
+
+    /// The number of steps applied to reach the current version.
+    pub fn position(&self) -> usize {
+        self.pos
+    }
+
+    /// The current version.
+    pub fn frontiers(&self) -> Frontiers {
+        self.doc.state_frontiers()
+    }
+
+    /// The deep value of the doc at the current version.
+    pub fn get_deep_value(&self) -> LoroValue {
+        self.doc.get_deep_value()
+    }
+
+    /// Jump to the version after the first `pos` steps, and return the diff from the current
+    /// version to it. `0` is the empty version.
+    ///
+    /// The iteration continues from the new position.
+    pub fn seek(&mut self, pos: usize) -> LoroResult<DiffBatch> {
+        if pos > self.steps.len() {
+            return Err(loro_common::LoroError::OutOfBound {
+                pos,
+                len: self.steps.len(),
+            });
+        }
+
+        let mut vv = VersionVector::default();
+        for span in self.steps[..pos].iter() {
+            vv.extend_to_include_last_id(ID::new(span.peer, span.counter.end - 1));
+        }
+        self.pos = pos;
+        self.vv = vv;
+        Ok(self.travel())
+    }
+
+    fn travel(&mut self) -> DiffBatch {
+        let frontiers = self.doc.vv_to_frontiers(&self.vv);
+        self.doc.app_state().lock().unwrap().start_recording();
+        self.doc.checkout_without_emitting(&frontiers).unwrap();
+        let mut state = self.doc.app_state().lock().unwrap();
+        let events = state.take_events();
+        state.stop_and_clear_recording();
+        DiffBatch::new(events)
+    }
+}
+
+impl Iterator for HistoryIter {
+    type Item = HistoryStep;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        let span = *self.steps.get(self.pos)?;
+        self.vv
+            .extend_to_include_last_id(ID::new(span.peer, span.counter.end - 1));
+        self.pos += 1;
+        let diff = self.travel();
+        Some(HistoryStep {
+            index: self.pos,
+            frontiers: self.frontiers(),
+            diff,
+        })
+    }
+}
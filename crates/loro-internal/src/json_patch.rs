@@ -0,0 +1,351 @@
+//! Convert the diff between two versions into [JSON Patch](https://datatracker.ietf.org/doc/html/rfc6902) operations.
+//!
+//! The paths are [JSON Pointers](https://datatracker.ietf.org/doc/html/rfc6901) into the value
+//! returned by [`LoroDoc::get_deep_value`].
+//!
+//! - Map updates become `add` (which also overwrites an existing key) or `remove`.
+//! - List inserts and deletions become `add`, `remove` and `replace` at the item index.
+//!   Moves in movable lists become `move`.
+//! - Text, counter and tree containers are exported as a `replace` of their whole value.
+//!   A tree node has no path in the tree value, so a node move is not a `move` either.
+//! - The content of a newly inserted container is included in the value of its `add` op,
+//!   so it doesn't produce separate ops.
+use fxhash::FxHashSet;
+use loro_common::{ContainerID, LoroResult, LoroValue};
+use loro_delta::DeltaItem;
+use serde::Serialize;
+
+use crate::{
+    event::{Diff, Index, ListDiff},
+    handler::ValueOrHandler,
+    state::DocState,
+    version::Frontiers,
+    DocDiff, LoroDoc,
+};
+
+/// A single JSON Patch operation.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+#[serde(tag = "op", rename_all = "lowercase")]
+pub enum JsonPatchOp {
+    Add { path: String, value: LoroValue },
+    Remove { path: String },
+    Replace { path: String, value: LoroValue },
+    Move { from: String, path: String },
+}
+
+impl JsonPatchOp {
+    pub fn path(&self) -> &str {
+        match self {
+            JsonPatchOp::Add { path, .. }
+            | JsonPatchOp::Remove { path }
+            | JsonPatchOp::Replace { path, .. }
+            | JsonPatchOp::Move { path, .. } => path,
+        }
+    }
+}
+
+impl LoroDoc {
+    /// Export the changes from version `from` to version `to` as JSON Patch operations.
+    ///
+    /// Applying the ops to the deep value at `from` produces the deep value at `to`.
+    /// The doc is restored to its previous version afterwards, and no event is emitted.
+    pub fn export_json_patch(
+        &self,
+        from: &Frontiers,
+        to: &Frontiers,
+    ) -> LoroResult<Vec<JsonPatchOp>> {
+        self.with_diff_events(from, to, |doc, events| {
+            doc.events_to_json_patch(from, events)
+        })
+    }
+
+    fn events_to_json_patch(&self, from: &Frontiers, events: Vec<DocDiff>) -> Vec<JsonPatchOp> {
+        let mut ans = Vec::new();
+        // Containers whose whole value has already been written into the patch
+        let mut whole: FxHashSet<ContainerID> = FxHashSet::default();
+        let mut state = self.app_state().lock().unwrap();
+        for event in events {
+            for c in event.diff {
+                if c.is_unknown || c.path.iter().any(|(id, _)| whole.contains(id)) {
+                    continue;
+                }
+
+                if let Some(i) = c.path.iter().position(|(_, index)| index.is_node()) {
+                    // The container is a node's metadata (or inside it), so we replace the
+                    // whole tree instead of locating the node in the tree value.
+                    let (tree, _) = &c.path[i - 1];
+                    let Some(idx) = state.arena.id_to_idx(tree) else {
+                        continue;
+                    };
+                    ans.push(JsonPatchOp::Replace {
+                        path: json_pointer(&c.path[..i]),
+                        value: state.get_container_deep_value(idx),
+                    });
+                    whole.insert(tree.clone());
+                    continue;
+                }
+
+                let base = json_pointer(&c.path);
+                match c.diff {
+                    Diff::Map(map) => {
+                        let mut entries: Vec<_> = map.updated.into_iter().collect();
+                        entries.sort_by(|a, b| a.0.cmp(&b.0));
+                        for (key, v) in entries {
+                            let path = format!("{}/{}", base, escape_token(&key));
+                            match v.value {
+                                Some(v) => ans.push(JsonPatchOp::Add {
+                                    path,
+                                    value: to_patch_value(v, &mut state, &mut whole),
+                                }),
+                                None => ans.push(JsonPatchOp::Remove { path }),
+                            }
+                        }
+                    }
+                    Diff::List(list) if has_move(&list) => {
+                        // The deleted values are needed to find the elements that are moved.
+                        // It reads the state, so the lock is released in the meantime.
+                        drop(state);
+                        let old = self._get_container_value_at(&c.id, from);
+                        state = self.app_state().lock().unwrap();
+                        let old = match old {
+                            Ok(LoroValue::List(old)) => old,
+                            _ => continue,
+                        };
+                        list_with_moves_to_json_patch(
+                            &base, &old, &list, &mut state, &mut whole, &mut ans,
+                        );
+                    }
+                    Diff::List(list) => {
+                        let mut index = 0;
+                        for item in list.iter() {
+                            match item {
+                                DeltaItem::Retain { len, .. } => index += len,
+                                DeltaItem::Replace { value, delete, .. } => {
+                                    let mut values = value.iter();
+                                    for _ in 0..*delete {
+                                        let path = format!("{}/{}", base, index);
+                                        match values.next() {
+                                            Some(v) => {
+                                                ans.push(JsonPatchOp::Replace {
+                                                    path,
+                                                    value: to_patch_value(
+                                                        v.clone(),
+                                                        &mut state,
+                                                        &mut whole,
+                                                    ),
+                                                });
+                                                index += 1;
+                                            }
+                                            None => ans.push(JsonPatchOp::Remove { path }),
+                                        }
+                                    }
+                                    for v in values {
+                                        ans.push(JsonPatchOp::Add {
+                                            path: format!("{}/{}", base, index),
+                                            value: to_patch_value(
+                                                v.clone(),
+                                                &mut state,
+                                                &mut whole,
+                                            ),
+                                        });
+                                        index += 1;
+                                    }
+                                }
+                            }
+                        }
+                    }
+                    Diff::Tree(_) => {
+                        ans.push(JsonPatchOp::Replace {
+                            path: base,
+                            value: state.get_container_deep_value(c.idx),
+                        });
+                        whole.insert(c.id);
+                    }
+                    Diff::Text(_) => {
+                        ans.push(JsonPatchOp::Replace {
+                            path: base,
+                            value: state.get_container_deep_value(c.idx),
+                        });
+                    }
+                    #[cfg(feature = "counter")]
+                    Diff::Counter(_) => {
+                        ans.push(JsonPatchOp::Replace {
+                            path: base,
+                            value: state.get_container_deep_value(c.idx),
+                        });
+                    }
+                    Diff::Unknown => {}
+                }
+            }
+        }
+
+        ans
+    }
+}
+
+fn has_move(list: &ListDiff) -> bool {
+    list.iter()
+        .any(|item| matches!(item, DeltaItem::Replace { attr, .. } if attr.from_move))
+}
+
+/// Convert a list diff with moves, given the shallow values of the list before the diff.
+///
+/// The unmatched deletions are removed first. Then each moved element is moved right after
+/// the previous element that is already in place, so every move is a single `move` op.
+/// The inserted values are added at last in the ascending order of their final indexes.
+fn list_with_moves_to_json_patch(
+    base: &str,
+    old: &[LoroValue],
+    list: &ListDiff,
+    state: &mut DocState,
+    whole: &mut FxHashSet<ContainerID>,
+    ans: &mut Vec<JsonPatchOp>,
+) {
+    enum Entry<'a> {
+        Old(usize),
+        New(&'a ValueOrHandler),
+    }
+
+    let mut deleted = Vec::new();
+    let mut k = 0;
+    for item in list.iter() {
+        match item {
+            DeltaItem::Retain { len, .. } => k += len,
+            DeltaItem::Replace { delete, .. } => {
+                deleted.extend(k..k + delete);
+                k += delete;
+            }
+        }
+    }
+
+    // Match every moved value with a deleted element that has the same value
+    let mut paired = vec![false; old.len()];
+    let mut target = Vec::new();
+    let mut k = 0;
+    for item in list.iter() {
+        match item {
+            DeltaItem::Retain { len, .. } => {
+                target.extend((k..k + len).map(Entry::Old));
+                k += len;
+            }
+            DeltaItem::Replace {
+                value,
+                attr,
+                delete,
+            } => {
+                for v in value.iter() {
+                    let matched = attr.from_move.then(|| {
+                        let v = v.to_value();
+                        deleted
+                            .iter()
+                            .copied()
+                            .find(|&i| !paired[i] && old.get(i) == Some(&v))
+                    });
+                    match matched.flatten() {
+                        Some(i) => {
+                            paired[i] = true;
+                            target.push(Entry::Old(i));
+                        }
+                        None => target.push(Entry::New(v)),
+                    }
+                }
+                k += delete;
+            }
+        }
+    }
+
+    let mut cur = (0..old.len()).collect::<Vec<_>>();
+    let position = |cur: &[usize], k: usize| cur.iter().position(|&x| x == k).unwrap();
+    for &i in deleted.iter().rev() {
+        if !paired[i] {
+            let index = position(&cur, i);
+            cur.remove(index);
+            ans.push(JsonPatchOp::Remove {
+                path: format!("{}/{}", base, index),
+            });
+        }
+    }
+
+    let olds = target
+        .iter()
+        .filter_map(|e| match e {
+            Entry::Old(i) => Some(*i),
+            Entry::New(_) => None,
+        })
+        .collect::<Vec<_>>();
+    // The retained elements are already in order
+    let mut placed = olds.iter().map(|&i| !paired[i]).collect::<Vec<_>>();
+    for t in 0..olds.len() {
+        if placed[t] {
+            continue;
+        }
+
+        let from = position(&cur, olds[t]);
+        cur.remove(from);
+        let to = (0..t)
+            .rev()
+            .find(|&s| placed[s])
+            .map_or(0, |s| position(&cur, olds[s]) + 1);
+        cur.insert(to, olds[t]);
+        placed[t] = true;
+        if from != to {
+            ans.push(JsonPatchOp::Move {
+                from: format!("{}/{}", base, from),
+                path: format!("{}/{}", base, to),
+            });
+        }
+    }
+
+    for (index, e) in target.into_iter().enumerate() {
+        if let Entry::New(v) = e {
+            ans.push(JsonPatchOp::Add {
+                path: format!("{}/{}", base, index),
+                value: to_patch_value(v.clone(), state, whole),
+            });
+        }
+    }
+}
+
+fn to_patch_value(
+    v: ValueOrHandler,
+    state: &mut DocState,
+    whole: &mut FxHashSet<ContainerID>,
+) -> LoroValue {
+    match v {
+        ValueOrHandler::Value(v) => v,
+        ValueOrHandler::Handler(h) => {
+            let id = h.id();
+            let idx = state.arena.register_container(&id);
+            whole.insert(id);
+            state.get_container_deep_value(idx)
+        }
+    }
+}
+
+fn json_pointer(path: &[(ContainerID, Index)]) -> String {
+    let mut ans = String::new();
+    for (_, index) in path {
+        ans.push('/');
+        match index {
+            Index::Key(key) => ans.push_str(&escape_token(key)),
+            Index::Seq(i) => ans.push_str(&i.to_string()),
+            Index::Node(id) => ans.push_str(&id.to_string()),
+        }
+    }
+    ans
+}
+
+/// Escape a reference token as described in [RFC 6901](https://datatracker.ietf.org/doc/html/rfc6901#section-3).
+fn escape_token(s: &str) -> String {
+    s.replace('~', "~0").replace('/', "~1")
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn escape_json_pointer_token() {
+        assert_eq!(escape_token("a/b~c"), "a~1b~0c");
+    }
+}
@@ -22,11 +22,15 @@ pub use oplog::OpLog;
 pub use state::DocState;
 pub use undo::UndoManager;
 pub mod awareness;
+pub mod container_blob;
 pub mod cursor;
+pub mod history;
+pub mod json_patch;
 pub mod loro;
 pub mod obs;
 pub mod oplog;
 pub mod txn;
+pub mod validate;
 
 pub mod change;
 pub mod configure;
@@ -11,29 +11,33 @@ use std::{
 };
 
 use either::Either;
-use fxhash::FxHashMap;
+use fxhash::{FxHashMap, FxHashSet};
 use itertools::Itertools;
-use loro_common::{ContainerID, ContainerType, HasIdSpan, IdSpan, LoroResult, LoroValue, ID};
+use loro_common::{
+    ContainerID, ContainerType, HasCounter, HasCounterSpan, HasIdSpan, IdSpan, LoroResult,
+    LoroValue, ID,
+};
 use rle::HasLength;
 use tracing::{info_span, instrument};
 
 use crate::{
     arena::SharedArena,
-    change::Timestamp,
+    change::{Lamport, Timestamp},
     configure::Configure,
     container::{
         idx::ContainerIdx, list::list_op::InnerListOp, richtext::config::StyleConfigMap,
         IntoContainerId,
     },
-    cursor::{AbsolutePosition, CannotFindRelativePosition, Cursor, PosQueryResult},
+    cursor::{AbsolutePosition, CannotFindRelativePosition, Cursor, CursorStatus, PosQueryResult},
     dag::DagUtils,
     encoding::{
-        decode_snapshot, export_snapshot, json_schema::op::JsonSchema, parse_header_and_body,
+        decode_change_headers, decode_snapshot, decode_snapshot_without_loading, export_snapshot,
+        export_snapshot_to, json_schema::op::JsonSchema, parse_header_and_body, DecodedSnapshot,
         EncodeMode, ParsedHeaderAndBody,
     },
-    event::{str_to_path, EventTriggerKind, Index},
+    event::{str_to_path, DocDiff, EventTriggerKind, Index},
     handler::{Handler, MovableListHandler, TextHandler, TreeHandler, ValueOrHandler},
-    id::PeerID,
+    id::{Counter, PeerID},
     op::InnerContent,
     oplog::dag::FrontiersNotIncluded,
     undo::DiffBatch,
@@ -44,10 +48,10 @@ use crate::{
 use super::{
     diff_calc::DiffCalculator,
     event::InternalDocDiff,
-    obs::{Observer, SubID, Subscriber},
-    oplog::OpLog,
-    state::DocState,
-    txn::Transaction,
+    obs::{LocalOpsSubscriber, Observer, OrphanSubscriber, SubID, Subscriber},
+    oplog::{DocStats, OpLog},
+    state::{ContainerState, DocState},
+    txn::{PreCommitHook, Transaction},
     ListHandler, MapHandler,
 };
 
@@ -79,6 +83,9 @@ pub struct LoroDoc {
     txn: Arc<Mutex<Option<Transaction>>>,
     auto_commit: AtomicBool,
     detached: AtomicBool,
+    pre_commit_hook: Mutex<Option<PreCommitHook>>,
+    /// Whether the pre-commit hook is running, so the commits made by it can be rejected
+    in_pre_commit_hook: AtomicBool,
 }
 
 impl Default for LoroDoc {
@@ -99,7 +106,10 @@ impl std::fmt::Debug for LoroDoc {
 
 impl LoroDoc {
     pub fn new() -> Self {
-        let oplog = OpLog::new();
+        Self::from_oplog(OpLog::new())
+    }
+
+    pub(crate) fn from_oplog(oplog: OpLog) -> Self {
         let arena = oplog.arena.clone();
         let global_txn = Arc::new(Mutex::new(None));
         let config: Configure = oplog.configure.clone();
@@ -115,9 +125,23 @@ impl LoroDoc {
             diff_calculator: Arc::new(Mutex::new(DiffCalculator::new())),
             txn: global_txn,
             arena,
+            pre_commit_hook: Mutex::new(None),
+            in_pre_commit_hook: AtomicBool::new(false),
         }
     }
 
+    /// Create a doc whose peer ids are derived from `seed` deterministically.
+    ///
+    /// The peer id of the doc, and the peer ids generated afterwards (e.g. by [LoroDoc::fork]
+    /// or by renewing the peer id after checkout), are distinct from each other.
+    /// It's useful for reproducible tests where the exported bytes should be stable.
+    pub fn new_with_peer_seed(seed: u64) -> Self {
+        let doc = Self::new();
+        doc.config.set_peer_id_seed(seed);
+        doc.state.lock().unwrap().refresh_peer_id();
+        doc
+    }
+
     pub fn fork(&self) -> Self {
         self.commit_then_stop();
         let arena = self.arena.fork();
@@ -143,6 +167,8 @@ impl LoroDoc {
             txn,
             auto_commit: AtomicBool::new(false),
             detached: AtomicBool::new(self.detached.load(std::sync::atomic::Ordering::Relaxed)),
+            pre_commit_hook: Mutex::new(None),
+            in_pre_commit_hook: AtomicBool::new(false),
         };
 
         if self.auto_commit.load(std::sync::atomic::Ordering::Relaxed) {
@@ -153,6 +179,41 @@ impl LoroDoc {
         doc
     }
 
+    /// Create a new doc whose state and history equal this doc's at `frontiers`.
+    ///
+    /// The new doc only contains the ops included by `frontiers`, and it gets a new peer id,
+    /// so the changes made on it can be merged back into this doc like a [LoroDoc::fork].
+    pub fn fork_at(&self, frontiers: &Frontiers) -> LoroResult<Self> {
+        self.commit_then_stop();
+        let bytes = {
+            let oplog = self.oplog.lock().unwrap();
+            match frontiers.iter().find(|id| !oplog.dag.contains(**id)) {
+                Some(id) => Err(LoroError::FrontiersNotFound(*id)),
+                None => {
+                    let vv = oplog.dag.frontiers_to_vv(frontiers).unwrap();
+                    let spans: Vec<IdSpan> = vv
+                        .iter()
+                        .filter(|(_, counter)| **counter > 0)
+                        .map(|(&peer, &counter)| IdSpan::new(peer, 0, counter))
+                        .collect();
+                    Ok(oplog.export_spans(&spans))
+                }
+            }
+        };
+        self.renew_txn_if_auto_commit();
+
+        let doc = Self::from_oplog(OpLog::new_with_arena(
+            SharedArena::new(),
+            self.config.fork(),
+        ));
+        doc.import_batch(&bytes?)?;
+        if self.auto_commit.load(std::sync::atomic::Ordering::Relaxed) {
+            doc.start_auto_commit();
+        }
+
+        Ok(doc)
+    }
+
     /// Set whether to record the timestamp of each change. Default is `false`.
     ///
     /// If enabled, the Unix timestamp will be recorded for each change automatically.
@@ -286,6 +347,56 @@ impl LoroDoc {
         self.checkout_to_latest()
     }
 
+    /// Whether the doc can be edited in detached mode.
+    #[inline]
+    pub fn is_detached_editing_enabled(&self) -> bool {
+        self.config.detached_editing()
+    }
+
+    /// Allow or forbid editing the doc in detached mode.
+    ///
+    /// When it's enabled, the edits made after a checkout depend on the checked out
+    /// version. They are merged with the newer ops as concurrent edits once the doc
+    /// is attached again. To keep the ops of each peer in a single chain, the peer id is
+    /// renewed if the checked out version doesn't include all the ops of the current peer.
+    pub fn set_detached_editing(&self, enable: bool) {
+        self.config.set_detached_editing(enable);
+        if !self.is_detached() {
+            return;
+        }
+
+        self.commit_then_stop();
+        if enable {
+            self.renew_peer_id_if_behind();
+            self.renew_txn_if_auto_commit();
+        }
+    }
+
+    #[inline]
+    fn can_edit(&self) -> bool {
+        !self.detached.load(Acquire) || self.config.detached_editing()
+    }
+
+    /// Renew the peer id if the state doesn't include all the ops of the current peer,
+    /// otherwise the new ops cannot be appended to the chain of the peer.
+    fn renew_peer_id_if_behind(&self) {
+        let oplog = self.oplog.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+        let peer = state.peer;
+        let state_vv = oplog.dag.frontiers_to_vv(&state.frontiers).unwrap();
+        if state_vv.get(&peer) != oplog.vv().get(&peer) {
+            state.refresh_peer_id();
+        }
+    }
+
+    /// Commit the edits made in detached mode and attach the doc to the latest version.
+    ///
+    /// The committed change depends on the checked out version, so it's merged with
+    /// the newer ops following the normal CRDT semantics of concurrent edits.
+    pub fn commit_rebased(&self) {
+        self.checkout_to_latest()
+    }
+
     /// Get the timestamp of the current state.
     /// It's the last edit time of the [DocState].
     pub fn state_timestamp(&self) -> Timestamp {
@@ -317,7 +428,7 @@ impl LoroDoc {
     pub fn start_auto_commit(&self) {
         self.auto_commit.store(true, Release);
         let mut self_txn = self.txn.try_lock().unwrap();
-        if self_txn.is_some() || self.detached.load(Acquire) {
+        if self_txn.is_some() || !self.can_edit() {
             return;
         }
 
@@ -328,35 +439,91 @@ impl LoroDoc {
     /// Commit the cumulative auto commit transaction.
     /// This method only has effect when `auto_commit` is true.
     ///
+    /// It's an implicit commit, so the pre-commit hook is not called.
+    ///
     /// Afterwards, the users need to call `self.renew_txn_after_commit()` to resume the continuous transaction.
     #[inline]
     pub fn commit_then_stop(&self) {
-        self.commit_with(CommitOptions::new().immediate_renew(false))
+        self.commit_with(CommitOptions::new().immediate_renew(false).implicit())
     }
 
     /// Commit the cumulative auto commit transaction.
     /// It will start the next one immediately
+    ///
+    /// It's an implicit commit, so the pre-commit hook is not called.
     #[inline]
     pub fn commit_then_renew(&self) {
-        self.commit_with(CommitOptions::new().immediate_renew(true))
+        self.commit_with(CommitOptions::new().immediate_renew(true).implicit())
     }
 
     /// Commit the cumulative auto commit transaction.
     /// This method only has effect when `auto_commit` is true.
     /// If `immediate_renew` is true, a new transaction will be created after the old one is committed
+    ///
+    /// **If the pre-commit hook rejects the change, the change is discarded without returning
+    /// an error**; only a warning is logged. Use [LoroDoc::try_commit_with] to get the error.
     #[instrument(skip_all)]
     pub fn commit_with(&self, config: CommitOptions) {
+        if let Err(err) = self.try_commit_with(config) {
+            tracing::warn!("Failed to commit: {}", err);
+        }
+    }
+
+    /// Commit the cumulative auto commit transaction like [LoroDoc::commit_with].
+    ///
+    /// The pre-commit hook is called before the change is committed, unless it's an implicit
+    /// commit like [LoroDoc::commit_then_stop]. The ops created by the handlers in the hook are
+    /// included in the change. If the hook returns an error, the transaction is rolled back
+    /// and the error is returned.
+    ///
+    /// Committing in the hook fails with [LoroError::TransactionError] and leaves the ops in
+    /// the pending change, instead of calling the hook again.
+    pub fn try_commit_with(&self, config: CommitOptions) -> LoroResult<()> {
         if !self.auto_commit.load(Acquire) {
             // if not auto_commit, nothing should happen
             // because the global txn is not used
-            return;
+            return Ok(());
         }
 
+        if self.in_pre_commit_hook.load(Acquire) {
+            return Err(LoroError::TransactionError(
+                "Cannot commit in the pre-commit hook".into(),
+            ));
+        }
+
+        // The implicit commits can't report the error, so they would silently discard the edits
+        let hook = if config.implicit {
+            None
+        } else {
+            self.pre_commit_hook.lock().unwrap().clone()
+        };
+        let result = match hook {
+            Some(hook) => {
+                let pending = self
+                    .txn
+                    .try_lock()
+                    .unwrap()
+                    .as_ref()
+                    .and_then(|txn| txn.pending_change());
+                // The txn lock is released, so the hook can edit the doc
+                match pending {
+                    Some(pending) => {
+                        self.in_pre_commit_hook.store(true, Release);
+                        let ans = hook(&pending);
+                        self.in_pre_commit_hook.store(false, Release);
+                        ans
+                    }
+                    None => Ok(()),
+                }
+            }
+            None => Ok(()),
+        };
+
         let mut txn_guard = self.txn.try_lock().unwrap();
         let txn = txn_guard.take();
         drop(txn_guard);
         let Some(mut txn) = txn else {
-            return;
+            return result;
         };
 
         let on_commit = txn.take_on_commit();
@@ -368,21 +535,51 @@ impl LoroDoc {
             txn.set_timestamp(timestamp);
         }
 
-        txn.commit().unwrap();
+        if let Some(msg) = config.commit_msg.filter(|x| !x.is_empty()) {
+            txn.set_msg(Some(msg.into()));
+        }
+
+        if let Some(author) = config.author {
+            txn.set_author(Some(author.into()));
+        }
+
+        if result.is_ok() {
+            txn.commit().unwrap();
+        } else {
+            txn.abort();
+        }
+
         if config.immediate_renew {
             let mut txn_guard = self.txn.try_lock().unwrap();
-            assert!(!self.detached.load(std::sync::atomic::Ordering::Acquire));
+            assert!(self.can_edit());
             *txn_guard = Some(self.txn().unwrap());
         }
 
         if let Some(on_commit) = on_commit {
             on_commit(&self.state);
         }
+
+        result
+    }
+
+    /// Set the hook called before a local change is committed.
+    ///
+    /// The hook receives the pending change and can reject it by returning an error, in which
+    /// case the change is rolled back. It's only called for the explicit commits of the auto
+    /// commit transaction, not for the implicit ones made by import, export or checkout.
+    /// There can be only one hook; setting a new one replaces the old one.
+    pub fn set_pre_commit_hook(&self, hook: PreCommitHook) {
+        *self.pre_commit_hook.lock().unwrap() = Some(hook);
+    }
+
+    /// Remove the pre-commit hook.
+    pub fn remove_pre_commit_hook(&self) {
+        *self.pre_commit_hook.lock().unwrap() = None;
     }
 
     #[inline]
     pub fn renew_txn_if_auto_commit(&self) {
-        if self.auto_commit.load(Acquire) && !self.detached.load(Acquire) {
+        if self.auto_commit.load(Acquire) && self.can_edit() {
             let mut self_txn = self.txn.try_lock().unwrap();
             if self_txn.is_some() {
                 return;
@@ -403,7 +600,7 @@ impl LoroDoc {
     /// The origin will be propagated to the events.
     /// There can only be one active transaction at a time for a [LoroDoc].
     pub fn txn_with_origin(&self, origin: &str) -> Result<Transaction, LoroError> {
-        if self.is_detached() {
+        if !self.can_edit() {
             return Err(LoroError::TransactionError(
                 String::from("LoroDoc is in detached mode. OpLog and AppState are using different version. So it's readonly.").into_boxed_str(),
             ));
@@ -417,6 +614,8 @@ impl LoroDoc {
         );
 
         let obs = self.observer.clone();
+        let oplog = self.oplog.clone();
+        let start_id = txn.next_id();
         txn.set_on_commit(Box::new(move |state| {
             let mut state = state.try_lock().unwrap();
             let events = state.take_events();
@@ -424,6 +623,19 @@ impl LoroDoc {
             for event in events {
                 obs.emit(event);
             }
+
+            if obs.has_local_ops_subscribers() {
+                // The ops of the txn are the ones of the peer after the start counter
+                let oplog = oplog.lock().unwrap();
+                let end_vv = oplog.vv().clone();
+                let mut start_vv = end_vv.clone();
+                start_vv.insert(start_id.peer, start_id.counter);
+                let json = crate::encoding::json_schema::export_json(&oplog, &start_vv, &end_vv);
+                drop(oplog);
+                if !json.changes.is_empty() {
+                    obs.emit_local_ops(&json);
+                }
+            }
         }));
 
         Ok(txn)
@@ -451,6 +663,51 @@ impl LoroDoc {
         ans
     }
 
+    /// Export the ops in `spans`, so that a peer can get exactly the ops it lacks.
+    ///
+    /// A blob can only contain one contiguous span of each peer, so multiple blobs are
+    /// returned if there are disjoint spans of the same peer. The blobs can be imported
+    /// in any order, e.g. by [LoroDoc::import_batch]. If a span only covers part of a
+    /// change, only that part is exported.
+    pub fn export_updates_in_spans(&self, spans: &[IdSpan]) -> Vec<Vec<u8>> {
+        self.commit_then_stop();
+        let ans = self.oplog.lock().unwrap().export_spans(spans);
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
+    /// Export the updates from `vv` into `writer`.
+    ///
+    /// The written bytes are identical to the output of [LoroDoc::export_from].
+    /// The body is written column by column, so the serialized blob is never in memory
+    /// as a whole. The columns themselves are still built for all the exported ops.
+    pub fn export_from_to(
+        &self,
+        vv: &VersionVector,
+        writer: &mut dyn std::io::Write,
+    ) -> std::io::Result<()> {
+        self.commit_then_stop();
+        let ans = self.oplog.lock().unwrap().export_from_to(vv, writer);
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
+    /// Export the updates that are in `to` but not in `from` into `writer`.
+    ///
+    /// There is only one span of each peer between two versions, so the written bytes are
+    /// one blob, the same as the output of [LoroDoc::export_updates_in_spans] for the spans.
+    pub fn export_updates_in_range_to(
+        &self,
+        from: &VersionVector,
+        to: &VersionVector,
+        writer: &mut dyn std::io::Write,
+    ) -> std::io::Result<()> {
+        self.commit_then_stop();
+        let ans = self.oplog.lock().unwrap().export_range_to(from, to, writer);
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
     #[inline(always)]
     #[instrument(skip_all)]
     pub fn import(&self, bytes: &[u8]) -> Result<(), LoroError> {
@@ -461,12 +718,225 @@ impl LoroDoc {
     pub fn import_with(&self, bytes: &[u8], origin: InternalString) -> Result<(), LoroError> {
         self.commit_then_stop();
         let ans = self._import_with(bytes, origin);
+        self.emit_events();
         self.renew_txn_if_auto_commit();
         ans
     }
 
+    /// Prepare the import of `bytes`, so that it can be applied by [LoroDoc::apply_import] later.
+    ///
+    /// If `bytes` is a snapshot and the doc is empty, the snapshot is decoded and the states
+    /// are built here, which is the expensive part of the import. It only locks the doc
+    /// briefly, so it can be called from another thread without blocking the doc.
+    /// Other data are only checked here and decoded when they are applied.
+    pub fn prepare_import(&self, bytes: &[u8]) -> LoroResult<PreparedImport> {
+        let parsed = parse_header_and_body(bytes)?;
+        if parsed.mode != EncodeMode::Snapshot || !self.can_reset_with_snapshot() {
+            return Ok(PreparedImport {
+                inner: PreparedImportInner::Bytes(bytes.to_vec()),
+            });
+        }
+
+        let base_len = self.arena.len_containers();
+        let arena = self.arena.fork();
+        let mut oplog = OpLog::new_with_arena(arena.clone(), self.config.clone());
+        let state = DocState::new_arc_with_peer(
+            arena.clone(),
+            Weak::new(),
+            self.config.clone(),
+            self.peer_id(),
+        );
+        let decoded = decode_snapshot_without_loading(
+            &mut oplog,
+            &mut state.try_lock().unwrap(),
+            parsed.mode,
+            parsed.body,
+        )?;
+        Ok(PreparedImport {
+            inner: PreparedImportInner::Snapshot {
+                arena,
+                base_len,
+                oplog,
+                decoded,
+            },
+        })
+    }
+
+    /// Apply the import prepared by [LoroDoc::prepare_import].
+    ///
+    /// The resulting state and the emitted events are the same as [LoroDoc::import].
+    /// If the doc has been changed since the import was prepared, the prepared snapshot
+    /// is imported as updates.
+    pub fn apply_import(&self, prepared: PreparedImport) -> LoroResult<()> {
+        self.commit_then_stop();
+        let ans = self._apply_import(prepared);
+        self.emit_events();
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
+    /// Calculate the diff that importing `bytes` would apply to the current state, without
+    /// changing the doc.
+    ///
+    /// The pending changes are found from the headers of the changes, and the oplog is only
+    /// copied when some of the changes would be applied to the state. Then the updates are
+    /// decoded into the copy, and the diff is applied to a temporary state that only contains
+    /// the affected containers. The changes whose deps are missing after the import, including
+    /// the ones already pending in the doc, are reported in [ImportPreview::pending]; they are
+    /// not included in the diff.
+    ///
+    /// If the doc is detached, the import doesn't change the state, so the diff is empty.
+    pub fn import_preview(&self, bytes: &[u8]) -> LoroResult<ImportPreview> {
+        let parsed = parse_header_and_body(bytes)?;
+        if parsed.mode.is_snapshot() && parsed.mode != EncodeMode::Snapshot {
+            let app = LoroDoc::new();
+            decode_snapshot(&app, parsed.mode, parsed.body)?;
+            let updates = app.export_from(&self.oplog_vv());
+            return self.import_preview(&updates);
+        }
+
+        self.commit_then_stop();
+        let ans = self._import_preview(parsed);
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
+    fn _import_preview(&self, parsed: ParsedHeaderAndBody<'_>) -> LoroResult<ImportPreview> {
+        let headers = decode_change_headers(parsed.body)?;
+        // Find the changes that would be applied and the ones that would be pending from
+        // their headers, so the oplog is only copied if the state would be changed
+        let (pending, can_apply) = {
+            let oplog = self.oplog.lock().unwrap();
+            let mut vv = oplog.vv().clone();
+            let mut rest: Vec<(IdSpan, Frontiers)> = oplog
+                .pending_changes
+                .iter()
+                .map(|c| (c.id_span(), c.deps.clone()))
+                .chain(headers.into_iter().map(|c| (c.span, c.deps)))
+                .filter(|(span, _)| span.counter.end > vv.get(&span.peer).copied().unwrap_or(0))
+                .collect();
+            loop {
+                let len = rest.len();
+                rest.retain(|(span, deps)| {
+                    let can_apply = span.counter.start <= vv.get(&span.peer).copied().unwrap_or(0)
+                        && deps.iter().all(|id| vv.includes_id(*id));
+                    if can_apply {
+                        vv.extend_to_include(*span);
+                    }
+
+                    !can_apply
+                });
+                if rest.len() == len {
+                    break;
+                }
+            }
+
+            let pending = merge_id_spans(rest.into_iter().map(|(span, _)| span).collect());
+            (pending, &vv != oplog.vv())
+        };
+        if !can_apply || self.is_detached() {
+            return Ok(ImportPreview {
+                diff: DiffBatch::default(),
+                pending,
+            });
+        }
+
+        // The diff of the new ops depends on the concurrent ops in the history, so they
+        // are decoded into a copy of the oplog
+        let (mut oplog, old_vv, old_frontiers) = {
+            let oplog = self.oplog.lock().unwrap();
+            let mut forked = oplog.fork(self.arena.fork(), self.config.fork());
+            forked.pending_changes = oplog.pending_changes.clone();
+            (forked, oplog.vv().clone(), oplog.frontiers().clone())
+        };
+        oplog.decode(parsed)?;
+
+        let diff = DiffCalculator::default().calc_diff_internal(
+            &oplog,
+            &old_vv,
+            Some(&old_frontiers),
+            oplog.vv(),
+            Some(oplog.dag.get_frontiers()),
+            None,
+        );
+        let containers: FxHashSet<_> = diff.iter().map(|d| d.idx).collect();
+        let state = self.state.lock().unwrap().fork_with_containers(
+            &containers,
+            oplog.arena.clone(),
+            oplog.configure.clone(),
+        );
+        let mut state = state.lock().unwrap();
+        state.start_recording();
+        state.apply_diff(InternalDocDiff {
+            origin: Default::default(),
+            diff: diff.into(),
+            by: EventTriggerKind::Import,
+            new_version: Cow::Owned(oplog.frontiers().clone()),
+        });
+        let events = state.take_events();
+        state.stop_and_clear_recording();
+        Ok(ImportPreview {
+            diff: DiffBatch::new(events),
+            pending,
+        })
+    }
+
+    fn _apply_import(&self, prepared: PreparedImport) -> LoroResult<()> {
+        let (arena, base_len, mut oplog, decoded) = match prepared.inner {
+            PreparedImportInner::Bytes(bytes) => {
+                return self._import_with(&bytes, Default::default())
+            }
+            PreparedImportInner::Snapshot {
+                arena,
+                base_len,
+                oplog,
+                decoded,
+            } => (arena, base_len, oplog, decoded),
+        };
+
+        let mut state = self.state.lock().unwrap();
+        let mut doc_oplog = self.oplog.lock().unwrap();
+        // The pending changes would be lost if the oplog were replaced
+        if !doc_oplog.is_empty()
+            || !doc_oplog.pending_changes.is_empty()
+            || !state.is_empty()
+            || state.is_in_txn()
+            || !self.arena.can_import_snapshot()
+            || self.arena.len_containers() != base_len
+        {
+            tracing::info!("Import prepared snapshot as updates");
+            let updates = oplog.export_from(doc_oplog.vv());
+            drop(doc_oplog);
+            drop(state);
+            return self._import_with(&updates, Default::default());
+        }
+
+        // The containers registered in the doc have the same indexes in the forked arena,
+        // so the arena can be replaced without invalidating the existing handlers.
+        oplog.set_arena(self.arena.clone());
+        self.arena.replace_with(arena);
+        *doc_oplog = oplog;
+        let DecodedSnapshot {
+            states,
+            frontiers,
+            unknown_containers,
+            ..
+        } = decoded;
+        state.init_with_states_and_version(states, frontiers, &doc_oplog, unknown_containers);
+        Ok(())
+    }
+
+    /// Import the data without emitting the events. The caller should emit them.
     fn _import_with(&self, bytes: &[u8], origin: InternalString) -> Result<(), LoroError> {
         let parsed = parse_header_and_body(bytes)?;
+        self.import_parsed(parsed, origin)
+    }
+
+    fn import_parsed(
+        &self,
+        parsed: ParsedHeaderAndBody<'_>,
+        origin: InternalString,
+    ) -> Result<(), LoroError> {
         match parsed.mode.is_snapshot() {
             false => {
                 if self.state.lock().unwrap().is_in_txn() {
@@ -502,12 +972,11 @@ impl LoroDoc {
                     let updates = app.export_from(oplog.vv());
                     drop(oplog);
 
-                    return self.import_with(&updates, origin);
+                    return self._import_with(&updates, origin);
                 }
             }
         };
 
-        self.emit_events();
         Ok(())
     }
 
@@ -598,6 +1067,21 @@ impl LoroDoc {
         }
     }
 
+    /// Merge the consecutive changes of each peer before `keep_since`, so that their adjacent
+    /// ops are coalesced and the history becomes smaller. It returns the number of the changes
+    /// merged into their previous changes.
+    ///
+    /// The ops keep their ids and contents, so the old versions can still be checked out and
+    /// the future concurrent changes can still be merged. The superseded map values are kept,
+    /// because dropping them would turn the ops into deletions for checkout, undo and the
+    /// peers importing them. Only the timestamps of the merged changes are lost.
+    pub fn compact_history(&self, keep_since: &Frontiers) -> LoroResult<usize> {
+        self.commit_then_stop();
+        let ans = self.oplog.lock().unwrap().compact_history(keep_since);
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
     #[instrument(skip_all)]
     pub fn export_snapshot(&self) -> Vec<u8> {
         self.commit_then_stop();
@@ -606,6 +1090,18 @@ impl LoroDoc {
         ans
     }
 
+    /// Export the snapshot into `writer`.
+    ///
+    /// The written bytes are identical to the output of [LoroDoc::export_snapshot].
+    /// Like [LoroDoc::export_from_to], it writes the body column by column.
+    #[instrument(skip_all)]
+    pub fn export_snapshot_to(&self, writer: &mut dyn std::io::Write) -> std::io::Result<()> {
+        self.commit_then_stop();
+        let ans = export_snapshot_to(self, writer);
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
     /// Import the json schema updates.
     ///
     /// only supports backward compatibility but not forward compatibility.
@@ -640,6 +1136,25 @@ impl LoroDoc {
         self.oplog.lock().unwrap().vv().clone()
     }
 
+    /// Create a sync request to be sent to another peer, which is the encoded version
+    /// of the oplog.
+    ///
+    /// The peer answers it by [LoroDoc::sync_response], and the response can be imported
+    /// directly.
+    pub fn sync_request(&self) -> Vec<u8> {
+        self.oplog_vv().encode()
+    }
+
+    /// Answer a sync request created by [LoroDoc::sync_request] with the updates the
+    /// requesting peer lacks.
+    ///
+    /// The two docs may have diverged, so this peer may lack some updates of the requesting
+    /// peer as well. Send a request from this peer too to sync both sides.
+    pub fn sync_response(&self, request: &[u8]) -> LoroResult<Vec<u8>> {
+        let vv = VersionVector::decode(request)?;
+        Ok(self.export_from(&vv))
+    }
+
     /// Get the version vector of the current [DocState]
     #[inline]
     pub fn state_vv(&self) -> VersionVector {
@@ -853,8 +1368,21 @@ impl LoroDoc {
 
     /// Calculate the diff between two versions so that apply diff on a will make the state same as b.
     ///
-    /// NOTE: This method will make the doc enter the **detached mode**.
+    /// `b` can be behind `a`. The doc is restored to its previous version and attached/detached
+    /// status afterwards, and no event is emitted.
     pub fn diff(&self, a: &Frontiers, b: &Frontiers) -> LoroResult<DiffBatch> {
+        self.with_diff_events(a, b, |_, e| DiffBatch::new(e))
+    }
+
+    /// Calculate the events from `a` to `b` and pass them to `f` while the doc state is at `b`.
+    ///
+    /// The doc is restored to its previous version and attached/detached status afterwards.
+    pub(crate) fn with_diff_events<R>(
+        &self,
+        a: &Frontiers,
+        b: &Frontiers,
+        f: impl FnOnce(&Self, Vec<DocDiff>) -> R,
+    ) -> LoroResult<R> {
         {
             // check whether a and b are valid
             let oplog = self.oplog.lock().unwrap();
@@ -871,18 +1399,34 @@ impl LoroDoc {
         }
 
         self.commit_then_stop();
+        let was_detached = self.is_detached();
+        let (was_recording, old_frontiers) = {
+            let mut state = self.state.lock().unwrap();
+            let was_recording = state.is_recording();
+            state.stop_and_clear_recording();
+            (was_recording, state.frontiers.clone())
+        };
 
         let ans = {
-            self.state.lock().unwrap().stop_and_clear_recording();
             self.checkout_without_emitting(a).unwrap();
             self.state.lock().unwrap().start_recording();
             self.checkout_without_emitting(b).unwrap();
-            let mut state = self.state.lock().unwrap();
-            let e = state.take_events();
-            state.stop_and_clear_recording();
-            DiffBatch::new(e)
+            let e = {
+                let mut state = self.state.lock().unwrap();
+                let e = state.take_events();
+                state.stop_and_clear_recording();
+                e
+            };
+            f(self, e)
         };
 
+        self.checkout_without_emitting(&old_frontiers).unwrap();
+        self.detached.store(was_detached, Release);
+        if was_recording {
+            self.state.lock().unwrap().start_recording();
+        }
+
+        self.renew_txn_if_auto_commit();
         Ok(ans)
     }
 
@@ -990,36 +1534,129 @@ impl LoroDoc {
         self.observer.subscribe(container_id, callback)
     }
 
+    /// Subscribe to the events of the container and its descendants.
+    ///
+    /// Unlike [LoroDoc::subscribe], the subscription is removed after the container is
+    /// deleted. The callback receives a final event with the diffs of the ancestors
+    /// that deleted the container.
+    pub fn subscribe_path(&self, container_id: &ContainerID, callback: Subscriber) -> SubID {
+        let mut state = self.state.lock().unwrap();
+        if !state.is_recording() {
+            state.start_recording();
+        }
+
+        let weak_state = Arc::downgrade(&self.state);
+        self.observer.subscribe_path(
+            container_id,
+            callback,
+            Arc::new(move |idx| match weak_state.upgrade() {
+                Some(state) => state.lock().unwrap().is_deleted(idx),
+                None => true,
+            }),
+        )
+    }
+
+    /// Subscribe to the containers that become unreachable from the root containers,
+    /// e.g. the child containers of a deleted list element, and to the ones that become
+    /// reachable again.
+    pub fn subscribe_orphaned(&self, callback: OrphanSubscriber) -> SubID {
+        {
+            let mut state = self.state.lock().unwrap();
+            if !state.is_recording() {
+                state.start_recording();
+            }
+        }
+
+        let weak_state = Arc::downgrade(&self.state);
+        self.observer.subscribe_orphaned(
+            callback,
+            Arc::new(move |idx| match weak_state.upgrade() {
+                Some(state) => state.lock().unwrap().is_deleted(idx),
+                None => true,
+            }),
+        )
+    }
+
+    /// Subscribe to the ops committed by the local peer.
+    ///
+    /// Unlike [LoroDoc::subscribe_root], the callback receives the ops themselves rather
+    /// than their effects on the state. It's called after each commit with the ops of the
+    /// change in the json schema, so they can be forwarded to another system and imported
+    /// by [LoroDoc::import_json_updates]. The imported and checked out changes are not reported.
+    pub fn subscribe_local_ops(&self, callback: LocalOpsSubscriber) -> SubID {
+        self.observer.subscribe_local_ops(callback)
+    }
+
     #[inline]
     pub fn unsubscribe(&self, id: SubID) {
         self.observer.unsubscribe(id);
     }
 
-    // PERF: opt
+    /// Import a batch of updates and snapshots.
+    ///
+    /// The blobs can be in arbitrary order. The state is only updated once after all of
+    /// them are imported into the [OpLog], so the subscribers receive a single event that
+    /// reflects the net change of the whole batch.
+    ///
+    /// The remaining blobs are still imported if one of them fails, and the last error is returned.
     pub fn import_batch(&self, bytes: &[Vec<u8>]) -> LoroResult<()> {
         self.commit_then_stop();
         let is_detached = self.is_detached();
         self.detach();
-        self.oplog.lock().unwrap().batch_importing = true;
         let mut err = None;
+        let mut blobs = Vec::with_capacity(bytes.len());
         for data in bytes.iter() {
-            match self.import(data) {
-                Ok(_) => {}
-                Err(e) => {
-                    err = Some(e);
-                }
+            match parse_header_and_body(data) {
+                Ok(parsed) => blobs.push(parsed),
+                Err(e) => err = Some(e),
+            }
+        }
+
+        // Import the snapshots first, so an empty doc can be initialized by a snapshot directly.
+        // It's done before batch importing, because the state needs the oplog frontiers.
+        blobs.sort_by_key(|x| !x.mode.is_snapshot());
+        let mut blobs = blobs.into_iter().peekable();
+        if self.can_reset_with_snapshot()
+            && matches!(blobs.peek(), Some(parsed) if parsed.mode.is_snapshot())
+        {
+            if let Err(e) = self.import_parsed(blobs.next().unwrap(), Default::default()) {
+                err = Some(e);
+            }
+        }
+
+        self.oplog.lock().unwrap().batch_importing = true;
+        for parsed in blobs {
+            if let Err(e) = self.import_parsed(parsed, Default::default()) {
+                err = Some(e);
             }
         }
 
         let mut oplog = self.oplog.lock().unwrap();
         oplog.batch_importing = false;
         oplog.dag.refresh_frontiers();
-        drop(oplog);
-
         if !is_detached {
-            self.checkout_to_latest();
+            let mut state = self.state.lock().unwrap();
+            let mut calc = self.diff_calculator.lock().unwrap();
+            let before = oplog.dag.frontiers_to_vv(&state.frontiers).unwrap();
+            let diff = calc.calc_diff_internal(
+                &oplog,
+                &before,
+                Some(&state.frontiers),
+                oplog.vv(),
+                Some(oplog.frontiers()),
+                None,
+            );
+            state.apply_diff(InternalDocDiff {
+                origin: Default::default(),
+                diff: Cow::Owned(diff),
+                by: EventTriggerKind::Import,
+                new_version: Cow::Owned(oplog.frontiers().clone()),
+            });
+            self.detached.store(false, Release);
         }
 
+        drop(oplog);
+        self.emit_events();
         self.renew_txn_if_auto_commit();
         if let Some(err) = err {
             return Err(err);
@@ -1034,12 +1671,76 @@ impl LoroDoc {
         self.state.lock().unwrap().get_deep_value()
     }
 
-    /// Get deep value of the document with container id
+    /// Get deep value of the document with container id.
+    ///
+    /// Each container is represented by `{ "cid": <container id>, "value": <deep value> }`.
     #[inline]
     pub fn get_deep_value_with_id(&self) -> LoroValue {
         self.state.lock().unwrap().get_deep_value_with_id()
     }
 
+    /// Get the value of a container at the given version without checking out the doc.
+    ///
+    /// Only the ops of the container included by `frontiers` are used to build a temporary
+    /// state of the container, so the doc state is not changed and the handlers of the
+    /// container still operate on the current version. The value is shallow: the child
+    /// containers are represented by their ids.
+    ///
+    /// It returns [LoroError::NotFoundError] if the container is unknown to the doc.
+    pub fn get_container_value_at(
+        &self,
+        id: &ContainerID,
+        frontiers: &Frontiers,
+    ) -> LoroResult<LoroValue> {
+        self.commit_then_stop();
+        let ans = self._get_container_value_at(id, frontiers);
+        self.renew_txn_if_auto_commit();
+        ans
+    }
+
+    pub(crate) fn _get_container_value_at(
+        &self,
+        id: &ContainerID,
+        frontiers: &Frontiers,
+    ) -> LoroResult<LoroValue> {
+        let oplog = self.oplog.lock().unwrap();
+        if let Some(id) = frontiers.iter().find(|id| !oplog.dag.contains(**id)) {
+            return Err(LoroError::FrontiersNotFound(*id));
+        }
+
+        let vv = oplog.dag.frontiers_to_vv(frontiers).unwrap();
+        let Some(idx) = self.arena.id_to_idx(id) else {
+            return Err(LoroError::NotFoundError(
+                format!("Cannot find the container {:?}", id).into_boxed_str(),
+            ));
+        };
+        let diff = DiffCalculator::default().calc_diff_internal(
+            &oplog,
+            &Default::default(),
+            None,
+            &vv,
+            Some(frontiers),
+            Some(&|x| x == idx),
+        );
+        let mut state = self.state.lock().unwrap().create_state(idx);
+        for d in diff {
+            if d.idx != idx {
+                continue;
+            }
+
+            if let Some(diff) = d.diff.into_internal() {
+                state.apply_diff(
+                    diff,
+                    &self.arena,
+                    &Arc::downgrade(&self.txn),
+                    &Arc::downgrade(&self.state),
+                );
+            }
+        }
+
+        Ok(state.get_value())
+    }
+
     pub fn checkout_to_latest(&self) {
         if !self.is_detached() {
             self.commit_then_renew();
@@ -1047,6 +1748,8 @@ impl LoroDoc {
         }
 
         tracing::info_span!("CheckoutToLatest", peer = self.peer_id()).in_scope(|| {
+            // the pending edits in detached mode should be included
+            self.commit_then_stop();
             let f = self.oplog_frontiers();
             self.checkout(&f).unwrap();
             self.detached.store(false, Release);
@@ -1061,11 +1764,45 @@ impl LoroDoc {
     pub fn checkout(&self, frontiers: &Frontiers) -> LoroResult<()> {
         self.checkout_without_emitting(frontiers)?;
         self.emit_events();
+        if self.config.detached_editing() {
+            self.renew_peer_id_if_behind();
+            self.renew_txn_if_auto_commit();
+        }
+
         Ok(())
     }
 
+    /// Checkout to the version, call `f`, and then restore the version and the attachment
+    /// the doc had before, even if `f` panics.
+    ///
+    /// It can be nested; the inner call restores the version checked out by the outer one.
+    /// If the frontiers are not in the oplog, [LoroError::FrontiersNotFound] is returned
+    /// without calling `f` or changing the doc.
+    pub fn with_version<R>(
+        &self,
+        frontiers: &Frontiers,
+        f: impl FnOnce(&LoroDoc) -> R,
+    ) -> LoroResult<R> {
+        // the pending edits should be included in the version to restore
+        self.commit_then_renew();
+        {
+            let oplog = self.oplog.lock().unwrap();
+            if let Some(&id) = frontiers.iter().find(|id| !oplog.dag.contains(**id)) {
+                return Err(LoroError::FrontiersNotFound(id));
+            }
+        }
+
+        let _guard = VersionGuard {
+            doc: self,
+            was_detached: self.is_detached(),
+            frontiers: self.state_frontiers(),
+        };
+        self.checkout(frontiers)?;
+        Ok(f(self))
+    }
+
     #[instrument(level = "info", skip(self))]
-    fn checkout_without_emitting(&self, frontiers: &Frontiers) -> Result<(), LoroError> {
+    pub(crate) fn checkout_without_emitting(&self, frontiers: &Frontiers) -> Result<(), LoroError> {
         self.commit_then_stop();
         let oplog = self.oplog.lock().unwrap();
         let mut state = self.state.lock().unwrap();
@@ -1136,6 +1873,109 @@ impl LoroDoc {
         oplog.len_changes()
     }
 
+    /// Get the per-peer and per-container storage statistics of the history.
+    ///
+    /// Ops in the pending transaction are not counted.
+    #[inline]
+    pub fn analyze(&self) -> DocStats {
+        let oplog = self.oplog.lock().unwrap();
+        oplog.analyze()
+    }
+
+    /// Get the approximate memory usage of the doc.
+    ///
+    /// It sums the sizes of the in-memory structures by the numbers of their elements,
+    /// without encoding anything. The undo managers are owned by the callers, so they
+    /// are not included.
+    pub fn memory_usage(&self) -> MemoryStats {
+        let mut ans = {
+            let oplog = self.oplog.lock().unwrap();
+            MemoryStats {
+                oplog: oplog.estimate_changes_size(),
+                dag: oplog.dag.estimate_size(),
+                op_groups: oplog.op_groups.estimate_size(),
+                pending_changes: oplog.pending_changes.estimate_size(),
+                arena: self.arena.estimate_size(),
+                ..Default::default()
+            }
+        };
+        {
+            let state = self.state.lock().unwrap();
+            ans.state = state.estimate_state_size();
+            ans.diff = state.estimate_recorded_events_size();
+        }
+        ans.diff += self.diff_calculator.lock().unwrap().estimate_size();
+        ans
+    }
+
+    /// Get the commit message of the change that contains `id`.
+    ///
+    /// It returns `None` if the change has no message or `id` is not in the oplog.
+    pub fn change_message(&self, id: ID) -> Option<Arc<str>> {
+        let oplog = self.oplog.lock().unwrap();
+        oplog.get_change_at(id).and_then(|c| c.commit_msg.clone())
+    }
+
+    /// Get the author of the change that contains `id`.
+    ///
+    /// It returns `None` if the change has no author or `id` is not in the oplog.
+    pub fn change_author(&self, id: ID) -> Option<Arc<str>> {
+        let oplog = self.oplog.lock().unwrap();
+        oplog.get_change_at(id).and_then(|c| c.author.clone())
+    }
+
+    /// Get the metadata of the changes that are included by `to` but not by `from`.
+    ///
+    /// The changes are sorted by their lamports, so a change always comes after its deps.
+    /// If a change is only partially included, the included part is returned.
+    pub fn get_changes_in_range(
+        &self,
+        from: &Frontiers,
+        to: &Frontiers,
+    ) -> LoroResult<Vec<ChangeMeta>> {
+        self.commit_then_renew();
+        let oplog = self.oplog.lock().unwrap();
+        if let Some(id) = from
+            .iter()
+            .chain(to.iter())
+            .find(|id| !oplog.dag.contains(**id))
+        {
+            return Err(LoroError::FrontiersNotFound(*id));
+        }
+
+        let from_vv = oplog.dag.frontiers_to_vv(from).unwrap();
+        let to_vv = oplog.dag.frontiers_to_vv(to).unwrap();
+        let mut ans = Vec::new();
+        for span in to_vv.sub_iter(&from_vv) {
+            let peer_changes = oplog.changes().get(&span.peer).unwrap();
+            let index = peer_changes.search_atom_index(span.counter.start);
+            for change in peer_changes[index..]
+                .iter()
+                .take_while(|c| c.ctr_start() < span.counter.end)
+            {
+                let start = change.ctr_start().max(span.counter.start);
+                let end = change.ctr_end().min(span.counter.end);
+                let offset = start - change.ctr_start();
+                ans.push(ChangeMeta {
+                    id: ID::new(span.peer, start),
+                    len: (end - start) as usize,
+                    lamport: change.lamport + offset as Lamport,
+                    timestamp: change.timestamp,
+                    deps: if offset > 0 {
+                        Frontiers::from_id(ID::new(span.peer, start - 1))
+                    } else {
+                        change.deps.clone()
+                    },
+                    message: change.commit_msg.clone(),
+                    author: change.author.clone(),
+                });
+            }
+        }
+
+        ans.sort_by_key(|c| (c.lamport, c.id.peer));
+        Ok(ans)
+    }
+
     pub fn config(&self) -> &Configure {
         &self.config
     }
@@ -1188,12 +2028,24 @@ impl LoroDoc {
     ) -> Result<PosQueryResult, CannotFindRelativePosition> {
         let mut state = self.state.lock().unwrap();
         if let Some(ans) = state.get_relative_position(pos, ret_event_index) {
+            // `origin_pos` of text cursors uses unicode index
+            let origin_pos =
+                if ret_event_index && pos.container.container_type() == ContainerType::Text {
+                    state.get_relative_position(pos, false)
+                } else {
+                    Some(ans)
+                };
             Ok(PosQueryResult {
                 update: None,
                 current: AbsolutePosition {
                     pos: ans,
                     side: pos.side,
                 },
+                status: if origin_pos == Some(pos.origin_pos) {
+                    CursorStatus::Exact
+                } else {
+                    CursorStatus::Shifted
+                },
             })
         } else {
             // We need to trace back to the version where the relative position is valid.
@@ -1245,6 +2097,7 @@ impl LoroDoc {
                                 pos: current_pos,
                                 side: c.side,
                             },
+                            status: CursorStatus::Deleted,
                         })
                     }
                     crate::diff_calc::ContainerDiffCalculator::List(list) => {
@@ -1257,6 +2110,7 @@ impl LoroDoc {
                                 pos: new_pos,
                                 side: c.side,
                             },
+                            status: CursorStatus::Deleted,
                         })
                     }
                     crate::diff_calc::ContainerDiffCalculator::MovableList(list) => {
@@ -1270,6 +2124,7 @@ impl LoroDoc {
                                 pos: new_pos,
                                 side: c.side,
                             },
+                            status: CursorStatus::Deleted,
                         })
                     }
                     crate::diff_calc::ContainerDiffCalculator::Tree(_) => unreachable!(),
@@ -1293,6 +2148,11 @@ impl LoroDoc {
                                 pos: text.len_event(),
                                 side: pos.side,
                             },
+                            status: if text.len_unicode() == pos.origin_pos {
+                                CursorStatus::Exact
+                            } else {
+                                CursorStatus::Shifted
+                            },
                         })
                     }
                     ContainerType::List => {
@@ -1308,6 +2168,11 @@ impl LoroDoc {
                                 pos: list.len(),
                                 side: pos.side,
                             },
+                            status: if list.len() == pos.origin_pos {
+                                CursorStatus::Exact
+                            } else {
+                                CursorStatus::Shifted
+                            },
                         })
                     }
                     ContainerType::MovableList => {
@@ -1323,6 +2188,11 @@ impl LoroDoc {
                                 pos: list.len(),
                                 side: pos.side,
                             },
+                            status: if list.len() == pos.origin_pos {
+                                CursorStatus::Exact
+                            } else {
+                                CursorStatus::Shifted
+                            },
                         })
                     }
                     ContainerType::Map | ContainerType::Tree | ContainerType::Unknown(_) => {
@@ -1366,12 +2236,164 @@ impl<'a> Drop for CommitWhenDrop<'a> {
     }
 }
 
+/// Restore the version and the attachment of the doc when dropped, see [LoroDoc::with_version].
+struct VersionGuard<'a> {
+    doc: &'a LoroDoc,
+    was_detached: bool,
+    frontiers: Frontiers,
+}
+
+impl<'a> Drop for VersionGuard<'a> {
+    fn drop(&mut self) {
+        if !self.was_detached {
+            self.doc.attach();
+        } else if let Err(err) = self.doc.checkout(&self.frontiers) {
+            tracing::error!(
+                "Failed to restore the version {:?}: {}",
+                self.frontiers,
+                err
+            );
+        }
+    }
+}
+
+/// The import prepared by [LoroDoc::prepare_import].
+pub struct PreparedImport {
+    inner: PreparedImportInner,
+}
+
+enum PreparedImportInner {
+    /// A snapshot decoded for an empty doc
+    Snapshot {
+        arena: SharedArena,
+        /// The number of the containers in the doc when the import is prepared
+        base_len: usize,
+        oplog: OpLog,
+        decoded: DecodedSnapshot,
+    },
+    /// The data that will be decoded when they are applied
+    Bytes(Vec<u8>),
+}
+
+impl std::fmt::Debug for PreparedImport {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let kind = match &self.inner {
+            PreparedImportInner::Snapshot { .. } => "Snapshot",
+            PreparedImportInner::Bytes(_) => "Bytes",
+        };
+        f.debug_struct("PreparedImport")
+            .field("kind", &kind)
+            .finish()
+    }
+}
+
+/// The approximate memory usage of a doc in bytes, returned by [LoroDoc::memory_usage].
+///
+/// The sizes are estimated from the numbers of the elements in each structure, so they
+/// don't include the unused capacity or the overhead of the allocator.
+#[derive(Debug, Clone, Default)]
+pub struct MemoryStats {
+    /// The changes and ops of the history
+    pub oplog: usize,
+    /// The causal graph of the changes, used to compare and convert versions
+    pub dag: usize,
+    /// The ops grouped by map, tree and movable list containers, used to resolve
+    /// concurrent edits
+    pub op_groups: usize,
+    /// The imported changes waiting for their missing deps
+    pub pending_changes: usize,
+    /// The container ids, strings and values shared by the history and the state
+    pub arena: usize,
+    /// The current state of each type of container
+    pub state: FxHashMap<ContainerType, usize>,
+    /// The cached diff calculators and the recorded events that are not emitted yet
+    pub diff: usize,
+    /// The undo and redo stacks. The doc doesn't own its undo managers, so it's 0 in
+    /// [LoroDoc::memory_usage]; add [crate::UndoManager::memory_usage] of each manager to it.
+    pub undo: usize,
+}
+
+impl MemoryStats {
+    /// The memory used by the history, which grows with the number of the ops.
+    pub fn history(&self) -> usize {
+        self.oplog + self.dag + self.op_groups + self.pending_changes
+    }
+
+    /// The memory used by the current state, which grows with the size of the doc.
+    pub fn total_state(&self) -> usize {
+        self.state.values().sum()
+    }
+
+    /// The total memory usage.
+    pub fn total(&self) -> usize {
+        self.history() + self.arena + self.total_state() + self.diff + self.undo
+    }
+}
+
+/// The metadata of a change, returned by [LoroDoc::get_changes_in_range].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ChangeMeta {
+    /// The id of the first op of the change
+    pub id: ID,
+    /// The number of the atom ops in the change
+    pub len: usize,
+    /// The lamport of the first op of the change
+    pub lamport: Lamport,
+    /// The unix time when the change was committed, or 0 if timestamps are not recorded
+    pub timestamp: Timestamp,
+    /// The ops that the change depends on
+    pub deps: Frontiers,
+    /// The message attached by [CommitOptions::commit_msg]
+    pub message: Option<Arc<str>>,
+    /// The author set by [CommitOptions::author]
+    pub author: Option<Arc<str>>,
+}
+
+impl ChangeMeta {
+    /// The ops of the change.
+    pub fn id_span(&self) -> IdSpan {
+        IdSpan::new(
+            self.id.peer,
+            self.id.counter,
+            self.id.counter + self.len as Counter,
+        )
+    }
+}
+
+/// Sort the spans and merge the overlapping spans of each peer.
+fn merge_id_spans(mut spans: Vec<IdSpan>) -> Vec<IdSpan> {
+    spans.sort_unstable_by_key(|x| (x.peer, x.counter.start));
+    let mut ans: Vec<IdSpan> = Vec::with_capacity(spans.len());
+    for span in spans {
+        match ans.last_mut() {
+            Some(last) if last.peer == span.peer && span.counter.start <= last.counter.end => {
+                last.counter.end = last.counter.end.max(span.counter.end);
+            }
+            _ => ans.push(span),
+        }
+    }
+
+    ans
+}
+
+/// The result of [LoroDoc::import_preview].
+#[derive(Debug, Clone)]
+pub struct ImportPreview {
+    /// The diff that the import would apply to the current state
+    pub diff: DiffBatch,
+    /// The changes that would be waiting for their missing deps after the import
+    pub pending: Vec<IdSpan>,
+}
+
 #[derive(Debug, Clone)]
 pub struct CommitOptions {
     origin: Option<InternalString>,
     immediate_renew: bool,
     timestamp: Option<Timestamp>,
     commit_msg: Option<Box<str>>,
+    author: Option<Box<str>>,
+    /// Whether it's an implicit commit, e.g. before an import, which skips the pre-commit hook
+    implicit: bool,
 }
 
 impl CommitOptions {
@@ -1381,9 +2403,16 @@ impl CommitOptions {
             immediate_renew: true,
             timestamp: None,
             commit_msg: None,
+            author: None,
+            implicit: false,
         }
     }
 
+    pub(crate) fn implicit(mut self) -> Self {
+        self.implicit = true;
+        self
+    }
+
     pub fn origin(mut self, origin: &str) -> Self {
         self.origin = Some(origin.into());
         self
@@ -1399,11 +2428,25 @@ impl CommitOptions {
         self
     }
 
+    /// Attach a message to the change. An empty message is ignored.
+    ///
+    /// The message is kept in the exported updates and snapshots, and it can be read by
+    /// [LoroDoc::change_message]. A change with a message is not merged with the other
+    /// changes.
     pub fn commit_msg(mut self, commit_msg: &str) -> Self {
         self.commit_msg = Some(commit_msg.into());
         self
     }
 
+    /// Set the author of the change, which can be read by [LoroDoc::change_author].
+    ///
+    /// Like the commit message, it's kept in the exported updates and snapshots. The
+    /// consecutive changes of a peer are only merged if they have the same author.
+    pub fn author(mut self, author: &str) -> Self {
+        self.author = Some(author.into());
+        self
+    }
+
     pub fn set_origin(&mut self, origin: Option<&str>) {
         self.origin = origin.map(|x| x.into())
     }
@@ -1411,6 +2454,14 @@ impl CommitOptions {
     pub fn set_timestamp(&mut self, timestamp: Option<Timestamp>) {
         self.timestamp = timestamp;
     }
+
+    pub fn set_commit_msg(&mut self, commit_msg: Option<&str>) {
+        self.commit_msg = commit_msg.map(|x| x.into())
+    }
+
+    pub fn set_author(&mut self, author: Option<&str>) {
+        self.author = author.map(|x| x.into())
+    }
 }
 
 impl Default for CommitOptions {
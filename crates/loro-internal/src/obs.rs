@@ -8,7 +8,7 @@ use itertools::Itertools;
 use loro_common::ContainerID;
 use smallvec::SmallVec;
 
-use crate::{container::idx::ContainerIdx, ContainerDiff};
+use crate::{container::idx::ContainerIdx, ContainerDiff, JsonSchema};
 
 use super::{
     arena::SharedArena,
@@ -16,12 +16,48 @@ use super::{
 };
 
 pub type Subscriber = Arc<dyn (for<'a> Fn(DiffEvent<'a>)) + Send + Sync>;
+/// Check whether the given container is deleted from the document
+pub(crate) type DeletionChecker = Arc<dyn Fn(ContainerIdx) -> bool + Send + Sync>;
+/// A subscriber to the containers that become orphaned or revived, see [OrphanEvent]
+pub type OrphanSubscriber = Arc<dyn Fn(&OrphanEvent) + Send + Sync>;
+/// A subscriber to the ops committed by the local peer.
+///
+/// It receives the ops of each committed change in the json schema, which can be
+/// imported by [crate::LoroDoc::import_json_updates].
+pub type LocalOpsSubscriber = Arc<dyn Fn(&JsonSchema) + Send + Sync>;
+
+/// The containers whose reachability from the root containers is changed by an event.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct OrphanEvent {
+    /// The containers that become unreachable
+    pub orphaned: Vec<ContainerID>,
+    /// The orphaned containers that become reachable again,
+    /// e.g. by undo or by checking out an earlier version
+    pub revived: Vec<ContainerID>,
+}
+
+impl OrphanEvent {
+    pub fn is_empty(&self) -> bool {
+        self.orphaned.is_empty() && self.revived.is_empty()
+    }
+}
+
+#[derive(Default)]
+struct OrphanTracker {
+    subscribers: FxHashMap<SubID, OrphanSubscriber>,
+    /// The containers that are unreachable now
+    orphaned: FxHashSet<ContainerIdx>,
+    is_deleted: Option<DeletionChecker>,
+}
 
 #[derive(Default)]
 struct ObserverInner {
     subscribers: FxHashMap<SubID, Subscriber>,
     containers: FxHashMap<ContainerIdx, FxHashSet<SubID>>,
     root: FxHashSet<SubID>,
+    /// The subscriptions created by [Observer::subscribe_path], which are
+    /// removed once the target container is deleted
+    paths: FxHashMap<SubID, (ContainerIdx, DeletionChecker)>,
     deleted: FxHashSet<SubID>,
     event_queue: Vec<DocDiff>,
 }
@@ -41,6 +77,8 @@ impl SubID {
 
 pub struct Observer {
     inner: Mutex<ObserverInner>,
+    orphans: Mutex<OrphanTracker>,
+    local_ops: Mutex<FxHashMap<SubID, LocalOpsSubscriber>>,
     arena: SharedArena,
     next_sub_id: AtomicU32,
     taken_times: AtomicUsize,
@@ -61,10 +99,13 @@ impl Observer {
             arena,
             next_sub_id: AtomicU32::new(0),
             taken_times: AtomicUsize::new(0),
+            orphans: Default::default(),
+            local_ops: Default::default(),
             inner: Mutex::new(ObserverInner {
                 subscribers: Default::default(),
                 containers: Default::default(),
                 root: Default::default(),
+                paths: Default::default(),
                 deleted: Default::default(),
                 event_queue: Default::default(),
             }),
@@ -80,6 +121,77 @@ impl Observer {
         sub_id
     }
 
+    /// Subscribe to the events of the container and its descendants.
+    ///
+    /// When the container is deleted, the subscriber receives a final event with
+    /// the diffs of its ancestors that removed it, and then it's unsubscribed.
+    pub(crate) fn subscribe_path(
+        &self,
+        id: &ContainerID,
+        callback: Subscriber,
+        is_deleted: DeletionChecker,
+    ) -> SubID {
+        let idx = self.arena.register_container(id);
+        let sub_id = self.fetch_add_next_id();
+        let mut inner = self.inner.lock().unwrap();
+        inner.subscribers.insert(sub_id, callback);
+        inner.containers.entry(idx).or_default().insert(sub_id);
+        inner.paths.insert(sub_id, (idx, is_deleted));
+        sub_id
+    }
+
+    /// Subscribe to the containers that become unreachable or reachable again.
+    ///
+    /// The containers that are already unreachable when the first subscriber is added
+    /// are not reported.
+    pub(crate) fn subscribe_orphaned(
+        &self,
+        callback: OrphanSubscriber,
+        is_deleted: DeletionChecker,
+    ) -> SubID {
+        let sub_id = self.fetch_add_next_id();
+        let mut orphans = self.orphans.lock().unwrap();
+        if orphans.is_deleted.is_none() {
+            orphans.orphaned = self
+                .arena
+                .export_containers()
+                .into_iter()
+                .enumerate()
+                .filter(|(_, id)| !id.is_root())
+                .map(|(i, id)| ContainerIdx::from_index_and_type(i as u32, id.container_type()))
+                .filter(|idx| self.arena.get_parent(*idx).is_some() && is_deleted(*idx))
+                .collect();
+            orphans.is_deleted = Some(is_deleted);
+        }
+        orphans.subscribers.insert(sub_id, callback);
+        sub_id
+    }
+
+    /// Subscribe to the ops committed by the local peer.
+    pub(crate) fn subscribe_local_ops(&self, callback: LocalOpsSubscriber) -> SubID {
+        let sub_id = self.fetch_add_next_id();
+        self.local_ops.lock().unwrap().insert(sub_id, callback);
+        sub_id
+    }
+
+    pub(crate) fn has_local_ops_subscribers(&self) -> bool {
+        !self.local_ops.lock().unwrap().is_empty()
+    }
+
+    pub(crate) fn emit_local_ops(&self, ops: &JsonSchema) {
+        // The subscribers are cloned so that they can subscribe or unsubscribe in the callback
+        let subscribers = self
+            .local_ops
+            .lock()
+            .unwrap()
+            .values()
+            .cloned()
+            .collect_vec();
+        for subscriber in subscribers {
+            subscriber(ops);
+        }
+    }
+
     pub fn subscribe_root(&self, callback: Subscriber) -> SubID {
         let sub_id = self.fetch_add_next_id();
         let mut inner = self.inner.lock().unwrap();
@@ -141,6 +253,10 @@ impl Observer {
             }
         }
 
+        if !inner.paths.is_empty() {
+            self.emit_path_deletions(doc_diff, inner);
+        }
+
         if !inner.root.is_empty() {
             let events = doc_diff.diff.iter().collect_vec();
             inner
@@ -158,6 +274,102 @@ impl Observer {
                     None => false,
                 })
         }
+
+        self.emit_orphan_changes(doc_diff);
+    }
+
+    /// Notify the orphan subscribers about the containers detached or re-attached by `doc_diff`.
+    ///
+    /// Only the descendants of the changed containers can be affected, so only they are checked.
+    fn emit_orphan_changes(&self, doc_diff: &DocDiff) {
+        let is_deleted = {
+            let orphans = self.orphans.lock().unwrap();
+            let Some(is_deleted) = orphans.is_deleted.clone() else {
+                return;
+            };
+            if orphans.subscribers.is_empty() || doc_diff.diff.is_empty() {
+                return;
+            }
+
+            is_deleted
+        };
+
+        let mut affected: FxHashSet<ContainerIdx> = FxHashSet::default();
+        for d in doc_diff.diff.iter() {
+            affected.extend(self.arena.get_descendants(d.idx));
+        }
+        if affected.is_empty() {
+            return;
+        }
+
+        // The checker reads the doc state, so it's called without holding the lock
+        let affected = affected
+            .into_iter()
+            .map(|idx| (idx, is_deleted(idx)))
+            .collect_vec();
+        let mut event = OrphanEvent::default();
+        let subscribers = {
+            let mut orphans = self.orphans.lock().unwrap();
+            for (idx, deleted) in affected {
+                match (orphans.orphaned.contains(&idx), deleted) {
+                    (false, true) => {
+                        orphans.orphaned.insert(idx);
+                        event.orphaned.extend(self.arena.get_container_id(idx));
+                    }
+                    (true, false) => {
+                        orphans.orphaned.remove(&idx);
+                        event.revived.extend(self.arena.get_container_id(idx));
+                    }
+                    _ => {}
+                }
+            }
+
+            if event.is_empty() {
+                return;
+            }
+
+            orphans.subscribers.values().cloned().collect_vec()
+        };
+
+        for f in subscribers {
+            f(&event);
+        }
+    }
+
+    /// Send the final events to the path subscribers whose target is deleted by `doc_diff`.
+    fn emit_path_deletions(&self, doc_diff: &DocDiff, inner: &mut ObserverInner) {
+        let ObserverInner {
+            subscribers, paths, ..
+        } = inner;
+        paths.retain(|sub, (idx, is_deleted)| {
+            let Some(f) = subscribers.get(sub) else {
+                return false;
+            };
+
+            // The container can only be deleted by the diffs on its ancestors
+            let mut ancestors = FxHashSet::default();
+            self.arena.with_ancestors(*idx, |ancestor, is_self| {
+                if !is_self {
+                    ancestors.insert(ancestor);
+                }
+            });
+            let events: SmallVec<[&ContainerDiff; 1]> = doc_diff
+                .diff
+                .iter()
+                .filter(|d| ancestors.contains(&d.idx))
+                .collect();
+            if events.is_empty() || !is_deleted(*idx) {
+                return true;
+            }
+
+            (f)(DiffEvent {
+                current_target: Some(self.arena.get_container_id(*idx).unwrap()),
+                events: &events,
+                event_meta: doc_diff,
+            });
+            subscribers.remove(sub);
+            false
+        });
     }
 
     fn take_inner(&self) -> ObserverInner {
@@ -187,6 +399,12 @@ impl Observer {
                 }
             }
 
+            if !inner_guard.paths.is_empty() {
+                for (key, value) in std::mem::take(&mut inner_guard.paths) {
+                    inner.paths.insert(key, value);
+                }
+            }
+
             if !inner_guard.subscribers.is_empty() {
                 for (key, value) in std::mem::take(&mut inner_guard.subscribers) {
                     inner.subscribers.insert(key, value);
@@ -230,6 +448,8 @@ impl Observer {
     }
 
     pub fn unsubscribe(&self, sub_id: SubID) {
+        self.orphans.lock().unwrap().subscribers.remove(&sub_id);
+        self.local_ops.lock().unwrap().remove(&sub_id);
         let mut inner = self.inner.try_lock().unwrap();
         inner.subscribers.remove(&sub_id);
         if self.is_taken() {
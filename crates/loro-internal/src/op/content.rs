@@ -67,7 +67,7 @@ impl InnerContent {
 #[derive(EnumAsInner, Debug, Clone)]
 pub enum FutureInnerContent {
     #[cfg(feature = "counter")]
-    Counter(f64),
+    Counter(CounterDelta),
     Unknown {
         prop: i32,
         value: OwnedValue,
@@ -82,13 +82,34 @@ pub enum RawOpContent<'a> {
     List(ListOp<'a>),
     Tree(TreeOp),
     #[cfg(feature = "counter")]
-    Counter(f64),
+    Counter(CounterDelta),
     Unknown {
         prop: i32,
         value: OwnedValue,
     },
 }
 
+/// The amount of a counter op.
+///
+/// The integers are summed up exactly, so an integer counter doesn't lose precision past 2^53.
+#[cfg(feature = "counter")]
+#[derive(Debug, Clone, Copy, PartialEq)]
+#[cfg_attr(feature = "wasm", derive(Serialize, Deserialize,))]
+pub enum CounterDelta {
+    Float(f64),
+    Int(i64),
+}
+
+#[cfg(feature = "counter")]
+impl CounterDelta {
+    pub fn to_f64(self) -> f64 {
+        match self {
+            CounterDelta::Float(x) => x,
+            CounterDelta::Int(x) => x as f64,
+        }
+    }
+}
+
 impl<'a> Clone for RawOpContent<'a> {
     fn clone(&self) -> Self {
         match self {
@@ -10,16 +10,22 @@ use std::rc::Rc;
 
 use crate::change::{get_sys_timestamp, Change, Lamport, Timestamp};
 use crate::configure::Configure;
+use crate::container::idx::ContainerIdx;
 use crate::container::list::list_op;
+use crate::container::ContainerID;
 use crate::dag::{Dag, DagUtils};
 use crate::encoding::ParsedHeaderAndBody;
-use crate::encoding::{decode_oplog, encode_oplog, EncodeMode};
+use crate::encoding::{
+    decode_oplog, encode_oplog, encode_oplog_range_to, encode_oplog_spans, encode_oplog_to,
+    EncodeMode,
+};
 use crate::group::OpGroups;
 use crate::id::{Counter, PeerID, ID};
-use crate::op::{FutureInnerContent, ListSlice, Op, RawOpContent, RemoteOp, RichOp};
+use crate::op::{FutureInnerContent, InnerContent, ListSlice, Op, RawOpContent, RemoteOp, RichOp};
 use crate::span::{HasCounterSpan, HasIdSpan, HasLamportSpan};
 use crate::version::{Frontiers, ImVersionVector, VersionVector};
 use crate::LoroError;
+use crate::LoroValue;
 use fxhash::FxHashMap;
 use loro_common::{HasCounter, HasId, IdLp, IdSpan};
 use rle::{HasLength, RleCollection, RlePush, RleVec, Sliceable};
@@ -96,6 +102,21 @@ impl OpLog {
 }
 
 impl AppDag {
+    /// The approximate memory usage of the dag in bytes.
+    ///
+    /// The version vectors of the nodes share most of their content, so only the size of
+    /// the handles is counted.
+    pub(crate) fn estimate_size(&self) -> usize {
+        self.map
+            .values()
+            .flat_map(|x| x.iter())
+            .map(|node| {
+                std::mem::size_of::<AppDagNode>() + node.deps.len() * std::mem::size_of::<ID>()
+            })
+            .sum::<usize>()
+            + self.vv.len() * std::mem::size_of::<(PeerID, Counter)>()
+    }
+
     pub fn get_mut(&mut self, id: ID) -> Option<&mut AppDagNode> {
         let ID {
             peer: client_id,
@@ -171,7 +192,10 @@ pub(crate) struct EnsureChangeDepsAreAtTheEnd;
 impl OpLog {
     #[inline]
     pub(crate) fn new() -> Self {
-        let arena = SharedArena::new();
+        Self::new_with_arena(SharedArena::new(), Configure::default())
+    }
+
+    pub(crate) fn new_with_arena(arena: SharedArena, configure: Configure) -> Self {
         Self {
             dag: AppDag::default(),
             op_groups: OpGroups::new(arena.clone()),
@@ -181,10 +205,16 @@ impl OpLog {
             latest_timestamp: Timestamp::default(),
             pending_changes: Default::default(),
             batch_importing: false,
-            configure: Configure::default(),
+            configure,
         }
     }
 
+    /// Make the oplog use `arena`, which should have the same content as the current arena.
+    pub(crate) fn set_arena(&mut self, arena: SharedArena) {
+        self.op_groups.set_arena(arena.clone());
+        self.arena = arena;
+    }
+
     #[inline]
     pub fn latest_timestamp(&self) -> Timestamp {
         self.latest_timestamp
@@ -254,8 +284,13 @@ impl OpLog {
                 );
                 let timestamp_change = change.timestamp - last.timestamp;
                 // TODO: make this a config
+                // A change with a commit message is kept apart, so the message only
+                // covers the ops of its own commit
                 if !last.has_dependents
                     && change.deps_on_self()
+                    && last.commit_msg.is_none()
+                    && change.commit_msg.is_none()
+                    && last.author == change.author
                     && timestamp_change < self.configure.merge_interval()
                 {
                     for op in take(change.ops.vec_mut()) {
@@ -558,6 +593,8 @@ impl OpLog {
             lamport: change.lamport,
             timestamp: change.timestamp,
             has_dependents: false,
+            commit_msg: change.commit_msg.clone(),
+            author: change.author.clone(),
         }
     }
 
@@ -709,6 +746,77 @@ impl OpLog {
         encode_oplog(self, vv, EncodeMode::Auto)
     }
 
+    #[inline(always)]
+    pub(crate) fn export_spans(&self, spans: &[IdSpan]) -> Vec<Vec<u8>> {
+        encode_oplog_spans(self, spans)
+    }
+
+    #[inline(always)]
+    pub(crate) fn export_from_to(
+        &self,
+        vv: &VersionVector,
+        writer: &mut dyn std::io::Write,
+    ) -> std::io::Result<()> {
+        encode_oplog_to(self, vv, EncodeMode::Auto, writer)
+    }
+
+    #[inline(always)]
+    pub(crate) fn export_range_to(
+        &self,
+        from: &VersionVector,
+        to: &VersionVector,
+        writer: &mut dyn std::io::Write,
+    ) -> std::io::Result<()> {
+        encode_oplog_range_to(self, from, to, writer)
+    }
+
+    /// Merge the consecutive changes of each peer before `keep_since`, so that their
+    /// adjacent ops, e.g. the text typed one commit at a time, are coalesced into fewer ops.
+    /// It returns the number of the changes merged into their previous changes.
+    ///
+    /// The ops keep their ids and contents, so every version can still be checked out and
+    /// the future concurrent changes can still be merged. A merged change keeps the timestamp
+    /// of its first part. Like in [OpLog::insert_new_change], the changes with commit
+    /// messages, different authors or dependents of other peers are kept apart.
+    pub(crate) fn compact_history(&mut self, keep_since: &Frontiers) -> Result<usize, LoroError> {
+        for id in keep_since.iter() {
+            if !self.dag.contains(*id) {
+                return Err(LoroError::FrontiersNotFound(*id));
+            }
+        }
+
+        let vv = self.dag.frontiers_to_vv(keep_since).unwrap();
+        let mut ans = 0;
+        for (peer, changes) in self.changes.iter_mut() {
+            let end = vv.get(peer).copied().unwrap_or(0);
+            let mut compacted: Vec<Change> = Vec::with_capacity(changes.len());
+            for mut change in take(changes) {
+                if let Some(last) = compacted.last_mut() {
+                    if change.ctr_end() <= end
+                        && !last.has_dependents
+                        && change.deps_on_self()
+                        && last.commit_msg.is_none()
+                        && change.commit_msg.is_none()
+                        && last.author == change.author
+                    {
+                        for op in take(change.ops.vec_mut()) {
+                            last.ops.push(op);
+                        }
+                        last.has_dependents = change.has_dependents;
+                        ans += 1;
+                        continue;
+                    }
+                }
+
+                compacted.push(change);
+            }
+
+            *changes = compacted;
+        }
+
+        Ok(ans)
+    }
+
     #[inline(always)]
     pub(crate) fn decode(&mut self, data: ParsedHeaderAndBody) -> Result<(), LoroError> {
         decode_oplog(self, data)
@@ -862,6 +970,77 @@ impl OpLog {
         }
     }
 
+    /// Collect per-peer and per-container statistics of the history.
+    ///
+    /// It only walks the changes in memory, so it's cheap compared to
+    /// exporting the document. The byte sizes are estimations of the
+    /// encoded payload, not the exact size of an exported blob.
+    pub fn analyze(&self) -> DocStats {
+        let mut peers: FxHashMap<PeerID, PeerStats> = FxHashMap::default();
+        let mut container_ops: FxHashMap<ContainerIdx, usize> = FxHashMap::default();
+        for (peer, changes) in self.changes.iter() {
+            let stats = peers.entry(*peer).or_default();
+            for change in changes.iter() {
+                stats.changes += 1;
+                stats.approx_bytes += CHANGE_HEADER_SIZE + change.deps.len() * ID_SIZE;
+                for op in change.ops.iter() {
+                    let atom_len = op.atom_len();
+                    stats.ops += 1;
+                    stats.atom_ops += atom_len;
+                    stats.approx_bytes += OP_HEADER_SIZE + self.estimate_op_content_size(op);
+                    *container_ops.entry(op.container).or_default() += atom_len;
+                }
+            }
+        }
+
+        let containers = container_ops
+            .into_iter()
+            .filter_map(|(idx, len)| self.arena.idx_to_id(idx).map(|id| (id, len)))
+            .collect();
+        DocStats { peers, containers }
+    }
+
+    /// The approximate memory usage of the changes in bytes.
+    ///
+    /// The strings and values of the ops are stored in the arena, so they are not counted.
+    pub(crate) fn estimate_changes_size(&self) -> usize {
+        self.changes
+            .values()
+            .flat_map(|x| x.iter())
+            .map(estimate_change_memory)
+            .sum()
+    }
+
+    fn estimate_op_content_size(&self, op: &Op) -> usize {
+        match &op.content {
+            InnerContent::List(l) => match l {
+                list_op::InnerListOp::Insert { slice, .. } => {
+                    if slice.is_unknown() {
+                        (slice.0.end - slice.0.start) as usize
+                    } else {
+                        self.arena
+                            .iter_value_slice(slice.to_range())
+                            .map(|v| estimate_value_size(&v))
+                            .sum()
+                    }
+                }
+                list_op::InnerListOp::InsertText { slice, .. } => slice.len(),
+                list_op::InnerListOp::Delete(_) => 2 * std::mem::size_of::<i32>(),
+                list_op::InnerListOp::Move { .. } => ID_SIZE + 2 * std::mem::size_of::<u32>(),
+                list_op::InnerListOp::Set { value, .. } => ID_SIZE + estimate_value_size(value),
+                list_op::InnerListOp::StyleStart { key, value, .. } => {
+                    key.len() + estimate_value_size(value) + 2 * std::mem::size_of::<u32>()
+                }
+                list_op::InnerListOp::StyleEnd => 0,
+            },
+            InnerContent::Map(m) => {
+                m.key.len() + m.value.as_ref().map(estimate_value_size).unwrap_or(1)
+            }
+            InnerContent::Tree(_) => 3 * ID_SIZE,
+            InnerContent::Future(_) => std::mem::size_of::<f64>(),
+        }
+    }
+
     #[allow(unused)]
     pub(crate) fn debug_check(&self) {
         for (_, changes) in self.changes().iter() {
@@ -971,6 +1150,73 @@ impl OpLog {
     }
 }
 
+/// Estimated encoded size of the metadata of a change (lamport, timestamp, lengths).
+const CHANGE_HEADER_SIZE: usize = 16;
+/// Estimated encoded size of the metadata of an op (container, counter, kind).
+const OP_HEADER_SIZE: usize = 4;
+/// Estimated encoded size of an ID.
+const ID_SIZE: usize = 12;
+
+fn estimate_change_memory(change: &Change) -> usize {
+    std::mem::size_of::<Change>()
+        + change.deps.len() * std::mem::size_of::<ID>()
+        + change.ops.len() * std::mem::size_of::<Op>()
+        + change.commit_msg.as_ref().map_or(0, |x| x.len())
+        + change.author.as_ref().map_or(0, |x| x.len())
+}
+
+fn estimate_value_size(value: &LoroValue) -> usize {
+    match value {
+        LoroValue::Null | LoroValue::Bool(_) => 1,
+        LoroValue::Double(_) | LoroValue::I64(_) => 8,
+        LoroValue::Binary(b) => b.len(),
+        LoroValue::String(s) => s.len(),
+        LoroValue::List(l) => l.iter().map(estimate_value_size).sum::<usize>() + 1,
+        LoroValue::Map(m) => {
+            m.iter()
+                .map(|(k, v)| k.len() + estimate_value_size(v))
+                .sum::<usize>()
+                + 1
+        }
+        LoroValue::Container(_) => ID_SIZE,
+    }
+}
+
+/// The statistics of the changes authored by a single peer.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct PeerStats {
+    /// The number of changes
+    pub changes: usize,
+    /// The number of ops. Consecutive ops may be merged into one.
+    pub ops: usize,
+    /// The number of atom ops
+    pub atom_ops: usize,
+    /// The approximate encoded size in bytes
+    pub approx_bytes: usize,
+}
+
+/// The storage statistics of a document, returned by [OpLog::analyze].
+#[derive(Debug, Clone, Default)]
+pub struct DocStats {
+    pub peers: FxHashMap<PeerID, PeerStats>,
+    /// The number of atom ops applied to each container
+    pub containers: FxHashMap<ContainerID, usize>,
+}
+
+impl DocStats {
+    pub fn total_changes(&self) -> usize {
+        self.peers.values().map(|x| x.changes).sum()
+    }
+
+    pub fn total_atom_ops(&self) -> usize {
+        self.peers.values().map(|x| x.atom_ops).sum()
+    }
+
+    pub fn total_approx_bytes(&self) -> usize {
+        self.peers.values().map(|x| x.approx_bytes).sum()
+    }
+}
+
 #[derive(Debug)]
 pub struct SizeInfo {
     pub total_changes: usize,
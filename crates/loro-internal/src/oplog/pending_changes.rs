@@ -5,7 +5,7 @@ use fxhash::FxHashMap;
 use loro_common::{Counter, CounterSpan, HasCounterSpan, HasIdSpan, HasLamportSpan, PeerID, ID};
 use smallvec::SmallVec;
 
-#[derive(Debug)]
+#[derive(Debug, Clone)]
 pub enum PendingChange {
     // The lamport of the change decoded by `enhanced` is unknown.
     // we need calculate it when the change can be applied
@@ -25,7 +25,7 @@ impl Deref for PendingChange {
     }
 }
 
-#[derive(Debug, Default)]
+#[derive(Debug, Default, Clone)]
 pub(crate) struct PendingChanges {
     changes: FxHashMap<PeerID, BTreeMap<Counter, SmallVec<[PendingChange; 1]>>>,
 }
@@ -34,6 +34,25 @@ impl PendingChanges {
     pub fn is_empty(&self) -> bool {
         self.changes.is_empty()
     }
+
+    /// The approximate memory usage of the pending changes in bytes.
+    pub(crate) fn estimate_size(&self) -> usize {
+        self.changes
+            .values()
+            .flat_map(|x| x.values())
+            .flat_map(|x| x.iter())
+            .map(|x| super::estimate_change_memory(x))
+            .sum()
+    }
+
+    /// The changes that are waiting for their deps
+    pub(crate) fn iter(&self) -> impl Iterator<Item = &Change> + '_ {
+        self.changes
+            .values()
+            .flat_map(|x| x.values())
+            .flat_map(|x| x.iter())
+            .map(|c| c.deref())
+    }
 }
 
 impl OpLog {
@@ -11,7 +11,7 @@ use loro_delta::DeltaItem;
 use tracing::{info, instrument};
 
 use crate::{
-    configure::{Configure, DefaultRandom, SecureRandomGenerator},
+    configure::Configure,
     container::{idx::ContainerIdx, richtext::config::StyleConfigMap, ContainerIdRaw},
     cursor::Cursor,
     diff_calc::DiffCalculator,
@@ -28,6 +28,8 @@ use crate::{
 
 #[cfg(feature = "counter")]
 mod counter_state;
+#[cfg(feature = "counter")]
+pub(crate) use counter_state::CounterSum;
 mod list_state;
 mod map_state;
 mod movable_list_state;
@@ -263,7 +265,17 @@ impl DocState {
         global_txn: Weak<Mutex<Option<Transaction>>>,
         config: Configure,
     ) -> Arc<Mutex<Self>> {
-        let peer = DefaultRandom.next_u64();
+        let peer = config.gen_peer_id();
+        Self::new_arc_with_peer(arena, global_txn, config, peer)
+    }
+
+    /// Create a state with the given peer id, so no peer id is generated from the config.
+    pub(crate) fn new_arc_with_peer(
+        arena: SharedArena,
+        global_txn: Weak<Mutex<Option<Transaction>>>,
+        config: Configure,
+        peer: PeerID,
+    ) -> Arc<Mutex<Self>> {
         // TODO: maybe we should switch to certain version in oplog?
         Arc::new_cyclic(|weak| {
             Mutex::new(Self {
@@ -289,7 +301,7 @@ impl DocState {
     ) -> Arc<Mutex<Self>> {
         Arc::new_cyclic(|weak| {
             Mutex::new(Self {
-                peer: DefaultRandom.next_u64(),
+                peer: config.gen_peer_id(),
                 frontiers: self.frontiers.clone(),
                 states: self.states.clone(),
                 arena,
@@ -303,6 +315,54 @@ impl DocState {
         })
     }
 
+    /// Fork the state with only the states of `containers`, their ancestors and their descendants.
+    ///
+    /// They are all the states needed to apply the diffs of `containers` and to convert them
+    /// into events, so the other states are not cloned. `arena` should be a fork of the
+    /// arena of this state, so it knows the parents of the new containers.
+    pub(crate) fn fork_with_containers(
+        &self,
+        containers: &FxHashSet<ContainerIdx>,
+        arena: SharedArena,
+        config: Configure,
+    ) -> Arc<Mutex<Self>> {
+        let mut kept = FxHashSet::default();
+        for &idx in containers.iter() {
+            let mut cur = Some(idx);
+            while let Some(c) = cur {
+                if !kept.insert(c) {
+                    break;
+                }
+                cur = arena.get_parent(c);
+            }
+        }
+
+        for &idx in self.states.keys() {
+            let mut parent = arena.get_parent(idx);
+            while let Some(p) = parent {
+                if containers.contains(&p) {
+                    kept.insert(idx);
+                    break;
+                }
+                parent = arena.get_parent(p);
+            }
+        }
+
+        let states = self
+            .states
+            .iter()
+            .filter(|(idx, _)| kept.contains(idx))
+            .map(|(idx, state)| (*idx, state.clone()))
+            .collect();
+        let state = Self::new_arc_with_peer(arena, Weak::new(), config, self.peer);
+        {
+            let mut s = state.try_lock().unwrap();
+            s.frontiers = self.frontiers.clone();
+            s.states = states;
+        }
+        state
+    }
+
     pub fn start_recording(&mut self) {
         if self.is_recording() {
             return;
@@ -323,7 +383,7 @@ impl DocState {
     }
 
     pub fn refresh_peer_id(&mut self) {
-        self.peer = DefaultRandom.next_u64();
+        self.peer = self.config.gen_peer_id();
     }
 
     /// Take all the diffs that are recorded and convert them to events.
@@ -600,6 +660,59 @@ impl DocState {
         self.in_txn = false;
     }
 
+    /// Abort the txn and restore the `containers` changed by it to the current version,
+    /// by replaying their history in the oplog.
+    ///
+    /// The `created` containers are created by the txn, so their states and parent links
+    /// are removed.
+    pub(crate) fn rollback_txn(
+        &mut self,
+        oplog: &OpLog,
+        containers: &FxHashSet<ContainerIdx>,
+        created: &[ContainerID],
+    ) {
+        self.in_txn = false;
+        self.changed_idx_in_txn.clear();
+        for id in created {
+            if let Some(idx) = self.arena.id_to_idx(id) {
+                self.arena.remove_parent(idx);
+                self.states.remove(&idx);
+            }
+        }
+
+        if containers.is_empty() {
+            return;
+        }
+
+        let vv = oplog.dag.frontiers_to_vv(&self.frontiers).unwrap();
+        let mut diff_calc = DiffCalculator::new();
+        let diffs = diff_calc.calc_diff_internal(
+            oplog,
+            &Default::default(),
+            Some(&Default::default()),
+            &vv,
+            Some(&self.frontiers),
+            Some(&|idx| containers.contains(&idx)),
+        );
+        for &idx in containers.iter() {
+            let state = self.create_state(idx);
+            self.states.insert(idx, state);
+        }
+
+        for diff in diffs {
+            let Some(internal_diff) = diff.diff.into_internal() else {
+                continue;
+            };
+            let state = get_or_create!(self, diff.idx);
+            state.apply_diff(
+                internal_diff,
+                &self.arena,
+                &self.global_txn,
+                &self.weak_state,
+            );
+        }
+    }
+
     pub fn iter(&self) -> impl Iterator<Item = &State> {
         self.states.values()
     }
@@ -826,70 +939,69 @@ impl DocState {
         LoroValue::Map(Arc::new(ans))
     }
 
+    /// Get the deep value of the container, where each container is represented by
+    /// `{ "cid": <container id>, "value": <deep value> }`.
+    ///
+    /// The `meta` of each tree node is also represented this way.
     pub(crate) fn get_container_deep_value_with_id(
         &mut self,
         container: ContainerIdx,
         id: Option<ContainerID>,
     ) -> LoroValue {
         let id = id.unwrap_or_else(|| self.arena.idx_to_id(container).unwrap());
+        let cid_str = LoroValue::String(Arc::new(id.to_string()));
         let Some(state) = self.states.get_mut(&container) else {
-            return container.get_type().default_value();
+            return LoroValue::Map(Arc::new(fx_map!(
+                "cid".into() => cid_str,
+                "value".into() => container.get_type().default_value()
+            )));
         };
         let value = state.get_value();
-        let cid_str =
-            LoroValue::String(Arc::new(format!("idx:{}, id:{}", container.to_index(), id)));
-        match value {
+        let value = match value {
             LoroValue::Container(_) => unreachable!(),
             LoroValue::List(mut list) => {
-                if list.iter().all(|x| !x.is_container()) {
-                    return LoroValue::Map(Arc::new(fx_map!(
-                        "cid".into() => cid_str,
-                        "value".into() => LoroValue::List(list)
-                    )));
-                }
-
-                let list_mut = Arc::make_mut(&mut list);
-                for item in list_mut.iter_mut() {
-                    if item.is_container() {
-                        let container = item.as_container().unwrap();
-                        let container_idx = self.arena.register_container(container);
-                        let value = self.get_container_deep_value_with_id(
-                            container_idx,
-                            Some(container.clone()),
-                        );
-                        *item = value;
+                if container.get_type() == ContainerType::Tree {
+                    for node in Arc::make_mut(&mut list).iter_mut() {
+                        let map = Arc::make_mut(node.as_map_mut().unwrap());
+                        let meta = map.get_mut("meta").unwrap();
+                        let meta_id = meta.as_container().unwrap().clone();
+                        let meta_idx = self.arena.register_container(&meta_id);
+                        *meta = self.get_container_deep_value_with_id(meta_idx, Some(meta_id));
+                    }
+                } else if list.iter().any(|x| x.is_container()) {
+                    for item in Arc::make_mut(&mut list).iter_mut() {
+                        if item.is_container() {
+                            let container = item.as_container().unwrap().clone();
+                            let container_idx = self.arena.register_container(&container);
+                            *item = self
+                                .get_container_deep_value_with_id(container_idx, Some(container));
+                        }
                     }
                 }
 
-                LoroValue::Map(Arc::new(fx_map!(
-                    "cid".into() => cid_str,
-                    "value".into() => LoroValue::List(list)
-                )))
+                LoroValue::List(list)
             }
             LoroValue::Map(mut map) => {
-                let map_mut = Arc::make_mut(&mut map);
-                for (_key, value) in map_mut.iter_mut() {
-                    if value.is_container() {
-                        let container = value.as_container().unwrap();
-                        let container_idx = self.arena.register_container(container);
-                        let new_value = self.get_container_deep_value_with_id(
-                            container_idx,
-                            Some(container.clone()),
-                        );
-                        *value = new_value;
+                if map.iter().any(|x| x.1.is_container()) {
+                    for (_key, value) in Arc::make_mut(&mut map).iter_mut() {
+                        if value.is_container() {
+                            let container = value.as_container().unwrap().clone();
+                            let container_idx = self.arena.register_container(&container);
+                            *value = self
+                                .get_container_deep_value_with_id(container_idx, Some(container));
+                        }
                     }
                 }
 
-                LoroValue::Map(Arc::new(fx_map!(
-                    "cid".into() => cid_str,
-                    "value".into() => LoroValue::Map(map)
-                )))
+                LoroValue::Map(map)
             }
-            _ => LoroValue::Map(Arc::new(fx_map!(
-                "cid".into() => cid_str,
-                "value".into() => value
-            ))),
-        }
+            _ => value,
+        };
+
+        LoroValue::Map(Arc::new(fx_map!(
+            "cid".into() => cid_str,
+            "value".into() => value
+        )))
     }
 
     pub fn get_container_deep_value(&mut self, container: ContainerIdx) -> LoroValue {
@@ -1037,6 +1149,11 @@ impl DocState {
     }
 
     // the container may be override, so it may return None
+    /// Whether the container is unreachable from the root containers
+    pub(crate) fn is_deleted(&self, idx: ContainerIdx) -> bool {
+        self.get_path(idx).is_none()
+    }
+
     fn get_path(&self, idx: ContainerIdx) -> Option<Vec<(ContainerID, Index)>> {
         let mut ans = Vec::new();
         let mut idx = idx;
@@ -1174,6 +1291,22 @@ impl DocState {
         );
     }
 
+    /// The approximate memory usage of the states of each type of container in bytes.
+    pub(crate) fn estimate_state_size(&self) -> FxHashMap<ContainerType, usize> {
+        let mut ans: FxHashMap<ContainerType, usize> = FxHashMap::default();
+        for (idx, state) in self.states.iter() {
+            *ans.entry(idx.get_type()).or_default() +=
+                std::mem::size_of::<(ContainerIdx, State)>() + state.estimate_size();
+        }
+        ans
+    }
+
+    /// The approximate memory usage of the recorded diffs and events in bytes.
+    pub(crate) fn estimate_recorded_events_size(&self) -> usize {
+        self.event_recorder.diffs.len() * std::mem::size_of::<InternalDocDiff<'static>>()
+            + self.event_recorder.events.len() * std::mem::size_of::<DocDiff>()
+    }
+
     pub fn create_state(&self, idx: ContainerIdx) -> State {
         match idx.get_type() {
             ContainerType::Map => State::MapState(Box::new(MapState::new(idx))),
@@ -7,22 +7,123 @@ use crate::{
     container::idx::ContainerIdx,
     encoding::{StateSnapshotDecodeContext, StateSnapshotEncoder},
     event::{Diff, Index, InternalDiff},
-    op::{Op, RawOp, RawOpContent},
+    op::{CounterDelta, Op, RawOp, RawOpContent},
     txn::Transaction,
     DocState,
 };
 
 use super::ContainerState;
 
+/// The largest integer that can be represented exactly by `f64`
+const MAX_SAFE_INTEGER: f64 = 9007199254740991.;
+
+/// The sum of counter ops.
+///
+/// The integral amounts are summed up exactly in `int`, and only the fractional ones
+/// go to `float`. So the value of a counter that is only changed by integers doesn't
+/// lose precision past 2^53.
+///
+/// If an amount would overflow `int`, it's added to `float` instead. The sum is no longer
+/// exact then, which is reported by [CounterSum::to_int] returning `None`.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub(crate) struct CounterSum {
+    pub(crate) int: i128,
+    pub(crate) float: f64,
+}
+
+impl CounterSum {
+    pub(crate) fn add(&mut self, delta: CounterDelta) {
+        match delta {
+            CounterDelta::Int(n) => self.add_int(n as i128),
+            CounterDelta::Float(x) if is_safe_integer(x) => self.add_int(x as i128),
+            CounterDelta::Float(x) => self.float += x,
+        }
+    }
+
+    pub(crate) fn sub(&mut self, delta: CounterDelta) {
+        match delta {
+            CounterDelta::Int(n) => self.sub_int(n as i128),
+            CounterDelta::Float(x) if is_safe_integer(x) => self.sub_int(x as i128),
+            CounterDelta::Float(x) => self.float -= x,
+        }
+    }
+
+    pub(crate) fn merge(&mut self, other: &CounterSum) {
+        self.add_int(other.int);
+        self.float += other.float;
+    }
+
+    fn add_int(&mut self, n: i128) {
+        match self.int.checked_add(n) {
+            Some(int) => self.int = int,
+            None => self.float += n as f64,
+        }
+    }
+
+    fn sub_int(&mut self, n: i128) {
+        match self.int.checked_sub(n) {
+            Some(int) => self.int = int,
+            None => self.float -= n as f64,
+        }
+    }
+
+    pub(crate) fn is_zero(&self) -> bool {
+        self.int == 0 && self.float.abs() < f64::EPSILON
+    }
+
+    pub(crate) fn to_f64(self) -> f64 {
+        self.int as f64 + self.float
+    }
+
+    /// Get the exact value if the fractional amounts add up to an integer.
+    ///
+    /// Returns `None` if the sum overflowed `i128`.
+    pub(crate) fn to_int(self) -> Option<i128> {
+        if self.float == 0. {
+            Some(self.int)
+        } else if is_safe_integer(self.float) {
+            self.int.checked_add(self.float as i128)
+        } else {
+            None
+        }
+    }
+
+    /// Split the sum into counter ops, which are needed when the amount of `int` exceeds `i64`.
+    pub(crate) fn to_deltas(self) -> Vec<CounterDelta> {
+        let mut ans = Vec::new();
+        let mut int = self.int;
+        while int != 0 {
+            let n = int.clamp(i64::MIN as i128, i64::MAX as i128);
+            ans.push(CounterDelta::Int(n as i64));
+            int -= n;
+        }
+        if self.float != 0. {
+            ans.push(CounterDelta::Float(self.float));
+        }
+        ans
+    }
+}
+
+fn is_safe_integer(x: f64) -> bool {
+    x.fract() == 0. && x.abs() <= MAX_SAFE_INTEGER
+}
+
 #[derive(Debug, Clone)]
 pub struct CounterState {
     idx: ContainerIdx,
-    value: f64,
+    value: CounterSum,
 }
 
 impl CounterState {
     pub(crate) fn new(idx: ContainerIdx) -> Self {
-        Self { idx, value: 0. }
+        Self {
+            idx,
+            value: CounterSum::default(),
+        }
+    }
+
+    pub(crate) fn get_sum(&self) -> CounterSum {
+        self.value
     }
 }
 
@@ -32,7 +133,7 @@ impl ContainerState for CounterState {
     }
 
     fn estimate_size(&self) -> usize {
-        std::mem::size_of::<i64>()
+        std::mem::size_of::<CounterSum>()
     }
 
     fn is_state_empty(&self) -> bool {
@@ -48,8 +149,8 @@ impl ContainerState for CounterState {
         _state: &Weak<Mutex<DocState>>,
     ) -> Diff {
         if let InternalDiff::Counter(diff) = diff {
-            self.value += diff;
-            Diff::Counter(diff)
+            self.value.merge(&diff);
+            Diff::Counter(diff.to_f64())
         } else {
             unreachable!()
         }
@@ -67,7 +168,7 @@ impl ContainerState for CounterState {
 
     fn apply_local_op(&mut self, raw_op: &RawOp, _op: &Op) -> LoroResult<()> {
         if let RawOpContent::Counter(diff) = raw_op.content {
-            self.value += diff;
+            self.value.add(diff);
             Ok(())
         } else {
             unreachable!()
@@ -81,11 +182,11 @@ impl ContainerState for CounterState {
         _txn: &Weak<Mutex<Option<Transaction>>>,
         _state: &Weak<Mutex<DocState>>,
     ) -> Diff {
-        Diff::Counter(self.value)
+        Diff::Counter(self.value.to_f64())
     }
 
     fn get_value(&mut self) -> LoroValue {
-        LoroValue::Double(self.value)
+        LoroValue::Double(self.value.to_f64())
     }
 
     #[doc = " Get the index of the child container"]
@@ -105,7 +206,11 @@ impl ContainerState for CounterState {
     #[doc = " The ops should be encoded into the snapshot as well as the blob."]
     #[doc = " The users then can use the ops and the blob to restore the state to the current state."]
     fn encode_snapshot(&self, _encoder: StateSnapshotEncoder) -> Vec<u8> {
-        self.value.to_be_bytes().to_vec()
+        // The approximate value goes first, so the versions before the exact sum can still read it
+        let mut ans = self.value.to_f64().to_be_bytes().to_vec();
+        ans.extend_from_slice(&self.value.int.to_be_bytes());
+        ans.extend_from_slice(&self.value.float.to_be_bytes());
+        ans
     }
 
     #[doc = " Restore the state to the state represented by the ops and the blob that exported by `get_snapshot_ops`"]
@@ -116,7 +221,20 @@ impl ContainerState for CounterState {
         };
         let mut buf = [0; 8];
         buf.copy_from_slice(bytes);
-        self.value = f64::from_be_bytes(buf);
+        let Some(bytes) = reader.get(8..32) else {
+            // Encoded by the versions before the exact sum
+            self.value = CounterSum::default();
+            self.value.add(CounterDelta::Float(f64::from_be_bytes(buf)));
+            return Ok(());
+        };
+
+        let mut int = [0; 16];
+        int.copy_from_slice(&bytes[..16]);
+        buf.copy_from_slice(&bytes[16..]);
+        self.value = CounterSum {
+            int: i128::from_be_bytes(int),
+            float: f64::from_be_bytes(buf),
+        };
         Ok(())
     }
 
@@ -125,3 +243,33 @@ impl ContainerState for CounterState {
         false
     }
 }
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn overflow_makes_sum_inexact() {
+        let mut sum = CounterSum {
+            int: i128::MAX,
+            float: 0.,
+        };
+        sum.add(CounterDelta::Int(1));
+        assert_eq!(sum.int, i128::MAX);
+        assert_eq!(sum.to_int(), None);
+        assert!(sum.to_f64() > 0.);
+
+        let mut sum = CounterSum {
+            int: i128::MIN,
+            float: 0.,
+        };
+        sum.sub(CounterDelta::Int(1));
+        assert_eq!(sum.int, i128::MIN);
+        assert_eq!(sum.to_int(), None);
+        sum.merge(&CounterSum {
+            int: i128::MAX,
+            float: 0.,
+        });
+        assert!(sum.to_f64() < 0.);
+    }
+}
@@ -288,6 +288,22 @@ impl ListState {
         ans
     }
 
+    /// Clone the values in `start..start + len`. It stops at the end of the list.
+    pub(crate) fn get_values_from(&self, start: usize, len: usize) -> Vec<LoroValue> {
+        if start >= self.len() {
+            return Vec::new();
+        }
+
+        let Some(result) = self.list.query::<LengthFinder>(&start) else {
+            return Vec::new();
+        };
+        self.list
+            .iter_range(result.cursor..)
+            .take(len)
+            .map(|x| x.elem.v.clone())
+            .collect()
+    }
+
     pub fn get(&self, index: usize) -> Option<&LoroValue> {
         let result = self.list.query::<LengthFinder>(&index)?;
         if result.found {
@@ -1063,12 +1063,15 @@ impl ContainerState for MovableListState {
                                 event.compose(
                                     &DeltaRopeBuilder::new()
                                         .retain(index, Default::default())
-                                        .delete(1)
-                                        .insert(
+                                        .replace(
                                             ArrayVec::from([ValueOrHandler::from_value(
                                                 value, arena, txn, state,
                                             )]),
-                                            ListDeltaMeta { from_move: false },
+                                            ListDeltaMeta {
+                                                from_move: false,
+                                                from_set: true,
+                                            },
+                                            1,
                                         )
                                         .build(),
                                 )
@@ -1099,6 +1102,7 @@ impl ContainerState for MovableListState {
                                         ListDeltaMeta {
                                             from_move: (result.delete.is_some() && !value_updated)
                                                 || from_delete,
+                                            from_set: false,
                                         },
                                     )
                                     .build();
@@ -1142,6 +1146,7 @@ impl ContainerState for MovableListState {
                                         ListDeltaMeta {
                                             from_move: (result.delete.is_some() && !value_updated)
                                                 || from_delete,
+                                            from_set: false,
                                         },
                                     )
                                     .build(),
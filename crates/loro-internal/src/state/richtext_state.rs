@@ -1,11 +1,11 @@
 use std::{
-    ops::Range,
+    ops::{ControlFlow, Range},
     sync::{Arc, Mutex, RwLock, Weak},
 };
 
 use fxhash::{FxHashMap, FxHashSet};
 use generic_btree::rle::HasLength;
-use loro_common::{ContainerID, InternalString, LoroResult, LoroValue, ID};
+use loro_common::{ContainerID, IdFull, InternalString, LoroResult, LoroValue, ID};
 use loro_delta::DeltaRopeBuilder;
 
 use crate::{
@@ -18,7 +18,7 @@ use crate::{
             richtext_state::{
                 DrainInfo, EntityRangeInfo, IterRangeItem, PosType, RichtextStateChunk,
             },
-            AnchorType, RichtextState as InnerState, StyleOp, Styles,
+            AnchorType, ExpandType, RichtextState as InnerState, StyleOp, Styles,
         },
     },
     delta::{StyleMeta, StyleMetaItem},
@@ -782,6 +782,44 @@ impl RichtextState {
         self.state.get_mut().get_richtext_value()
     }
 
+    #[inline]
+    #[allow(clippy::type_complexity)]
+    pub(crate) fn get_runs_with_expand(
+        &mut self,
+    ) -> Vec<(String, Vec<(InternalString, LoroValue, ExpandType)>)> {
+        self.state.get_mut().get_runs_with_expand()
+    }
+
+    #[inline]
+    pub(crate) fn get_style_spans_in_event_range(
+        &mut self,
+        range: Range<usize>,
+        key: &InternalString,
+    ) -> Vec<(usize, usize)> {
+        self.state
+            .get_mut()
+            .get_style_spans_in_event_range(range, key)
+    }
+
+    #[inline]
+    pub(crate) fn iter_styled_runs_in_event_range(
+        &mut self,
+        range: Range<usize>,
+        f: &mut dyn FnMut(&str, &StyleMeta) -> ControlFlow<()>,
+    ) {
+        self.state
+            .get_mut()
+            .iter_styled_runs_in_event_range(range, f)
+    }
+
+    #[inline]
+    pub(crate) fn get_text_id_runs_in_event_range(
+        &mut self,
+        range: Range<usize>,
+    ) -> Vec<(Range<usize>, IdFull)> {
+        self.state.get_mut().get_text_id_runs_in_event_range(range)
+    }
+
     #[inline]
     pub(crate) fn get_stable_position(
         &mut self,
@@ -809,6 +847,15 @@ impl RichtextState {
             .get_mut()
             .event_index_to_unicode_index(event_index)
     }
+
+    pub(crate) fn convert_index(
+        &mut self,
+        index: usize,
+        from: PosType,
+        to: PosType,
+    ) -> Option<usize> {
+        self.state.get_mut().convert_index(index, from, to)
+    }
 }
 
 #[derive(Debug, Default, Clone)]
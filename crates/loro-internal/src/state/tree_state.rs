@@ -1,7 +1,7 @@
 use either::Either;
 use enum_as_inner::EnumAsInner;
 use fractional_index::FractionalIndex;
-use fxhash::FxHashMap;
+use fxhash::{FxHashMap, FxHashSet};
 use itertools::Itertools;
 use loro_common::{
     ContainerID, IdFull, IdLp, LoroError, LoroResult, LoroTreeError, LoroValue, PeerID, TreeID,
@@ -614,7 +614,7 @@ impl TreeState {
     }
 
     #[inline(never)]
-    fn is_ancestor_of(&self, maybe_ancestor: &TreeID, node_id: &TreeParentId) -> bool {
+    pub(crate) fn is_ancestor_of(&self, maybe_ancestor: &TreeID, node_id: &TreeParentId) -> bool {
         if !self.trees.contains_key(maybe_ancestor) {
             return false;
         }
@@ -625,7 +625,10 @@ impl TreeState {
         }
         match node_id {
             TreeParentId::Node(id) => {
-                let parent = &self.trees.get(id).unwrap().parent;
+                let Some(node) = self.trees.get(id) else {
+                    return false;
+                };
+                let parent = &node.parent;
                 if parent == node_id {
                     panic!("is_ancestor_of loop")
                 }
@@ -816,86 +819,156 @@ impl ContainerState for TreeState {
     ) -> Diff {
         let mut ans = vec![];
         if let InternalDiff::Tree(tree) = &diff {
-            // println!("before {:?}", self.children);
-            // assert never cause cycle move
-            for diff in tree.diff.iter() {
-                // println!("\ndiff {:?}", diff);
+            // A node may have several items in the diff, e.g. a retreat into a deleted parent
+            // and then a forward out of it. Only the last one decides where the node ends up,
+            // so the items are composed per node and the events are calculated from the state
+            // before and after the diff. Otherwise a move between two alive parents may be
+            // emitted as a delete and a create.
+            let mut last: FxHashMap<TreeID, usize> = FxHashMap::default();
+            for (i, item) in tree.diff.iter().enumerate() {
+                last.insert(item.target, i);
+            }
+            let was_alive: FxHashSet<TreeID> = last
+                .keys()
+                .filter(|target| self.trees.contains_key(target) && !self.is_node_deleted(target))
+                .copied()
+                .collect();
+            let final_parent = |target: &TreeID| match last.get(target) {
+                Some(&i) => match &tree.diff[i].action {
+                    TreeInternalDiff::Create { parent, .. }
+                    | TreeInternalDiff::Move { parent, .. }
+                    | TreeInternalDiff::Delete { parent, .. }
+                    | TreeInternalDiff::MoveInDelete { parent, .. } => *parent,
+                    TreeInternalDiff::UnCreate => TreeParentId::Unexist,
+                },
+                None => self.parent(target),
+            };
+            // The depth of the node after the diff, None if it's deleted
+            let max_depth = self.trees.len() + last.len();
+            let final_depth = |target: &TreeID| {
+                let mut depth = 0;
+                let mut parent = final_parent(target);
+                loop {
+                    match parent {
+                        TreeParentId::Root => return Some(depth),
+                        TreeParentId::Deleted | TreeParentId::Unexist => return None,
+                        TreeParentId::Node(p) => {
+                            depth += 1;
+                            if depth > max_depth {
+                                return None;
+                            }
+                            parent = final_parent(&p);
+                        }
+                    }
+                }
+            };
+            let mut order = last.values().copied().collect_vec();
+            order.sort_unstable();
+            let mut alive = vec![];
+            let mut deleted = vec![];
+            for i in order {
+                match final_depth(&tree.diff[i].target) {
+                    Some(depth) => alive.push((depth, i)),
+                    None => deleted.push(i),
+                }
+            }
+
+            // The parents are placed before their children, so the nodes never form a cycle
+            // and the index of every event is calculated on an alive parent
+            alive.sort_by_key(|(depth, _)| *depth);
+            for (_, i) in alive {
+                let diff = &tree.diff[i];
                 let last_move_op = diff.last_effective_move_op_id;
                 let target = diff.target;
-                // create associated metadata container
-                match &diff.action {
-                    TreeInternalDiff::Create { parent, position } => {
-                        self.mov(target, *parent, last_move_op, Some(position.clone()), false)
-                            .unwrap();
-                        let index = self.get_index_by_tree_id(&target).unwrap();
-                        ans.push(TreeDiffItem {
-                            target,
-                            action: TreeExternalDiff::Create {
-                                parent: parent.into_node().ok(),
-                                index,
-                                position: position.clone(),
-                            },
-                        });
+                let (parent, position) = match &diff.action {
+                    TreeInternalDiff::Create { parent, position }
+                    | TreeInternalDiff::Move { parent, position } => (*parent, position.clone()),
+                    TreeInternalDiff::Delete { parent, position }
+                    | TreeInternalDiff::MoveInDelete { parent, position } => {
+                        (*parent, position.clone().unwrap())
                     }
-                    TreeInternalDiff::Move { parent, position } => {
-                        let old_parent = self.trees.get(&target).unwrap().parent;
-                        let old_index = self.get_index_by_tree_id(&target).unwrap();
-                        self.mov(target, *parent, last_move_op, Some(position.clone()), false)
-                            .unwrap();
-                        let index = self.get_index_by_tree_id(&target).unwrap();
+                    TreeInternalDiff::UnCreate => unreachable!(),
+                };
+                if was_alive.contains(&target) {
+                    let old = self.trees.get(&target).unwrap();
+                    if old.parent == parent
+                        && old.position.as_ref() == Some(&position)
+                        && old.last_move_op == last_move_op
+                    {
+                        continue;
+                    }
+
+                    let old_parent = old.parent;
+                    let old_index = self.get_index_by_tree_id(&target).unwrap();
+                    self.mov(target, parent, last_move_op, Some(position.clone()), false)
+                        .unwrap();
+                    let index = self.get_index_by_tree_id(&target).unwrap();
+                    if old_parent != parent || old_index != index {
                         ans.push(TreeDiffItem {
                             target,
                             action: TreeExternalDiff::Move {
                                 parent: parent.into_node().ok(),
                                 index,
-                                position: position.clone(),
+                                position,
                                 old_parent,
                                 old_index,
                             },
                         });
                     }
-                    TreeInternalDiff::Delete { parent, position } => {
-                        let old_parent = self.trees.get(&target).unwrap().parent;
-                        let old_index = self.get_index_by_tree_id(&target).unwrap();
-                        self.mov(target, *parent, last_move_op, position.clone(), false)
+                } else {
+                    self.mov(target, parent, last_move_op, Some(position.clone()), false)
+                        .unwrap();
+                    let index = self.get_index_by_tree_id(&target).unwrap();
+                    ans.push(TreeDiffItem {
+                        target,
+                        action: TreeExternalDiff::Create {
+                            parent: parent.into_node().ok(),
+                            index,
+                            position,
+                        },
+                    });
+                }
+            }
+
+            for i in deleted {
+                let diff = &tree.diff[i];
+                let last_move_op = diff.last_effective_move_op_id;
+                let target = diff.target;
+                // The node may be already removed with its deleted ancestor
+                let old_parent = self.parent(&target);
+                let old_index = (!self.is_node_deleted(&target))
+                    .then(|| self.get_index_by_tree_id(&target))
+                    .flatten();
+                match &diff.action {
+                    TreeInternalDiff::Create { parent, position }
+                    | TreeInternalDiff::Move { parent, position } => {
+                        self.mov(target, *parent, last_move_op, Some(position.clone()), false)
                             .unwrap();
-                        ans.push(TreeDiffItem {
-                            target,
-                            action: TreeExternalDiff::Delete {
-                                old_parent,
-                                old_index,
-                            },
-                        });
                     }
-                    TreeInternalDiff::MoveInDelete { parent, position } => {
+                    TreeInternalDiff::Delete { parent, position }
+                    | TreeInternalDiff::MoveInDelete { parent, position } => {
                         self.mov(target, *parent, last_move_op, position.clone(), false)
                             .unwrap();
                     }
                     TreeInternalDiff::UnCreate => {
-                        let old_parent = self.trees.get(&target).unwrap().parent;
-                        let old_index = self.get_index_by_tree_id(&target).unwrap();
-                        ans.push(TreeDiffItem {
-                            target,
-                            action: TreeExternalDiff::Delete {
-                                old_parent,
-                                old_index,
-                            },
-                        });
                         // delete it from state
                         let parent = self.trees.remove(&target);
                         if let Some(parent) = parent {
                             if !parent.parent.is_deleted() {
-                                self.children
-                                    .get_mut(&parent.parent)
-                                    .unwrap()
-                                    .delete_child(&target);
+                                self.delete_position(&parent.parent, target);
                             }
                         }
-                        // println!("after {:?}", self.children);
-                        continue;
                     }
-                };
-                // println!("after {:?}", self.children);
+                }
+                if let Some(old_index) = old_index {
+                    ans.push(TreeDiffItem {
+                        target,
+                        action: TreeExternalDiff::Delete {
+                            old_parent,
+                            old_index,
+                        },
+                    });
+                }
             }
         }
 
@@ -1,13 +1,15 @@
 use core::panic;
 use std::{
     borrow::Cow,
+    collections::hash_map::Entry,
     mem::take,
     sync::{Arc, Mutex, Weak},
 };
 
 use enum_as_inner::EnumAsInner;
+use fxhash::FxHashSet;
 use generic_btree::rle::{HasLength as RleHasLength, Mergeable as GBSliceable};
-use loro_common::{ContainerType, IdLp, LoroResult};
+use loro_common::{ContainerID, ContainerType, IdLp, IdSpan, LoroResult};
 use loro_delta::{array_vec::ArrayVec, DeltaRopeBuilder};
 use rle::{HasLength, Mergable, RleVec};
 use smallvec::{smallvec, SmallVec};
@@ -26,6 +28,7 @@ use crate::{
     id::{Counter, PeerID, ID},
     op::{Op, RawOp, RawOpContent},
     span::HasIdSpan,
+    undo::DiffBatch,
     version::Frontiers,
     InternalString, LoroError, LoroValue,
 };
@@ -40,6 +43,24 @@ use super::{
 
 pub type OnCommitFn = Box<dyn FnOnce(&Arc<Mutex<DocState>>) + Sync + Send>;
 
+/// The local change that is going to be committed, passed to the [PreCommitHook].
+#[derive(Debug, Clone)]
+pub struct PendingLocalChange {
+    /// The id of the first op of the change
+    pub id: ID,
+    /// The lamport of the first op of the change
+    pub lamport: Lamport,
+    /// The number of the atom ops in the change
+    pub len: usize,
+    /// The diff that the change applies to the doc
+    pub diff: DiffBatch,
+}
+
+/// The hook called before a local change is committed.
+///
+/// If it returns an error, the change is discarded.
+pub type PreCommitHook = Arc<dyn Fn(&PendingLocalChange) -> LoroResult<()> + Send + Sync>;
+
 pub struct Transaction {
     global_txn: Weak<Mutex<Option<Transaction>>>,
     peer: PeerID,
@@ -57,6 +78,8 @@ pub struct Transaction {
     finished: bool,
     on_commit: Option<OnCommitFn>,
     timestamp: Option<Timestamp>,
+    msg: Option<Arc<str>>,
+    author: Option<Arc<str>>,
 }
 
 impl std::fmt::Debug for Transaction {
@@ -75,6 +98,8 @@ impl std::fmt::Debug for Transaction {
             .field("finished", &self.finished)
             .field("on_commit", &self.on_commit.is_some())
             .field("timestamp", &self.timestamp)
+            .field("msg", &self.msg)
+            .field("author", &self.author)
             .finish()
     }
 }
@@ -126,7 +151,7 @@ pub(super) enum EventHint {
     Tree(TreeDiffItem),
     MarkEnd,
     #[cfg(feature = "counter")]
-    Counter(f64),
+    Counter(crate::op::CounterDelta),
 }
 
 impl generic_btree::rle::HasLength for EventHint {
@@ -258,6 +283,8 @@ impl Transaction {
             oplog,
             frontiers,
             timestamp: None,
+            msg: None,
+            author: None,
             global_txn,
             next_counter,
             next_lamport,
@@ -283,6 +310,14 @@ impl Transaction {
         self.timestamp = Some(time);
     }
 
+    pub fn set_msg(&mut self, msg: Option<Arc<str>>) {
+        self.msg = msg;
+    }
+
+    pub fn set_author(&mut self, author: Option<Arc<str>>) {
+        self.author = author;
+    }
+
     pub(crate) fn set_on_commit(&mut self, f: OnCommitFn) {
         self.on_commit = Some(f);
     }
@@ -291,6 +326,78 @@ impl Transaction {
         self.on_commit.take()
     }
 
+    /// Get the change that will be created by committing this txn, or None if it's empty.
+    pub(crate) fn pending_change(&self) -> Option<PendingLocalChange> {
+        if self.local_ops.is_empty() {
+            return None;
+        }
+
+        let change = Change {
+            lamport: self.start_lamport,
+            ops: self.local_ops.clone(),
+            deps: self.frontiers.clone(),
+            id: ID::new(self.peer, self.start_counter),
+            timestamp: 0,
+            has_dependents: false,
+            commit_msg: self.msg.clone(),
+            author: self.author.clone(),
+        };
+        let mut diff = DiffBatch::default();
+        for d in change_to_diff(
+            &change,
+            &self.arena,
+            &self.global_txn,
+            &Arc::downgrade(&self.state),
+            self.event_hints.clone(),
+        ) {
+            let id = self.arena.idx_to_id(d.idx).unwrap();
+            match diff.0.entry(id) {
+                Entry::Occupied(mut o) => o.get_mut().compose_ref(&d.diff),
+                Entry::Vacant(v) => {
+                    v.insert(d.diff);
+                }
+            }
+        }
+
+        Some(PendingLocalChange {
+            id: change.id,
+            lamport: change.lamport,
+            len: (self.next_counter - self.start_counter) as usize,
+            diff,
+        })
+    }
+
+    /// Discard the ops of the txn, and restore the states changed by them.
+    pub(crate) fn abort(mut self) {
+        self.finished = true;
+        // The ids of the containers created by the txn are in its span, so they are new
+        let span = IdSpan::new(self.peer, self.start_counter, self.next_counter);
+        let mut created = Vec::new();
+        for op in self.local_ops.iter() {
+            op.content.visit_created_children(&self.arena, &mut |c| {
+                if let ContainerID::Normal { peer, counter, .. } = c {
+                    if span.contains(ID::new(*peer, *counter)) {
+                        created.push(c.clone());
+                    }
+                }
+            });
+        }
+
+        let containers: FxHashSet<ContainerIdx> = self
+            .local_ops
+            .iter()
+            .map(|op| op.container)
+            .filter(|idx| {
+                !created
+                    .iter()
+                    .any(|c| self.arena.id_to_idx(c) == Some(*idx))
+            })
+            .collect();
+        let mut state = self.state.lock().unwrap();
+        let oplog = self.oplog.lock().unwrap();
+        state.rollback_txn(&oplog, &containers, &created);
+    }
+
     fn _commit(&mut self) -> Result<(), LoroError> {
         if self.finished {
             return Ok(());
@@ -316,6 +423,8 @@ impl Transaction {
                     .unwrap_or_else(|| oplog.get_timestamp_for_next_txn()),
             ),
             has_dependents: false,
+            commit_msg: self.msg.take(),
+            author: self.author.take(),
         };
 
         let diff = if state.is_recording() {
@@ -673,7 +782,10 @@ fn change_to_diff(
                         .retain(to as usize, Default::default())
                         .insert(
                             ArrayVec::from([ValueOrHandler::from_value(value, arena, txn, state)]),
-                            ListDeltaMeta { from_move: true },
+                            ListDeltaMeta {
+                                from_move: true,
+                                from_set: false,
+                            },
                         )
                         .build(),
                 );
@@ -688,12 +800,15 @@ fn change_to_diff(
                     diff: Diff::List(
                         DeltaRopeBuilder::new()
                             .retain(index, Default::default())
-                            .delete(1)
-                            .insert(
+                            .replace(
                                 ArrayVec::from([ValueOrHandler::from_value(
                                     value, arena, txn, state,
                                 )]),
-                                Default::default(),
+                                ListDeltaMeta {
+                                    from_move: false,
+                                    from_set: true,
+                                },
+                                1,
                             )
                             .build(),
                     ),
@@ -706,7 +821,7 @@ fn change_to_diff(
             EventHint::Counter(diff) => {
                 ans.push(TxnContainerDiff {
                     idx: op.container,
-                    diff: Diff::Counter(diff),
+                    diff: Diff::Counter(diff.to_f64()),
                 });
             }
         }
@@ -4,7 +4,7 @@ use std::{
 };
 
 use either::Either;
-use fxhash::FxHashMap;
+use fxhash::{FxHashMap, FxHashSet};
 use loro_common::{
     ContainerID, Counter, CounterSpan, HasCounterSpan, HasIdSpan, IdSpan, LoroError, LoroResult,
     LoroValue, PeerID,
@@ -62,6 +62,23 @@ impl DiffBatch {
     pub fn clear(&mut self) {
         self.0.clear();
     }
+
+    /// Iterate over the diff of each container. The order is arbitrary.
+    pub fn iter(&self) -> impl Iterator<Item = (&ContainerID, &Diff)> + '_ {
+        self.0.iter()
+    }
+
+    pub fn get(&self, id: &ContainerID) -> Option<&Diff> {
+        self.0.get(id)
+    }
+
+    pub fn len(&self) -> usize {
+        self.0.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
 }
 
 fn transform_cursor(
@@ -157,6 +174,20 @@ struct UndoManagerInner {
     last_popped_selection: Option<Vec<CursorWithPos>>,
     on_push: Option<OnPush>,
     on_pop: Option<OnPop>,
+    group: Option<UndoGroup>,
+}
+
+/// The state of an explicit undo group started by [UndoManager::start_group].
+///
+/// Every checkpoint recorded inside the group is merged into a single undo item.
+#[derive(Debug, Default)]
+struct UndoGroup {
+    /// The number of `start_group` calls that have not been ended yet
+    depth: usize,
+    /// Whether the undo item of this group has been pushed
+    has_item: bool,
+    /// The containers touched by the local changes of this group
+    affected_cids: FxHashSet<ContainerID>,
 }
 
 impl std::fmt::Debug for UndoManagerInner {
@@ -170,6 +201,7 @@ impl std::fmt::Debug for UndoManagerInner {
             .field("merge_interval", &self.merge_interval)
             .field("max_stack_size", &self.max_stack_size)
             .field("exclude_origin_prefixes", &self.exclude_origin_prefixes)
+            .field("group", &self.group)
             .finish()
     }
 }
@@ -266,12 +298,37 @@ impl Stack {
     }
 
     pub fn push(&mut self, span: CounterSpan, meta: UndoItemMeta) {
-        self.push_with_merge(span, meta, false)
+        self.push_with_merge(span, meta, false, None)
     }
 
-    pub fn push_with_merge(&mut self, span: CounterSpan, meta: UndoItemMeta, can_merge: bool) {
+    /// Push a new item, or merge it into the last item if `can_merge` is true.
+    ///
+    /// Normally an item cannot be merged if there are remote changes after the last item.
+    /// But if `group` is given, the merge is still allowed when none of the remote changes
+    /// touch the containers in `group`.
+    pub fn push_with_merge(
+        &mut self,
+        span: CounterSpan,
+        meta: UndoItemMeta,
+        can_merge: bool,
+        group: Option<&FxHashSet<ContainerID>>,
+    ) {
         let last = self.stack.back_mut().unwrap();
         let mut last_remote_diff = last.1.try_lock().unwrap();
+        let remote_diff_is_independent = match group {
+            Some(group) => last_remote_diff.0.keys().all(|cid| !group.contains(cid)),
+            None => false,
+        };
+        if can_merge && (last_remote_diff.0.is_empty() || remote_diff_is_independent) {
+            if let Some(last_span) = last.0.back_mut() {
+                if last_span.span.end == span.start {
+                    // merge the span
+                    last_span.span.end = span.end;
+                    return;
+                }
+            }
+        }
+
         if !last_remote_diff.0.is_empty() {
             // If the remote diff is not empty, we cannot merge
             if last.0.is_empty() {
@@ -287,16 +344,6 @@ impl Stack {
 
             self.size += 1;
         } else {
-            if can_merge {
-                if let Some(last_span) = last.0.back_mut() {
-                    if last_span.span.end == span.start {
-                        // merge the span
-                        last_span.span.end = span.end;
-                        return;
-                    }
-                }
-            }
-
             self.size += 1;
             last.0.push_back(StackItem { span, meta });
         }
@@ -341,6 +388,23 @@ impl Stack {
         self.size
     }
 
+    /// The approximate memory usage of the items and the remote diffs in bytes.
+    fn estimate_size(&self) -> usize {
+        self.stack
+            .iter()
+            .map(|(items, diff)| {
+                items
+                    .iter()
+                    .map(|x| {
+                        std::mem::size_of::<StackItem>()
+                            + x.meta.cursors.len() * std::mem::size_of::<CursorWithPos>()
+                    })
+                    .sum::<usize>()
+                    + diff.try_lock().unwrap().0.len() * std::mem::size_of::<(ContainerID, Diff)>()
+            })
+            .sum()
+    }
+
     fn pop_front(&mut self) {
         if self.is_empty() {
             return;
@@ -376,6 +440,7 @@ impl UndoManagerInner {
             last_popped_selection: None,
             on_pop: None,
             on_push: None,
+            group: None,
         }
     }
 
@@ -393,8 +458,19 @@ impl UndoManagerInner {
             .map(|x| x(UndoOrRedo::Undo, span))
             .unwrap_or_default();
 
-        if !self.undo_stack.is_empty() && now - self.last_undo_time < self.merge_interval {
-            self.undo_stack.push_with_merge(span, meta, true);
+        if let Some(group) = self.group.as_mut() {
+            if group.has_item && !self.undo_stack.is_empty() {
+                self.undo_stack
+                    .push_with_merge(span, meta, true, Some(&group.affected_cids));
+            } else {
+                group.has_item = true;
+                self.undo_stack.push(span, meta);
+            }
+
+            // The next checkpoint after the group should not be merged into it
+            self.last_undo_time = 0;
+        } else if !self.undo_stack.is_empty() && now - self.last_undo_time < self.merge_interval {
+            self.undo_stack.push_with_merge(span, meta, true, None);
         } else {
             self.last_undo_time = now;
             self.undo_stack.push(span, meta);
@@ -447,6 +523,11 @@ impl UndoManager {
                         inner.redo_stack.compose_remote_event(event.events);
                         inner.latest_counter = id.counter + 1;
                     } else {
+                        if let Some(group) = inner.group.as_mut() {
+                            group
+                                .affected_cids
+                                .extend(event.events.iter().map(|e| e.id.clone()));
+                        }
                         inner.record_checkpoint(id.counter + 1);
                     }
                 }
@@ -500,6 +581,47 @@ impl UndoManager {
         Ok(())
     }
 
+    /// Start an undo group.
+    ///
+    /// All the local changes committed before the matching [UndoManager::end_group]
+    /// are merged into a single undo item, regardless of the merge interval.
+    /// Groups can be nested; the inner groups are folded into the outermost one.
+    ///
+    /// If remote changes that touch the same containers are imported in the middle
+    /// of the group, the group has to be split into separate undo items.
+    pub fn start_group(&mut self, doc: &LoroDoc) -> LoroResult<()> {
+        // Make sure the pending changes before the group are not merged into it
+        self.record_new_checkpoint(doc)?;
+        let mut inner = self.inner.try_lock().unwrap();
+        inner.group.get_or_insert_with(Default::default).depth += 1;
+        Ok(())
+    }
+
+    /// End the undo group started by [UndoManager::start_group].
+    ///
+    /// The pending changes are committed and folded into the group. It's a no-op
+    /// if there is no group.
+    pub fn end_group(&mut self, doc: &LoroDoc) -> LoroResult<()> {
+        if self.inner.try_lock().unwrap().group.is_none() {
+            return Ok(());
+        }
+
+        self.record_new_checkpoint(doc)?;
+        let mut inner = self.inner.try_lock().unwrap();
+        let group = inner.group.as_mut().unwrap();
+        group.depth -= 1;
+        if group.depth == 0 {
+            inner.group = None;
+        }
+
+        Ok(())
+    }
+
+    /// Whether there is an undo group that has not been ended.
+    pub fn in_group(&self) -> bool {
+        self.inner.try_lock().unwrap().group.is_some()
+    }
+
     #[instrument(skip_all)]
     pub fn undo(&mut self, doc: &LoroDoc) -> LoroResult<bool> {
         self.perform(
@@ -586,6 +708,12 @@ impl UndoManager {
         let mut top = {
             let mut inner = self.inner.try_lock().unwrap();
             inner.processing_undo = true;
+            if let Some(group) = inner.group.as_mut() {
+                // The changes after the undo/redo should not be merged into the popped item
+                group.has_item = false;
+                group.affected_cids.clear();
+            }
+
             get_stack(&mut inner).pop()
         };
 
@@ -666,6 +794,15 @@ impl UndoManager {
         !self.inner.try_lock().unwrap().undo_stack.is_empty()
     }
 
+    /// The approximate memory usage of the undo and redo stacks in bytes.
+    ///
+    /// It's not included in [LoroDoc::memory_usage], because the doc doesn't own its undo
+    /// managers. Add it to [crate::loro::MemoryStats::undo] to count it in.
+    pub fn memory_usage(&self) -> usize {
+        let inner = self.inner.try_lock().unwrap();
+        inner.undo_stack.estimate_size() + inner.redo_stack.estimate_size()
+    }
+
     pub fn can_redo(&self) -> bool {
         !self.inner.try_lock().unwrap().redo_stack.is_empty()
     }
@@ -99,6 +99,18 @@ impl StringSlice {
         count_utf16_len(self.bytes())
     }
 
+    /// The length in [Event Index](crate::event::Index)
+    ///
+    /// - if feature="wasm", it's the UTF-16 length
+    /// - if feature!="wasm", it's the Unicode length
+    pub fn len_event(&self) -> usize {
+        if cfg!(feature = "wasm") {
+            self.len_utf16()
+        } else {
+            self.len_unicode()
+        }
+    }
+
     pub fn is_empty(&self) -> bool {
         self.bytes().is_empty()
     }
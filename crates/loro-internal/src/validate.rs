@@ -0,0 +1,303 @@
+//! Check the invariants of a doc without panicking.
+//!
+//! [LoroDoc::validate] reports the broken invariants as [Inconsistency]s, so a doc
+//! corrupted by a bad import can be detected and dropped or repaired by [LoroDoc::repair]
+//! instead of crashing the application later.
+use std::fmt::Display;
+
+use fxhash::{FxHashMap, FxHashSet};
+use loro_common::{ContainerID, Counter, HasCounter, HasCounterSpan, PeerID, ID};
+
+use crate::{change::Lamport, oplog::OpLog, version::Frontiers, LoroDoc};
+
+/// A broken invariant found by [LoroDoc::validate].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Inconsistency {
+    /// The changes of a peer don't start from counter 0 or are not continuous
+    CounterGap {
+        peer: PeerID,
+        expected: Counter,
+        found: Counter,
+    },
+    /// The version vector of the oplog doesn't match the changes of a peer
+    VersionMismatch {
+        peer: PeerID,
+        changes_end: Counter,
+        vv_end: Counter,
+    },
+    /// A dep of a change is not in the oplog
+    MissingDep { change: ID, dep: ID },
+    /// The lamport of a change is not greater than the lamport of its dep
+    InvalidLamport {
+        change: ID,
+        lamport: Lamport,
+        dep: ID,
+        dep_lamport: Lamport,
+    },
+    /// The frontiers of the oplog are not the ops that no other op depends on
+    WrongFrontiers {
+        expected: Frontiers,
+        found: Frontiers,
+    },
+    /// The version of the state is not in the oplog
+    StateVersionNotFound { frontiers: Frontiers },
+    /// A container is one of its own ancestors
+    ContainerCycle { container: ContainerID },
+}
+
+impl Inconsistency {
+    /// Whether it may be fixed by [LoroDoc::repair].
+    pub fn is_recoverable(&self) -> bool {
+        matches!(
+            self,
+            Inconsistency::VersionMismatch { .. } | Inconsistency::WrongFrontiers { .. }
+        )
+    }
+}
+
+impl Display for Inconsistency {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Inconsistency::CounterGap {
+                peer,
+                expected,
+                found,
+            } => write!(
+                f,
+                "The change of peer {} starts at counter {}, expected {}",
+                peer, found, expected
+            ),
+            Inconsistency::VersionMismatch {
+                peer,
+                changes_end,
+                vv_end,
+            } => write!(
+                f,
+                "The changes of peer {} end at counter {}, but the version vector ends at {}",
+                peer, changes_end, vv_end
+            ),
+            Inconsistency::MissingDep { change, dep } => {
+                write!(
+                    f,
+                    "The dep {} of change {} is not in the oplog",
+                    dep, change
+                )
+            }
+            Inconsistency::InvalidLamport {
+                change,
+                lamport,
+                dep,
+                dep_lamport,
+            } => write!(
+                f,
+                "The lamport {} of change {} is not greater than the lamport {} of its dep {}",
+                lamport, change, dep_lamport, dep
+            ),
+            Inconsistency::WrongFrontiers { expected, found } => write!(
+                f,
+                "The frontiers of the oplog are {:?}, expected {:?}",
+                found, expected
+            ),
+            Inconsistency::StateVersionNotFound { frontiers } => {
+                write!(
+                    f,
+                    "The version {:?} of the state is not in the oplog",
+                    frontiers
+                )
+            }
+            Inconsistency::ContainerCycle { container } => {
+                write!(f, "The container {} is one of its own ancestors", container)
+            }
+        }
+    }
+}
+
+impl LoroDoc {
+    /// Check the invariants of the oplog, the state and the container hierarchy.
+    ///
+    /// It returns the broken invariants instead of panicking, and an empty vec if the doc
+    /// is consistent. It goes through the whole history, so it's slow on a large doc.
+    pub fn validate(&self) -> Vec<Inconsistency> {
+        let state_frontiers = self.state_frontiers();
+        let (mut ans, arena) = {
+            let oplog = self.oplog().lock().unwrap();
+            let mut ans = validate_oplog(&oplog);
+            if state_frontiers
+                .iter()
+                .any(|id| oplog.get_change_at(*id).is_none())
+            {
+                ans.push(Inconsistency::StateVersionNotFound {
+                    frontiers: state_frontiers,
+                });
+            }
+            (ans, oplog.arena.clone())
+        };
+
+        let containers = arena.export_containers();
+        let parents = arena.export_parents();
+        for (i, container) in containers.into_iter().enumerate() {
+            // The depth of a container can't be greater than the number of containers
+            let mut parent = parents.get(i).copied().flatten();
+            let mut steps = 0;
+            while let Some(p) = parent {
+                if p.to_index() as usize == i || steps > parents.len() {
+                    ans.push(Inconsistency::ContainerCycle { container });
+                    break;
+                }
+
+                parent = parents.get(p.to_index() as usize).copied().flatten();
+                steps += 1;
+            }
+        }
+
+        ans
+    }
+
+    /// Fix the recoverable inconsistencies found by [LoroDoc::validate], and return the
+    /// ones that are left.
+    ///
+    /// The version vector and the frontiers of the oplog are recalculated from its changes.
+    /// The other inconsistencies mean that some history is lost or broken, and they can't be
+    /// fixed in place.
+    pub fn repair(&self) -> Vec<Inconsistency> {
+        self.commit_then_stop();
+        {
+            let mut oplog = self.oplog().lock().unwrap();
+            for inconsistency in validate_oplog(&oplog) {
+                match inconsistency {
+                    Inconsistency::VersionMismatch {
+                        peer, changes_end, ..
+                    } => {
+                        // It can only be fixed if the causal graph has the same changes
+                        let dag_end = oplog
+                            .dag
+                            .map
+                            .get(&peer)
+                            .and_then(|nodes| nodes.last())
+                            .map_or(0, |node| node.cnt + node.len as Counter);
+                        if dag_end != changes_end {
+                            continue;
+                        }
+
+                        if changes_end == 0 {
+                            oplog.dag.vv.remove(&peer);
+                        } else {
+                            oplog.dag.vv.insert(peer, changes_end);
+                        }
+                    }
+                    Inconsistency::WrongFrontiers { expected, .. } => {
+                        oplog.dag.frontiers = expected;
+                    }
+                    _ => {}
+                }
+            }
+        }
+
+        self.renew_txn_if_auto_commit();
+        self.validate()
+    }
+}
+
+fn validate_oplog(oplog: &OpLog) -> Vec<Inconsistency> {
+    let mut ans = Vec::new();
+    let mut changes_end: FxHashMap<PeerID, Counter> = FxHashMap::default();
+    let mut deps: FxHashSet<ID> = FxHashSet::default();
+    for (&peer, changes) in oplog.changes().iter() {
+        let mut expected = 0;
+        for change in changes.iter() {
+            if change.ctr_start() != expected {
+                ans.push(Inconsistency::CounterGap {
+                    peer,
+                    expected,
+                    found: change.ctr_start(),
+                });
+            }
+
+            expected = change.ctr_end();
+            for &dep in change.deps.iter() {
+                deps.insert(dep);
+                match oplog.get_change_at(dep) {
+                    Some(dep_change) => {
+                        let dep_lamport =
+                            dep_change.lamport + (dep.counter - dep_change.ctr_start()) as Lamport;
+                        if dep_lamport >= change.lamport {
+                            ans.push(Inconsistency::InvalidLamport {
+                                change: change.id,
+                                lamport: change.lamport,
+                                dep,
+                                dep_lamport,
+                            });
+                        }
+                    }
+                    None => ans.push(Inconsistency::MissingDep {
+                        change: change.id,
+                        dep,
+                    }),
+                }
+            }
+        }
+
+        changes_end.insert(peer, expected);
+    }
+
+    let peers: FxHashSet<PeerID> = changes_end
+        .keys()
+        .chain(oplog.dag.vv.keys())
+        .copied()
+        .collect();
+    for peer in peers {
+        let changes_end = changes_end.get(&peer).copied().unwrap_or(0);
+        let vv_end = oplog.dag.vv.get(&peer).copied().unwrap_or(0);
+        if changes_end != vv_end {
+            ans.push(Inconsistency::VersionMismatch {
+                peer,
+                changes_end,
+                vv_end,
+            });
+        }
+    }
+
+    // The frontiers are the last ops of the peers that no change depends on
+    let expected: Frontiers = changes_end
+        .iter()
+        .filter(|(_, &end)| end > 0)
+        .map(|(&peer, &end)| ID::new(peer, end - 1))
+        .filter(|id| !deps.contains(id))
+        .collect();
+    let found = oplog.frontiers();
+    if expected.len() != found.len() || &expected != found {
+        ans.push(Inconsistency::WrongFrontiers {
+            expected,
+            found: found.clone(),
+        });
+    }
+
+    ans
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[test]
+    fn repair_wrong_frontiers() {
+        let doc = LoroDoc::new_auto_commit();
+        doc.set_peer_id(1).unwrap();
+        doc.get_text("text").insert(0, "Hello").unwrap();
+        doc.commit_then_renew();
+        assert!(doc.validate().is_empty());
+
+        doc.oplog().lock().unwrap().dag.frontiers = Frontiers::from_id(ID::new(1, 1));
+        let found = doc.validate();
+        assert_eq!(
+            found,
+            vec![Inconsistency::WrongFrontiers {
+                expected: Frontiers::from_id(ID::new(1, 4)),
+                found: Frontiers::from_id(ID::new(1, 1)),
+            }]
+        );
+        assert!(found[0].is_recoverable());
+        assert!(doc.repair().is_empty());
+        assert_eq!(doc.oplog_frontiers(), Frontiers::from_id(ID::new(1, 4)));
+    }
+}
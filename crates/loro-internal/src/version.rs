@@ -384,6 +384,12 @@ impl DerefMut for VersionVector {
 }
 
 impl VersionVector {
+    /// Get the spans that each side is missing.
+    ///
+    /// - `left` contains the spans that are in `self` but not in `rhs`
+    /// - `right` contains the spans that are in `rhs` but not in `self`
+    ///
+    /// Both sides may be non-empty if the versions are concurrent.
     pub fn diff(&self, rhs: &Self) -> VersionVectorDiff {
         let mut ans: VersionVectorDiff = Default::default();
         for (client_id, &counter) in self.iter() {
@@ -409,7 +415,7 @@ impl VersionVector {
                     }
                     Ordering::Equal => {}
                 }
-            } else {
+            } else if counter > 0 {
                 ans.left.insert(
                     *client_id,
                     CounterSpan {
@@ -420,7 +426,7 @@ impl VersionVector {
             }
         }
         for (client_id, &rhs_counter) in rhs.iter() {
-            if !self.contains_key(client_id) {
+            if !self.contains_key(client_id) && rhs_counter > 0 {
                 ans.right.insert(
                     *client_id,
                     CounterSpan {
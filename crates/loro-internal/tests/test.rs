@@ -973,3 +973,42 @@ fn counter() {
     let doc2 = LoroDoc::new_auto_commit();
     doc2.import_json_updates(json).unwrap();
 }
+
+#[test]
+#[cfg(feature = "counter")]
+fn counter_sums_integers_exactly() {
+    let a = LoroDoc::new_auto_commit();
+    a.set_peer_id(1).unwrap();
+    let b = LoroDoc::new_auto_commit();
+    b.set_peer_id(2).unwrap();
+    let big = (1i64 << 53) + 1;
+    a.get_counter("counter").increment_int(big).unwrap();
+    a.commit_then_renew();
+    let before_concurrent = a.oplog_frontiers();
+    b.get_counter("counter").increment_int(big).unwrap();
+    b.get_counter("counter").increment(2.).unwrap();
+    a.import(&b.export_from(&Default::default())).unwrap();
+    b.import(&a.export_from(&Default::default())).unwrap();
+    let expected = 2 * big as i128 + 2;
+    assert_eq!(a.get_counter("counter").get_int_value(), Some(expected));
+    assert_eq!(b.get_counter("counter").get_int_value(), Some(expected));
+
+    // The snapshot and the json updates keep the exact value
+    let c = LoroDoc::new_auto_commit();
+    c.import(&a.export_snapshot()).unwrap();
+    assert_eq!(c.get_counter("counter").get_int_value(), Some(expected));
+    let d = LoroDoc::new_auto_commit();
+    d.import_json_updates(a.export_json_updates(&Default::default(), &a.oplog_vv()))
+        .unwrap();
+    assert_eq!(d.get_counter("counter").get_int_value(), Some(expected));
+
+    // The diff of checkout is exact too
+    c.checkout(&before_concurrent).unwrap();
+    assert_eq!(c.get_counter("counter").get_int_value(), Some(big as i128));
+
+    // Fractional increments make it inexact
+    a.get_counter("counter").increment(0.5).unwrap();
+    assert_eq!(a.get_counter("counter").get_int_value(), None);
+    a.get_counter("counter").increment(0.5).unwrap();
+    assert_eq!(a.get_counter("counter").get_int_value(), Some(expected + 1));
+}
@@ -1,8 +1,12 @@
+use std::sync::Arc;
+
 use js_sys::{Array, Object, Reflect};
-use loro_internal::{awareness::Awareness as InternalAwareness, id::PeerID};
+use loro_internal::{awareness::Awareness as InternalAwareness, id::PeerID, obs::SubID};
 use wasm_bindgen::prelude::*;
 
-use crate::{js_peer_to_peer, JsIntoPeerID, JsResult, JsStrPeerID};
+use crate::{
+    call_js_after_micro_task, js_peer_to_peer, observer, JsIntoPeerID, JsResult, JsStrPeerID,
+};
 
 /// `Awareness` is a structure that tracks the ephemeral state of peers.
 ///
@@ -70,6 +74,39 @@ impl AwarenessWasm {
         Ok(v.into())
     }
 
+    /// Subscribe to the changes of the states.
+    ///
+    /// The listener receives `{ added, updated, removed }` with the ids of the changed peers,
+    /// including the peers removed by `removeOutdated`. It's called after the current
+    /// micro task.
+    ///
+    /// Returns a subscription ID, which can be used to unsubscribe.
+    #[wasm_bindgen(skip_typescript)]
+    pub fn subscribe(&mut self, f: js_sys::Function) -> u32 {
+        let observer = observer::Observer::new(f);
+        self.inner
+            .subscribe(Arc::new(move |change| {
+                let obj = Object::new();
+                for (key, peers) in [
+                    ("added", &change.added),
+                    ("updated", &change.updated),
+                    ("removed", &change.removed),
+                ] {
+                    let arr = Array::from_iter(peers.iter().map(|&peer| peer_to_str_js(peer)));
+                    Reflect::set(&obj, &key.into(), &arr).unwrap();
+                }
+                call_js_after_micro_task(observer.clone(), obj.into())
+            }))
+            .into_u32()
+    }
+
+    /// Unsubscribe by the subscription id.
+    ///
+    /// Returns false if the subscription doesn't exist.
+    pub fn unsubscribe(&mut self, subscription: u32) -> bool {
+        self.inner.unsubscribe(SubID::from_u32(subscription))
+    }
+
     /// Sets the state of the local peer.
     #[wasm_bindgen(skip_typescript)]
     pub fn setLocalState(&mut self, value: JsValue) {
@@ -171,6 +171,29 @@ fn delta_item_to_js(item: ListDiffItem, doc: &Arc<LoroDoc>) -> (JsValue, Option<
             .unwrap();
             (obj.into_js_result().unwrap(), None)
         }
+        loro_internal::loro_delta::DeltaItem::Replace {
+            value,
+            attr,
+            delete,
+        } if attr.from_set && value.len() == delete => {
+            let obj = Object::new();
+            let arr = Array::new_with_length(value.len() as u32);
+            for (i, v) in value.into_iter().enumerate() {
+                let value = match v {
+                    ValueOrHandler::Value(v) => convert(v),
+                    ValueOrHandler::Handler(h) => handler_to_js_value(h, Some(doc.clone())),
+                };
+                arr.set(i as u32, value);
+            }
+
+            js_sys::Reflect::set(
+                &obj,
+                &JsValue::from_str("set"),
+                &arr.into_js_result().unwrap(),
+            )
+            .unwrap();
+            (obj.into_js_result().unwrap(), None)
+        }
         loro_internal::loro_delta::DeltaItem::Replace {
             value,
             attr: _,
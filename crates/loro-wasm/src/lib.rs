@@ -8,14 +8,19 @@ use js_sys::{Array, Object, Promise, Reflect, Uint8Array};
 use loro_internal::{
     change::Lamport,
     configure::{StyleConfig, StyleConfigMap},
-    container::{richtext::ExpandType, ContainerID},
-    cursor::{self, Side},
+    container::{
+        richtext::{ExpandType, IndexType},
+        ContainerID,
+    },
+    container_blob::ForeignMergeStrategy,
+    cursor::{self, CursorStatus, Side},
     encoding::ImportBlobMetadata,
     event::Index,
     handler::{
         Handler, ListHandler, MapHandler, TextDelta, TextHandler, TreeHandler, ValueOrHandler,
     },
     id::{Counter, TreeID, ID},
+    json_patch::JsonPatchOp,
     loro::CommitOptions,
     obs::SubID,
     undo::{UndoItemMeta, UndoOrRedo},
@@ -25,7 +30,7 @@ use loro_internal::{
 };
 use rle::HasLength;
 use serde::{Deserialize, Serialize};
-use std::{cell::RefCell, cmp::Ordering, rc::Rc, sync::Arc};
+use std::{cell::RefCell, cmp::Ordering, ops::ControlFlow, rc::Rc, sync::Arc};
 use wasm_bindgen::{__rt::IntoJsResult, prelude::*, throw_val};
 use wasm_bindgen_derive::TryFromJsValue;
 
@@ -95,6 +100,10 @@ extern "C" {
     pub type JsIDs;
     #[wasm_bindgen(typescript_type = "{ start: number, end: number }")]
     pub type JsRange;
+    #[wasm_bindgen(typescript_type = "{ start: number, end: number }[]")]
+    pub type JsRanges;
+    #[wasm_bindgen(typescript_type = "[number, number][]")]
+    pub type JsMoves;
     #[wasm_bindgen(typescript_type = "number|bool|string|null")]
     pub type JsMarkValue;
     #[wasm_bindgen(typescript_type = "TreeID")]
@@ -161,7 +170,9 @@ extern "C" {
     pub type JsImportBlobMetadata;
     #[wasm_bindgen(typescript_type = "Side")]
     pub type JsSide;
-    #[wasm_bindgen(typescript_type = "{ update?: Cursor, offset: number, side: Side }")]
+    #[wasm_bindgen(
+        typescript_type = "{ update?: Cursor, offset: number, side: Side, status: \"exact\" | \"shifted\" | \"deleted\" }"
+    )]
     pub type JsCursorQueryAns;
     #[wasm_bindgen(typescript_type = "UndoConfig")]
     pub type JsUndoConfig;
@@ -223,6 +234,48 @@ mod observer {
     unsafe impl Sync for Observer {}
 }
 
+/// A [std::io::Write] that forwards every written chunk to a js callback as an `Uint8Array`.
+struct JsChunkWriter {
+    callback: js_sys::Function,
+    err: Option<JsValue>,
+}
+
+impl JsChunkWriter {
+    fn new(callback: js_sys::Function) -> Self {
+        Self {
+            callback,
+            err: None,
+        }
+    }
+
+    fn finish(self, result: std::io::Result<()>) -> JsResult<()> {
+        if let Some(err) = self.err {
+            return Err(err);
+        }
+
+        result.map_err(|e| JsValue::from_str(&e.to_string()))
+    }
+}
+
+impl std::io::Write for JsChunkWriter {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        let chunk = Uint8Array::from(buf);
+        if let Err(e) = self.callback.call1(&JsValue::NULL, &chunk) {
+            self.err = Some(e);
+            return Err(std::io::Error::new(
+                std::io::ErrorKind::Other,
+                "the export callback threw an error",
+            ));
+        }
+
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
 fn ids_to_frontiers(ids: Vec<JsID>) -> JsResult<Frontiers> {
     let mut frontiers = Frontiers::default();
     for id in ids {
@@ -248,6 +301,13 @@ fn js_id_to_id(id: JsID) -> Result<ID, JsValue> {
     Ok(id)
 }
 
+fn js_to_map_entries(entries: JsValue) -> JsResult<Vec<(String, LoroValue)>> {
+    match LoroValue::from(entries) {
+        LoroValue::Map(map) => Ok(map.iter().map(|(k, v)| (k.clone(), v.clone())).collect()),
+        _ => Err(JsValue::from_str("The entries should be an object")),
+    }
+}
+
 fn frontiers_to_ids(frontiers: &Frontiers) -> JsIDs {
     let js_arr = Array::new();
     for id in frontiers.iter() {
@@ -276,6 +336,31 @@ fn js_value_to_container_id(
     Ok(cid)
 }
 
+fn js_str_to_index_type(s: &str) -> JsResult<IndexType> {
+    match s {
+        "entity" => Ok(IndexType::Entity),
+        "utf8" => Ok(IndexType::Utf8),
+        "utf16" => Ok(IndexType::Utf16),
+        "unicode" => Ok(IndexType::Unicode),
+        _ => Err(JsValue::from_str(&format!(
+            "Invalid index type {}. It should be one of \"entity\", \"utf8\", \"utf16\" and \"unicode\"",
+            s
+        ))),
+    }
+}
+
+fn js_str_to_merge_strategy(s: &str) -> JsResult<ForeignMergeStrategy> {
+    match s {
+        "rename" => Ok(ForeignMergeStrategy::Rename),
+        "merge" => Ok(ForeignMergeStrategy::Merge),
+        "skip" => Ok(ForeignMergeStrategy::Skip),
+        _ => Err(JsValue::from_str(&format!(
+            "Invalid merge strategy {}. It should be one of \"rename\", \"merge\" and \"skip\"",
+            s
+        ))),
+    }
+}
+
 #[derive(Debug, Clone, Serialize)]
 struct StringID {
     peer: String,
@@ -311,6 +396,26 @@ impl Loro {
         Self(Arc::new(doc))
     }
 
+    /// Create a new loro document whose peer ids are derived from `seed` deterministically.
+    ///
+    /// The peer id of the document and the peer ids generated later (e.g. by `fork`) are
+    /// distinct from each other. It's useful for tests that expect stable exported bytes.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const a = Loro.fromPeerSeed(42n);
+    /// const b = Loro.fromPeerSeed(42n);
+    /// console.log(a.peerId === b.peerId); // true
+    /// ```
+    #[wasm_bindgen(js_name = "fromPeerSeed")]
+    pub fn from_peer_seed(seed: u64) -> Self {
+        let doc = LoroDoc::new_with_peer_seed(seed);
+        doc.start_auto_commit();
+        Self(Arc::new(doc))
+    }
+
     /// Set whether to record the timestamp of each change. Default is `false`.
     ///
     /// If enabled, the Unix timestamp will be recorded for each change automatically.
@@ -454,6 +559,44 @@ impl Loro {
         self.0.attach();
     }
 
+    /// Allow or forbid editing the document in detached mode.
+    ///
+    /// When it's enabled, you can edit the document after a `checkout`. The edits depend on the
+    /// checked out version, and they are merged with the newer ops as concurrent edits when the
+    /// document is attached again. The peer id may be renewed on checkout.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// text.insert(0, "Hello");
+    /// const frontiers = doc.frontiers();
+    /// text.insert(5, " World!");
+    /// doc.setDetachedEditing(true);
+    /// doc.checkout(frontiers);
+    /// text.insert(0, "Hi ");
+    /// doc.commitRebased();
+    /// console.log(text.toString()); // "Hi Hello World!"
+    /// ```
+    #[wasm_bindgen(js_name = "setDetachedEditing")]
+    pub fn set_detached_editing(&self, enable: bool) {
+        self.0.set_detached_editing(enable);
+    }
+
+    /// Whether the document can be edited in detached mode.
+    #[wasm_bindgen(js_name = "isDetachedEditingEnabled")]
+    pub fn is_detached_editing_enabled(&self) -> bool {
+        self.0.is_detached_editing_enabled()
+    }
+
+    /// Commit the edits made in detached mode and attach the document to the latest version.
+    #[wasm_bindgen(js_name = "commitRebased")]
+    pub fn commit_rebased(&self) {
+        self.0.commit_rebased();
+    }
+
     /// `detached` indicates that the `DocState` is not synchronized with the latest version of `OpLog`.
     ///
     /// > The document becomes detached during a `checkout` operation.
@@ -507,6 +650,30 @@ impl Loro {
         Self(Arc::new(self.0.fork()))
     }
 
+    /// Create a new document whose state and history equal this document's at `frontiers`.
+    ///
+    /// The new document gets a different PeerID, so its changes can be merged back.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// text.insert(0, "Hello");
+    /// doc.commit();
+    /// const frontiers = doc.frontiers();
+    /// text.insert(5, " world");
+    /// doc.commit();
+    /// const branch = doc.forkAt(frontiers);
+    /// console.log(branch.getText("text").toString()); // "Hello"
+    /// ```
+    #[wasm_bindgen(js_name = "forkAt")]
+    pub fn fork_at(&self, frontiers: Vec<JsID>) -> JsResult<Loro> {
+        let doc = self.0.fork_at(&ids_to_frontiers(frontiers)?)?;
+        Ok(Self(Arc::new(doc)))
+    }
+
     /// Checkout the `DocState` to the latest version of `OpLog`.
     ///
     /// > The document becomes detached during a `checkout` operation.
@@ -562,6 +729,119 @@ impl Loro {
         Ok(())
     }
 
+    /// Checkout to the version, call `f`, and then restore the version and the attachment
+    /// the doc had before, even if `f` throws.
+    ///
+    /// It returns the return value of `f`. It throws without calling `f` if the frontiers
+    /// are not in the history.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// text.insert(0, "Hello");
+    /// doc.commit();
+    /// const frontiers = doc.frontiers();
+    /// text.insert(5, " World");
+    /// const old = doc.withVersion(frontiers, () => text.toString());
+    /// console.log(old); // "Hello"
+    /// console.log(doc.isDetached()); // false
+    /// ```
+    #[wasm_bindgen(js_name = "withVersion")]
+    pub fn with_version(&self, frontiers: Vec<JsID>, f: js_sys::Function) -> JsResult<JsValue> {
+        let frontiers = ids_to_frontiers(frontiers)?;
+        self.0
+            .with_version(&frontiers, |_| f.call0(&JsValue::UNDEFINED))?
+    }
+
+    /// Calculate the diff between two versions.
+    ///
+    /// It returns an array of `{ target, diff }`, where `diff` has the same shape as
+    /// the diff in the events. The current state of the doc is not changed.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// const v0 = doc.frontiers();
+    /// text.insert(0, "Hello");
+    /// doc.commit();
+    /// const diff = doc.diff(v0, doc.frontiers());
+    /// // [{ target: "cid:root-text:Text", diff: { type: "text", diff: [{ insert: "Hello" }] } }]
+    /// ```
+    #[wasm_bindgen(skip_typescript)]
+    pub fn diff(&self, from: Vec<JsID>, to: Vec<JsID>) -> JsResult<JsValue> {
+        let from = ids_to_frontiers(from)?;
+        let to = ids_to_frontiers(to)?;
+        let batch = self.0.diff(&from, &to)?;
+        let arr = Array::new();
+        for (id, diff) in batch.iter() {
+            let obj = Object::new();
+            Reflect::set(&obj, &"target".into(), &id.to_string().into())?;
+            Reflect::set(&obj, &"diff".into(), &resolved_diff_to_js(diff, &self.0))?;
+            arr.push(&obj);
+        }
+
+        Ok(arr.into())
+    }
+
+    /// Export the changes between two versions as JSON Patch (RFC 6902) operations.
+    ///
+    /// The paths are JSON Pointers into the value of `toJSON()`. Text containers are
+    /// exported as a `replace` of the whole string. The current state of the doc is not changed.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const map = doc.getMap("map");
+    /// const v0 = doc.frontiers();
+    /// map.set("name", "Alice");
+    /// doc.commit();
+    /// const patch = doc.exportJsonPatch(v0, doc.frontiers());
+    /// // [{ op: "add", path: "/map/name", value: "Alice" }]
+    /// ```
+    #[wasm_bindgen(js_name = "exportJsonPatch")]
+    pub fn export_json_patch(&self, from: Vec<JsID>, to: Vec<JsID>) -> JsResult<Array> {
+        let from = ids_to_frontiers(from)?;
+        let to = ids_to_frontiers(to)?;
+        let arr = Array::new();
+        for op in self.0.export_json_patch(&from, &to)? {
+            let obj = Object::new();
+            let (name, value) = match op {
+                JsonPatchOp::Add { path, value } => {
+                    Reflect::set(&obj, &"path".into(), &path.into())?;
+                    ("add", Some(value))
+                }
+                JsonPatchOp::Remove { path } => {
+                    Reflect::set(&obj, &"path".into(), &path.into())?;
+                    ("remove", None)
+                }
+                JsonPatchOp::Replace { path, value } => {
+                    Reflect::set(&obj, &"path".into(), &path.into())?;
+                    ("replace", Some(value))
+                }
+                JsonPatchOp::Move { from, path } => {
+                    Reflect::set(&obj, &"from".into(), &from.into())?;
+                    Reflect::set(&obj, &"path".into(), &path.into())?;
+                    ("move", None)
+                }
+            };
+            Reflect::set(&obj, &"op".into(), &name.into())?;
+            if let Some(value) = value {
+                Reflect::set(&obj, &"value".into(), &value.into())?;
+            }
+            arr.push(&obj);
+        }
+
+        Ok(arr)
+    }
+
     /// Peer ID of the current writer.
     #[wasm_bindgen(js_name = "peerId", method, getter)]
     pub fn peer_id(&self) -> u64 {
@@ -590,15 +870,24 @@ impl Loro {
 
     /// Commit the cumulative auto committed transaction.
     ///
-    /// You can specify the `origin` and `timestamp` of the commit.
+    /// You can specify the `origin`, `timestamp`, `message` and `author` of the commit.
+    /// The message and the author are kept in the exported updates and snapshots.
     ///
     /// NOTE: Timestamps are forced to be in ascending order.
     /// If you commit a new change with a timestamp that is less than the existing one,
     /// the largest existing timestamp will be used instead.
-    pub fn commit(&self, origin: Option<String>, timestamp: Option<f64>) {
+    pub fn commit(
+        &self,
+        origin: Option<String>,
+        timestamp: Option<f64>,
+        message: Option<String>,
+        author: Option<String>,
+    ) {
         let mut options = CommitOptions::default();
         options.set_origin(origin.as_deref());
         options.set_timestamp(timestamp.map(|x| x as i64));
+        options.set_commit_msg(message.as_deref());
+        options.set_author(author.as_deref());
         self.0.commit_with(options);
     }
 
@@ -903,6 +1192,214 @@ impl Loro {
         Ok(self.0.export_snapshot())
     }
 
+    /// Export the current state of a container and its descendants as a portable blob,
+    /// which can be imported into any document by `importContainerAs`.
+    #[wasm_bindgen(js_name = "exportContainer")]
+    pub fn export_container(&self, container_id: JsContainerID) -> JsResult<Vec<u8>> {
+        let container_id: ContainerID = container_id.to_owned().try_into()?;
+        Ok(self.0.export_container(&container_id)?)
+    }
+
+    /// Import a blob exported by `exportContainer` as a new container at `key` of the map
+    /// `parent`, and return the id of the new container.
+    ///
+    /// The container and its descendants are recreated with new ids.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const a = new Loro();
+    /// a.getMap("block").set("title", "Hello");
+    /// const blob = a.exportContainer(a.getMap("block").id);
+    /// const b = new Loro();
+    /// const id = b.importContainerAs(blob, b.getMap("doc").id, "pasted");
+    /// console.log(b.toJSON()); // {"doc": {"pasted": {"title": "Hello"}}}
+    /// ```
+    #[wasm_bindgen(js_name = "importContainerAs")]
+    pub fn import_container_as(
+        &self,
+        blob: &[u8],
+        parent: JsContainerID,
+        key: &str,
+    ) -> JsResult<JsContainerID> {
+        let parent: ContainerID = parent.to_owned().try_into()?;
+        let id = self.0.import_container_as(blob, &parent, key)?;
+        let value: JsValue = (&id).into();
+        Ok(value.into())
+    }
+
+    /// Copy the root containers of `other`, a document that doesn't share history with
+    /// this one, into this document.
+    ///
+    /// `strategy` is one of `"rename"`, `"merge"` and `"skip"`, which decides what to do with
+    /// a root whose name is already used. If `mount` is the id of a map, the roots are copied
+    /// into the map instead. The content is recreated with new ids, and the history of
+    /// `other` is not copied.
+    ///
+    /// It returns an array of `{ source, target }`, the ids of the copied roots and the ids
+    /// of the containers they are copied to.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const a = new Loro();
+    /// a.getText("notes").insert(0, "a");
+    /// const b = new Loro();
+    /// b.getText("notes").insert(0, "b");
+    /// a.mergeForeign(b, "rename");
+    /// console.log(a.toJSON()); // {"notes": "a", "notes_1": "b"}
+    /// ```
+    #[wasm_bindgen(js_name = "mergeForeign")]
+    pub fn merge_foreign(
+        &self,
+        other: &Loro,
+        strategy: &str,
+        mount: Option<String>,
+    ) -> JsResult<Array> {
+        let strategy = js_str_to_merge_strategy(strategy)?;
+        let mount = match mount {
+            Some(mount) => Some(
+                ContainerID::try_from(mount.as_str())
+                    .map_err(|_| JsValue::from_str(&format!("Invalid container id {}", mount)))?,
+            ),
+            None => None,
+        };
+        let arr = Array::new();
+        for (source, target) in self.0.merge_foreign(&other.0, mount.as_ref(), strategy)? {
+            let obj = Object::new();
+            Reflect::set(&obj, &"source".into(), &(&source).into())?;
+            Reflect::set(&obj, &"target".into(), &(&target).into())?;
+            arr.push(&obj);
+        }
+
+        Ok(arr)
+    }
+
+    /// Get the commit message of the change that contains `id`.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// doc.setPeerId("1");
+    /// doc.getText("text").insert(0, "Hello");
+    /// doc.commit(undefined, undefined, "Say hello", "Alice");
+    /// console.log(doc.changeMessage({ peer: "1", counter: 0 })); // "Say hello"
+    /// console.log(doc.changeAuthor({ peer: "1", counter: 0 })); // "Alice"
+    /// ```
+    #[wasm_bindgen(js_name = "changeMessage")]
+    pub fn change_message(&self, id: JsID) -> JsResult<Option<String>> {
+        let id = js_id_to_id(id)?;
+        Ok(self.0.change_message(id).map(|x| x.to_string()))
+    }
+
+    /// Get the author of the change that contains `id`.
+    #[wasm_bindgen(js_name = "changeAuthor")]
+    pub fn change_author(&self, id: JsID) -> JsResult<Option<String>> {
+        let id = js_id_to_id(id)?;
+        Ok(self.0.change_author(id).map(|x| x.to_string()))
+    }
+
+    /// Get the metadata of the changes that are included by `to` but not by `from`.
+    ///
+    /// It returns an array of
+    /// `{ peer, counter, length, lamport, timestamp, deps, message, author }` sorted by lamport, so a change always comes after its deps.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// doc.getText("text").insert(0, "Hello");
+    /// doc.commit(undefined, undefined, "Say hello");
+    /// const changes = doc.getChangesInRange([], doc.oplogFrontiers());
+    /// console.log(changes[0].message); // "Say hello"
+    /// ```
+    #[wasm_bindgen(js_name = "getChangesInRange")]
+    pub fn get_changes_in_range(&self, from: Vec<JsID>, to: Vec<JsID>) -> JsResult<Array> {
+        let from = ids_to_frontiers(from)?;
+        let to = ids_to_frontiers(to)?;
+        let arr = Array::new();
+        for change in self.0.get_changes_in_range(&from, &to)? {
+            let obj = Object::new();
+            Reflect::set(&obj, &"peer".into(), &change.id.peer.to_string().into())?;
+            Reflect::set(&obj, &"counter".into(), &change.id.counter.into())?;
+            Reflect::set(&obj, &"length".into(), &change.len.into())?;
+            Reflect::set(&obj, &"lamport".into(), &change.lamport.into())?;
+            Reflect::set(&obj, &"timestamp".into(), &(change.timestamp as f64).into())?;
+            Reflect::set(&obj, &"deps".into(), &frontiers_to_ids(&change.deps).into())?;
+            let message: JsValue = match &change.message {
+                Some(msg) => msg.as_ref().into(),
+                None => JsValue::UNDEFINED,
+            };
+            Reflect::set(&obj, &"message".into(), &message)?;
+            let author: JsValue = match &change.author {
+                Some(author) => author.as_ref().into(),
+                None => JsValue::UNDEFINED,
+            };
+            Reflect::set(&obj, &"author".into(), &author)?;
+            arr.push(&obj);
+        }
+
+        Ok(arr)
+    }
+
+    /// Check the invariants of the document without panicking.
+    ///
+    /// It returns the descriptions of the broken invariants, or an empty array if the
+    /// document is consistent.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// doc.import(bytes);
+    /// if (doc.validate().length > 0) {
+    ///     doc.repair();
+    /// }
+    /// ```
+    pub fn validate(&self) -> Array {
+        self.0
+            .validate()
+            .iter()
+            .map(|x| JsValue::from_str(&x.to_string()))
+            .collect()
+    }
+
+    /// Fix the recoverable inconsistencies found by `validate()`, and return the
+    /// descriptions of the ones that are left.
+    pub fn repair(&self) -> Array {
+        self.0
+            .repair()
+            .iter()
+            .map(|x| JsValue::from_str(&x.to_string()))
+            .collect()
+    }
+
+    /// Export the snapshot of current version and pass it to `callback` chunk by chunk.
+    ///
+    /// Concatenating all the chunks gives the same bytes as `exportSnapshot()`.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// doc.getText("text").insert(0, "Hello");
+    /// const chunks: Uint8Array[] = [];
+    /// doc.exportSnapshotStream((chunk) => chunks.push(chunk));
+    /// ```
+    #[wasm_bindgen(js_name = "exportSnapshotStream")]
+    pub fn export_snapshot_stream(&self, callback: js_sys::Function) -> JsResult<()> {
+        let mut writer = JsChunkWriter::new(callback);
+        let ans = self.0.export_snapshot_to(&mut writer);
+        writer.finish(ans)
+    }
+
     /// Export updates from the specific version to the current version
     ///
     /// @example
@@ -929,6 +1426,69 @@ impl Loro {
         }
     }
 
+    /// Create a sync request to be sent to another peer.
+    ///
+    /// The peer answers it by `syncResponse` with the updates this document lacks.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const a = new Loro();
+    /// a.getText("text").insert(0, "a");
+    /// const b = new Loro();
+    /// b.getText("text").insert(0, "b");
+    /// // The docs have diverged, so they sync in both directions
+    /// b.import(a.syncResponse(b.syncRequest()));
+    /// a.import(b.syncResponse(a.syncRequest()));
+    /// ```
+    #[wasm_bindgen(js_name = "syncRequest")]
+    pub fn sync_request(&self) -> Vec<u8> {
+        self.0.sync_request()
+    }
+
+    /// Answer a sync request of another peer with the updates it lacks.
+    #[wasm_bindgen(js_name = "syncResponse")]
+    pub fn sync_response(&self, request: &[u8]) -> JsResult<Vec<u8>> {
+        Ok(self.0.sync_response(request)?)
+    }
+
+    /// Export updates from the specific version to the current version and
+    /// pass them to `callback` chunk by chunk.
+    ///
+    /// Concatenating all the chunks gives the same bytes as `exportFrom(version)`.
+    #[wasm_bindgen(js_name = "exportFromStream")]
+    pub fn export_from_stream(
+        &self,
+        vv: Option<VersionVector>,
+        callback: js_sys::Function,
+    ) -> JsResult<()> {
+        let mut writer = JsChunkWriter::new(callback);
+        let ans = match vv {
+            Some(vv) => self.0.export_from_to(&vv.0, &mut writer),
+            None => self.0.export_from_to(&Default::default(), &mut writer),
+        };
+        writer.finish(ans)
+    }
+
+    /// Export the updates that are in `to` but not in `from` and pass them to `callback`
+    /// chunk by chunk.
+    ///
+    /// Concatenating all the chunks gives one blob of updates that can be imported.
+    #[wasm_bindgen(js_name = "exportUpdatesInRangeStream")]
+    pub fn export_updates_in_range_stream(
+        &self,
+        from: &VersionVector,
+        to: &VersionVector,
+        callback: js_sys::Function,
+    ) -> JsResult<()> {
+        let mut writer = JsChunkWriter::new(callback);
+        let ans = self
+            .0
+            .export_updates_in_range_to(&from.0, &to.0, &mut writer);
+        writer.finish(ans)
+    }
+
     /// Export updates from the specific version to the current version with JSON format.
     #[wasm_bindgen(js_name = "exportJsonUpdates")]
     pub fn export_json_updates(
@@ -997,9 +1557,53 @@ impl Loro {
         Ok(())
     }
 
+    /// Calculate the diff that importing the data would apply, without changing the doc.
+    ///
+    /// It returns `{ diff, pending }`. `diff` has the same shape as the result of `diff()`.
+    /// `pending` is an array of `{ peer, counter, length }` of the changes that would be
+    /// waiting for their missing dependencies after the import.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const other = new Loro();
+    /// other.getMap("map").set("key", "value");
+    /// const { diff, pending } = doc.importPreview(other.exportFrom());
+    /// // diff: [{ target: "cid:root-map:Map", diff: { type: "map", updated: { key: "value" } } }]
+    /// // pending: []
+    /// ```
+    #[wasm_bindgen(js_name = "importPreview")]
+    pub fn import_preview(&self, update_or_snapshot: &[u8]) -> JsResult<JsValue> {
+        let preview = self.0.import_preview(update_or_snapshot)?;
+        let diff = Array::new();
+        for (id, d) in preview.diff.iter() {
+            let obj = Object::new();
+            Reflect::set(&obj, &"target".into(), &id.to_string().into())?;
+            Reflect::set(&obj, &"diff".into(), &resolved_diff_to_js(d, &self.0))?;
+            diff.push(&obj);
+        }
+
+        let pending = Array::new();
+        for span in preview.pending.iter() {
+            let obj = Object::new();
+            Reflect::set(&obj, &"peer".into(), &span.peer.to_string().into())?;
+            Reflect::set(&obj, &"counter".into(), &span.counter.start.into())?;
+            Reflect::set(&obj, &"length".into(), &span.atom_len().into())?;
+            pending.push(&obj);
+        }
+
+        let ans = Object::new();
+        Reflect::set(&ans, &"diff".into(), &diff)?;
+        Reflect::set(&ans, &"pending".into(), &pending)?;
+        Ok(ans.into())
+    }
+
     /// Import a batch of updates.
     ///
-    /// It's more efficient than importing updates one by one.
+    /// It's more efficient than importing updates one by one. The updates can be in arbitrary
+    /// order, and the subscribers receive a single event that reflects the net change of the batch.
     ///
     /// @example
     /// ```ts
@@ -1028,32 +1632,196 @@ impl Loro {
         Ok(self.0.import_batch(&data)?)
     }
 
-    /// Get the json format of the document state.
+    /// Get the json format of the document state.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const list = doc.getList("list");
+    /// list.insert(0, "Hello");
+    /// const text = list.insertContainer(0, new LoroText());
+    /// text.insert(0, "Hello");
+    /// const map = list.insertContainer(1, new LoroMap());
+    /// map.set("foo", "bar");
+    /// /*
+    /// {"list": ["Hello", {"foo": "bar"}]}
+    ///  *\/
+    /// console.log(doc.toJSON());
+    /// ```
+    #[wasm_bindgen(js_name = "toJSON")]
+    pub fn to_json(&self) -> JsResult<JsValue> {
+        let json = self.0.get_deep_value();
+        Ok(json.into())
+    }
+
+    /// Get the json format of the entire document state, with the id of each container.
+    ///
+    /// Every container is represented by `{ cid, value }`, including the `meta` of each
+    /// tree node, so the nodes can be correlated with the events or passed to `getContainerById`.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro, LoroText } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// doc.setPeerId(1);
+    /// const map = doc.getMap("map");
+    /// const text = map.setContainer("text", new LoroText());
+    /// text.insert(0, "Hi");
+    /// /*
+    /// {"map": {"cid": "cid:root-map:Map", "value": {"text": {"cid": "cid:0@1:Text", "value": "Hi"}}}}
+    ///  *\/
+    /// console.log(doc.getDeepValueWithID());
+    /// ```
+    #[wasm_bindgen(js_name = "getDeepValueWithID")]
+    pub fn get_deep_value_with_id(&self) -> JsValue {
+        self.0.get_deep_value_with_id().into()
+    }
+
+    /// Get the shallow value of a container at the given version, without checking out
+    /// the document.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// text.insert(0, "Hello");
+    /// doc.commit();
+    /// const v0 = doc.frontiers();
+    /// text.insert(5, " world");
+    /// doc.commit();
+    /// console.log(doc.getContainerValueAt(text.id, v0)); // "Hello"
+    /// ```
+    #[wasm_bindgen(js_name = "getContainerValueAt")]
+    pub fn get_container_value_at(
+        &self,
+        container_id: JsContainerID,
+        frontiers: Vec<JsID>,
+    ) -> JsResult<JsValue> {
+        let id: ContainerID = container_id.to_owned().try_into()?;
+        let frontiers = ids_to_frontiers(frontiers)?;
+        Ok(self.0.get_container_value_at(&id, &frontiers)?.into())
+    }
+
+    /// Subscribe to the changes of the loro document. The function will be called when the
+    /// transaction is committed or updates from remote are imported.
+    ///
+    /// Returns a subscription ID, which can be used to unsubscribe.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// doc.subscribe((event)=>{
+    ///     console.log(event);
+    /// });
+    /// text.insert(0, "Hello");
+    /// // the events will be emitted when `commit()` is called.
+    /// doc.commit();
+    /// ```
+    // TODO: convert event and event sub config
+    pub fn subscribe(&self, f: js_sys::Function) -> u32 {
+        let observer = observer::Observer::new(f);
+        let doc = self.0.clone();
+        self.0
+            .subscribe_root(Arc::new(move |e| {
+                call_after_micro_task(observer.clone(), e, &doc)
+                // call_subscriber(observer.clone(), e);
+            }))
+            .into_u32()
+    }
+
+    /// Subscribe to the changes of the given container and its descendants.
+    ///
+    /// The subscription is removed once the container is deleted from the document.
+    /// In that case the listener receives a final event, whose `events` are the diffs
+    /// of the ancestors that deleted the container.
+    ///
+    /// Returns a subscription ID, which can be used to unsubscribe.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro, LoroMap } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const root = doc.getMap("root");
+    /// const child = root.setContainer("child", new LoroMap());
+    /// doc.subscribePath(child.id, (event)=>{
+    ///     console.log(event);
+    /// });
+    /// child.set("key", "value");
+    /// doc.commit();
+    /// ```
+    #[wasm_bindgen(js_name = "subscribePath")]
+    pub fn subscribe_path(
+        &self,
+        container_id: JsContainerID,
+        f: js_sys::Function,
+    ) -> JsResult<u32> {
+        let container_id: ContainerID = container_id.to_owned().try_into()?;
+        let observer = observer::Observer::new(f);
+        let doc = self.0.clone();
+        Ok(self
+            .0
+            .subscribe_path(
+                &container_id,
+                Arc::new(move |e| call_after_micro_task(observer.clone(), e, &doc)),
+            )
+            .into_u32())
+    }
+
+    /// Subscribe to the containers that become unreachable from the root containers,
+    /// e.g. the child containers of a deleted list element.
+    ///
+    /// The listener receives `{ orphaned: ContainerID[], revived: ContainerID[] }`.
+    /// A container is revived when it becomes reachable again, e.g. by checking out an
+    /// earlier version.
+    ///
+    /// Returns a subscription ID, which can be used to unsubscribe.
     ///
     /// @example
     /// ```ts
-    /// import { Loro } from "loro-crdt";
+    /// import { Loro, LoroMap } from "loro-crdt";
     ///
     /// const doc = new Loro();
     /// const list = doc.getList("list");
-    /// list.insert(0, "Hello");
-    /// const text = list.insertContainer(0, new LoroText());
-    /// text.insert(0, "Hello");
-    /// const map = list.insertContainer(1, new LoroMap());
-    /// map.set("foo", "bar");
-    /// /*
-    /// {"list": ["Hello", {"foo": "bar"}]}
-    ///  *\/
-    /// console.log(doc.toJSON());
+    /// const map = list.insertContainer(0, new LoroMap());
+    /// doc.commit();
+    /// doc.subscribeOrphaned((event)=>{
+    ///     console.log(event.orphaned); // [map.id]
+    /// });
+    /// list.delete(0, 1);
+    /// doc.commit();
     /// ```
-    #[wasm_bindgen(js_name = "toJSON")]
-    pub fn to_json(&self) -> JsResult<JsValue> {
-        let json = self.0.get_deep_value();
-        Ok(json.into())
+    #[wasm_bindgen(js_name = "subscribeOrphaned")]
+    pub fn subscribe_orphaned(&self, f: js_sys::Function) -> u32 {
+        let observer = observer::Observer::new(f);
+        self.0
+            .subscribe_orphaned(Arc::new(move |e| {
+                let obj = Object::new();
+                for (key, ids) in [("orphaned", &e.orphaned), ("revived", &e.revived)] {
+                    let arr = Array::new_with_length(ids.len() as u32);
+                    for (i, id) in ids.iter().enumerate() {
+                        arr.set(i as u32, id.to_string().into());
+                    }
+                    Reflect::set(&obj, &key.into(), &arr).unwrap();
+                }
+                call_js_after_micro_task(observer.clone(), obj.into())
+            }))
+            .into_u32()
     }
 
-    /// Subscribe to the changes of the loro document. The function will be called when the
-    /// transaction is committed or updates from remote are imported.
+    /// Subscribe to the ops committed by the local peer.
+    ///
+    /// The listener receives the ops of each committed change in the same format as
+    /// `exportJsonUpdates`, so they can be forwarded and imported by `importJsonUpdates`.
+    /// The imported changes are not reported.
     ///
     /// Returns a subscription ID, which can be used to unsubscribe.
     ///
@@ -1062,22 +1830,21 @@ impl Loro {
     /// import { Loro } from "loro-crdt";
     ///
     /// const doc = new Loro();
-    /// const text = doc.getText("text");
-    /// doc.subscribe((event)=>{
-    ///     console.log(event);
+    /// const replica = new Loro();
+    /// doc.subscribeLocalOps((ops)=>{
+    ///     replica.importJsonUpdates(ops);
     /// });
-    /// text.insert(0, "Hello");
-    /// // the events will be emitted when `commit()` is called.
+    /// doc.getText("text").insert(0, "Hello");
     /// doc.commit();
     /// ```
-    // TODO: convert event and event sub config
-    pub fn subscribe(&self, f: js_sys::Function) -> u32 {
+    #[wasm_bindgen(js_name = "subscribeLocalOps")]
+    pub fn subscribe_local_ops(&self, f: js_sys::Function) -> u32 {
         let observer = observer::Observer::new(f);
-        let doc = self.0.clone();
         self.0
-            .subscribe_root(Arc::new(move |e| {
-                call_after_micro_task(observer.clone(), e, &doc)
-                // call_subscriber(observer.clone(), e);
+            .subscribe_local_ops(Arc::new(move |ops| {
+                let s = serde_wasm_bindgen::Serializer::new().serialize_maps_as_objects(true);
+                let v = ops.serialize(&s).unwrap();
+                call_js_after_micro_task(observer.clone(), v)
             }))
             .into_u32()
     }
@@ -1304,6 +2071,11 @@ impl Loro {
 
     /// Get the absolute position of the given Cursor
     ///
+    /// `status` tells whether the anchored element is still at the position where the cursor
+    /// was created (`"exact"`), has been shifted by other edits (`"shifted"`), or has been
+    /// deleted (`"deleted"`). When it's deleted, the offset falls back to where the element
+    /// used to be, and `update` is a new cursor anchored at its neighbor.
+    ///
     /// @example
     /// ```ts
     /// const doc = new Loro();
@@ -1318,6 +2090,12 @@ impl Loro {
     /// {
     ///    const ans = doc.getCursorPos(pos0!);
     ///    expect(ans.offset).toBe(1);
+    ///    expect(ans.status).toBe("shifted");
+    /// }
+    /// text.delete(1, 1);
+    /// {
+    ///    const ans = doc.getCursorPos(pos0!);
+    ///    expect(ans.status).toBe("deleted");
     /// }
     /// ```
     pub fn getCursorPos(&self, cursor: &Cursor) -> JsResult<JsCursorQueryAns> {
@@ -1342,6 +2120,16 @@ impl Loro {
             &JsValue::from_str("side"),
             &JsValue::from(ans.current.side.to_i32()),
         )?;
+        let status = match ans.status {
+            CursorStatus::Exact => "exact",
+            CursorStatus::Shifted => "shifted",
+            CursorStatus::Deleted => "deleted",
+        };
+        Reflect::set(
+            &obj,
+            &JsValue::from_str("status"),
+            &JsValue::from_str(status),
+        )?;
         Ok(JsValue::from(obj).into())
     }
 }
@@ -1362,11 +2150,14 @@ fn call_subscriber(ob: observer::Observer, e: DiffEvent, doc: &Arc<LoroDoc>) {
 
 #[allow(unused)]
 fn call_after_micro_task(ob: observer::Observer, event: DiffEvent, doc: &Arc<LoroDoc>) {
+    call_js_after_micro_task(ob, diff_event_to_js_value(event, doc))
+}
+
+fn call_js_after_micro_task(ob: observer::Observer, event: JsValue) {
     let promise = Promise::resolve(&JsValue::NULL);
     type C = Closure<dyn FnMut(JsValue)>;
     let drop_handler: Rc<RefCell<Option<C>>> = Rc::new(RefCell::new(None));
     let copy = drop_handler.clone();
-    let event = diff_event_to_js_value(event, doc);
     let closure = Closure::once(move |_: JsValue| {
         let ans = ob.call1(&event);
         drop(copy);
@@ -1538,6 +2329,80 @@ impl LoroText {
         Ok(())
     }
 
+    /// Find the non-overlapping occurrences of `pattern` in the text.
+    ///
+    /// It returns an array of `{ start, end }` in UTF-16 indexes, which can be passed to
+    /// `replace`, `delete` or `mark` directly.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// text.insert(0, "foo bar foo");
+    /// console.log(text.search("foo")); // [{ start: 0, end: 3 }, { start: 8, end: 11 }]
+    /// ```
+    pub fn search(&self, pattern: &str) -> JsResult<Array> {
+        let arr = Array::new();
+        for range in self.handler.search(pattern) {
+            let obj = Object::new();
+            Reflect::set(&obj, &"start".into(), &range.start.into())?;
+            Reflect::set(&obj, &"end".into(), &range.end.into())?;
+            arr.push(&obj);
+        }
+
+        Ok(arr)
+    }
+
+    /// Replace the text in `start..end` with `text`.
+    ///
+    /// The new text inherits the styles of the replaced text that expand after it.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// text.insert(0, "Hello world");
+    /// text.replace(6, 11, "Loro");
+    /// console.log(text.toString()); // "Hello Loro"
+    /// ```
+    pub fn replace(&mut self, start: usize, end: usize, text: &str) -> JsResult<()> {
+        self.handler.replace(start..end, text)?;
+        Ok(())
+    }
+
+    /// Get the peers that inserted the text in `start..end`.
+    ///
+    /// It returns an array of `{ start, end, peer, lamport }` in UTF-16 indexes. Each item is
+    /// a run of text inserted continuously by the same peer.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// doc.setPeerId("1");
+    /// const text = doc.getText("text");
+    /// text.insert(0, "Hello");
+    /// console.log(text.blame(0, 5)); // [{ start: 0, end: 5, peer: "1", lamport: 0 }]
+    /// ```
+    pub fn blame(&self, start: usize, end: usize) -> JsResult<Array> {
+        let arr = Array::new();
+        for (range, id) in self.handler.blame(start, end)? {
+            let obj = Object::new();
+            Reflect::set(&obj, &"start".into(), &range.start.into())?;
+            Reflect::set(&obj, &"end".into(), &range.end.into())?;
+            Reflect::set(&obj, &"peer".into(), &id.peer.to_string().into())?;
+            Reflect::set(&obj, &"lamport".into(), &id.lamport.into())?;
+            arr.push(&obj);
+        }
+
+        Ok(arr)
+    }
+
     /// Mark a range of text with a key and a value.
     ///
     /// > You should call `configTextStyle` before using `mark` and `unmark`.
@@ -1546,6 +2411,9 @@ impl LoroText {
     ///
     /// Note: this is not suitable for unmergeable annotations like comments.
     ///
+    /// If `expand` is given, it's used for this mark instead of the expand type configured
+    /// for the key. It must be one of `"before"`, `"after"`, `"both"` and `"none"`.
+    ///
     /// @example
     /// ```ts
     /// import { Loro } from "loro-crdt";
@@ -1555,11 +2423,28 @@ impl LoroText {
     /// const text = doc.getText("text");
     /// text.insert(0, "Hello World!");
     /// text.mark({ start: 0, end: 5 }, "bold", true);
+    /// // Text inserted right after "World" won't be bold
+    /// text.mark({ start: 6, end: 11 }, "bold", true, "none");
     /// ```
-    pub fn mark(&self, range: JsRange, key: &str, value: JsValue) -> Result<(), JsError> {
+    pub fn mark(
+        &self,
+        range: JsRange,
+        key: &str,
+        value: JsValue,
+        expand: Option<String>,
+    ) -> Result<(), JsError> {
         let range: MarkRange = serde_wasm_bindgen::from_value(range.into())?;
         let value: LoroValue = LoroValue::from(value);
-        self.handler.mark(range.start, range.end, key, value)?;
+        match expand {
+            Some(expand) => {
+                let expand = ExpandType::try_from_str(&expand).ok_or_else(|| {
+                    JsError::new("`expand` must be one of `before`, `after`, `both` and `none`")
+                })?;
+                self.handler
+                    .mark_with_expand(range.start, range.end, key, value, expand)?;
+            }
+            None => self.handler.mark(range.start, range.end, key, value)?,
+        }
         Ok(())
     }
 
@@ -1580,11 +2465,18 @@ impl LoroText {
     /// text.mark({ start: 0, end: 5 }, "bold", true);
     /// text.unmark({ start: 0, end: 5 }, "bold");
     /// ```
-    pub fn unmark(&self, range: JsRange, key: &str) -> Result<(), JsValue> {
+    ///
+    /// It returns the ranges that were marked with `key` before and are unmarked by this call.
+    pub fn unmark(&self, range: JsRange, key: &str) -> Result<JsRanges, JsValue> {
         // Internally, this may be marking with null or deleting all the marks with key in the range entirely.
         let range: MarkRange = serde_wasm_bindgen::from_value(range.into())?;
-        self.handler.unmark(range.start, range.end, key)?;
-        Ok(())
+        let spans: Vec<MarkRange> = self
+            .handler
+            .unmark(range.start, range.end, key)?
+            .into_iter()
+            .map(|(start, end)| MarkRange { start, end })
+            .collect();
+        Ok(serde_wasm_bindgen::to_value(&spans)?.into())
     }
 
     /// Convert the state to string
@@ -1594,6 +2486,73 @@ impl LoroText {
         self.handler.get_value().as_string().unwrap().to_string()
     }
 
+    /// Iterate the styled runs in the given range without building the delta of the whole text.
+    ///
+    /// The callback receives the text of each run and its attributes. Runs crossing the range
+    /// boundaries are cut at the boundaries. Return `true` from the callback to stop the iteration.
+    ///
+    /// The callback must not access the document.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// doc.configTextStyle({bold: {expand: "after"}});
+    /// text.insert(0, "Hello World!");
+    /// text.mark({ start: 0, end: 5 }, "bold", true);
+    /// text.iterStyledRuns({ start: 3, end: 8 }, (s, attributes) => {
+    ///   console.log(s, attributes); // "lo" { bold: true }, then " Wo" {}
+    /// });
+    /// ```
+    #[wasm_bindgen(js_name = "iterStyledRuns")]
+    pub fn iter_styled_runs(&self, range: JsRange, callback: js_sys::Function) -> JsResult<()> {
+        let range: MarkRange = serde_wasm_bindgen::from_value(range.into())?;
+        let mut err = None;
+        self.handler
+            .iter_styled_runs(range.start, range.end, &mut |s, attributes| {
+                let attributes: JsValue = attributes.clone().into();
+                match callback.call2(&JsValue::NULL, &JsValue::from_str(s), &attributes) {
+                    Ok(v) if v.is_truthy() => ControlFlow::Break(()),
+                    Ok(_) => ControlFlow::Continue(()),
+                    Err(e) => {
+                        err = Some(e);
+                        ControlFlow::Break(())
+                    }
+                }
+            })?;
+        match err {
+            Some(e) => Err(e),
+            None => Ok(()),
+        }
+    }
+
+    /// Convert a text index between units.
+    ///
+    /// The unit can be `"entity"`, `"utf8"`, `"utf16"` or `"unicode"`. The entity index counts
+    /// the unicode code points and the style anchors created by `mark`. If there are style
+    /// anchors at the given text position, the entity index after them is returned.
+    ///
+    /// Returns `undefined` if the index is out of bound or not at a char boundary.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const text = doc.getText("text");
+    /// text.insert(0, "你好😀");
+    /// console.log(text.indexConvert(4, "utf16", "unicode")); // 3
+    /// console.log(text.indexConvert(3, "unicode", "utf8")); // 10
+    /// ```
+    #[wasm_bindgen(js_name = "indexConvert")]
+    pub fn index_convert(&self, pos: usize, from: &str, to: &str) -> JsResult<Option<usize>> {
+        let from = js_str_to_index_type(from)?;
+        let to = js_str_to_index_type(to)?;
+        Ok(self.handler.index_convert(pos, from, to))
+    }
+
     /// Get the text in [Delta](https://quilljs.com/docs/delta/) format.
     ///
     /// The returned value will include the rich text information.
@@ -1679,6 +2638,9 @@ impl LoroText {
     /// build the binding between Loro and rich text editors like Quill, which might assume there
     /// is always a newline at the end of the text implicitly.
     ///
+    /// A `null` attribute removes the style. The delta is checked before it's applied, so an
+    /// out of bound delta or a style without config throws without changing the text.
+    ///
     /// @example
     /// ```ts
     /// import { Loro } from "loro-crdt";
@@ -1807,6 +2769,44 @@ impl LoroMap {
         Ok(())
     }
 
+    /// Set all the entries of the object in one transaction.
+    ///
+    /// The keys absent from the object are left untouched.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const map = doc.getMap("map");
+    /// map.set("a", 1);
+    /// map.update({ b: 2, c: 3 });
+    /// console.log(map.toJSON()); // {"a": 1, "b": 2, "c": 3}
+    /// ```
+    pub fn update(&mut self, entries: JsValue) -> JsResult<()> {
+        self.handler.update(js_to_map_entries(entries)?)?;
+        Ok(())
+    }
+
+    /// Set all the entries of the object in one transaction, and delete the keys
+    /// absent from the object.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const map = doc.getMap("map");
+    /// map.set("a", 1);
+    /// map.replaceAll({ b: 2 });
+    /// console.log(map.toJSON()); // {"b": 2}
+    /// ```
+    #[wasm_bindgen(js_name = "replaceAll")]
+    pub fn replace_all(&mut self, entries: JsValue) -> JsResult<()> {
+        self.handler.replace_all(js_to_map_entries(entries)?)?;
+        Ok(())
+    }
+
     /// Remove the key from the map.
     ///
     /// @example
@@ -2167,6 +3167,28 @@ impl LoroList {
         Ok(())
     }
 
+    /// Delete `len` elements at `index` and insert `items` there, like `Array.prototype.splice`.
+    ///
+    /// It returns the deleted values.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const list = doc.getList("list");
+    /// list.insert(0, 1);
+    /// list.insert(1, 2);
+    /// list.insert(2, 3);
+    /// console.log(list.splice(1, 1, ["a", "b"]));  // [2]
+    /// console.log(list.value);  // [1, "a", "b", 3]
+    /// ```
+    pub fn splice(&mut self, index: usize, len: usize, items: Array) -> JsResult<Array> {
+        let items: Vec<LoroValue> = items.iter().map(LoroValue::from).collect();
+        let removed = self.handler.splice(index, len, &items)?;
+        Ok(removed.into_iter().map(JsValue::from).collect())
+    }
+
     /// Get the value at the index. If the value is a container, the corresponding handler will be returned.
     ///
     /// @example
@@ -2494,6 +3516,28 @@ impl LoroMovableList {
         Ok(())
     }
 
+    /// Delete `len` elements at `index` and insert `items` there, like `Array.prototype.splice`.
+    ///
+    /// It returns the deleted values.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const list = doc.getMovableList("list");
+    /// list.insert(0, 1);
+    /// list.insert(1, 2);
+    /// list.insert(2, 3);
+    /// console.log(list.splice(1, 1, ["a", "b"]));  // [2]
+    /// console.log(list.value);  // [1, "a", "b", 3]
+    /// ```
+    pub fn splice(&mut self, index: usize, len: usize, items: Array) -> JsResult<Array> {
+        let items: Vec<LoroValue> = items.iter().map(LoroValue::from).collect();
+        let removed = self.handler.splice(index, len, &items)?;
+        Ok(removed.into_iter().map(JsValue::from).collect())
+    }
+
     /// Get the value at the index. If the value is a container, the corresponding handler will be returned.
     ///
     /// @example
@@ -2739,6 +3783,31 @@ impl LoroMovableList {
         Ok(())
     }
 
+    /// Apply a batch of moves in a single transaction.
+    ///
+    /// Each `[from, to]` pair is applied to the list produced by the previous pairs,
+    /// like calling `move(from, to)` for each of them. Only the minimal set of move
+    /// operations that leads to the final order is recorded.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const list = doc.getMovableList("list");
+    /// list.push(0);
+    /// list.push(1);
+    /// list.push(2);
+    /// list.moveBatch([[0, 2], [0, 2]]);
+    /// console.log(list.toJSON()); // [2, 0, 1]
+    /// ```
+    #[wasm_bindgen(js_name = "moveBatch")]
+    pub fn move_batch(&self, moves: JsMoves) -> JsResult<()> {
+        let moves: Vec<(usize, usize)> = serde_wasm_bindgen::from_value(moves.into())?;
+        self.handler.move_batch(&moves)?;
+        Ok(())
+    }
+
     /// Set the value at the given position.
     ///
     /// It's different from `delete` + `insert` that it will replace the value at the position.
@@ -2994,6 +4063,40 @@ impl LoroTreeNode {
         parent.map(|p| LoroTreeNode::from_tree(p, self.tree.clone(), self.doc.clone()))
     }
 
+    /// Get the path from the root to this node.
+    ///
+    /// It returns an array of `{ id, index }`, where `index` is the index of the node among
+    /// its siblings. The last item is this node. It returns `undefined` if the node or one
+    /// of its ancestors is deleted.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const tree = doc.getTree("tree");
+    /// const root = tree.createNode();
+    /// root.createNode();
+    /// const node = root.createNode();
+    /// console.log(node.path()); // [{ id: root.id, index: 0 }, { id: node.id, index: 1 }]
+    /// ```
+    #[wasm_bindgen]
+    pub fn path(&self) -> JsResult<Option<Array>> {
+        let Some(path) = self.tree.get_path(&self.id) else {
+            return Ok(None);
+        };
+        let arr = Array::new();
+        for (id, index) in path {
+            let obj = Object::new();
+            let id: JsValue = id.into();
+            Reflect::set(&obj, &"id".into(), &id)?;
+            Reflect::set(&obj, &"index".into(), &index.into())?;
+            arr.push(&obj);
+        }
+
+        Ok(Some(arr))
+    }
+
     /// Get the children of this node.
     ///
     /// The objects returned are new js objects each time because they need to cross
@@ -3546,6 +4649,38 @@ impl UndoManager {
         Ok(executed)
     }
 
+    /// Start an undo group.
+    ///
+    /// All the local changes committed before the matching `endGroup()` are merged
+    /// into a single undo step, regardless of the merge interval. Groups can be nested,
+    /// in which case the inner groups are folded into the outermost one.
+    ///
+    /// @example
+    /// ```ts
+    /// import { Loro, UndoManager } from "loro-crdt";
+    ///
+    /// const doc = new Loro();
+    /// const undo = new UndoManager(doc, { mergeInterval: 0 });
+    /// const text = doc.getText("text");
+    /// undo.startGroup();
+    /// text.insert(0, "Hello");
+    /// doc.commit();
+    /// text.insert(5, " world");
+    /// doc.commit();
+    /// undo.endGroup();
+    /// undo.undo(); // text is "" now
+    /// ```
+    pub fn startGroup(&mut self) -> JsResult<()> {
+        self.undo.start_group(&self.doc)?;
+        Ok(())
+    }
+
+    /// End the undo group started by `startGroup()`.
+    pub fn endGroup(&mut self) -> JsResult<()> {
+        self.undo.end_group(&self.doc)?;
+        Ok(())
+    }
+
     /// Can undo the last operation.
     pub fn canUndo(&self) -> bool {
         self.undo.can_undo()
@@ -3854,6 +4989,44 @@ pub fn decode_import_blob_meta(blob: &[u8]) -> JsResult<JsImportBlobMetadata> {
     Ok(meta.into())
 }
 
+/// Decode the metadata of the blob and the values of the `previews` containers without
+/// importing it.
+///
+/// It returns `{ meta, containerNum, previews }`, where `meta` is the same as the result of
+/// `decodeImportBlobMeta`, and `previews` maps the container ids to their shallow values.
+/// The values are only available if the blob is a snapshot.
+///
+/// @example
+/// ```ts
+/// import { Loro, peekDoc } from "loro-crdt";
+///
+/// const doc = new Loro();
+/// doc.getText("title").insert(0, "Notes");
+/// const { previews } = peekDoc(doc.exportSnapshot(), ["cid:root-title:Text"]);
+/// console.log(previews["cid:root-title:Text"]); // "Notes"
+/// ```
+#[wasm_bindgen(js_name = "peekDoc")]
+pub fn peek_doc(blob: &[u8], previews: Vec<String>) -> JsResult<JsValue> {
+    let ids = previews
+        .iter()
+        .map(|x| {
+            ContainerID::try_from(x.as_str())
+                .map_err(|_| JsValue::from_str(&format!("Invalid container id {}", x)))
+        })
+        .collect::<JsResult<Vec<_>>>()?;
+    let meta = LoroDoc::peek(blob, &ids)?;
+    let obj = Object::new();
+    let js_meta: JsImportBlobMetadata = meta.meta.into();
+    Reflect::set(&obj, &"meta".into(), &js_meta.into())?;
+    Reflect::set(&obj, &"containerNum".into(), &meta.container_num.into())?;
+    let values = Object::new();
+    for (id, value) in meta.previews {
+        Reflect::set(&values, &id.to_string().into(), &value.into())?;
+    }
+    Reflect::set(&obj, &"previews".into(), &values.into())?;
+    Ok(obj.into())
+}
+
 #[wasm_bindgen(typescript_custom_section)]
 const TYPES: &'static str = r#"
 /**
@@ -3950,6 +5123,9 @@ interface Loro {
  * 3. Retain Operation:
  *    - `retain`: The number of elements to retain.
  *    - `attributes`: (Optional) A dictionary of attributes, describing styles in richtext
+ *
+ * 4. Set Operation, only in the events of movable lists:
+ *    - `set`: The new values of the next elements. The elements keep their identities.
  */
 export type Delta<T> =
   | {
@@ -3969,6 +5145,13 @@ export type Delta<T> =
     attributes?: { [key in string]: {} };
     delete?: undefined;
     insert?: undefined;
+  }
+  | {
+    set: T;
+    attributes?: undefined;
+    retain?: undefined;
+    delete?: undefined;
+    insert?: undefined;
   };
 
 /**
@@ -39,10 +39,40 @@ impl LoroCounter {
         self.handler.decrement(value)
     }
 
+    /// Increment the counter by the given integer.
+    ///
+    /// The integers are summed up exactly, including the concurrent increments of other peers,
+    /// so the value doesn't lose precision past 2^53 like the `f64` value returned by
+    /// [`LoroCounter::get_value`]. Use [`LoroCounter::get_int_value`] to read it.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// let counter = doc.get_counter("counter");
+    /// counter.increment_int(i64::MAX).unwrap();
+    /// counter.increment_int(i64::MAX).unwrap();
+    /// counter.increment_int(2).unwrap();
+    /// assert_eq!(counter.get_int_value(), Some(1 << 64));
+    /// ```
+    pub fn increment_int(&self, value: i64) -> LoroResult<()> {
+        self.handler.increment_int(value)
+    }
+
     /// Get the current value of the counter.
     pub fn get_value(&self) -> LoroValue {
         self.handler.get_value()
     }
+
+    /// Get the exact value of the counter as an integer.
+    ///
+    /// The integral increments, including the ones made by [`LoroCounter::increment`],
+    /// are summed up exactly. It returns `None` if the fractional increments don't add up
+    /// to an integer, or if the sum overflowed `i128`, in which case only the approximate
+    /// value of [`LoroCounter::get_value`] is available.
+    pub fn get_int_value(&self) -> Option<i128> {
+        self.handler.get_int_value()
+    }
 }
 
 impl SealedTrait for LoroCounter {}
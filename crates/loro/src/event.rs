@@ -1,12 +1,16 @@
 //! Loro event handling.
 use enum_as_inner::EnumAsInner;
+use loro_internal::change::Lamport;
 use loro_internal::container::ContainerID;
 use loro_internal::delta::TreeDiff;
 use loro_internal::event::EventTriggerKind;
 use loro_internal::handler::{TextDelta, ValueOrHandler};
+use loro_internal::id::ID;
+use loro_internal::loro_common::IdSpan;
 use loro_internal::FxHashMap;
 use loro_internal::{
     event::{Diff as DiffInner, Index},
+    undo::DiffBatch as DiffBatchInner,
     ContainerDiff as ContainerDiffInner, DiffEvent as DiffEventInner,
 };
 use std::sync::Arc;
@@ -52,6 +56,9 @@ pub enum Diff<'a> {
     /// A map diff.
     Map(MapDelta<'a>),
     /// A tree diff.
+    ///
+    /// There is at most one item for each node. A node that is alive both before and after
+    /// the diff is reported as a move, even if its old parent is deleted in the same diff.
     Tree(&'a TreeDiff),
     #[cfg(feature = "counter")]
     /// A counter diff.
@@ -60,11 +67,67 @@ pub enum Diff<'a> {
     Unknown,
 }
 
+/// The diffs of the changed containers between two versions.
+///
+/// It's returned by [`crate::LoroDoc::diff`] and [`crate::LoroDoc::import_preview`].
+#[derive(Debug, Clone)]
+pub struct DiffBatch(DiffBatchInner);
+
+impl DiffBatch {
+    pub(crate) fn new(inner: DiffBatchInner) -> Self {
+        Self(inner)
+    }
+
+    /// Iterate over the diff of each changed container. The order is arbitrary.
+    pub fn iter(&self) -> impl Iterator<Item = (&ContainerID, Diff<'_>)> + '_ {
+        self.0.iter().map(|(id, diff)| (id, diff.into()))
+    }
+
+    /// Get the diff of the given container.
+    pub fn get(&self, id: &ContainerID) -> Option<Diff<'_>> {
+        self.0.get(id).map(|diff| diff.into())
+    }
+
+    /// The number of changed containers.
+    pub fn len(&self) -> usize {
+        self.0.len()
+    }
+
+    /// Whether no container is changed.
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+}
+
+/// The local change that is going to be committed.
+///
+/// It's passed to the hook set by [`crate::LoroDoc::set_pre_commit_hook`].
+#[derive(Debug, Clone)]
+pub struct PendingLocalChange {
+    /// The id of the first op of the change
+    pub id: ID,
+    /// The lamport of the first op of the change
+    pub lamport: Lamport,
+    /// The number of the atom ops in the change
+    pub len: usize,
+    /// The diff that the change applies to the document
+    pub diff: DiffBatch,
+}
+
+/// The result of [`crate::LoroDoc::import_preview`].
+#[derive(Debug, Clone)]
+pub struct ImportPreview {
+    /// The diff that the import would apply to the current state
+    pub diff: DiffBatch,
+    /// The changes that would be waiting for their missing deps after the import
+    pub pending: Vec<IdSpan>,
+}
+
 /// A list diff item.
 ///
 /// We use a `Vec<ListDiffItem>` to represent a list diff.
 ///
-/// Each item can be either an insert, delete, or retain.
+/// Each item can be either an insert, delete, retain, or set.
 ///
 /// ## Example
 ///
@@ -74,6 +137,7 @@ pub enum Diff<'a> {
 ///
 /// If the original list is [1, 2, 3, 4, 5], the list after the diff is [1, 2, 3, 1, 2, 5].
 #[derive(Debug)]
+#[non_exhaustive]
 pub enum ListDiffItem {
     /// Insert a new element into the list.
     Insert {
@@ -94,6 +158,18 @@ pub enum ListDiffItem {
         /// The number of elements to retain.
         retain: usize,
     },
+    /// Replace the values of the next n elements, where n is the length of `set`.
+    ///
+    /// The elements keep their identities. It's created by [`LoroMovableList::set`](crate::LoroMovableList::set).
+    /// If the elements are inserted or deleted in the same diff, the set is reported as a
+    /// [`ListDiffItem::Delete`] and a [`ListDiffItem::Insert`] instead.
+    ///
+    /// This variant is new in this release, so the enum is now `#[non_exhaustive]` and
+    /// a `match` on it needs a wildcard arm.
+    Set {
+        /// The new values of the elements.
+        set: Vec<ValueOrContainer>,
+    },
 }
 
 /// A map delta.
@@ -135,6 +211,18 @@ impl<'a> From<&'a DiffInner> for Diff<'a> {
                         delta::DeltaItem::Retain { len, .. } => {
                             ans.push(ListDiffItem::Retain { retain: *len });
                         }
+                        delta::DeltaItem::Replace {
+                            value,
+                            delete,
+                            attr,
+                        } if attr.from_set && value.len() == *delete => {
+                            ans.push(ListDiffItem::Set {
+                                set: value
+                                    .iter()
+                                    .map(|v| ValueOrContainer::from(v.clone()))
+                                    .collect(),
+                            });
+                        }
                         delta::DeltaItem::Replace {
                             value,
                             delete,
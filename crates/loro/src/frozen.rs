@@ -0,0 +1,424 @@
+//! Read-only views of a [LoroDoc] and its containers.
+//!
+//! The frozen types only expose the methods that read the document, so passing them to
+//! the code that should never mutate the document is checked at compile time. They share
+//! the state with the document and reflect the latest changes of it.
+use either::Either;
+use loro_internal::container::IntoContainerId;
+use loro_internal::cursor::{Cursor, Side};
+
+use crate::event::Subscriber;
+use crate::{
+    Container, ContainerID, Frontiers, LoroDoc, LoroList, LoroMap, LoroMovableList, LoroResult,
+    LoroText, LoroTree, LoroUnknown, LoroValue, PeerID, SubID, TreeID, VersionVector,
+};
+
+/// A read-only view of a [LoroDoc].
+///
+/// It's created by [LoroDoc::frozen_view].
+#[derive(Debug, Clone, Copy)]
+pub struct FrozenDoc<'a> {
+    doc: &'a LoroDoc,
+}
+
+impl<'a> FrozenDoc<'a> {
+    pub(crate) fn new(doc: &'a LoroDoc) -> Self {
+        Self { doc }
+    }
+
+    /// Get the peer id of the document.
+    pub fn peer_id(&self) -> PeerID {
+        self.doc.peer_id()
+    }
+
+    /// Whether the document is detached from the latest version.
+    pub fn is_detached(&self) -> bool {
+        self.doc.is_detached()
+    }
+
+    /// Get a read-only [LoroText] by container id.
+    pub fn get_text<I: IntoContainerId>(&self, id: I) -> FrozenText {
+        FrozenText(self.doc.get_text(id))
+    }
+
+    /// Get a read-only [LoroMap] by container id.
+    pub fn get_map<I: IntoContainerId>(&self, id: I) -> FrozenMap {
+        FrozenMap(self.doc.get_map(id))
+    }
+
+    /// Get a read-only [LoroList] by container id.
+    pub fn get_list<I: IntoContainerId>(&self, id: I) -> FrozenList {
+        FrozenList(self.doc.get_list(id))
+    }
+
+    /// Get a read-only [LoroMovableList] by container id.
+    pub fn get_movable_list<I: IntoContainerId>(&self, id: I) -> FrozenMovableList {
+        FrozenMovableList(self.doc.get_movable_list(id))
+    }
+
+    /// Get a read-only [LoroTree] by container id.
+    pub fn get_tree<I: IntoContainerId>(&self, id: I) -> FrozenTree {
+        FrozenTree(self.doc.get_tree(id))
+    }
+
+    /// Get a read-only [LoroCounter](crate::LoroCounter) by container id.
+    #[cfg(feature = "counter")]
+    pub fn get_counter<I: IntoContainerId>(&self, id: I) -> FrozenCounter {
+        FrozenCounter(self.doc.get_counter(id))
+    }
+
+    /// Get the current state of the document.
+    pub fn get_deep_value(&self) -> LoroValue {
+        self.doc.get_deep_value()
+    }
+
+    /// Get the current state of the document, with the id of each container.
+    ///
+    /// See [LoroDoc::get_deep_value_with_id].
+    pub fn get_deep_value_with_id(&self) -> LoroValue {
+        self.doc.get_deep_value_with_id()
+    }
+
+    /// Get the `Frontiers` version of `OpLog`.
+    pub fn oplog_frontiers(&self) -> Frontiers {
+        self.doc.oplog_frontiers()
+    }
+
+    /// Get the `Frontiers` version of `DocState`.
+    pub fn state_frontiers(&self) -> Frontiers {
+        self.doc.state_frontiers()
+    }
+
+    /// Get the `VersionVector` version of `OpLog`.
+    pub fn oplog_vv(&self) -> VersionVector {
+        self.doc.oplog_vv()
+    }
+
+    /// Get the `VersionVector` version of `DocState`.
+    pub fn state_vv(&self) -> VersionVector {
+        self.doc.state_vv()
+    }
+
+    /// Subscribe the events of a container.
+    ///
+    /// See [LoroDoc::subscribe]. The containers in the events are not frozen;
+    /// use [FrozenContainer::from] to keep them read-only.
+    pub fn subscribe(&self, container_id: &ContainerID, callback: Subscriber) -> SubID {
+        self.doc.subscribe(container_id, callback)
+    }
+
+    /// Subscribe all the events.
+    ///
+    /// See [LoroDoc::subscribe_root]. The containers in the events are not frozen;
+    /// use [FrozenContainer::from] to keep them read-only.
+    pub fn subscribe_root(&self, callback: Subscriber) -> SubID {
+        self.doc.subscribe_root(callback)
+    }
+
+    /// Remove a subscription by subscription id.
+    pub fn unsubscribe(&self, id: SubID) {
+        self.doc.unsubscribe(id)
+    }
+}
+
+/// A read-only [LoroText].
+#[derive(Debug, Clone)]
+pub struct FrozenText(LoroText);
+
+impl FrozenText {
+    /// Get the [ContainerID] of the text container.
+    pub fn id(&self) -> ContainerID {
+        self.0.id()
+    }
+
+    /// Whether the text container is empty.
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// Get the length of the text container in UTF-8.
+    pub fn len_utf8(&self) -> usize {
+        self.0.len_utf8()
+    }
+
+    /// Get the length of the text container in Unicode.
+    pub fn len_unicode(&self) -> usize {
+        self.0.len_unicode()
+    }
+
+    /// Get the length of the text container in UTF-16.
+    pub fn len_utf16(&self) -> usize {
+        self.0.len_utf16()
+    }
+
+    /// Get the text in [Delta](https://quilljs.com/docs/delta/) format.
+    pub fn to_delta(&self) -> LoroValue {
+        self.0.to_delta()
+    }
+
+    /// Get the text content of the text container.
+    #[allow(clippy::inherent_to_string)]
+    pub fn to_string(&self) -> String {
+        self.0.to_string()
+    }
+
+    /// Get the cursor at the given position.
+    pub fn get_cursor(&self, pos: usize, side: Side) -> Option<Cursor> {
+        self.0.get_cursor(pos, side)
+    }
+}
+
+/// A read-only [LoroMap].
+#[derive(Debug, Clone)]
+pub struct FrozenMap(LoroMap);
+
+impl FrozenMap {
+    /// Get the ID of the map.
+    pub fn id(&self) -> ContainerID {
+        self.0.id()
+    }
+
+    /// Get the length of the map.
+    pub fn len(&self) -> usize {
+        self.0.len()
+    }
+
+    /// Whether the map is empty.
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// Get the value or the read-only container at the given key.
+    pub fn get(&self, key: &str) -> Option<Either<LoroValue, FrozenContainer>> {
+        self.0.get(key).map(freeze)
+    }
+
+    /// Get the shallow value of the map.
+    pub fn get_value(&self) -> LoroValue {
+        self.0.get_value()
+    }
+
+    /// Get the deep value of the map.
+    pub fn get_deep_value(&self) -> LoroValue {
+        self.0.get_deep_value()
+    }
+}
+
+/// A read-only [LoroList].
+#[derive(Debug, Clone)]
+pub struct FrozenList(LoroList);
+
+impl FrozenList {
+    /// Get the ID of the list.
+    pub fn id(&self) -> ContainerID {
+        self.0.id()
+    }
+
+    /// Get the length of the list.
+    pub fn len(&self) -> usize {
+        self.0.len()
+    }
+
+    /// Whether the list is empty.
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// Get the value or the read-only container at the given position.
+    pub fn get(&self, index: usize) -> Option<Either<LoroValue, FrozenContainer>> {
+        self.0.get(index).map(freeze)
+    }
+
+    /// Get the shallow value of the list.
+    pub fn get_value(&self) -> LoroValue {
+        self.0.get_value()
+    }
+
+    /// Get the deep value of the list.
+    pub fn get_deep_value(&self) -> LoroValue {
+        self.0.get_deep_value()
+    }
+
+    /// Get the cursor at the given position.
+    pub fn get_cursor(&self, pos: usize, side: Side) -> Option<Cursor> {
+        self.0.get_cursor(pos, side)
+    }
+}
+
+/// A read-only [LoroMovableList].
+#[derive(Debug, Clone)]
+pub struct FrozenMovableList(LoroMovableList);
+
+impl FrozenMovableList {
+    /// Get the container id of the movable list.
+    pub fn id(&self) -> ContainerID {
+        self.0.id()
+    }
+
+    /// Get the length of the list.
+    pub fn len(&self) -> usize {
+        self.0.len()
+    }
+
+    /// Whether the list is empty.
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// Get the value or the read-only container at the given position.
+    pub fn get(&self, index: usize) -> Option<Either<LoroValue, FrozenContainer>> {
+        self.0.get(index).map(freeze)
+    }
+
+    /// Get the shallow value of the list.
+    pub fn get_value(&self) -> LoroValue {
+        self.0.get_value()
+    }
+
+    /// Get the deep value of the list.
+    pub fn get_deep_value(&self) -> LoroValue {
+        self.0.get_deep_value()
+    }
+
+    /// Get the cursor at the given position.
+    pub fn get_cursor(&self, pos: usize, side: Side) -> Option<Cursor> {
+        self.0.get_cursor(pos, side)
+    }
+}
+
+/// A read-only [LoroTree].
+#[derive(Debug, Clone)]
+pub struct FrozenTree(LoroTree);
+
+impl FrozenTree {
+    /// Return container id of the tree.
+    pub fn id(&self) -> ContainerID {
+        self.0.id()
+    }
+
+    /// Get the read-only associated metadata map of a tree node.
+    pub fn get_meta(&self, target: TreeID) -> LoroResult<FrozenMap> {
+        self.0.get_meta(target).map(FrozenMap)
+    }
+
+    /// Return the parent of target node.
+    ///
+    /// - If the target node does not exist, return `None`.
+    /// - If the target node is a root node, return `Some(None)`.
+    pub fn parent(&self, target: &TreeID) -> Option<Option<TreeID>> {
+        self.0.parent(target)
+    }
+
+    /// Return whether target node exists.
+    pub fn contains(&self, target: TreeID) -> bool {
+        self.0.contains(target)
+    }
+
+    /// Return all nodes.
+    pub fn nodes(&self) -> Vec<TreeID> {
+        self.0.nodes()
+    }
+
+    /// Return all children of the target node.
+    pub fn children(&self, parent: Option<TreeID>) -> Option<Vec<TreeID>> {
+        self.0.children(parent)
+    }
+
+    /// Return the number of children of the target node.
+    pub fn children_num(&self, parent: Option<TreeID>) -> Option<usize> {
+        self.0.children_num(parent)
+    }
+
+    /// Return the fractional index of the target node with hex format.
+    pub fn fractional_index(&self, target: &TreeID) -> Option<String> {
+        self.0.fractional_index(target)
+    }
+
+    /// Return the flat array of the forest.
+    pub fn get_value(&self) -> LoroValue {
+        self.0.get_value()
+    }
+
+    /// Return the flat array of the forest, each node is with metadata.
+    pub fn get_value_with_meta(&self) -> LoroValue {
+        self.0.get_value_with_meta()
+    }
+}
+
+/// A read-only [LoroCounter](crate::LoroCounter).
+#[cfg(feature = "counter")]
+#[derive(Debug, Clone)]
+pub struct FrozenCounter(crate::LoroCounter);
+
+#[cfg(feature = "counter")]
+impl FrozenCounter {
+    /// Return container id of the Counter.
+    pub fn id(&self) -> ContainerID {
+        self.0.id()
+    }
+
+    /// Get the current value of the counter.
+    pub fn get_value(&self) -> LoroValue {
+        self.0.get_value()
+    }
+
+    /// Get the exact integer value of the counter. See [LoroCounter::get_int_value](crate::LoroCounter::get_int_value).
+    pub fn get_int_value(&self) -> Option<i128> {
+        self.0.get_int_value()
+    }
+}
+
+/// A read-only [Container].
+#[derive(Debug, Clone)]
+pub enum FrozenContainer {
+    /// A read-only [LoroList]
+    List(FrozenList),
+    /// A read-only [LoroMap]
+    Map(FrozenMap),
+    /// A read-only [LoroText]
+    Text(FrozenText),
+    /// A read-only [LoroTree]
+    Tree(FrozenTree),
+    /// A read-only [LoroMovableList]
+    MovableList(FrozenMovableList),
+    #[cfg(feature = "counter")]
+    /// A read-only [LoroCounter](crate::LoroCounter)
+    Counter(FrozenCounter),
+    /// Unknown container
+    Unknown(LoroUnknown),
+}
+
+impl FrozenContainer {
+    /// Get the id of the container.
+    pub fn id(&self) -> ContainerID {
+        match self {
+            FrozenContainer::List(x) => x.id(),
+            FrozenContainer::Map(x) => x.id(),
+            FrozenContainer::Text(x) => x.id(),
+            FrozenContainer::Tree(x) => x.id(),
+            FrozenContainer::MovableList(x) => x.id(),
+            #[cfg(feature = "counter")]
+            FrozenContainer::Counter(x) => x.id(),
+            FrozenContainer::Unknown(x) => Container::Unknown(x.clone()).id(),
+        }
+    }
+}
+
+impl From<Container> for FrozenContainer {
+    fn from(value: Container) -> Self {
+        match value {
+            Container::List(x) => FrozenContainer::List(FrozenList(x)),
+            Container::Map(x) => FrozenContainer::Map(FrozenMap(x)),
+            Container::Text(x) => FrozenContainer::Text(FrozenText(x)),
+            Container::Tree(x) => FrozenContainer::Tree(FrozenTree(x)),
+            Container::MovableList(x) => FrozenContainer::MovableList(FrozenMovableList(x)),
+            #[cfg(feature = "counter")]
+            Container::Counter(x) => FrozenContainer::Counter(FrozenCounter(x)),
+            Container::Unknown(x) => FrozenContainer::Unknown(x),
+        }
+    }
+}
+
+fn freeze(v: Either<LoroValue, Container>) -> Either<LoroValue, FrozenContainer> {
+    v.map_right(FrozenContainer::from)
+}
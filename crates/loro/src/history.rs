@@ -0,0 +1,73 @@
+//! Step through the historical versions of a [LoroDoc](crate::LoroDoc).
+//!
+//! See [LoroDoc::history_iter](crate::LoroDoc::history_iter).
+use loro_internal::{history::HistoryIter as InnerHistoryIter, LoroResult, LoroValue};
+
+pub use loro_internal::history::HistoryGranularity;
+
+use crate::{event::DiffBatch, Frontiers};
+
+/// A version visited by [HistoryIter].
+#[derive(Debug, Clone)]
+pub struct HistoryStep {
+    /// The number of steps applied to reach this version, starting from 1
+    pub index: usize,
+    /// The version after this step
+    pub frontiers: Frontiers,
+    /// The diff from the previous version to this version
+    pub diff: DiffBatch,
+}
+
+/// An iterator over the historical versions of a doc in causal order.
+///
+/// Each item contains the diff from the previous version, so a renderer can be
+/// updated incrementally while scrubbing through the history.
+#[derive(Debug)]
+pub struct HistoryIter(pub(crate) InnerHistoryIter);
+
+impl HistoryIter {
+    /// The number of steps from the empty version to the latest version.
+    pub fn len(&self) -> usize {
+        self.0.len()
+    }
+
+    /// Whether the doc has no history.
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// The number of steps applied to reach the current version.
+    pub fn position(&self) -> usize {
+        self.0.position()
+    }
+
+    /// The current version.
+    pub fn frontiers(&self) -> Frontiers {
+        self.0.frontiers()
+    }
+
+    /// The deep value of the doc at the current version.
+    pub fn get_deep_value(&self) -> LoroValue {
+        self.0.get_deep_value()
+    }
+
+    /// Jump to the version after the first `pos` steps, and return the diff from the current
+    /// version to it. `0` is the empty version.
+    ///
+    /// The iteration continues from the new position.
+    pub fn seek(&mut self, pos: usize) -> LoroResult<DiffBatch> {
+        self.0.seek(pos).map(DiffBatch::new)
+    }
+}
+
+impl Iterator for HistoryIter {
+    type Item = HistoryStep;
+
+    fn next(&mut self) -> Option<Self::Item> {
+        self.0.next().map(|step| HistoryStep {
+            index: step.index,
+            frontiers: step.frontiers,
+            diff: DiffBatch::new(step.diff),
+        })
+    }
+}
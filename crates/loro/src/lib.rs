@@ -2,7 +2,8 @@
 #![warn(missing_docs)]
 #![warn(missing_debug_implementations)]
 use either::Either;
-use event::{DiffEvent, Subscriber};
+use event::{DiffBatch, DiffEvent, Subscriber};
+use loro_internal::change::Lamport;
 use loro_internal::container::IntoContainerId;
 use loro_internal::cursor::CannotFindRelativePosition;
 use loro_internal::cursor::Cursor;
@@ -22,27 +23,34 @@ use loro_internal::{
     UnknownHandler as InnerUnknownHandler,
 };
 use std::cmp::Ordering;
-use std::ops::Range;
+use std::ops::{ControlFlow, Range};
 use std::sync::Arc;
 
 use tracing::info;
 
 pub mod event;
+pub mod frozen;
+pub mod history;
 pub use loro_internal::awareness;
 pub use loro_internal::configure::Configure;
 pub use loro_internal::configure::StyleConfigMap;
-pub use loro_internal::container::richtext::ExpandType;
+pub use loro_internal::container::richtext::{ExpandType, IndexType};
 pub use loro_internal::container::{ContainerID, ContainerType};
+pub use loro_internal::container_blob::ForeignMergeStrategy;
 pub use loro_internal::cursor;
 pub use loro_internal::delta::{TreeDeltaItem, TreeDiff, TreeExternalDiff};
+pub use loro_internal::encoding::DocMeta;
 pub use loro_internal::event::Index;
 pub use loro_internal::handler::TextDelta;
 pub use loro_internal::id::{PeerID, TreeID, ID};
-pub use loro_internal::loro::CommitOptions;
-pub use loro_internal::obs::SubID;
-pub use loro_internal::oplog::FrontiersNotIncluded;
+pub use loro_internal::json_patch::JsonPatchOp;
+pub use loro_internal::loro::{ChangeMeta, CommitOptions, MemoryStats, PreparedImport};
+pub use loro_internal::loro_common::IdSpan;
+pub use loro_internal::obs::{LocalOpsSubscriber, OrphanEvent, OrphanSubscriber, SubID};
+pub use loro_internal::oplog::{DocStats, FrontiersNotIncluded, PeerStats};
 pub use loro_internal::undo;
-pub use loro_internal::version::{Frontiers, VersionVector};
+pub use loro_internal::validate::Inconsistency;
+pub use loro_internal::version::{Frontiers, VersionVector, VersionVectorDiff};
 pub use loro_internal::ApplyDiff;
 pub use loro_internal::JsonSchema;
 pub use loro_internal::UndoManager as InnerUndoManager;
@@ -77,6 +85,33 @@ impl LoroDoc {
         LoroDoc { doc }
     }
 
+    /// Create a new `LoroDoc` whose peer ids are derived from `seed` deterministically.
+    ///
+    /// The peer id of the doc and the peer ids generated later, e.g. by [`LoroDoc::fork`],
+    /// are distinct from each other. The encoding format is not affected.
+    ///
+    /// It's useful for tests that expect byte-stable exported data across runs.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let a = LoroDoc::new_with_peer_seed(42);
+    /// let b = LoroDoc::new_with_peer_seed(42);
+    /// assert_eq!(a.peer_id(), b.peer_id());
+    /// assert_ne!(a.fork().peer_id(), a.peer_id());
+    /// a.get_text("text").insert(0, "Hello").unwrap();
+    /// b.get_text("text").insert(0, "Hello").unwrap();
+    /// a.commit();
+    /// b.commit();
+    /// assert_eq!(a.export_snapshot(), b.export_snapshot());
+    /// ```
+    pub fn new_with_peer_seed(seed: u64) -> Self {
+        let doc = InnerLoroDoc::new_with_peer_seed(seed);
+        doc.start_auto_commit();
+
+        LoroDoc { doc }
+    }
+
     /// Duplicate the document with a different PeerID
     ///
     /// The time complexity and space complexity of this operation are both O(n),
@@ -85,6 +120,35 @@ impl LoroDoc {
         LoroDoc { doc }
     }
 
+    /// Create a new document whose state and history equal this document's at `frontiers`.
+    ///
+    /// The history of the new document only contains the ops included by `frontiers`.
+    /// It gets a different PeerID, so the changes made on it can be merged back.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let f = doc.oplog_frontiers();
+    /// text.insert(5, " world").unwrap();
+    /// doc.commit();
+    ///
+    /// let branch = doc.fork_at(&f).unwrap();
+    /// assert_eq!(branch.get_text("text").to_string(), "Hello");
+    /// assert_ne!(branch.peer_id(), doc.peer_id());
+    /// branch.get_text("text").insert(0, "> ").unwrap();
+    /// branch.commit();
+    /// doc.import(&branch.export_from(&doc.oplog_vv())).unwrap();
+    /// assert_eq!(text.to_string(), "> Hello world");
+    /// ```
+    pub fn fork_at(&self, frontiers: &Frontiers) -> LoroResult<Self> {
+        let doc = self.doc.fork_at(frontiers)?;
+        Ok(LoroDoc { doc })
+    }
+
     /// Get the configureations of the document.
     pub fn config(&self) -> &Configure {
         self.doc.config()
@@ -95,6 +159,28 @@ impl LoroDoc {
         InnerLoroDoc::decode_import_blob_meta(bytes)
     }
 
+    /// Decode the metadata of a blob and the values of some of its containers without
+    /// importing it, e.g. to show the titles of the documents in a file browser.
+    ///
+    /// The result contains the versions, timestamps and the number of containers of the
+    /// blob. If it's a snapshot, only the states of `previews` are built, and their shallow
+    /// values are returned. The nested containers are represented by their ids.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{ContainerID, ContainerType, LoroDoc, LoroValue};
+    /// let doc = LoroDoc::new();
+    /// doc.get_text("title").insert(0, "Notes").unwrap();
+    /// doc.get_list("items").push("a").unwrap();
+    /// let title = ContainerID::new_root("title", ContainerType::Text);
+    /// let meta = LoroDoc::peek(&doc.export_snapshot(), &[title.clone()]).unwrap();
+    /// assert_eq!(meta.container_num, 2);
+    /// assert_eq!(meta.previews[&title], LoroValue::from("Notes"));
+    /// ```
+    pub fn peek(bytes: &[u8], previews: &[ContainerID]) -> LoroResult<DocMeta> {
+        InnerLoroDoc::peek(bytes, previews)
+    }
+
     /// Set whether to record the timestamp of each change. Default is `false`.
     ///
     /// If enabled, the Unix timestamp will be recorded for each change automatically.
@@ -153,7 +239,8 @@ impl LoroDoc {
     ///
     /// > The document becomes detached during a `checkout` operation.
     /// > Being `detached` implies that the `DocState` is not synchronized with the latest version of the `OpLog`.
-    /// > In a detached state, the document is not editable, and any `import` operations will be
+    /// > In a detached state, the document is not editable unless detached editing is enabled
+    /// > by [`LoroDoc::set_detached_editing`], and any `import` operations will be
     /// > recorded in the `OpLog` without being applied to the `DocState`.
     ///
     /// You should call `attach` to attach the `DocState` to the lastest version of `OpLog`.
@@ -161,6 +248,139 @@ impl LoroDoc {
         self.doc.checkout(frontiers)
     }
 
+    /// Checkout to the version, call `f`, and then restore the version and the attachment
+    /// the doc had before.
+    ///
+    /// The doc is restored even if `f` panics, so it can't be left detached by accident.
+    /// It can be nested; the inner call restores the version checked out by the outer one.
+    /// If the frontiers are not in the history, [`LoroError::FrontiersNotFound`] is returned
+    /// without calling `f`.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let v1 = doc.oplog_frontiers();
+    /// text.insert(5, " World").unwrap();
+    ///
+    /// let old = doc.with_version(&v1, |doc| doc.get_text("text").to_string()).unwrap();
+    /// assert_eq!(old, "Hello");
+    /// assert!(!doc.is_detached());
+    /// assert_eq!(text.to_string(), "Hello World");
+    /// ```
+    pub fn with_version<R>(
+        &self,
+        frontiers: &Frontiers,
+        f: impl FnOnce(&LoroDoc) -> R,
+    ) -> LoroResult<R> {
+        self.doc.with_version(frontiers, |_| f(self))
+    }
+
+    /// Allow or forbid editing the doc in detached mode.
+    ///
+    /// When it's enabled, you can edit the doc after a `checkout`. The edits depend on the
+    /// checked out version, and they are merged with the newer ops as concurrent edits when
+    /// the doc is attached again, e.g. by [`LoroDoc::commit_rebased`].
+    ///
+    /// The peer id is renewed on checkout if the checked out version doesn't include all the
+    /// ops of the current peer, because the ops of a peer must form a single chain.
+    pub fn set_detached_editing(&self, enable: bool) {
+        self.doc.set_detached_editing(enable)
+    }
+
+    /// Whether the doc can be edited in detached mode.
+    pub fn is_detached_editing_enabled(&self) -> bool {
+        self.doc.is_detached_editing_enabled()
+    }
+
+    /// Commit the edits made in detached mode and attach the doc to the latest version.
+    ///
+    /// The edits are merged with the ops that are newer than the checked out version
+    /// as if they were made concurrently.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let v0 = doc.oplog_frontiers();
+    /// text.insert(5, " world").unwrap();
+    /// doc.commit();
+    ///
+    /// doc.set_detached_editing(true);
+    /// doc.checkout(&v0).unwrap();
+    /// text.insert(0, "Hi! ").unwrap();
+    /// assert_eq!(text.to_string(), "Hi! Hello");
+    /// doc.commit_rebased();
+    /// assert!(!doc.is_detached());
+    /// assert_eq!(text.to_string(), "Hi! Hello world");
+    /// ```
+    pub fn commit_rebased(&self) {
+        self.doc.commit_rebased()
+    }
+
+    /// Calculate the diff between two versions.
+    ///
+    /// Applying the returned diff on the state at `from` turns it into the state at `to`.
+    /// The diffs have the same shape as the ones delivered to subscribers. `to` can be
+    /// behind `from`.
+    ///
+    /// The doc's current state is left untouched and no event is emitted.
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, event::Diff};
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let v0 = doc.oplog_frontiers();
+    /// text.insert(5, " world").unwrap();
+    /// doc.commit();
+    /// let diff = doc.diff(&v0, &doc.oplog_frontiers()).unwrap();
+    /// assert_eq!(diff.len(), 1);
+    /// assert!(matches!(diff.get(&text.id()), Some(Diff::Text(_))));
+    /// ```
+    pub fn diff(&self, from: &Frontiers, to: &Frontiers) -> LoroResult<DiffBatch> {
+        self.doc.diff(from, to).map(DiffBatch::new)
+    }
+
+    /// Create an iterator that steps through the historical versions of the document,
+    /// starting from the empty version.
+    ///
+    /// The versions are visited in causal order. Each step applies a change or an op,
+    /// depending on `granularity`, and yields the diff from the previous version. The
+    /// iterator keeps its own copy of the state, so each step only calculates the diff of
+    /// that step instead of checking out from scratch. Use [`history::HistoryIter::seek`]
+    /// to jump to a step.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, ToJson, Frontiers, history::HistoryGranularity};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// let map = doc.get_map("map");
+    /// map.insert("a", 1).unwrap();
+    /// doc.commit();
+    /// map.insert("b", 2).unwrap();
+    /// doc.commit();
+    /// let mut iter = doc.history_iter(HistoryGranularity::Op);
+    /// assert_eq!(iter.len(), 2);
+    /// let step = iter.next().unwrap();
+    /// assert!(step.diff.get(&map.id()).is_some());
+    /// assert_eq!(iter.get_deep_value().to_json_value(), json!({"map": {"a": 1}}));
+    /// iter.seek(0).unwrap();
+    /// assert_eq!(iter.frontiers(), Frontiers::default());
+    /// ```
+    pub fn history_iter(&self, granularity: history::HistoryGranularity) -> history::HistoryIter {
+        history::HistoryIter(self.doc.history_iter(granularity))
+    }
+
     /// Checkout the `DocState` to the latest version.
     ///
     /// > The document becomes detached during a `checkout` operation.
@@ -203,10 +423,70 @@ impl LoroDoc {
     /// Import a batch of updates/snapshot.
     ///
     /// The data can be in arbitrary order. The import result will be the same.
-    pub fn import_batch(&mut self, bytes: &[Vec<u8>]) -> LoroResult<()> {
+    ///
+    /// The state is only updated once after all the data are imported, so it's
+    /// faster than importing them one by one, and the subscribers receive a single
+    /// event that reflects the net change of the whole batch.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// # use std::sync::{Arc, atomic::{AtomicUsize, Ordering}};
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let snapshot = doc.export_snapshot();
+    /// let v = doc.oplog_vv();
+    /// text.insert(5, " world").unwrap();
+    /// doc.commit();
+    /// let updates = doc.export_from(&v);
+    ///
+    /// let new_doc = LoroDoc::new();
+    /// let count = Arc::new(AtomicUsize::new(0));
+    /// let count_clone = count.clone();
+    /// let _sub = new_doc.subscribe_root(Arc::new(move |_| {
+    ///     count_clone.fetch_add(1, Ordering::SeqCst);
+    /// }));
+    /// new_doc.import_batch(&[updates, snapshot]).unwrap();
+    /// assert_eq!(new_doc.get_text("text").to_string(), "Hello world");
+    /// assert_eq!(count.load(Ordering::SeqCst), 1);
+    /// ```
+    pub fn import_batch(&self, bytes: &[Vec<u8>]) -> LoroResult<()> {
         self.doc.import_batch(bytes)
     }
 
+    /// Export the ops in `spans`, so that a peer can get exactly the ops it lacks.
+    ///
+    /// A blob can only contain one contiguous span of each peer, so multiple blobs are
+    /// returned if there are disjoint spans of the same peer. The blobs can be imported
+    /// in any order, e.g. by [`LoroDoc::import_batch`].
+    ///
+    /// ```
+    /// # use loro::{IdSpan, LoroDoc};
+    /// let doc = LoroDoc::new();
+    /// doc.set_peer_id(1).unwrap();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "a").unwrap();
+    /// doc.commit();
+    /// text.insert(1, "b").unwrap();
+    /// doc.commit();
+    /// text.insert(2, "c").unwrap();
+    /// doc.commit();
+    ///
+    /// let new_doc = LoroDoc::new();
+    /// new_doc.import_batch(&doc.export_updates_in_spans(&[IdSpan::new(1, 0, 1)])).unwrap();
+    /// assert_eq!(new_doc.get_text("text").to_string(), "a");
+    /// // The peer lacks the ops in 1..3 now
+    /// let blobs = doc.export_updates_in_spans(&[IdSpan::new(1, 2, 3), IdSpan::new(1, 1, 2)]);
+    /// assert_eq!(blobs.len(), 1);
+    /// new_doc.import_batch(&blobs).unwrap();
+    /// assert_eq!(new_doc.get_text("text").to_string(), "abc");
+    /// ```
+    pub fn export_updates_in_spans(&self, spans: &[IdSpan]) -> Vec<Vec<u8>> {
+        self.doc.export_updates_in_spans(spans)
+    }
+
     /// Get a [LoroMovableList] by container id.
     ///
     /// If the provided id is string, it will be converted into a root container id with the name of the string.
@@ -238,9 +518,7 @@ impl LoroDoc {
     ///
     /// If the provided id is string, it will be converted into a root container id with the name of the string.
     pub fn get_text<I: IntoContainerId>(&self, id: I) -> LoroText {
-        LoroText {
-            handler: self.doc.get_text(id),
-        }
+        LoroText::from_handler(self.doc.get_text(id))
     }
 
     /// Get a [LoroTree] by container id.
@@ -267,8 +545,12 @@ impl LoroDoc {
     /// There is a transaction behind every operation.
     /// It will automatically commit when users invoke export or import.
     /// The event will be sent after a transaction is committed
+    ///
+    /// **If the pre-commit hook rejects the change, the change is dropped without an error.**
+    /// Use [`LoroDoc::try_commit`] to get the error.
     pub fn commit(&self) {
-        self.doc.commit_then_renew()
+        self.doc
+            .commit_with(CommitOptions::new().immediate_renew(true))
     }
 
     /// Commit the cumulative auto commit transaction with custom configure.
@@ -276,10 +558,83 @@ impl LoroDoc {
     /// There is a transaction behind every operation.
     /// It will automatically commit when users invoke export or import.
     /// The event will be sent after a transaction is committed
+    ///
+    /// **If the pre-commit hook rejects the change, the change is dropped without an error.**
+    /// Use [`LoroDoc::try_commit_with`] to get the error.
     pub fn commit_with(&self, options: CommitOptions) {
         self.doc.commit_with(options)
     }
 
+    /// Commit the cumulative auto commit transaction, and return the error if the change is
+    /// rejected by the pre-commit hook.
+    ///
+    /// See [`LoroDoc::set_pre_commit_hook`].
+    pub fn try_commit(&self) -> LoroResult<()> {
+        self.doc
+            .try_commit_with(CommitOptions::new().immediate_renew(true))
+    }
+
+    /// Commit the cumulative auto commit transaction with custom configure, and return the
+    /// error if the change is rejected by the pre-commit hook.
+    pub fn try_commit_with(&self, options: CommitOptions) -> LoroResult<()> {
+        self.doc.try_commit_with(options)
+    }
+
+    /// Set a hook that is called before a local change is committed.
+    ///
+    /// The hook sees the pending change and can be used to enforce the invariants of the
+    /// document. If it returns an error, the change is rolled back, and [`LoroDoc::try_commit`]
+    /// returns the error. The hook can also edit the document to fix the change; the ops
+    /// created in the hook are included in the change without being checked again.
+    ///
+    /// It only runs on the explicit commits. The transactions committed implicitly, e.g. by
+    /// [`LoroDoc::export_from`] or [`LoroDoc::import`], skip the hook, so their pending edits
+    /// are never dropped without an error. Setting a new hook replaces the old one. The hook must not commit the document; such a
+    /// commit fails with [`LoroError::TransactionError`] and its ops stay in the pending change.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, LoroError, event::Diff};
+    /// let doc = LoroDoc::new();
+    /// let map = doc.get_map("map");
+    /// doc.set_pre_commit_hook(move |change| {
+    ///     for (_, diff) in change.diff.iter() {
+    ///         if let Diff::Map(delta) = diff {
+    ///             for value in delta.updated.values().flatten() {
+    ///                 if value.as_value().and_then(|v| v.as_i64()).is_none() {
+    ///                     return Err(LoroError::ArgErr("Only numbers are allowed".into()));
+    ///                 }
+    ///             }
+    ///         }
+    ///     }
+    ///     Ok(())
+    /// });
+    /// map.insert("a", 1).unwrap();
+    /// doc.try_commit().unwrap();
+    /// map.insert("b", "text").unwrap();
+    /// assert!(doc.try_commit().is_err());
+    /// assert!(map.get("b").is_none());
+    /// assert_eq!(map.len(), 1);
+    /// ```
+    pub fn set_pre_commit_hook<F>(&self, hook: F)
+    where
+        F: Fn(&event::PendingLocalChange) -> LoroResult<()> + Send + Sync + 'static,
+    {
+        self.doc.set_pre_commit_hook(Arc::new(move |change| {
+            hook(&event::PendingLocalChange {
+                id: change.id,
+                lamport: change.lamport,
+                len: change.len,
+                diff: DiffBatch::new(change.diff.clone()),
+            })
+        }));
+    }
+
+    /// Remove the hook set by [`LoroDoc::set_pre_commit_hook`].
+    pub fn remove_pre_commit_hook(&self) {
+        self.doc.remove_pre_commit_hook()
+    }
+
     /// Whether the document is in detached mode, where the [loro_internal::DocState] is not
     /// synchronized with the latest version of the [loro_internal::OpLog].
     pub fn is_detached(&self) -> bool {
@@ -299,6 +654,71 @@ impl LoroDoc {
         self.doc.import_with(bytes, origin.into())
     }
 
+    /// Prepare the import of `bytes`, which can be applied by [`LoroDoc::apply_import`] later.
+    ///
+    /// If `bytes` is a snapshot and the doc is empty, the expensive decoding and state
+    /// building are done here. The doc is only locked briefly, so it can be called from
+    /// another thread to avoid blocking the thread that owns the doc.
+    ///
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// let snapshot = doc.export_snapshot();
+    ///
+    /// let new_doc = LoroDoc::new();
+    /// let prepared = std::thread::scope(|s| {
+    ///     s.spawn(|| new_doc.prepare_import(&snapshot)).join().unwrap()
+    /// })
+    /// .unwrap();
+    /// new_doc.apply_import(prepared).unwrap();
+    /// assert_eq!(new_doc.get_text("text").to_string(), "Hello");
+    /// ```
+    pub fn prepare_import(&self, bytes: &[u8]) -> LoroResult<PreparedImport> {
+        self.doc.prepare_import(bytes)
+    }
+
+    /// Apply the import prepared by [`LoroDoc::prepare_import`].
+    ///
+    /// The resulting state and the emitted events are the same as [`LoroDoc::import`].
+    pub fn apply_import(&self, prepared: PreparedImport) -> LoroResult<()> {
+        self.doc.apply_import(prepared)
+    }
+
+    /// Calculate the diff that importing `bytes` would apply to the current state, without
+    /// changing the document.
+    ///
+    /// It can be used to check the updates from an untrusted peer before importing them.
+    /// Only the containers affected by the updates are copied to calculate the diff.
+    /// The changes whose dependencies are missing can't be applied; they are reported in
+    /// [`event::ImportPreview::pending`] instead of the diff.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, ToJson, event::Diff};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// doc.get_map("map").insert("key", "value").unwrap();
+    /// doc.commit();
+    /// let other = doc.fork();
+    /// other.get_map("map").delete("key").unwrap();
+    /// other.commit();
+    ///
+    /// let preview = doc.import_preview(&other.export_from(&doc.oplog_vv())).unwrap();
+    /// assert!(matches!(preview.diff.get(&doc.get_map("map").id()), Some(Diff::Map(_))));
+    /// assert!(preview.pending.is_empty());
+    /// // The doc is not changed
+    /// assert_eq!(doc.get_deep_value().to_json_value(), json!({"map": {"key": "value"}}));
+    /// ```
+    pub fn import_preview(&self, bytes: &[u8]) -> LoroResult<event::ImportPreview> {
+        self.doc
+            .import_preview(bytes)
+            .map(|preview| event::ImportPreview {
+                diff: DiffBatch::new(preview.diff),
+                pending: preview.pending,
+            })
+    }
+
     /// Import the json schema updates.
     ///
     /// only supports backward compatibility but not forward compatibility.
@@ -325,6 +745,99 @@ impl LoroDoc {
         self.doc.export_snapshot()
     }
 
+    /// Export all the ops not included in the given `VersionVector` into `writer`.
+    ///
+    /// The written bytes are identical to the output of [`LoroDoc::export_from`].
+    /// The body is written column by column, so the serialized blob is never in memory as a
+    /// whole. The memory usage is still proportional to the exported ops, because each
+    /// column of the format holds the values of all of them.
+    pub fn export_from_to<W: std::io::Write>(
+        &self,
+        vv: &VersionVector,
+        writer: &mut W,
+    ) -> std::io::Result<()> {
+        self.doc.export_from_to(vv, writer)
+    }
+
+    /// Export the ops that are included in `to` but not in `from` into `writer`.
+    ///
+    /// The written bytes are one blob of updates, like the output of
+    /// [`LoroDoc::export_updates_in_spans`] for the spans between the two versions.
+    ///
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let base = doc.export_snapshot();
+    /// let from = doc.oplog_vv();
+    /// text.insert(5, " World").unwrap();
+    /// doc.commit();
+    /// let mut updates: Vec<u8> = Vec::new();
+    /// doc.export_updates_in_range_to(&from, &doc.oplog_vv(), &mut updates)
+    ///     .unwrap();
+    /// let other = LoroDoc::new();
+    /// other.import(&base).unwrap();
+    /// other.import(&updates).unwrap();
+    /// assert_eq!(other.get_text("text").to_string(), "Hello World");
+    /// ```
+    pub fn export_updates_in_range_to<W: std::io::Write>(
+        &self,
+        from: &VersionVector,
+        to: &VersionVector,
+        writer: &mut W,
+    ) -> std::io::Result<()> {
+        self.doc.export_updates_in_range_to(from, to, writer)
+    }
+
+    /// Export the current state and history of the document into `writer`.
+    ///
+    /// The written bytes are identical to the output of [`LoroDoc::export_snapshot`],
+    /// so they can be imported by [`LoroDoc::import`] directly. Like
+    /// [`LoroDoc::export_from_to`], the body is written column by column.
+    ///
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// let mut file: Vec<u8> = Vec::new();
+    /// doc.export_snapshot_to(&mut file).unwrap();
+    /// let new_doc = LoroDoc::new();
+    /// new_doc.import(&file).unwrap();
+    /// assert_eq!(new_doc.get_text("text").to_string(), "Hello");
+    /// ```
+    pub fn export_snapshot_to<W: std::io::Write>(&self, writer: &mut W) -> std::io::Result<()> {
+        self.doc.export_snapshot_to(writer)
+    }
+
+    /// Merge the consecutive changes of each peer before `keep_since`, so that their adjacent
+    /// ops, e.g. the text typed one commit at a time, are coalesced and the history becomes
+    /// smaller. It returns the number of the changes merged into their previous changes.
+    ///
+    /// The ops keep their ids and contents, so the old versions can still be checked out and
+    /// the concurrent changes made by other peers can still be merged. Only the timestamps of
+    /// the merged changes are lost. The changes with commit messages are kept apart.
+    ///
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// doc.set_change_merge_interval(0);
+    /// let text = doc.get_text("text");
+    /// for i in 0..10 {
+    ///     text.insert(i, "a").unwrap();
+    ///     doc.commit();
+    /// }
+    /// let before = doc.export_snapshot().len();
+    /// assert_eq!(doc.compact_history(&doc.oplog_frontiers()).unwrap(), 9);
+    /// assert_eq!(doc.len_changes(), 1);
+    /// assert_eq!(text.to_string(), "aaaaaaaaaa");
+    /// assert!(doc.export_snapshot().len() < before);
+    /// ```
+    pub fn compact_history(&self, keep_since: &Frontiers) -> LoroResult<usize> {
+        self.doc.compact_history(keep_since)
+    }
+
     /// Convert `Frontiers` into `VersionVector`
     pub fn frontiers_to_vv(&self, frontiers: &Frontiers) -> Option<VersionVector> {
         self.doc.frontiers_to_vv(frontiers)
@@ -361,11 +874,386 @@ impl LoroDoc {
         self.doc.len_changes()
     }
 
+    /// Get the storage statistics of the history.
+    ///
+    /// It reports the number of changes, ops and the approximate encoded size
+    /// of each peer, along with the number of ops applied to each container.
+    /// It's computed from the in-memory oplog, so it doesn't need an export.
+    /// Ops in the pending transaction are not counted until they are committed.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// doc.set_peer_id(1).unwrap();
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let stats = doc.analyze();
+    /// assert_eq!(stats.peers[&1].atom_ops, 5);
+    /// assert_eq!(stats.total_atom_ops(), 5);
+    /// ```
+    pub fn analyze(&self) -> DocStats {
+        self.doc.analyze()
+    }
+
+    /// Get the approximate memory usage of the document in bytes.
+    ///
+    /// It's broken down into the history (the oplog, the causal graph and the op indexes),
+    /// the shared arena, the current state of each container type and the diff caches,
+    /// which scale differently as the history grows. It can be used to decide when to
+    /// evict a cold document, or when to trim its history.
+    ///
+    /// It's computed from the sizes of the in-memory structures without encoding the
+    /// document, so it's cheap but not exact. The undo managers are not owned by the document,
+    /// so their stacks are only counted after [`UndoManager::memory_usage`] is added to
+    /// [`MemoryStats::undo`].
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{ContainerType, LoroDoc};
+    /// let doc = LoroDoc::new();
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let stats = doc.memory_usage();
+    /// assert!(stats.oplog > 0);
+    /// assert!(stats.state[&ContainerType::Text] > 0);
+    /// assert!(stats.total() >= stats.history() + stats.total_state());
+    /// ```
+    pub fn memory_usage(&self) -> MemoryStats {
+        self.doc.memory_usage()
+    }
+
+    /// Get the commit message of the change that contains `id`.
+    ///
+    /// The message is attached by [CommitOptions::commit_msg]. It's kept in the exported
+    /// updates and snapshots, and the versions that don't support it just ignore it.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{CommitOptions, LoroDoc, ID};
+    /// let doc = LoroDoc::new();
+    /// doc.set_peer_id(1).unwrap();
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// doc.commit_with(CommitOptions::new().commit_msg("Say hello").author("Alice"));
+    /// let new_doc = LoroDoc::new();
+    /// new_doc.import(&doc.export_snapshot()).unwrap();
+    /// assert_eq!(new_doc.change_message(ID::new(1, 2)).as_deref(), Some("Say hello"));
+    /// assert_eq!(new_doc.change_author(ID::new(1, 2)).as_deref(), Some("Alice"));
+    /// ```
+    pub fn change_message(&self, id: ID) -> Option<Arc<str>> {
+        self.doc.change_message(id)
+    }
+
+    /// Get the author of the change that contains `id`, which is set by [CommitOptions::author].
+    pub fn change_author(&self, id: ID) -> Option<Arc<str>> {
+        self.doc.change_author(id)
+    }
+
+    /// Get the metadata of the changes that are included by `to` but not by `from`.
+    ///
+    /// Each [ChangeMeta] contains the id span, lamport, timestamp, deps, commit message and
+    /// author of a change, so it can be used to render a commit list or draw the DAG
+    /// of the history. The changes are sorted by their lamports, so a change always comes
+    /// after its deps. If a change is only partially included, the included part is returned.
+    ///
+    /// The consecutive commits of a peer may be merged into one change, unless they have
+    /// commit messages or different authors.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{CommitOptions, Frontiers, LoroDoc, ID};
+    /// let doc = LoroDoc::new();
+    /// doc.set_peer_id(1).unwrap();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit_with(CommitOptions::new().commit_msg("hello"));
+    /// text.insert(5, " world").unwrap();
+    /// doc.commit_with(CommitOptions::new().commit_msg("world"));
+    /// let changes = doc
+    ///     .get_changes_in_range(&Frontiers::default(), &doc.oplog_frontiers())
+    ///     .unwrap();
+    /// assert_eq!(changes.len(), 2);
+    /// assert_eq!(changes[0].message.as_deref(), Some("hello"));
+    /// assert_eq!(changes[1].deps, Frontiers::from_id(ID::new(1, 4)));
+    /// ```
+    pub fn get_changes_in_range(
+        &self,
+        from: &Frontiers,
+        to: &Frontiers,
+    ) -> LoroResult<Vec<ChangeMeta>> {
+        self.doc.get_changes_in_range(from, to)
+    }
+
+    /// Check the invariants of the document without panicking.
+    ///
+    /// It checks that the changes of each peer are continuous and match the version vector,
+    /// the deps of the changes are in the history, the frontiers and the state version are
+    /// consistent with the history, and no container is its own ancestor. The broken
+    /// invariants are returned as [Inconsistency]s, so a corrupted document can be detected
+    /// after an import instead of crashing the application later.
+    ///
+    /// It goes through the whole history, so it's slow on a large document.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// let fork = doc.fork();
+    /// fork.get_text("text").insert(5, " world").unwrap();
+    /// doc.import(&fork.export_from(&doc.oplog_vv())).unwrap();
+    /// assert!(doc.validate().is_empty());
+    /// ```
+    pub fn validate(&self) -> Vec<Inconsistency> {
+        self.doc.validate()
+    }
+
+    /// Fix the recoverable inconsistencies found by [LoroDoc::validate], and return the
+    /// ones that are left.
+    ///
+    /// The version vector and the frontiers of the history are recalculated from the changes.
+    /// The other inconsistencies, like a missing dep, can't be fixed in place.
+    pub fn repair(&self) -> Vec<Inconsistency> {
+        self.doc.repair()
+    }
+
+    /// Export the changes between two versions as [JSON Patch](https://datatracker.ietf.org/doc/html/rfc6902) operations.
+    ///
+    /// The paths are JSON Pointers into the value of [`LoroDoc::get_deep_value`], so applying the
+    /// ops to the deep value at `from` produces the deep value at `to`. Text containers are
+    /// exported as a `replace` of the whole string. The doc is restored to its previous version
+    /// afterwards, and no event is emitted.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, LoroMap, JsonPatchOp};
+    /// let doc = LoroDoc::new();
+    /// let list = doc.get_list("list");
+    /// let map = list.insert_container(0, LoroMap::new()).unwrap();
+    /// map.insert("name", "Alice").unwrap();
+    /// doc.commit();
+    /// let v0 = doc.oplog_frontiers();
+    /// map.insert("name", "Bob").unwrap();
+    /// doc.commit();
+    /// let patch = doc.export_json_patch(&v0, &doc.oplog_frontiers()).unwrap();
+    /// assert_eq!(
+    ///     patch,
+    ///     vec![JsonPatchOp::Add {
+    ///         path: "/list/0/name".into(),
+    ///         value: "Bob".into()
+    ///     }]
+    /// );
+    /// ```
+    #[inline]
+    pub fn export_json_patch(
+        &self,
+        from: &Frontiers,
+        to: &Frontiers,
+    ) -> LoroResult<Vec<JsonPatchOp>> {
+        self.doc.export_json_patch(from, to)
+    }
+
     /// Get the current state of the document.
     pub fn get_deep_value(&self) -> LoroValue {
         self.doc.get_deep_value()
     }
 
+    /// Get the current state of the document, with the id of each container.
+    ///
+    /// Every container is represented by `{ "cid": <container id>, "value": <deep value> }`,
+    /// including the `meta` of each tree node. The ids can be parsed by `ContainerID::try_from`
+    /// to correlate the nodes with the events or to get their handlers by `get_map`, `get_text`, etc.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// use loro::{LoroDoc, LoroText, ToJson};
+    /// use serde_json::json;
+    ///
+    /// let doc = LoroDoc::new();
+    /// let map = doc.get_map("map");
+    /// let text = map.insert_container("text", LoroText::new()).unwrap();
+    /// text.insert(0, "Hi").unwrap();
+    /// assert_eq!(
+    ///     doc.get_deep_value_with_id().to_json_value(),
+    ///     json!({
+    ///         "map": {
+    ///             "cid": map.id().to_string(),
+    ///             "value": {
+    ///                 "text": { "cid": text.id().to_string(), "value": "Hi" }
+    ///             }
+    ///         }
+    ///     })
+    /// );
+    /// ```
+    pub fn get_deep_value_with_id(&self) -> LoroValue {
+        self.doc.get_deep_value_with_id()
+    }
+
+    /// Get the value of a container at the given version, without checking out the document.
+    ///
+    /// Only the history of the container is replayed, so the other containers and the
+    /// current state are not touched. The container handlers still operate on the latest
+    /// version. The value is shallow: the child containers are represented by their ids.
+    /// It returns [`LoroError::NotFoundError`] if the container is unknown to the document.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, LoroValue};
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let v0 = doc.oplog_frontiers();
+    /// text.insert(5, " world").unwrap();
+    /// doc.commit();
+    /// let old = doc.get_container_value_at(&text.id(), &v0).unwrap();
+    /// assert_eq!(old, LoroValue::from("Hello"));
+    /// assert!(!doc.is_detached());
+    /// assert_eq!(text.to_string(), "Hello world");
+    /// ```
+    pub fn get_container_value_at(
+        &self,
+        id: &ContainerID,
+        frontiers: &Frontiers,
+    ) -> LoroResult<LoroValue> {
+        self.doc.get_container_value_at(id, frontiers)
+    }
+
+    /// Get a read-only view of the document.
+    ///
+    /// The view shares the state with the document, so it reflects the later changes.
+    /// It and the containers got from it only have the methods that read the document,
+    /// so the code holding them can't mutate the document by accident.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// use loro::LoroDoc;
+    ///
+    /// let doc = LoroDoc::new();
+    /// let view = doc.frozen_view();
+    /// let text = view.get_text("text");
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// assert_eq!(text.to_string(), "Hello");
+    /// ```
+    ///
+    /// ```compile_fail
+    /// let doc = loro::LoroDoc::new();
+    /// doc.frozen_view().get_text("text").insert(0, "Hello");
+    /// ```
+    pub fn frozen_view(&self) -> frozen::FrozenDoc<'_> {
+        frozen::FrozenDoc::new(self)
+    }
+
+    /// Export the current state of a container and its descendants as a portable blob.
+    ///
+    /// The blob has no history, and it can be imported into any document by
+    /// [`LoroDoc::import_container_as`], e.g. to copy and paste structured content.
+    pub fn export_container(&self, id: &ContainerID) -> LoroResult<Vec<u8>> {
+        self.doc.export_container(id)
+    }
+
+    /// Import a blob exported by [`LoroDoc::export_container`] as a new container at `key`
+    /// of the map `parent`, and return the id of the new container.
+    ///
+    /// The container and its descendants are recreated by new ops, so they get new ids,
+    /// and the nested containers (including the metadata of tree nodes) are rewritten
+    /// to point to the recreated ones.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, LoroText, ToJson};
+    /// # use serde_json::json;
+    /// let a = LoroDoc::new();
+    /// let text = a.get_map("block").insert_container("text", LoroText::new()).unwrap();
+    /// text.insert(0, "Hello").unwrap();
+    /// text.mark(0..5, "bold", true).unwrap();
+    /// let blob = a.export_container(&a.get_map("block").id()).unwrap();
+    ///
+    /// let b = LoroDoc::new();
+    /// let id = b.import_container_as(&blob, &b.get_map("doc").id(), "pasted").unwrap();
+    /// assert_eq!(
+    ///     b.get_map(id).get_deep_value().to_json_value(),
+    ///     json!({"text": "Hello"})
+    /// );
+    /// ```
+    pub fn import_container_as(
+        &self,
+        blob: &[u8],
+        parent: &ContainerID,
+        key: &str,
+    ) -> LoroResult<ContainerID> {
+        self.doc.import_container_as(blob, parent, key)
+    }
+
+    /// Copy the root containers of `other`, a document that doesn't share history with
+    /// this one, into this document.
+    ///
+    /// If `mount` is a map, each root becomes a child container of the map at the key of
+    /// its name. Otherwise they become root containers with the same names. `strategy`
+    /// decides what to do with a root whose name is already used.
+    ///
+    /// Like [`LoroDoc::import_container_as`], the content is recreated by new ops, so the
+    /// ids are remapped and never collide with the ids of this document. The history of
+    /// `other` is not copied. It returns the ids of the copied roots with the ids of the
+    /// containers they are copied to.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{ForeignMergeStrategy, LoroDoc, ToJson};
+    /// # use serde_json::json;
+    /// let a = LoroDoc::new();
+    /// a.get_text("notes").insert(0, "a").unwrap();
+    /// let b = LoroDoc::new();
+    /// b.get_text("notes").insert(0, "b").unwrap();
+    /// b.get_list("todo").push("write docs").unwrap();
+    ///
+    /// a.merge_foreign(&b, None, ForeignMergeStrategy::Rename).unwrap();
+    /// assert_eq!(
+    ///     a.get_deep_value().to_json_value(),
+    ///     json!({"notes": "a", "notes_1": "b", "todo": ["write docs"]})
+    /// );
+    /// ```
+    pub fn merge_foreign(
+        &self,
+        other: &LoroDoc,
+        mount: Option<&ContainerID>,
+        strategy: ForeignMergeStrategy,
+    ) -> LoroResult<Vec<(ContainerID, ContainerID)>> {
+        self.doc.merge_foreign(&other.doc, mount, strategy)
+    }
+
+    /// Create a sync request to be sent to another peer.
+    ///
+    /// The request is the encoded [`VersionVector`] of the oplog. The peer answers it by
+    /// [`LoroDoc::sync_response`] with the updates this document lacks, and the response
+    /// can be imported by [`LoroDoc::import`].
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let a = LoroDoc::new();
+    /// a.get_text("text").insert(0, "a").unwrap();
+    /// let b = LoroDoc::new();
+    /// b.get_text("text").insert(0, "b").unwrap();
+    /// // The docs have diverged, so they sync in both directions
+    /// b.import(&a.sync_response(&b.sync_request()).unwrap()).unwrap();
+    /// a.import(&b.sync_response(&a.sync_request()).unwrap()).unwrap();
+    /// assert_eq!(a.get_deep_value(), b.get_deep_value());
+    /// ```
+    pub fn sync_request(&self) -> Vec<u8> {
+        self.doc.sync_request()
+    }
+
+    /// Answer a sync request of another peer with the updates it lacks.
+    ///
+    /// An empty version in the request means the peer has nothing, so all the updates are
+    /// returned.
+    pub fn sync_response(&self, request: &[u8]) -> LoroResult<Vec<u8>> {
+        self.doc.sync_response(request)
+    }
+
     /// Get the `Frontiers` version of `OpLog`
     pub fn oplog_frontiers(&self) -> Frontiers {
         self.doc.oplog_frontiers()
@@ -435,6 +1323,50 @@ impl LoroDoc {
         )
     }
 
+    /// Subscribe to the events of a container and its descendants.
+    ///
+    /// It works like [`LoroDoc::subscribe`], but the subscription is removed once the
+    /// container is deleted from the document. In that case the callback receives a final
+    /// event, whose `events` are the diffs of the ancestors that deleted the container.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, LoroMap};
+    /// # use std::sync::{atomic::{AtomicUsize, Ordering}, Arc};
+    /// let doc = LoroDoc::new();
+    /// let root = doc.get_map("root");
+    /// let child = root.insert_container("child", LoroMap::new()).unwrap();
+    /// doc.commit();
+    /// let count = Arc::new(AtomicUsize::new(0));
+    /// let count_cp = count.clone();
+    /// doc.subscribe_path(
+    ///     &child.id(),
+    ///     Arc::new(move |_| {
+    ///         count_cp.fetch_add(1, Ordering::SeqCst);
+    ///     }),
+    /// );
+    /// child.insert("key", 1).unwrap();
+    /// doc.commit();
+    /// assert_eq!(count.load(Ordering::SeqCst), 1);
+    /// // Events of other containers are not delivered
+    /// doc.get_text("text").insert(0, "Hi").unwrap();
+    /// doc.commit();
+    /// assert_eq!(count.load(Ordering::SeqCst), 1);
+    /// // Deleting the container delivers a final event
+    /// root.delete("child").unwrap();
+    /// doc.commit();
+    /// assert_eq!(count.load(Ordering::SeqCst), 2);
+    /// ```
+    pub fn subscribe_path(&self, container_id: &ContainerID, callback: Subscriber) -> SubID {
+        self.doc.subscribe_path(
+            container_id,
+            Arc::new(move |e| {
+                callback(DiffEvent::from(e));
+            }),
+        )
+    }
+
     /// Subscribe all the events.
     ///
     /// The callback will be invoked when any part of the [loro_internal::DocState] is changed.
@@ -446,6 +1378,68 @@ impl LoroDoc {
         }))
     }
 
+    /// Subscribe to the containers that become unreachable from the root containers.
+    ///
+    /// A container is orphaned when it or one of its ancestors is deleted, e.g. the sub-map
+    /// of a deleted list element. It still exists in the history, so it's reported as
+    /// revived if it becomes reachable again, e.g. by checking out an earlier version.
+    /// This is useful to evict the caches keyed by [`ContainerID`].
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, LoroMap};
+    /// # use std::sync::{Arc, Mutex};
+    /// let doc = LoroDoc::new();
+    /// let list = doc.get_list("list");
+    /// let map = list.insert_container(0, LoroMap::new()).unwrap();
+    /// doc.commit();
+    /// let orphaned = Arc::new(Mutex::new(Vec::new()));
+    /// let orphaned_cp = orphaned.clone();
+    /// doc.subscribe_orphaned(Arc::new(move |e| {
+    ///     orphaned_cp.lock().unwrap().extend(e.orphaned.iter().cloned());
+    /// }));
+    /// list.delete(0, 1).unwrap();
+    /// doc.commit();
+    /// assert_eq!(*orphaned.lock().unwrap(), vec![map.id()]);
+    /// ```
+    pub fn subscribe_orphaned(&self, callback: OrphanSubscriber) -> SubID {
+        self.doc.subscribe_orphaned(callback)
+    }
+
+    /// Subscribe to the ops committed by the local peer.
+    ///
+    /// Unlike [`LoroDoc::subscribe_root`], the callback receives the ops themselves, with
+    /// their ids, containers and contents, rather than the diffs of the state. It's called
+    /// after each commit with the ops of the new change in the json schema, which can be
+    /// forwarded to another system and imported by [`LoroDoc::import_json_updates`].
+    /// The imported changes are not reported.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, JsonSchema};
+    /// # use std::sync::{Arc, Mutex};
+    /// let doc = LoroDoc::new();
+    /// let updates: Arc<Mutex<Vec<JsonSchema>>> = Default::default();
+    /// let updates_cp = updates.clone();
+    /// doc.subscribe_local_ops(Arc::new(move |ops| {
+    ///     updates_cp.lock().unwrap().push(ops.clone());
+    /// }));
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// assert_eq!(updates.lock().unwrap().len(), 1);
+    ///
+    /// let replica = LoroDoc::new();
+    /// for ops in updates.lock().unwrap().drain(..) {
+    ///     replica.import_json_updates(ops).unwrap();
+    /// }
+    /// assert_eq!(replica.get_text("text").to_string(), "Hello");
+    /// ```
+    pub fn subscribe_local_ops(&self, callback: LocalOpsSubscriber) -> SubID {
+        self.doc.subscribe_local_ops(callback)
+    }
+
     /// Remove a subscription.
     pub fn unsubscribe(&self, id: SubID) {
         self.doc.unsubscribe(id)
@@ -474,6 +1468,11 @@ impl LoroDoc {
 
     /// Get the absolute position of the given cursor.
     ///
+    /// [`PosQueryResult::status`] tells whether the anchored element is still at the position
+    /// where the cursor was created, has been shifted by other edits, or has been deleted.
+    /// When it's deleted, the position falls back to where the element used to be, and
+    /// [`PosQueryResult::update`] is a new cursor anchored at its neighbor.
+    ///
     /// # Example
     ///
     /// ```
@@ -612,6 +1611,33 @@ impl LoroList {
         self.handler.delete(pos, len)
     }
 
+    /// Delete `len` values at `pos` and insert `values` there, like `Array.prototype.splice` in JS.
+    ///
+    /// It returns the deleted values, which are the deep values if they are containers.
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, LoroValue, ToJson};
+    /// let doc = LoroDoc::new();
+    /// let list = doc.get_list("list");
+    /// for i in 0..5 {
+    ///     list.push(i).unwrap();
+    /// }
+    /// let removed = list.splice(1, 2, &["a".into(), "b".into(), "c".into()]).unwrap();
+    /// assert_eq!(removed, vec![LoroValue::from(1), LoroValue::from(2)]);
+    /// assert_eq!(
+    ///     list.get_value().to_json_value(),
+    ///     serde_json::json!([0, "a", "b", "c", 3, 4])
+    /// );
+    /// ```
+    pub fn splice(
+        &self,
+        pos: usize,
+        len: usize,
+        values: &[LoroValue],
+    ) -> LoroResult<Vec<LoroValue>> {
+        self.handler.splice(pos, len, values)
+    }
+
     /// Get the value at the given position.
     #[inline]
     pub fn get(&self, index: usize) -> Option<Either<LoroValue, Container>> {
@@ -671,6 +1697,32 @@ impl LoroList {
         self.handler.for_each(f)
     }
 
+    /// Iterate over the elements of the list lazily, in the order of the list.
+    ///
+    /// The values are cloned from the state chunk by chunk instead of all at once, and the
+    /// nested containers are yielded as [Container]s, so the caller decides how deep to go.
+    /// The chunks are read by index, so editing the list during the iteration may make the
+    /// iterator skip or repeat elements. Create a new iterator after editing the list.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, LoroText, LoroValue};
+    /// let doc = LoroDoc::new();
+    /// let list = doc.get_list("list");
+    /// list.push(1).unwrap();
+    /// list.push_container(LoroText::new()).unwrap();
+    /// let mut iter = list.iter();
+    /// assert_eq!(iter.next().unwrap().left(), Some(LoroValue::from(1)));
+    /// assert!(iter.next().unwrap().right().unwrap().into_text().is_ok());
+    /// assert!(iter.next().is_none());
+    /// ```
+    pub fn iter(&self) -> impl Iterator<Item = Either<LoroValue, Container>> {
+        self.handler.iter().map(|v| match v {
+            ValueOrHandler::Handler(c) => Either::Right(c.into()),
+            ValueOrHandler::Value(v) => Either::Left(v),
+        })
+    }
+
     /// Get the length of the list.
     #[inline]
     pub fn len(&self) -> usize {
@@ -846,6 +1898,50 @@ impl LoroMap {
         self.handler.insert(key, value)
     }
 
+    /// Insert all the key-value pairs of `entries` in one transaction, so they are committed
+    /// in the same change and emitted in one event.
+    ///
+    /// The keys absent from `entries` are left untouched. It fails without any change if a
+    /// value is a container.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, ToJson};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// let map = doc.get_map("map");
+    /// map.insert("a", 1).unwrap();
+    /// map.update([("b", 2), ("c", 3)]).unwrap();
+    /// assert_eq!(map.get_value().to_json_value(), json!({"a": 1, "b": 2, "c": 3}));
+    /// ```
+    pub fn update<K: Into<String>, V: Into<LoroValue>>(
+        &self,
+        entries: impl IntoIterator<Item = (K, V)>,
+    ) -> LoroResult<()> {
+        self.handler
+            .update(entries.into_iter().map(|(k, v)| (k.into(), v.into())))
+    }
+
+    /// Like [`LoroMap::update`], but the keys absent from `entries` are deleted.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, ToJson};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// let map = doc.get_map("map");
+    /// map.update([("a", 1), ("b", 2)]).unwrap();
+    /// map.replace_all([("b", 3)]).unwrap();
+    /// assert_eq!(map.get_value().to_json_value(), json!({"b": 3}));
+    /// ```
+    pub fn replace_all<K: Into<String>, V: Into<LoroValue>>(
+        &self,
+        entries: impl IntoIterator<Item = (K, V)>,
+    ) -> LoroResult<()> {
+        self.handler
+            .replace_all(entries.into_iter().map(|(k, v)| (k.into(), v.into())))
+    }
+
     /// Get the length of the map.
     pub fn len(&self) -> usize {
         self.handler.len()
@@ -911,6 +2007,31 @@ impl LoroMap {
                 .get_or_create_container(key, child.to_handler())?,
         ))
     }
+
+    /// Get the container at `key`, or insert a new container of type `ty` if the key is empty.
+    ///
+    /// The lookup and the insertion happen in the same transaction. If several peers
+    /// concurrently create containers at the same key, the key converges to one of them
+    /// by last-writer-wins, and calling this method after syncing returns the surviving
+    /// container on every peer.
+    ///
+    /// It returns an error if the key holds a value or a container of another type.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, ContainerType};
+    /// let doc = LoroDoc::new();
+    /// let map = doc.get_map("map");
+    /// let a = map.get_or_insert_container("sub", ContainerType::Map).unwrap();
+    /// let b = map.get_or_insert_container("sub", ContainerType::Map).unwrap();
+    /// assert_eq!(a.id(), b.id());
+    /// assert!(map.get_or_insert_container("sub", ContainerType::Text).is_err());
+    /// ```
+    pub fn get_or_insert_container(&self, key: &str, ty: ContainerType) -> LoroResult<Container> {
+        Ok(Container::from(
+            self.handler.get_or_insert_container(key, ty)?,
+        ))
+    }
 }
 
 impl Default for LoroMap {
@@ -920,9 +2041,13 @@ impl Default for LoroMap {
 }
 
 /// LoroText container. It's used to model plaintext/richtext.
+///
+/// The positions taken by its methods are Unicode indexes by default. Use
+/// [`LoroText::set_index_type`] to change the unit of this handle.
 #[derive(Clone, Debug)]
 pub struct LoroText {
     handler: InnerTextHandler,
+    index_type: IndexType,
 }
 
 impl SealedTrait for LoroText {}
@@ -938,7 +2063,10 @@ impl ContainerTrait for LoroText {
     }
 
     fn from_handler(handler: Self::Handler) -> Self {
-        Self { handler }
+        Self {
+            handler,
+            index_type: IndexType::Unicode,
+        }
     }
 
     fn is_attached(&self) -> bool {
@@ -946,7 +2074,10 @@ impl ContainerTrait for LoroText {
     }
 
     fn get_attached(&self) -> Option<Self> {
-        self.handler.get_attached().map(Self::from_handler)
+        self.handler.get_attached().map(|handler| Self {
+            handler,
+            index_type: self.index_type,
+        })
     }
 
     fn try_from_container(container: Container) -> Option<Self> {
@@ -960,9 +2091,7 @@ impl LoroText {
     /// The edits on a detached container will not be persisted.
     /// To attach the container to the document, please insert it into an attached container.
     pub fn new() -> Self {
-        Self {
-            handler: InnerTextHandler::new_detached(),
-        }
+        Self::from_handler(InnerTextHandler::new_detached())
     }
 
     /// Whether the container is attached to a document
@@ -978,14 +2107,237 @@ impl LoroText {
         self.handler.id().clone()
     }
 
-    /// Insert a string at the given unicode position.
+    /// Get the unit of the positions taken by the methods of this handle.
+    pub fn index_type(&self) -> IndexType {
+        self.index_type
+    }
+
+    /// Set the unit of the positions taken by [`LoroText::insert`], [`LoroText::delete`],
+    /// [`LoroText::mark`], [`LoroText::unmark`], [`LoroText::iter_styled_runs`] and
+    /// [`LoroText::get_cursor`] on this handle. The default is [`IndexType::Unicode`].
+    ///
+    /// It only affects this handle, other handles of the same container are unchanged.
+    /// A position that is not at a char boundary in this unit, e.g. in the middle of a
+    /// surrogate pair in UTF-16, is rejected with an error.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, IndexType};
+    /// let doc = LoroDoc::new();
+    /// let mut text = doc.get_text("text");
+    /// text.set_index_type(IndexType::Utf16);
+    /// text.insert(0, "😀b").unwrap();
+    /// text.insert(2, "a").unwrap();
+    /// assert_eq!(text.to_string(), "😀ab");
+    /// // Inside the surrogate pair of 😀
+    /// assert!(text.insert(1, "x").is_err());
+    /// // Override it for a single call
+    /// text.with_index_type(IndexType::Utf8).delete(0, 4).unwrap();
+    /// assert_eq!(text.to_string(), "ab");
+    /// ```
+    pub fn set_index_type(&mut self, index_type: IndexType) {
+        self.index_type = index_type;
+    }
+
+    /// Get a handle of the same container whose positions are in `index_type`.
+    ///
+    /// See [`LoroText::set_index_type`].
+    pub fn with_index_type(&self, index_type: IndexType) -> Self {
+        Self {
+            handler: self.handler.clone(),
+            index_type,
+        }
+    }
+
+    /// Convert a position in the unit of this handle to a unicode position.
+    fn to_unicode_pos(&self, pos: usize) -> LoroResult<usize> {
+        if self.index_type == IndexType::Unicode {
+            return Ok(pos);
+        }
+
+        self.handler
+            .index_convert(pos, self.index_type, IndexType::Unicode)
+            .ok_or_else(|| {
+                let len = match self.index_type {
+                    IndexType::Utf8 => Some(self.len_utf8()),
+                    IndexType::Utf16 => Some(self.len_utf16()),
+                    _ => None,
+                };
+                match len {
+                    Some(len) if pos > len => LoroError::OutOfBound { pos, len },
+                    _ => LoroError::ArgErr(
+                        format!(
+                            "Position {} is not at a char boundary of {:?} index",
+                            pos, self.index_type
+                        )
+                        .into_boxed_str(),
+                    ),
+                }
+            })
+    }
+
+    fn to_unicode_range(&self, range: Range<usize>) -> LoroResult<Range<usize>> {
+        Ok(self.to_unicode_pos(range.start)?..self.to_unicode_pos(range.end)?)
+    }
+
+    /// Insert a string at the given position.
+    ///
+    /// The position is a unicode index unless the index type of the handle is changed by
+    /// [`LoroText::set_index_type`].
     pub fn insert(&self, pos: usize, s: &str) -> LoroResult<()> {
-        self.handler.insert(pos, s)
+        self.handler.insert(self.to_unicode_pos(pos)?, s)
+    }
+
+    /// Insert a string at the given position, and return the range of entity indices
+    /// the inserted content occupies in the local state at the time of the insertion.
+    ///
+    /// The entity indices count the style anchors created by [`LoroText::mark`] as well as the
+    /// unicode characters. The range is not updated by the later changes, so it may not be
+    /// where the content is after the concurrent insertions are merged; use a cursor to track
+    /// a position across the changes. If `s` is empty, nothing is inserted and the range
+    /// is empty at the entity index where `s` would be inserted.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// use loro::LoroDoc;
+    ///
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello").unwrap();
+    /// assert_eq!(text.insert_with_result(5, " world").unwrap(), 5..11);
+    /// ```
+    pub fn insert_with_result(&self, pos: usize, s: &str) -> LoroResult<Range<usize>> {
+        self.handler
+            .insert_with_result(self.to_unicode_pos(pos)?, s)
     }
 
-    /// Delete a range of text at the given unicode position with unicode length.
+    /// Delete a range of text at the given position with the given length.
+    ///
+    /// Both are unicode indexes unless the index type of the handle is changed by
+    /// [`LoroText::set_index_type`].
     pub fn delete(&self, pos: usize, len: usize) -> LoroResult<()> {
-        self.handler.delete(pos, len)
+        let range = self.to_unicode_range(pos..pos + len)?;
+        self.handler.delete(range.start, range.len())
+    }
+
+    /// Find the non-overlapping occurrences of `pattern` in the text, from the start to the end.
+    ///
+    /// The ranges are in the index type of the handle, so they can be passed to
+    /// [`LoroText::replace`], [`LoroText::delete`] or [`LoroText::mark`] directly. The text is
+    /// matched char by char, so a match never splits a char. The whole string is not built
+    /// during the search.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, IndexType};
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "😀 aa 😀 aaa").unwrap();
+    /// assert_eq!(text.search("aa"), vec![2..4, 7..9]);
+    /// assert_eq!(text.with_index_type(IndexType::Utf16).search("😀"), vec![0..2, 6..8]);
+    /// ```
+    pub fn search(&self, pattern: &str) -> Vec<Range<usize>> {
+        let ans = self.handler.search(pattern);
+        if self.index_type == IndexType::Unicode {
+            return ans;
+        }
+
+        let convert = |pos| {
+            self.handler
+                .index_convert(pos, IndexType::Unicode, self.index_type)
+                .unwrap()
+        };
+        ans.into_iter()
+            .map(|range| convert(range.start)..convert(range.end))
+            .collect()
+    }
+
+    /// Replace the text in `range` with `s`.
+    ///
+    /// The range is in the index type of the handle. The new text inherits the styles of
+    /// the replaced text that expand after it, such as bold.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, ToJson};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello world").unwrap();
+    /// text.mark(6..11, "bold", true).unwrap();
+    /// text.replace(6..11, "Loro").unwrap();
+    /// assert_eq!(
+    ///     text.to_delta().to_json_value(),
+    ///     json!([{ "insert": "Hello " }, { "insert": "Loro", "attributes": { "bold": true } }])
+    /// );
+    /// ```
+    pub fn replace(&self, range: Range<usize>, s: &str) -> LoroResult<()> {
+        self.handler.replace(self.to_unicode_range(range)?, s)
+    }
+
+    /// Replace all the occurrences of `pattern` with `s`, and return the number of
+    /// replacements.
+    pub fn replace_all(&self, pattern: &str, s: &str) -> LoroResult<usize> {
+        let ranges = self.handler.search(pattern);
+        // Replace from the end, so the earlier ranges are not shifted
+        for range in ranges.iter().rev() {
+            self.handler.replace(range.clone(), s)?;
+        }
+
+        Ok(ranges.len())
+    }
+
+    /// Get the peers that inserted the text in `range`.
+    ///
+    /// Each item is a run of chars inserted continuously by the same peer, with the lamport
+    /// of the op that inserted its first char. The ranges are in the index type of the handle.
+    /// Applying marks or styles doesn't change the author of the text.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc_a = LoroDoc::new();
+    /// doc_a.set_peer_id(1).unwrap();
+    /// let text_a = doc_a.get_text("text");
+    /// text_a.insert(0, "Hello").unwrap();
+    /// doc_a.commit();
+    ///
+    /// let doc_b = LoroDoc::new();
+    /// doc_b.set_peer_id(2).unwrap();
+    /// doc_b.import(&doc_a.export_snapshot()).unwrap();
+    /// let text_b = doc_b.get_text("text");
+    /// text_b.insert(5, " world").unwrap();
+    /// text_b.mark(0..11, "bold", true).unwrap();
+    /// doc_b.commit();
+    ///
+    /// assert_eq!(
+    ///     text_b.blame(0..11).unwrap(),
+    ///     vec![(0..5, 1, 0), (5..11, 2, 5)]
+    /// );
+    /// ```
+    pub fn blame(&self, range: Range<usize>) -> LoroResult<Vec<(Range<usize>, PeerID, Lamport)>> {
+        let range = self.to_unicode_range(range)?;
+        let ans = self.handler.blame(range.start, range.end)?;
+        let convert = |pos| {
+            if self.index_type == IndexType::Unicode {
+                pos
+            } else {
+                self.handler
+                    .index_convert(pos, IndexType::Unicode, self.index_type)
+                    .unwrap()
+            }
+        };
+        Ok(ans
+            .into_iter()
+            .map(|(range, id)| {
+                (
+                    convert(range.start)..convert(range.end),
+                    id.peer,
+                    id.lamport,
+                )
+            })
+            .collect())
     }
 
     /// Whether the text container is empty.
@@ -1009,6 +2361,41 @@ impl LoroText {
     }
 
     /// Apply a [delta](https://quilljs.com/docs/delta/) to the text container.
+    ///
+    /// It's the inverse of [`LoroText::to_delta`]. The attributes are applied as marks with
+    /// the expand behavior configured by [`LoroDoc::config_text_style`], and a `null`
+    /// attribute removes the style. The inserted text gets exactly the attributes in the
+    /// delta, even if it would inherit other styles from its neighbours.
+    ///
+    /// The delta is checked before it's applied, so if it's out of bound or uses a style
+    /// without config, an error is returned and the text is not changed. All the ops are in
+    /// the same transaction, so they are emitted as a single event on the next commit.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, TextDelta, ToJson};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello World!").unwrap();
+    /// let delta: Vec<TextDelta> = serde_json::from_value(json!([
+    ///     { "retain": 6 },
+    ///     { "delete": 5 },
+    ///     { "insert": "Alice", "attributes": { "bold": true } },
+    /// ]))
+    /// .unwrap();
+    /// text.apply_delta(&delta).unwrap();
+    /// assert_eq!(text.to_string(), "Hello Alice!");
+    /// assert_eq!(
+    ///     text.to_delta().to_json_value(),
+    ///     json!([
+    ///         { "insert": "Hello " },
+    ///         { "insert": "Alice", "attributes": { "bold": true } },
+    ///         { "insert": "!" },
+    ///     ])
+    /// );
+    /// ```
     pub fn apply_delta(&self, delta: &[TextDelta]) -> LoroResult<()> {
         self.handler.apply_delta(delta)
     }
@@ -1024,7 +2411,8 @@ impl LoroText {
     /// - `none`: the mark will not be expanded to include the inserted text at the boundaries
     /// - `both`: when inserting text either right before or right after the given range, the mark will be expanded to include the inserted text
     ///
-    /// *You should make sure that a key is always associated with the same expand type.*
+    /// The expand type of a key is configured by [`LoroDoc::config_text_style`]. Use
+    /// [`LoroText::mark_with_expand`] to choose it for a single mark.
     ///
     /// Note: this is not suitable for unmergeable annotations like comments.
     pub fn mark(
@@ -1033,9 +2421,50 @@ impl LoroText {
         key: &str,
         value: impl Into<LoroValue>,
     ) -> LoroResult<()> {
+        let range = self.to_unicode_range(range)?;
         self.handler.mark(range.start, range.end, key, value.into())
     }
 
+    /// Mark a range of text with a key-value pair like [`LoroText::mark`], but use the given
+    /// `expand` type instead of the one configured for the key.
+    ///
+    /// The expand type is stored in the mark, so the text inserted at the boundaries of this
+    /// mark follows its own rule, even when it's inserted concurrently by another peer and the
+    /// other marks with the same key expand differently.
+    ///
+    /// # Example
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, ToJson, ExpandType};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello World").unwrap();
+    /// text.mark_with_expand(0..5, "bold", true, ExpandType::None).unwrap();
+    /// text.mark_with_expand(6..11, "bold", true, ExpandType::After).unwrap();
+    /// text.insert(5, ",").unwrap();
+    /// text.insert(12, "!").unwrap();
+    /// assert_eq!(
+    ///     text.to_delta().to_json_value(),
+    ///     json!([
+    ///         { "insert": "Hello", "attributes": { "bold": true } },
+    ///         { "insert": ", " },
+    ///         { "insert": "World!", "attributes": { "bold": true } },
+    ///     ])
+    /// );
+    /// ```
+    pub fn mark_with_expand(
+        &self,
+        range: Range<usize>,
+        key: &str,
+        value: impl Into<LoroValue>,
+        expand: ExpandType,
+    ) -> LoroResult<()> {
+        let range = self.to_unicode_range(range)?;
+        self.handler
+            .mark_with_expand(range.start, range.end, key, value.into(), expand)
+    }
+
     /// Unmark a range of text with a key and a value.
     ///
     /// You can use it to remove highlights, bolds or links
@@ -1052,8 +2481,35 @@ impl LoroText {
     /// *You should make sure that a key is always associated with the same expand type.*
     ///
     /// Note: you cannot delete unmergeable annotations like comments by this method.
-    pub fn unmark(&self, range: Range<usize>, key: &str) -> LoroResult<()> {
-        self.handler.unmark(range.start, range.end, key)
+    ///
+    /// It returns the `(start, end)` spans that were marked with `key` before this call
+    /// and are unmarked by it. Adjacent spans are merged.
+    ///
+    /// ```
+    /// # use loro::LoroDoc;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello world!").unwrap();
+    /// text.mark(0..2, "bold", true).unwrap();
+    /// text.mark(4..8, "bold", true).unwrap();
+    /// assert_eq!(text.unmark(1..6, "bold").unwrap(), vec![(1, 2), (4, 6)]);
+    /// ```
+    pub fn unmark(&self, range: Range<usize>, key: &str) -> LoroResult<Vec<(usize, usize)>> {
+        let range = self.to_unicode_range(range)?;
+        let spans = self.handler.unmark(range.start, range.end, key)?;
+        if self.index_type == IndexType::Unicode {
+            return Ok(spans);
+        }
+
+        let from_unicode = |pos| {
+            self.handler
+                .index_convert(pos, IndexType::Unicode, self.index_type)
+                .unwrap()
+        };
+        Ok(spans
+            .into_iter()
+            .map(|(start, end)| (from_unicode(start), from_unicode(end)))
+            .collect())
     }
 
     /// Get the text in [Delta](https://quilljs.com/docs/delta/) format.
@@ -1087,6 +2543,74 @@ impl LoroText {
         self.handler.get_richtext_value()
     }
 
+    /// Iterate the styled runs in the given range without building the delta of the whole text.
+    ///
+    /// `f` receives the text of each run and its attributes as a map. Runs crossing the range
+    /// boundaries are cut at the boundaries. The iteration stops once `f` returns
+    /// [ControlFlow::Break]. It's useful for rendering only the visible part of a large text.
+    ///
+    /// `f` must not access the document.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, ToJson};
+    /// # use serde_json::json;
+    /// # use std::ops::ControlFlow;
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "Hello world!").unwrap();
+    /// text.mark(0..5, "bold", true).unwrap();
+    /// let mut runs = Vec::new();
+    /// text.iter_styled_runs(3..8, |s, attributes| {
+    ///     runs.push((s.to_string(), attributes.to_json_value()));
+    ///     ControlFlow::Continue(())
+    /// })
+    /// .unwrap();
+    /// assert_eq!(
+    ///     runs,
+    ///     vec![
+    ///         ("lo".to_string(), json!({"bold": true})),
+    ///         (" wo".to_string(), json!({})),
+    ///     ]
+    /// );
+    /// ```
+    pub fn iter_styled_runs(
+        &self,
+        range: Range<usize>,
+        mut f: impl FnMut(&str, &LoroValue) -> ControlFlow<()>,
+    ) -> LoroResult<()> {
+        let range = self.to_unicode_range(range)?;
+        self.handler
+            .iter_styled_runs(range.start, range.end, &mut f)
+    }
+
+    /// Convert a text index between the units of [`IndexType`].
+    ///
+    /// The entity index counts the Unicode code points and the style anchors created by
+    /// [`LoroText::mark`], which take entity indexes but no visible text. If there are style
+    /// anchors at the given text position, the entity index after them is returned.
+    ///
+    /// Returns `None` if `pos` is out of bound or not at a char boundary.
+    ///
+    /// # Example
+    /// ```
+    /// # use loro::{LoroDoc, IndexType};
+    /// let doc = LoroDoc::new();
+    /// let text = doc.get_text("text");
+    /// text.insert(0, "你好a😀").unwrap();
+    /// text.mark(0..2, "bold", true).unwrap();
+    /// assert_eq!(text.index_convert(2, IndexType::Unicode, IndexType::Utf8), Some(6));
+    /// assert_eq!(text.index_convert(5, IndexType::Utf16, IndexType::Unicode), Some(4));
+    /// // Inside a surrogate pair
+    /// assert_eq!(text.index_convert(4, IndexType::Utf16, IndexType::Unicode), None);
+    /// // The start and end anchors of the bold style take two entity indexes
+    /// assert_eq!(text.index_convert(6, IndexType::Utf8, IndexType::Entity), Some(4));
+    /// assert_eq!(text.index_convert(4, IndexType::Entity, IndexType::Utf16), Some(2));
+    /// ```
+    pub fn index_convert(&self, pos: usize, from: IndexType, to: IndexType) -> Option<usize> {
+        self.handler.index_convert(pos, from, to)
+    }
+
     /// Get the text content of the text container.
     #[allow(clippy::inherent_to_string)]
     pub fn to_string(&self) -> String {
@@ -1124,7 +2648,8 @@ impl LoroText {
     /// assert_eq!(doc.get_cursor_pos(&pos).unwrap().current.pos, 5);
     /// ```
     pub fn get_cursor(&self, pos: usize, side: Side) -> Option<Cursor> {
-        self.handler.get_cursor(pos, side)
+        self.handler
+            .get_cursor(self.to_unicode_pos(pos).ok()?, side)
     }
 }
 
@@ -1263,6 +2788,13 @@ impl LoroTree {
     /// Move the `target` node to be a child of the `parent` node at the given index.
     /// If the `parent` is `None`, the `target` node will be a root.
     ///
+    /// The fractional index of `target` is generated between its new siblings, so you don't need
+    /// to compute it yourself. When `target` is already a child of `parent`, `to` is the index
+    /// of `target` after the move, which can be at most `children_num - 1`.
+    ///
+    /// Moving a node under itself or one of its descendants returns a `CyclicMoveError`,
+    /// and the tree is left untouched.
+    ///
     /// # Example
     ///
     /// ```rust
@@ -1274,6 +2806,8 @@ impl LoroTree {
     /// let root2 = tree.create(None).unwrap();
     /// // move `root2` to be a child of `root` at index 0.
     /// tree.mov_to(root2, root, 0).unwrap();
+    /// // `root` cannot be moved under its child
+    /// assert!(tree.mov_to(root, root2, 0).is_err());
     /// ```
     pub fn mov_to<T: Into<Option<TreeID>>>(
         &self,
@@ -1366,6 +2900,33 @@ impl LoroTree {
         self.handler.get_node_parent(target)
     }
 
+    /// Return the path from the root to the target node.
+    ///
+    /// Each item is a node on the path and its index among its siblings, which follows the
+    /// order of the fractional indexes. The last item is the target node itself.
+    ///
+    /// - If the target node does not exist, or it or one of its ancestors is deleted, return `None`.
+    ///
+    /// # Example
+    ///
+    /// ```rust
+    /// use loro::LoroDoc;
+    ///
+    /// let doc = LoroDoc::new();
+    /// let tree = doc.get_tree("tree");
+    /// let root = tree.create(None).unwrap();
+    /// let a = tree.create(root).unwrap();
+    /// let b = tree.create(root).unwrap();
+    /// let c = tree.create(b).unwrap();
+    /// assert_eq!(tree.get_path(&c), Some(vec![(root, 0), (b, 1), (c, 0)]));
+    /// tree.delete(b).unwrap();
+    /// assert_eq!(tree.get_path(&c), None);
+    /// assert_eq!(tree.get_path(&a), Some(vec![(root, 0), (a, 0)]));
+    /// ```
+    pub fn get_path(&self, target: &TreeID) -> Option<Vec<(TreeID, usize)>> {
+        self.handler.get_path(target)
+    }
+
     /// Return whether target node exists.
     pub fn contains(&self, target: TreeID) -> bool {
         self.handler.contains(target)
@@ -1503,6 +3064,18 @@ impl LoroMovableList {
         self.handler.delete(pos, len)
     }
 
+    /// Delete `len` values at `pos` and insert `values` there, like `Array.prototype.splice` in JS.
+    ///
+    /// It returns the deleted values, which are the deep values if they are containers.
+    pub fn splice(
+        &self,
+        pos: usize,
+        len: usize,
+        values: &[LoroValue],
+    ) -> LoroResult<Vec<LoroValue>> {
+        self.handler.splice(pos, len, values)
+    }
+
     /// Get the value at the given position.
     pub fn get(&self, index: usize) -> Option<Either<LoroValue, Container>> {
         match self.handler.get_(index) {
@@ -1560,6 +3133,11 @@ impl LoroMovableList {
     }
 
     /// Set the value at the given position.
+    ///
+    /// The element keeps its identity, so the cursors on it and the concurrent moves of it
+    /// still work, and the event reports it as a [`ListDiffItem::Set`](event::ListDiffItem::Set)
+    /// instead of a deletion and an insertion. The concurrent sets on the same element
+    /// converge to the value of the last writer.
     pub fn set(&self, pos: usize, value: impl Into<LoroValue>) -> LoroResult<()> {
         self.handler.set(pos, value.into())
     }
@@ -1569,6 +3147,27 @@ impl LoroMovableList {
         self.handler.mov(from, to)
     }
 
+    /// Apply a batch of moves in a single commit.
+    ///
+    /// Each `(from, to)` pair is applied to the list produced by the previous pairs,
+    /// just like calling [`LoroMovableList::mov`] for each of them. But only the minimal
+    /// set of move ops that turns the current order into the final order is recorded.
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, ToJson};
+    /// # use serde_json::json;
+    /// let doc = LoroDoc::new();
+    /// let list = doc.get_movable_list("list");
+    /// for i in 0..4 {
+    ///     list.push(i).unwrap();
+    /// }
+    /// list.move_batch(&[(0, 3), (0, 3), (0, 3)]).unwrap();
+    /// assert_eq!(list.get_value().to_json_value(), json!([3, 0, 1, 2]));
+    /// ```
+    pub fn move_batch(&self, moves: &[(usize, usize)]) -> LoroResult<()> {
+        self.handler.move_batch(moves)
+    }
+
     /// Insert a container at the given position.
     pub fn insert_container<C: ContainerTrait>(&self, pos: usize, child: C) -> LoroResult<C> {
         Ok(C::from_handler(
@@ -1724,7 +3323,7 @@ impl ContainerTrait for Container {
 
     fn from_handler(handler: Self::Handler) -> Self {
         match handler {
-            InnerHandler::Text(x) => Container::Text(LoroText { handler: x }),
+            InnerHandler::Text(x) => Container::Text(LoroText::from_handler(x)),
             InnerHandler::Map(x) => Container::Map(LoroMap { handler: x }),
             InnerHandler::List(x) => Container::List(LoroList { handler: x }),
             InnerHandler::MovableList(x) => Container::MovableList(LoroMovableList { handler: x }),
@@ -1820,7 +3419,7 @@ impl Container {
 impl From<InnerHandler> for Container {
     fn from(value: InnerHandler) -> Self {
         match value {
-            InnerHandler::Text(x) => Container::Text(LoroText { handler: x }),
+            InnerHandler::Text(x) => Container::Text(LoroText::from_handler(x)),
             InnerHandler::Map(x) => Container::Map(LoroMap { handler: x }),
             InnerHandler::List(x) => Container::List(LoroList { handler: x }),
             InnerHandler::Tree(x) => Container::Tree(LoroTree { handler: x }),
@@ -1869,6 +3468,23 @@ impl UndoManager {
         self.0.record_new_checkpoint(&doc.doc)
     }
 
+    /// Start an undo group.
+    ///
+    /// All the local changes committed before the matching [`UndoManager::end_group`]
+    /// are merged into a single undo step, regardless of the merge interval.
+    /// Groups can be nested, in which case the inner groups are folded into the outermost one.
+    ///
+    /// If remote changes that touch the same containers are imported in the middle of
+    /// the group, the group will be split into separate undo steps.
+    pub fn start_group(&mut self, doc: &LoroDoc) -> LoroResult<()> {
+        self.0.start_group(&doc.doc)
+    }
+
+    /// End the undo group started by [`UndoManager::start_group`].
+    pub fn end_group(&mut self, doc: &LoroDoc) -> LoroResult<()> {
+        self.0.end_group(&doc.doc)
+    }
+
     /// Whether the undo manager can undo.
     pub fn can_undo(&self) -> bool {
         self.0.can_undo()
@@ -1879,6 +3495,22 @@ impl UndoManager {
         self.0.can_redo()
     }
 
+    /// The approximate memory usage of the undo and redo stacks in bytes.
+    ///
+    /// ```
+    /// # use loro::{LoroDoc, UndoManager};
+    /// let doc = LoroDoc::new();
+    /// let undo = UndoManager::new(&doc);
+    /// doc.get_text("text").insert(0, "Hello").unwrap();
+    /// doc.commit();
+    /// let mut stats = doc.memory_usage();
+    /// stats.undo += undo.memory_usage();
+    /// assert!(stats.undo > 0);
+    /// ```
+    pub fn memory_usage(&self) -> usize {
+        self.0.memory_usage()
+    }
+
     /// If a local event's origin matches the given prefix, it will not be recorded in the
     /// undo stack.
     pub fn add_exclude_origin_prefix(&mut self, prefix: &str) {
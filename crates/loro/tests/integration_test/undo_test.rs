@@ -1636,3 +1636,56 @@ fn undo_transform_cursor_position() -> anyhow::Result<()> {
 
     Ok(())
 }
+
+#[test]
+fn undo_group_merges_nested_commits() -> anyhow::Result<()> {
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let text = doc.get_text("text");
+    let mut undo = UndoManager::new(&doc);
+    undo.set_on_push(Some(Box::new(move |_, span| UndoItemMeta {
+        value: LoroValue::I64(span.start as i64),
+        cursors: Default::default(),
+    })));
+    let popped_value = Arc::new(Mutex::new(LoroValue::Null));
+    let popped_value_clone = popped_value.clone();
+    undo.set_on_pop(Some(Box::new(move |_, _, meta| {
+        *popped_value_clone.lock().unwrap() = meta.value;
+    })));
+    text.insert(0, "A")?;
+    doc.commit();
+
+    undo.start_group(&doc)?;
+    text.insert(1, "B")?;
+    doc.commit();
+    undo.start_group(&doc)?;
+    text.insert(2, "C")?;
+    doc.commit();
+    undo.end_group(&doc)?;
+    {
+        // remote changes on other containers do not split the group
+        let doc_b = LoroDoc::new();
+        doc_b.set_peer_id(2)?;
+        doc_b.get_list("list").push(1)?;
+        doc.import(&doc_b.export_snapshot())?;
+    }
+    text.insert(3, "D")?;
+    undo.end_group(&doc)?;
+    text.insert(4, "E")?;
+    doc.commit();
+    assert_eq!(text.to_string(), "ABCDE");
+
+    undo.undo(&doc)?;
+    assert_eq!(text.to_string(), "ABCD");
+    undo.undo(&doc)?;
+    assert_eq!(text.to_string(), "A");
+    // the meta of the group is the one pushed at the start of the group
+    assert_eq!(&*popped_value.lock().unwrap(), &LoroValue::I64(1));
+    undo.redo(&doc)?;
+    assert_eq!(text.to_string(), "ABCD");
+    undo.undo(&doc)?;
+    undo.undo(&doc)?;
+    assert_eq!(text.to_string(), "");
+    assert!(!undo.can_undo());
+    Ok(())
+}
@@ -434,6 +434,84 @@ fn richtext_test() {
     );
 }
 
+#[test]
+fn iter_styled_runs_in_range() -> LoroResult<()> {
+    use std::ops::ControlFlow;
+    let doc = LoroDoc::new();
+    let text = doc.get_text("text");
+    text.insert(0, "你好 world!")?;
+    text.mark(0..2, "bold", true)?;
+    // bold expands after its end by default
+    text.insert(2, "呀")?;
+    let collect = |range: std::ops::Range<usize>| {
+        let mut runs = Vec::new();
+        text.iter_styled_runs(range, |s, attributes| {
+            runs.push((s.to_string(), attributes.to_json_value()));
+            ControlFlow::Continue(())
+        })
+        .unwrap();
+        runs
+    };
+
+    assert_eq!(
+        collect(0..text.len_unicode()),
+        vec![
+            ("你好呀".to_string(), json!({"bold": true})),
+            (" world!".to_string(), json!({})),
+        ]
+    );
+    assert_eq!(
+        collect(1..5),
+        vec![
+            ("好呀".to_string(), json!({"bold": true})),
+            (" w".to_string(), json!({})),
+        ]
+    );
+    assert_eq!(collect(4..6), vec![("wo".to_string(), json!({}))]);
+    assert!(collect(3..3).is_empty());
+
+    let mut count = 0;
+    text.iter_styled_runs(0..text.len_unicode(), |_, _| {
+        count += 1;
+        ControlFlow::Break(())
+    })?;
+    assert_eq!(count, 1);
+    assert!(text
+        .iter_styled_runs(0..100, |_, _| ControlFlow::Continue(()))
+        .is_err());
+    Ok(())
+}
+
+#[test]
+fn unmark_returns_the_cleared_spans() -> LoroResult<()> {
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let text_a = doc_a.get_text("text");
+    text_a.insert(0, "Hello world!")?;
+    text_a.mark(0..2, "bold", true)?;
+    text_a.mark(4..8, "bold", "heavy")?;
+    doc_a.commit();
+
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    doc_b.get_text("text").insert(1, "XX")?;
+    doc_b.commit();
+    doc_a.import(&doc_b.export_from(&doc_a.oplog_vv()))?;
+    assert_eq!(text_a.to_string(), "HXXello world!");
+
+    assert_eq!(text_a.unmark(1..12, "bold")?, vec![(1, 4), (6, 10)]);
+    assert_eq!(
+        text_a.to_delta().to_json_value(),
+        json!([
+            { "insert": "H", "attributes": {"bold": true} },
+            { "insert": "XXello world!" },
+        ])
+    );
+    assert_eq!(text_a.unmark(1..12, "bold")?, vec![]);
+    Ok(())
+}
+
 #[test]
 fn sync() {
     use loro::{LoroDoc, ToJson};
@@ -701,6 +779,7 @@ fn get_container_by_str_path() {
 
 #[test]
 fn get_cursor() {
+    use loro::cursor::CursorStatus;
     let doc1 = LoroDoc::new();
     doc1.set_peer_id(1).unwrap();
     let text = doc1.get_text("text");
@@ -709,10 +788,12 @@ fn get_cursor() {
     let pos_info = doc1.get_cursor_pos(&pos_7).unwrap();
     assert!(pos_info.update.is_none());
     assert_eq!(pos_info.current.pos, 1);
+    assert_eq!(pos_info.status, CursorStatus::Exact);
     text.insert(0, "012345").unwrap();
     let pos_info = doc1.get_cursor_pos(&pos_7).unwrap();
     assert!(pos_info.update.is_none());
     assert_eq!(pos_info.current.pos, 7);
+    assert_eq!(pos_info.status, CursorStatus::Shifted);
 
     // test merge
     let doc2 = LoroDoc::new();
@@ -737,6 +818,7 @@ fn get_cursor() {
     let pos_info = doc2.get_cursor_pos(&pos_7).unwrap(); // it should be fine to query from another doc
     assert_eq!(pos_info.update.as_ref().unwrap().id.unwrap(), ID::new(2, 0));
     assert_eq!(pos_info.current.pos, 5);
+    assert!(pos_info.status.is_deleted());
 
     // rich text
     //
@@ -854,3 +936,2347 @@ fn awareness() {
     );
     assert_eq!(b.get_all_states().get(&2).map(|x| x.state.clone()), None);
 }
+
+#[test]
+fn awareness_notifies_added_updated_and_expired_peers() {
+    use loro::awareness::AwarenessChange;
+    use std::sync::Mutex;
+    let changes = Arc::new(Mutex::new(Vec::new()));
+    let changes_clone = changes.clone();
+    let mut a = Awareness::new(1, 50);
+    a.set_local_state("a");
+    let mut b = Awareness::new(2, 50);
+    let sub = b.subscribe(Arc::new(move |change: &AwarenessChange| {
+        changes_clone.lock().unwrap().push(change.clone());
+    }));
+    b.apply(&a.encode_all());
+    a.set_local_state("typing");
+    b.apply(&a.encode_all());
+    b.set_local_state("b");
+    // A clone doesn't notify the subscribers of the original
+    let mut cloned = b.clone();
+    cloned.set_local_state("cloned");
+    std::thread::sleep(std::time::Duration::from_millis(100));
+    // Peer 1 is not heard from within the timeout, so it's removed
+    b.set_local_state("b");
+    assert!(b.get_all_states().get(&1).is_none());
+    assert!(b.unsubscribe(sub));
+    b.apply(&a.encode_all());
+    assert_eq!(
+        *changes.lock().unwrap(),
+        vec![
+            AwarenessChange {
+                added: vec![1],
+                ..Default::default()
+            },
+            AwarenessChange {
+                updated: vec![1],
+                ..Default::default()
+            },
+            AwarenessChange {
+                added: vec![2],
+                ..Default::default()
+            },
+            AwarenessChange {
+                updated: vec![2],
+                removed: vec![1],
+                ..Default::default()
+            },
+        ]
+    );
+}
+
+#[test]
+fn export_to_writer_is_identical_to_buffered_export() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    doc.get_text("text").insert(0, "Hello world")?;
+    doc.get_list("list").insert(0, 1)?;
+    doc.commit();
+    let vv = doc.oplog_vv();
+    doc.get_map("map").insert("key", "value")?;
+    doc.commit();
+
+    let mut snapshot = Vec::new();
+    doc.export_snapshot_to(&mut snapshot).unwrap();
+    assert_eq!(snapshot, doc.export_snapshot());
+    let mut updates = Vec::new();
+    doc.export_from_to(&Default::default(), &mut updates)
+        .unwrap();
+    assert_eq!(updates, doc.export_from(&Default::default()));
+    let mut partial = Vec::new();
+    doc.export_from_to(&vv, &mut partial).unwrap();
+    assert_eq!(partial, doc.export_from(&vv));
+    let mut range = Vec::new();
+    doc.export_updates_in_range_to(&vv, &doc.oplog_vv(), &mut range)
+        .unwrap();
+    let end = *doc.oplog_vv().get(&1).unwrap();
+    let start = *vv.get(&1).unwrap();
+    assert_eq!(
+        vec![range],
+        doc.export_updates_in_spans(&[loro::IdSpan::new(1, start, end)])
+    );
+
+    // The body is written column by column instead of in one piece
+    struct ChunkSizes(Vec<usize>);
+    impl std::io::Write for ChunkSizes {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.push(buf.len());
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+    let mut chunks = ChunkSizes(Vec::new());
+    doc.export_snapshot_to(&mut chunks).unwrap();
+    assert_eq!(chunks.0.iter().sum::<usize>(), snapshot.len());
+    assert!(chunks.0.iter().all(|&len| len < snapshot.len() - 22));
+
+    let new_doc = LoroDoc::new();
+    new_doc.import(&snapshot)?;
+    assert_eq!(new_doc.get_deep_value(), doc.get_deep_value());
+    Ok(())
+}
+
+#[test]
+fn movable_list_move_batch() -> LoroResult<()> {
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let list_a = doc_a.get_movable_list("list");
+    for i in 0..5 {
+        list_a.push(i)?;
+    }
+    doc_a.commit();
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    let list_b = doc_b.get_movable_list("list");
+
+    let ops = doc_a.len_ops();
+    list_a.move_batch(&[(0, 4), (0, 3), (4, 0)])?;
+    doc_a.commit();
+    assert_eq!(list_a.get_value().to_json_value(), json!([0, 2, 3, 4, 1]));
+    // only `1` needs to be moved
+    assert_eq!(doc_a.len_ops(), ops + 1);
+
+    list_b.move_batch(&[(4, 0), (1, 4)])?;
+    doc_b.commit();
+    assert_eq!(list_b.get_value().to_json_value(), json!([4, 1, 2, 3, 0]));
+
+    doc_a.import(&doc_b.export_from(&doc_a.oplog_vv()))?;
+    doc_b.import(&doc_a.export_from(&doc_b.oplog_vv()))?;
+    assert_eq!(doc_a.get_deep_value(), doc_b.get_deep_value());
+    assert!(list_a.move_batch(&[(0, 5)]).is_err());
+    Ok(())
+}
+
+#[test]
+fn diff_between_versions() -> LoroResult<()> {
+    use loro::event::{Diff, ListDiffItem};
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let text = doc.get_text("text");
+    text.insert(0, "Hello")?;
+    doc.commit();
+    let v0 = doc.oplog_frontiers();
+    text.insert(5, " world")?;
+    let list = doc
+        .get_map("map")
+        .insert_container("list", LoroList::new())?;
+    list.push(1)?;
+    doc.commit();
+    let v1 = doc.oplog_frontiers();
+
+    let triggered = Arc::new(AtomicBool::new(false));
+    let triggered_clone = triggered.clone();
+    let _sub = doc.subscribe_root(Arc::new(move |_| {
+        triggered_clone.store(true, std::sync::atomic::Ordering::Release);
+    }));
+
+    let forward = doc.diff(&v0, &v1)?;
+    assert_eq!(forward.len(), 3);
+    match forward.get(&text.id()).unwrap() {
+        Diff::Text(delta) => assert_eq!(
+            delta,
+            vec![
+                TextDelta::Retain {
+                    retain: 5,
+                    attributes: None
+                },
+                TextDelta::Insert {
+                    insert: " world".into(),
+                    attributes: None
+                }
+            ]
+        ),
+        _ => unreachable!(),
+    }
+    // the list is created within the range
+    match forward.get(&list.id()).unwrap() {
+        Diff::List(items) => {
+            assert!(
+                matches!(&items[..], [ListDiffItem::Insert { insert, .. }] if insert.len() == 1)
+            )
+        }
+        _ => unreachable!(),
+    }
+
+    let backward = doc.diff(&v1, &v0)?;
+    match backward.get(&text.id()).unwrap() {
+        Diff::Text(delta) => assert_eq!(
+            delta,
+            vec![
+                TextDelta::Retain {
+                    retain: 5,
+                    attributes: None
+                },
+                TextDelta::Delete { delete: 6 }
+            ]
+        ),
+        _ => unreachable!(),
+    }
+
+    // the doc is not changed
+    assert!(!doc.is_detached());
+    assert_eq!(doc.state_frontiers(), v1);
+    assert!(!triggered.load(std::sync::atomic::Ordering::Acquire));
+    text.insert(0, "!")?;
+    assert_eq!(text.to_string(), "!Hello world");
+    Ok(())
+}
+
+#[test]
+fn analyze_reports_per_peer_stats() -> LoroResult<()> {
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let text = doc_a.get_text("text");
+    text.insert(0, "Hello")?;
+    doc_a.commit();
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    let map = doc_b.get_map("map");
+    map.insert("a", 1)?;
+    map.insert("b", "value")?;
+    doc_b.get_text("text").delete(0, 2)?;
+    doc_b.commit();
+    doc_a.import(&doc_b.export_from(&doc_a.oplog_vv()))?;
+
+    let stats = doc_a.analyze();
+    assert_eq!(stats.peers.len(), 2);
+    assert_eq!(stats.peers[&1].atom_ops, 5);
+    assert_eq!(stats.peers[&2].atom_ops, 4);
+    assert_eq!(stats.total_changes(), doc_a.len_changes());
+    assert_eq!(stats.total_atom_ops(), doc_a.len_ops());
+    assert!(stats.peers[&1].approx_bytes > 0);
+    assert_eq!(stats.containers[&text.id()], 7);
+    assert_eq!(stats.containers[&map.id()], 2);
+    Ok(())
+}
+
+#[test]
+fn import_batch_emits_a_single_event() -> LoroResult<()> {
+    use std::sync::Mutex;
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let text = doc.get_text("text");
+    let mut updates = Vec::new();
+    for (i, s) in ["a", "b", "c"].iter().enumerate() {
+        let vv = doc.oplog_vv();
+        text.insert(i, s)?;
+        doc.commit();
+        updates.push(doc.export_from(&vv));
+    }
+
+    let new_doc = LoroDoc::new();
+    let deltas = Arc::new(Mutex::new(Vec::new()));
+    let deltas_clone = deltas.clone();
+    let _sub = new_doc.subscribe_root(Arc::new(move |event| {
+        assert!(matches!(
+            event.triggered_by,
+            loro_internal::event::EventTriggerKind::Import
+        ));
+        for e in event.events {
+            deltas_clone
+                .lock()
+                .unwrap()
+                .push(e.diff.as_text().unwrap().clone());
+        }
+    }));
+    new_doc.import_batch(&[updates[2].clone(), updates[0].clone(), updates[1].clone()])?;
+    assert_eq!(new_doc.get_text("text").to_string(), "abc");
+    assert_eq!(
+        deltas.lock().unwrap().drain(..).collect::<Vec<_>>(),
+        vec![vec![TextDelta::Insert {
+            insert: "abc".into(),
+            attributes: None,
+        }]]
+    );
+
+    text.insert(3, "d")?;
+    doc.commit();
+    new_doc.import_batch(&[doc.export_snapshot(), doc.export_from(&new_doc.oplog_vv())])?;
+    assert_eq!(new_doc.get_text("text").to_string(), "abcd");
+    assert_eq!(
+        deltas.lock().unwrap().drain(..).collect::<Vec<_>>(),
+        vec![vec![
+            TextDelta::Retain {
+                retain: 3,
+                attributes: None,
+            },
+            TextDelta::Insert {
+                insert: "d".into(),
+                attributes: None,
+            }
+        ]]
+    );
+    Ok(())
+}
+
+#[test]
+fn detached_editing_is_merged_as_concurrent_edits() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let text = doc.get_text("text");
+    let map = doc.get_map("map");
+    text.insert(0, "Hello")?;
+    map.insert("key", "old")?;
+    doc.commit();
+    let v0 = doc.oplog_frontiers();
+    text.insert(5, " world")?;
+    map.insert("key", "new")?;
+    doc.commit();
+
+    doc.checkout(&v0)?;
+    assert!(text.insert(0, "Hi! ").is_err());
+    doc.set_detached_editing(true);
+    assert!(doc.is_detached());
+    assert_ne!(doc.peer_id(), 1);
+    text.insert(0, "Hi! ")?;
+    map.insert("key", "staged")?;
+    assert_eq!(text.to_string(), "Hi! Hello");
+    doc.commit_rebased();
+    assert!(!doc.is_detached());
+    assert_eq!(text.to_string(), "Hi! Hello world");
+
+    // the edits converge as if they were concurrent
+    let other = LoroDoc::new();
+    other.import(&doc.export_snapshot())?;
+    assert_eq!(other.get_deep_value(), doc.get_deep_value());
+    let peers: Vec<_> = doc.oplog_vv().iter().map(|(peer, _)| *peer).collect();
+    assert_eq!(peers.len(), 2);
+    Ok(())
+}
+
+#[test]
+fn tree_mov_to_index() -> LoroResult<()> {
+    use loro_internal::loro_common::LoroTreeError;
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let tree = doc.get_tree("tree");
+    let root = tree.create(None)?;
+    let a = tree.create(root)?;
+    let b = tree.create(root)?;
+    let c = tree.create(root)?;
+    let other = tree.create(None)?;
+
+    // reorder inside the same parent
+    tree.mov_to(a, root, 2)?;
+    assert_eq!(tree.children(Some(root)).unwrap(), vec![b, c, a]);
+    tree.mov_to(a, root, 0)?;
+    assert_eq!(tree.children(Some(root)).unwrap(), vec![a, b, c]);
+    assert!(tree.mov_to(a, root, 3).is_err());
+    // move across parents
+    tree.mov_to(b, other, 0)?;
+    assert_eq!(tree.children(Some(root)).unwrap(), vec![a, c]);
+    assert_eq!(tree.children(Some(other)).unwrap(), vec![b]);
+    // cycles are rejected and the tree is unchanged
+    let value = tree.get_value();
+    assert!(matches!(
+        tree.mov_to(root, a, 0),
+        Err(LoroError::TreeError(LoroTreeError::CyclicMoveError))
+    ));
+    assert!(matches!(
+        tree.mov_to(root, root, 0),
+        Err(LoroError::TreeError(LoroTreeError::CyclicMoveError))
+    ));
+    assert_eq!(tree.get_value(), value);
+    doc.commit();
+
+    // concurrent moves to the same slot converge
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc.export_snapshot())?;
+    let tree_b = doc_b.get_tree("tree");
+    tree.mov_to(a, root, 1)?;
+    tree_b.mov_to(b, root, 1)?;
+    doc.import(&doc_b.export_from(&doc.oplog_vv()))?;
+    doc_b.import(&doc.export_from(&doc_b.oplog_vv()))?;
+    let children = tree.children(Some(root)).unwrap();
+    assert_eq!(children, tree_b.children(Some(root)).unwrap());
+    assert_eq!(children.len(), 3);
+    assert_eq!(tree.get_value(), tree_b.get_value());
+    Ok(())
+}
+
+#[test]
+fn export_json_patch_of_nested_containers() -> LoroResult<()> {
+    use loro::{loro_value, Frontiers, JsonPatchOp};
+    let doc = LoroDoc::new();
+    let root = doc.get_map("root");
+    let list = root.insert_container("items", LoroList::new())?;
+    let item = list.insert_container(0, LoroMap::new())?;
+    item.insert("title", "a")?;
+    list.insert(1, 5)?;
+    let text = root.insert_container("note", LoroText::new())?;
+    text.insert(0, "hi")?;
+    doc.commit();
+    let v0 = doc.oplog_frontiers();
+
+    item.insert("title", "b")?;
+    list.delete(1, 1)?;
+    text.insert(2, " there")?;
+    root.insert("a/b", 1)?;
+    doc.commit();
+    let v1 = doc.oplog_frontiers();
+
+    let patch = doc.export_json_patch(&v0, &v1)?;
+    assert_eq!(patch.len(), 4);
+    for op in [
+        JsonPatchOp::Add {
+            path: "/root/a~1b".into(),
+            value: 1.into(),
+        },
+        JsonPatchOp::Remove {
+            path: "/root/items/1".into(),
+        },
+        JsonPatchOp::Replace {
+            path: "/root/note".into(),
+            value: "hi there".into(),
+        },
+        JsonPatchOp::Add {
+            path: "/root/items/0/title".into(),
+            value: "b".into(),
+        },
+    ] {
+        assert!(patch.contains(&op), "{:?} not in {:?}", op, patch);
+    }
+
+    // A newly created container is exported as a whole value
+    let patch = doc.export_json_patch(&Frontiers::default(), &v0)?;
+    assert_eq!(
+        patch,
+        vec![
+            JsonPatchOp::Add {
+                path: "/root/items".into(),
+                value: loro_value!([{ "title": "a" }, 5]),
+            },
+            JsonPatchOp::Add {
+                path: "/root/note".into(),
+                value: "hi".into(),
+            },
+        ]
+    );
+    // The doc is not checked out
+    assert_eq!(doc.state_frontiers(), v1);
+    Ok(())
+}
+
+#[test]
+fn export_json_patch_of_movable_list_moves() -> LoroResult<()> {
+    use loro::{Frontiers, JsonPatchOp};
+    let doc = LoroDoc::new();
+    let list = doc.get_movable_list("list");
+    for (i, v) in ["a", "b", "c", "d"].into_iter().enumerate() {
+        list.insert(i, v)?;
+    }
+    doc.commit();
+    let v0 = doc.oplog_frontiers();
+    list.mov(0, 3)?;
+    list.delete(0, 1)?;
+    list.insert(0, "e")?;
+    doc.commit();
+
+    let patch = doc.export_json_patch(&v0, &doc.oplog_frontiers())?;
+    assert_eq!(
+        patch,
+        vec![
+            JsonPatchOp::Remove {
+                path: "/list/1".into(),
+            },
+            JsonPatchOp::Move {
+                from: "/list/0".into(),
+                path: "/list/2".into(),
+            },
+            JsonPatchOp::Add {
+                path: "/list/0".into(),
+                value: "e".into(),
+            },
+        ]
+    );
+    assert!(doc
+        .export_json_patch(&Frontiers::default(), &v0)?
+        .iter()
+        .all(|op| !matches!(op, JsonPatchOp::Move { .. })));
+    Ok(())
+}
+
+#[test]
+fn subscribe_path_until_the_container_is_deleted() -> LoroResult<()> {
+    use std::sync::Mutex;
+    let doc = LoroDoc::new();
+    let root = doc.get_map("root");
+    let child = root.insert_container("child", LoroMap::new())?;
+    doc.commit();
+
+    let targets = Arc::new(Mutex::new(Vec::new()));
+    let targets_cp = targets.clone();
+    doc.subscribe_path(
+        &child.id(),
+        Arc::new(move |e| {
+            let ids: Vec<_> = e.events.iter().map(|x| x.target.clone()).collect();
+            targets_cp.lock().unwrap().push(ids);
+        }),
+    );
+
+    // A container created in the subtree in the same commit is reported
+    let list = child.insert_container("list", LoroList::new())?;
+    list.insert(0, 1)?;
+    doc.commit();
+    assert_eq!(targets.lock().unwrap().len(), 1);
+    assert!(targets.lock().unwrap()[0].contains(&list.id()));
+
+    root.insert("other", 1)?;
+    doc.commit();
+    assert_eq!(targets.lock().unwrap().len(), 1);
+
+    root.delete("child")?;
+    doc.commit();
+    assert_eq!(targets.lock().unwrap().len(), 2);
+    assert_eq!(targets.lock().unwrap()[1], vec![root.id()]);
+
+    // The subscription is removed after the deletion
+    root.insert_container("child", LoroMap::new())?;
+    doc.commit();
+    assert_eq!(targets.lock().unwrap().len(), 2);
+    Ok(())
+}
+
+#[test]
+fn get_or_insert_container_converges() -> LoroResult<()> {
+    use loro::ContainerType;
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    let sub_a = doc_a
+        .get_map("map")
+        .get_or_insert_container("sub", ContainerType::Map)?
+        .into_map()
+        .unwrap();
+    sub_a.insert("from", "a")?;
+    let sub_b = doc_b
+        .get_map("map")
+        .get_or_insert_container("sub", ContainerType::Map)?
+        .into_map()
+        .unwrap();
+    sub_b.insert("from", "b")?;
+    assert_ne!(sub_a.id(), sub_b.id());
+
+    doc_a.import(&doc_b.export_from(&Default::default()))?;
+    doc_b.import(&doc_a.export_from(&Default::default()))?;
+    let winner_a = doc_a
+        .get_map("map")
+        .get_or_insert_container("sub", ContainerType::Map)?;
+    let winner_b = doc_b
+        .get_map("map")
+        .get_or_insert_container("sub", ContainerType::Map)?;
+    assert_eq!(winner_a.id(), winner_b.id());
+    assert_eq!(doc_a.get_deep_value(), doc_b.get_deep_value());
+    Ok(())
+}
+
+#[test]
+fn compact_history_keeps_history_and_merges_concurrent_changes() -> LoroResult<()> {
+    use loro::CommitOptions;
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    doc_a.set_change_merge_interval(0);
+    let text = doc_a.get_text("text");
+    let map = doc_a.get_map("map");
+    let mut versions = Vec::new();
+    for i in 0..100 {
+        text.insert(i, "a")?;
+        doc_a.commit();
+        map.insert("key", i as i64)?;
+        doc_a.commit();
+        versions.push((doc_a.oplog_frontiers(), doc_a.get_deep_value()));
+    }
+    text.insert(100, "b")?;
+    doc_a.commit_with(CommitOptions::new().commit_msg("kept apart"));
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    doc_b.get_text("text").insert(0, "from b ")?;
+    doc_b.get_map("map").insert("key", "from b")?;
+    doc_b.commit();
+
+    let value = doc_a.get_deep_value();
+    let before = doc_a.export_from(&Default::default()).len();
+    assert_eq!(doc_a.len_changes(), 201);
+    assert_eq!(doc_a.compact_history(&doc_a.oplog_frontiers())?, 199);
+    assert_eq!(doc_a.len_changes(), 2);
+    assert_eq!(doc_a.get_deep_value(), value);
+    assert!(doc_a.export_from(&Default::default()).len() < before);
+    assert_eq!(doc_a.compact_history(&doc_a.oplog_frontiers())?, 0);
+
+    // The superseded values are kept, so the old versions are the same
+    for (frontiers, value) in versions.iter() {
+        doc_a.checkout(frontiers)?;
+        assert_eq!(&doc_a.get_deep_value(), value);
+    }
+    doc_a.checkout_to_latest();
+
+    let doc_c = LoroDoc::new();
+    doc_c.import(&doc_a.export_from(&Default::default()))?;
+    assert_eq!(doc_c.get_deep_value(), value);
+    doc_c.checkout(&versions[10].0)?;
+    assert_eq!(doc_c.get_deep_value(), versions[10].1);
+
+    doc_a.import(&doc_b.export_from(&doc_a.oplog_vv()))?;
+    doc_b.import(&doc_a.export_from(&doc_b.oplog_vv()))?;
+    assert_eq!(doc_a.get_deep_value(), doc_b.get_deep_value());
+    assert_eq!(
+        doc_a
+            .get_map("map")
+            .get("key")
+            .unwrap()
+            .into_value()
+            .unwrap(),
+        "from b".into()
+    );
+    Ok(())
+}
+
+#[test]
+fn prepared_import_is_the_same_as_import() -> LoroResult<()> {
+    use std::sync::Mutex;
+    let doc = LoroDoc::new();
+    doc.get_text("text").insert(0, "Hello")?;
+    let list = doc
+        .get_map("map")
+        .insert_container("list", LoroList::new())?;
+    list.insert(0, 1)?;
+    doc.get_movable_list("movable").insert(0, "a")?;
+    doc.commit();
+    let snapshot = doc.export_snapshot();
+
+    let collect_targets = |doc: &LoroDoc| {
+        let targets = Arc::new(Mutex::new(Vec::new()));
+        let targets_clone = targets.clone();
+        let sub = doc.subscribe_root(Arc::new(move |e| {
+            for e in e.events {
+                targets_clone.lock().unwrap().push(e.id.to_string());
+            }
+        }));
+        (sub, targets)
+    };
+
+    let expected = LoroDoc::new();
+    let (_sub, expected_targets) = collect_targets(&expected);
+    expected.import(&snapshot)?;
+
+    let actual = LoroDoc::new();
+    let text = actual.get_text("text");
+    let (_sub, actual_targets) = collect_targets(&actual);
+    let prepared =
+        std::thread::scope(|s| s.spawn(|| actual.prepare_import(&snapshot)).join().unwrap())?;
+    // The doc is not changed until the import is applied
+    assert_eq!(text.to_string(), "");
+    assert!(actual_targets.lock().unwrap().is_empty());
+    actual.apply_import(prepared)?;
+    assert_eq!(actual.get_deep_value(), expected.get_deep_value());
+    assert_eq!(text.to_string(), "Hello");
+    let mut expected_targets = expected_targets.lock().unwrap().clone();
+    let mut actual_targets = actual_targets.lock().unwrap().clone();
+    expected_targets.sort();
+    actual_targets.sort();
+    assert_eq!(actual_targets, expected_targets);
+
+    // The doc is changed after the import is prepared
+    let changed = LoroDoc::new();
+    let prepared = changed.prepare_import(&snapshot)?;
+    changed.get_text("text").insert(0, "Hi ")?;
+    changed.commit();
+    changed.apply_import(prepared)?;
+    assert_eq!(changed.get_text("text").len_unicode(), 8);
+    assert_eq!(changed.get_map("map").len(), 1);
+
+    // The pending changes of the doc are kept
+    let source = LoroDoc::new();
+    source.get_text("text").insert(0, "a")?;
+    source.commit();
+    let base = source.export_snapshot();
+    let vv = source.oplog_vv();
+    source.get_text("text").insert(1, "b")?;
+    source.commit();
+    let pending = LoroDoc::new();
+    pending.import(&source.export_from(&vv))?;
+    assert_eq!(pending.get_text("text").to_string(), "");
+    let prepared = pending.prepare_import(&base)?;
+    pending.apply_import(prepared)?;
+    assert_eq!(pending.get_text("text").to_string(), "ab");
+    Ok(())
+}
+
+#[test]
+fn export_updates_in_scattered_spans() -> LoroResult<()> {
+    use loro::IdSpan;
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let list = doc.get_list("list");
+    for i in 0..10 {
+        list.push(i)?;
+    }
+    doc.commit();
+    let doc_2 = LoroDoc::new();
+    doc_2.set_peer_id(2)?;
+    doc_2.import(&doc.export_snapshot())?;
+    for i in 10..20 {
+        doc_2.get_list("list").push(i)?;
+    }
+    doc_2.commit();
+    doc.import(&doc_2.export_from(&doc.oplog_vv()))?;
+
+    let blobs = doc.export_updates_in_spans(&[
+        IdSpan::new(1, 7, 10),
+        IdSpan::new(2, 0, 10),
+        IdSpan::new(1, 0, 3),
+        IdSpan::new(1, 2, 6),
+        // The ops that don't exist are ignored
+        IdSpan::new(3, 0, 10),
+    ]);
+    assert_eq!(blobs.len(), 2);
+    let new_doc = LoroDoc::new();
+    for blob in blobs.iter().rev() {
+        new_doc.import(blob)?;
+    }
+    // The ops after 1@6 are pending
+    assert_eq!(new_doc.get_list("list").len(), 6);
+    new_doc.import_batch(&doc.export_updates_in_spans(&[IdSpan::new(1, 6, 7)]))?;
+    assert_eq!(new_doc.get_deep_value(), doc.get_deep_value());
+
+    // Only the missing ops are exported
+    let partial = LoroDoc::new();
+    partial.import_batch(&doc.export_updates_in_spans(&[IdSpan::new(1, 0, 5)]))?;
+    assert_eq!(partial.get_list("list").len(), 5);
+    let blobs = doc.export_updates_in_spans(&[IdSpan::new(1, 5, 10), IdSpan::new(2, 0, 10)]);
+    assert_eq!(blobs.len(), 1);
+    partial.import(&blobs[0])?;
+    assert_eq!(partial.get_deep_value(), doc.get_deep_value());
+    Ok(())
+}
+
+#[test]
+fn splice_list_and_movable_list() -> LoroResult<()> {
+    use loro::LoroValue;
+    let v = |x: i32| LoroValue::from(x);
+    let doc = LoroDoc::new();
+    let list = doc.get_list("list");
+    let movable = doc.get_movable_list("movable");
+    for i in 0..4 {
+        list.push(i)?;
+        movable.push(i)?;
+    }
+    let sub = list.insert_container(4, LoroText::new())?;
+    sub.insert(0, "text")?;
+
+    assert_eq!(
+        list.splice(2, 3, &["a".into()])?,
+        vec![v(2), v(3), LoroValue::from("text")]
+    );
+    assert_eq!(list.get_value().to_json_value(), json!([0, 1, "a"]));
+    assert_eq!(
+        movable.splice(0, 2, &["a".into(), "b".into()])?,
+        vec![v(0), v(1)]
+    );
+    assert_eq!(movable.get_value().to_json_value(), json!(["a", "b", 2, 3]));
+    assert!(movable.splice(4, 0, &["c".into()])?.is_empty());
+    assert_eq!(
+        movable.get_value().to_json_value(),
+        json!(["a", "b", 2, 3, "c"])
+    );
+
+    // A failed splice has no effect
+    assert!(list.splice(2, 2, &[]).is_err());
+    assert!(matches!(
+        list.splice(1, usize::MAX, &[]),
+        Err(LoroError::OutOfBound { .. })
+    ));
+    assert!(matches!(
+        movable.splice(1, usize::MAX, &[]),
+        Err(LoroError::OutOfBound { .. })
+    ));
+    assert!(list
+        .splice(0, 1, &[LoroValue::Container(sub.id())])
+        .is_err());
+    assert_eq!(list.get_value().to_json_value(), json!([0, 1, "a"]));
+
+    let detached = LoroList::new();
+    detached.push(1)?;
+    assert_eq!(detached.splice(0, 1, &[v(2)])?, vec![v(1)]);
+    assert_eq!(detached.get_value().to_json_value(), json!([2]));
+    assert!(matches!(
+        detached.splice(1, usize::MAX, &[]),
+        Err(LoroError::OutOfBound { .. })
+    ));
+    Ok(())
+}
+
+#[test]
+fn deep_value_with_id_includes_nested_containers() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    let list = doc.get_list("list");
+    list.push(1)?;
+    let text = list.push_container(LoroText::new())?;
+    text.insert(0, "abc")?;
+    let movable = doc.get_movable_list("movable");
+    let map = movable.push_container(LoroMap::new())?;
+    map.insert("k", "v")?;
+    let tree = doc.get_tree("tree");
+    let node = tree.create(None)?;
+    let meta = tree.get_meta(node)?;
+    meta.insert("name", "root")?;
+
+    let value = doc.get_deep_value_with_id().to_json_value();
+    assert_eq!(
+        value["list"],
+        json!({
+            "cid": list.id().to_string(),
+            "value": [1, { "cid": text.id().to_string(), "value": "abc" }]
+        })
+    );
+    assert_eq!(
+        value["movable"],
+        json!({
+            "cid": movable.id().to_string(),
+            "value": [{ "cid": map.id().to_string(), "value": { "k": "v" } }]
+        })
+    );
+    assert_eq!(value["tree"]["cid"], json!(tree.id().to_string()));
+    assert_eq!(
+        value["tree"]["value"][0]["meta"],
+        json!({ "cid": meta.id().to_string(), "value": { "name": "root" } })
+    );
+    let cid = value["list"]["value"][1]["cid"].as_str().unwrap();
+    assert_eq!(loro::ContainerID::try_from(cid).unwrap(), text.id());
+    Ok(())
+}
+
+#[test]
+fn text_insert_with_result_returns_entity_range() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    let text = doc.get_text("text");
+    assert_eq!(text.insert_with_result(0, "hello")?, 0..5);
+    text.mark(0..2, "bold", true)?;
+    // The style anchors before "h" and after "e" take one entity index each
+    assert_eq!(text.insert_with_result(3, "XY")?, 5..7);
+    assert_eq!(text.to_string(), "helXYlo");
+    // An empty insertion reports the entity index a real insertion would start at
+    assert_eq!(text.insert_with_result(3, "")?, 5..5);
+    let empty = text.insert_with_result(2, "")?;
+    assert_eq!(empty.start, empty.end);
+    assert_eq!(text.insert_with_result(2, "Z")?.start, empty.start);
+    assert_eq!(text.to_string(), "heZlXYlo");
+
+    let detached = LoroText::new();
+    detached.insert(0, "ab")?;
+    assert_eq!(detached.insert_with_result(1, "c")?, 1..2);
+    assert_eq!(detached.insert_with_result(2, "")?, 2..2);
+    Ok(())
+}
+
+#[test]
+fn frozen_view_reads_live_state() -> LoroResult<()> {
+    use loro::frozen::FrozenContainer;
+    let doc = LoroDoc::new();
+    let view = doc.frozen_view();
+    let map = view.get_map("map");
+    assert!(map.is_empty());
+
+    let text = doc
+        .get_map("map")
+        .insert_container("text", LoroText::new())?;
+    text.insert(0, "abc")?;
+    doc.get_tree("tree").create(None)?;
+    doc.commit();
+    let Some(either::Either::Right(FrozenContainer::Text(frozen_text))) = map.get("text") else {
+        panic!("expect a text container");
+    };
+    assert_eq!(frozen_text.id(), text.id());
+    assert_eq!(frozen_text.to_string(), "abc");
+    assert_eq!(view.get_tree("tree").nodes().len(), 1);
+    assert_eq!(view.get_deep_value(), doc.get_deep_value());
+    assert_eq!(view.oplog_frontiers(), doc.oplog_frontiers());
+
+    let called = Arc::new(AtomicBool::new(false));
+    let called_clone = called.clone();
+    let sub = view.subscribe_root(Arc::new(move |_| {
+        called_clone.store(true, std::sync::atomic::Ordering::Release);
+    }));
+    text.insert(3, "d")?;
+    doc.commit();
+    assert!(called.load(std::sync::atomic::Ordering::Acquire));
+    view.unsubscribe(sub);
+    assert_eq!(frozen_text.to_string(), "abcd");
+    Ok(())
+}
+
+#[test]
+fn fork_at_past_version() -> LoroResult<()> {
+    let a = LoroDoc::new();
+    a.set_peer_id(1)?;
+    let b = LoroDoc::new();
+    b.set_peer_id(2)?;
+    a.get_list("list").push(1)?;
+    a.commit();
+    b.import(&a.export_from(&Default::default()))?;
+    b.get_list("list").push(2)?;
+    b.commit();
+    a.get_list("list").push(3)?;
+    a.commit();
+    a.import(&b.export_from(&Default::default()))?;
+    // Excludes the concurrent `push(3)` of peer 1
+    let f: loro::Frontiers = ID::new(2, 0).into();
+    a.get_map("map").insert("k", "v")?;
+    a.commit();
+
+    let fork = a.fork_at(&f)?;
+    assert_eq!(fork.oplog_vv(), a.frontiers_to_vv(&f).unwrap());
+    {
+        let expected = a.fork();
+        expected.checkout(&f)?;
+        assert_eq!(fork.get_deep_value(), expected.get_deep_value());
+    }
+    assert!(!fork.is_detached());
+    assert_ne!(fork.peer_id(), 1);
+    assert_ne!(fork.peer_id(), 2);
+
+    fork.get_list("list").push(4)?;
+    fork.commit();
+    a.import(&fork.export_from(&a.oplog_vv()))?;
+    fork.import(&a.export_from(&fork.oplog_vv()))?;
+    assert_eq!(a.get_deep_value(), fork.get_deep_value());
+    assert_eq!(a.oplog_vv(), fork.oplog_vv());
+
+    let err = a.fork_at(&ID::new(3, 0).into()).unwrap_err();
+    assert!(matches!(err, LoroError::FrontiersNotFound(_)));
+    Ok(())
+}
+
+#[test]
+fn map_update_and_replace_all_in_one_change() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    let map = doc.get_map("map");
+    map.insert("a", 1)?;
+    doc.commit();
+    let events = Arc::new(std::sync::Mutex::new(Vec::new()));
+    let events_clone = events.clone();
+    let sub = doc.subscribe_root(Arc::new(move |e| {
+        for c in e.events {
+            if let loro::event::Diff::Map(m) = &c.diff {
+                let mut keys: Vec<_> = m.updated.keys().map(|k| k.to_string()).collect();
+                keys.sort();
+                events_clone.lock().unwrap().push(keys);
+            }
+        }
+    }));
+
+    let changes = doc.len_changes();
+    map.update(std::collections::HashMap::from([("b", 2), ("c", 3)]))?;
+    doc.commit();
+    assert_eq!(doc.len_changes(), changes + 1);
+    assert_eq!(
+        map.get_value().to_json_value(),
+        json!({"a": 1, "b": 2, "c": 3})
+    );
+
+    map.replace_all([("c", 4), ("d", 5)])?;
+    doc.commit();
+    assert_eq!(map.get_value().to_json_value(), json!({"c": 4, "d": 5}));
+    assert_eq!(
+        *events.lock().unwrap(),
+        vec![vec!["b", "c"], vec!["a", "b", "c", "d"]]
+    );
+    doc.unsubscribe(sub);
+
+    let text = doc.get_text("text");
+    let err = map.update([("e", loro::LoroValue::Container(text.id()))]);
+    assert!(err.is_err());
+    assert!(map.get("e").is_none());
+    Ok(())
+}
+
+#[test]
+fn export_and_import_container_subtree() -> LoroResult<()> {
+    let a = LoroDoc::new();
+    let block = a.get_map("block");
+    let text = block.insert_container("text", LoroText::new())?;
+    text.insert(0, "Hello world")?;
+    text.mark(0..5, "bold", true)?;
+    // The style isn't configured in either doc
+    text.mark_with_expand(6..11, "comment", "c1", loro::ExpandType::None)?;
+    let tree = block.insert_container("outline", loro::LoroTree::new())?;
+    let root = tree.create(None)?;
+    let child = tree.create(root)?;
+    tree.get_meta(root)?.insert("title", "Intro")?;
+    let note = tree
+        .get_meta(child)?
+        .insert_container("note", LoroText::new())?;
+    note.insert(0, "details")?;
+    let list = block.insert_container("tags", LoroList::new())?;
+    list.push("a")?;
+    list.push_container(LoroMap::new())?.insert("k", 1)?;
+    a.commit();
+    let blob = a.export_container(&block.id())?;
+
+    let b = LoroDoc::new();
+    b.get_map("doc").insert("x", 1)?;
+    let id = b.import_container_as(&blob, &b.get_map("doc").id(), "pasted")?;
+    b.commit();
+    let pasted = b.get_map(id.clone());
+    assert_eq!(
+        b.get_map("doc")
+            .get("pasted")
+            .unwrap()
+            .right()
+            .unwrap()
+            .id(),
+        id
+    );
+    let pasted_text = pasted
+        .get("text")
+        .unwrap()
+        .right()
+        .unwrap()
+        .into_text()
+        .unwrap();
+    assert_ne!(pasted_text.id(), text.id());
+    assert_eq!(pasted_text.to_delta(), text.to_delta());
+    assert_eq!(
+        pasted
+            .get("tags")
+            .unwrap()
+            .right()
+            .unwrap()
+            .into_list()
+            .unwrap()
+            .get_deep_value(),
+        list.get_deep_value()
+    );
+
+    let pasted_tree = pasted
+        .get("outline")
+        .unwrap()
+        .right()
+        .unwrap()
+        .into_tree()
+        .unwrap();
+    let roots = pasted_tree.children(None).unwrap();
+    assert_eq!(roots.len(), 1);
+    let children = pasted_tree.children(Some(roots[0])).unwrap();
+    assert_eq!(children.len(), 1);
+    assert_eq!(
+        pasted_tree
+            .get_meta(roots[0])?
+            .get_deep_value()
+            .to_json_value(),
+        json!({"title": "Intro"})
+    );
+    let pasted_note = pasted_tree.get_meta(children[0])?.get("note").unwrap();
+    let pasted_note = pasted_note.right().unwrap().into_text().unwrap();
+    assert_ne!(pasted_note.id(), note.id());
+    assert_eq!(pasted_note.to_string(), "details");
+
+    // The pasted content syncs like any other content
+    let c = LoroDoc::new();
+    c.import(&b.export_from(&Default::default()))?;
+    assert_eq!(c.get_deep_value(), b.get_deep_value());
+
+    // The expand type of each mark is kept
+    pasted_text.insert(11, "!")?;
+    assert_eq!(
+        pasted_text.to_delta().to_json_value(),
+        json!([
+            { "insert": "Hello", "attributes": { "bold": true } },
+            { "insert": " " },
+            { "insert": "world", "attributes": { "comment": "c1" } },
+            { "insert": "!" },
+        ])
+    );
+
+    assert!(b
+        .import_container_as(&blob, &pasted_text.id(), "k")
+        .is_err());
+    assert!(b
+        .import_container_as(&blob[1..], &b.get_map("doc").id(), "k")
+        .is_err());
+    Ok(())
+}
+
+#[test]
+fn sync_request_and_response_between_diverged_peers() -> LoroResult<()> {
+    let a = LoroDoc::new();
+    a.set_peer_id(1)?;
+    let b = LoroDoc::new();
+    b.set_peer_id(2)?;
+    a.get_text("text").insert(0, "123")?;
+    a.commit();
+
+    // Full sync to an empty doc
+    let diff = b.oplog_vv().diff(&a.oplog_vv());
+    assert!(diff.left.is_empty());
+    assert_eq!(diff.right.get(&1).unwrap().end, 3);
+    b.import(&a.sync_response(&b.sync_request())?)?;
+    assert_eq!(a.get_deep_value(), b.get_deep_value());
+
+    // Concurrent edits
+    a.get_text("text").insert(0, "a")?;
+    a.commit();
+    b.get_text("text").insert(0, "bb")?;
+    b.commit();
+    let diff = a.oplog_vv().diff(&b.oplog_vv());
+    assert_eq!(diff.left.get(&1).unwrap().start, 3);
+    assert_eq!(diff.left.get(&1).unwrap().end, 4);
+    assert_eq!(diff.right.get(&2).unwrap().end, 2);
+    b.import(&a.sync_response(&b.sync_request())?)?;
+    a.import(&b.sync_response(&a.sync_request())?)?;
+    assert_eq!(a.get_deep_value(), b.get_deep_value());
+    assert_eq!(a.oplog_vv(), b.oplog_vv());
+    assert!(a.oplog_vv().diff(&b.oplog_vv()).left.is_empty());
+
+    assert!(a.sync_response(&[255, 255]).is_err());
+    Ok(())
+}
+
+#[test]
+fn subscribe_orphaned_reports_deleted_and_revived_containers() -> LoroResult<()> {
+    use std::sync::Mutex;
+    let doc = LoroDoc::new();
+    let list = doc.get_list("list");
+    let map = list.insert_container(0, LoroMap::new())?;
+    let text = map.insert_container("text", LoroText::new())?;
+    doc.commit();
+    let before_delete = doc.state_frontiers();
+
+    let events = Arc::new(Mutex::new(Vec::new()));
+    let events_cp = events.clone();
+    let sub = doc.subscribe_orphaned(Arc::new(move |e| {
+        events_cp.lock().unwrap().push(e.clone());
+    }));
+    let take = || std::mem::take(&mut *events.lock().unwrap());
+    let sorted = |mut ids: Vec<loro::ContainerID>| {
+        ids.sort_by_key(|id| id.to_string());
+        ids
+    };
+    let expected = sorted(vec![map.id(), text.id()]);
+
+    // Unrelated changes are not reported
+    doc.get_text("other").insert(0, "abc")?;
+    doc.commit();
+    assert!(take().is_empty());
+
+    list.delete(0, 1)?;
+    doc.commit();
+    let e = take();
+    assert_eq!(e.len(), 1);
+    assert_eq!(sorted(e[0].orphaned.clone()), expected);
+    assert!(e[0].revived.is_empty());
+
+    doc.checkout(&before_delete)?;
+    let e = take();
+    assert_eq!(e.len(), 1);
+    assert!(e[0].orphaned.is_empty());
+    assert_eq!(sorted(e[0].revived.clone()), expected);
+
+    doc.checkout_to_latest();
+    let e = take();
+    assert_eq!(e.len(), 1);
+    assert_eq!(sorted(e[0].orphaned.clone()), expected);
+
+    doc.unsubscribe(sub);
+    doc.checkout(&before_delete)?;
+    assert!(take().is_empty());
+    Ok(())
+}
+
+#[test]
+fn text_handle_index_type() -> LoroResult<()> {
+    use loro::IndexType;
+    let doc = LoroDoc::new();
+    let mut text = doc.get_text("text");
+    text.insert(0, "你好😀")?;
+    text.set_index_type(IndexType::Utf16);
+    assert_eq!(text.index_type(), IndexType::Utf16);
+    // Other handles still use unicode indexes
+    assert_eq!(doc.get_text("text").index_type(), IndexType::Unicode);
+
+    text.insert(4, "!")?;
+    assert_eq!(text.to_string(), "你好😀!");
+    text.mark(2..4, "bold", true)?;
+    assert_eq!(
+        text.to_delta().to_json_value(),
+        json!([
+            { "insert": "你好" },
+            { "insert": "😀", "attributes": { "bold": true } },
+            { "insert": "!" },
+        ])
+    );
+    assert_eq!(text.unmark(0..5, "bold")?, vec![(2, 4)]);
+
+    // Positions inside a surrogate pair are rejected
+    assert!(matches!(text.insert(3, "x"), Err(LoroError::ArgErr(_))));
+    assert!(matches!(text.delete(2, 1), Err(LoroError::ArgErr(_))));
+    assert!(matches!(
+        text.insert(6, "x"),
+        Err(LoroError::OutOfBound { pos: 6, len: 5 })
+    ));
+    assert_eq!(text.to_string(), "你好😀!");
+
+    text.with_index_type(IndexType::Utf8).delete(3, 3)?;
+    assert_eq!(text.to_string(), "你😀!");
+    text.delete(1, 2)?;
+    assert_eq!(text.to_string(), "你!");
+    Ok(())
+}
+
+#[test]
+fn history_iter_steps_through_versions() -> LoroResult<()> {
+    use loro::history::HistoryGranularity;
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_a.get_map("map").insert("a", 1)?;
+    doc_a.get_map("map").insert("b", 2)?;
+    doc_a.commit();
+    doc_b.get_list("list").push("x")?;
+    doc_b.commit();
+    doc_a.import(&doc_b.export_from(&Default::default()))?;
+    doc_a.get_list("list").push("y")?;
+    doc_a.commit();
+    let latest = doc_a.get_deep_value();
+
+    assert_eq!(doc_a.history_iter(HistoryGranularity::Op).len(), 4);
+    let mut iter = doc_a.history_iter(HistoryGranularity::Change);
+    assert_eq!(iter.len(), 3);
+    let mut versions = Vec::new();
+    for step in iter.by_ref() {
+        assert_eq!(step.index, versions.len() + 1);
+        assert!(!step.diff.is_empty());
+        versions.push((step.frontiers, iter.get_deep_value()));
+    }
+    assert_eq!(iter.position(), 3);
+    assert_eq!(versions.last().unwrap().1, latest);
+
+    // Seeking backwards and forwards reaches the same versions
+    iter.seek(1)?;
+    assert_eq!(iter.frontiers(), versions[0].0);
+    assert_eq!(iter.get_deep_value(), versions[0].1);
+    let step = iter.next().unwrap();
+    assert_eq!(step.index, 2);
+    assert_eq!(iter.get_deep_value(), versions[1].1);
+    assert!(!iter.seek(0)?.is_empty());
+    assert!(iter.seek(4).is_err());
+
+    // The original doc is not affected
+    assert_eq!(doc_a.get_deep_value(), latest);
+    doc_a.get_list("list").push("z")?;
+    doc_a.commit();
+    Ok(())
+}
+
+#[test]
+fn import_preview_does_not_change_doc() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    doc.get_map("map").insert("a", 1)?;
+    doc.get_text("text").insert(0, "Hello")?;
+    doc.get_list("list").push(0)?;
+    doc.commit();
+    let before = doc.get_deep_value();
+    let vv = doc.oplog_vv();
+    let base = doc.export_from(&Default::default());
+
+    let other = doc.fork();
+    other.get_map("map").delete("a")?;
+    let child = other
+        .get_map("map")
+        .insert_container("child", LoroMap::new())?;
+    child.insert("b", 2)?;
+    other.get_text("text").insert(5, " world")?;
+    other.commit();
+    let updates = other.export_from(&vv);
+
+    let preview = doc.import_preview(&updates)?;
+    assert!(preview.pending.is_empty());
+    assert_eq!(preview.diff.len(), 3);
+    assert!(preview.diff.get(&doc.get_map("map").id()).is_some());
+    assert!(preview.diff.get(&child.id()).is_some());
+    assert!(preview.diff.get(&doc.get_list("list").id()).is_none());
+    assert_eq!(doc.get_deep_value(), before);
+    assert_eq!(doc.oplog_vv(), vv);
+
+    // An empty doc lacks the deps of the updates
+    let empty = LoroDoc::new();
+    let preview = empty.import_preview(&updates)?;
+    assert!(preview.diff.is_empty());
+    assert_eq!(preview.pending.len(), 1);
+    assert_eq!(preview.pending[0].peer, other.peer_id());
+    // The changes already pending are not reported twice
+    empty.import(&updates)?;
+    let preview = empty.import_preview(&updates)?;
+    assert_eq!(preview.pending.len(), 1);
+    // The pending changes are applied once their deps are imported
+    let preview = empty.import_preview(&base)?;
+    assert!(preview.pending.is_empty());
+    assert!(!preview.diff.is_empty());
+
+    doc.import(&updates)?;
+    assert_eq!(doc.get_deep_value(), other.get_deep_value());
+    // The updates that are already included change nothing
+    let preview = doc.import_preview(&updates)?;
+    assert!(preview.diff.is_empty());
+    assert!(preview.pending.is_empty());
+    Ok(())
+}
+
+#[test]
+fn tree_get_path_follows_concurrent_moves() -> LoroResult<()> {
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let tree_a = doc_a.get_tree("tree");
+    let root = tree_a.create(None)?;
+    let x = tree_a.create(root)?;
+    let y = tree_a.create(root)?;
+    let leaf = tree_a.create(x)?;
+    doc_a.commit();
+    assert_eq!(
+        tree_a.get_path(&leaf),
+        Some(vec![(root, 0), (x, 0), (leaf, 0)])
+    );
+
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    let tree_b = doc_b.get_tree("tree");
+    // Concurrently move the parent of leaf to different places
+    tree_a.mov(x, y)?;
+    tree_b.mov(x, None)?;
+    doc_a.import(&doc_b.export_from(&Default::default()))?;
+    doc_b.import(&doc_a.export_from(&Default::default()))?;
+
+    let path = tree_a.get_path(&leaf).unwrap();
+    assert_eq!(path, tree_b.get_path(&leaf).unwrap());
+    assert_eq!(path.last(), Some(&(leaf, 0)));
+    let parent = tree_a.parent(&x).unwrap();
+    assert!(parent == Some(y) || parent.is_none());
+    assert_eq!(path[path.len() - 2].0, x);
+    assert_eq!(path.len(), if parent.is_none() { 2 } else { 4 });
+
+    tree_a.delete(x)?;
+    assert_eq!(tree_a.get_path(&leaf), None);
+    assert_eq!(tree_a.get_path(&y).map(|p| p.len()), Some(2));
+    Ok(())
+}
+
+#[test]
+fn get_container_value_at_old_version() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let text = doc.get_text("text");
+    let list = doc.get_list("list");
+    let map = doc.get_map("map");
+    text.insert(0, "Hello")?;
+    list.push(1)?;
+    map.insert("a", 1)?;
+    doc.commit();
+    let v0 = doc.oplog_frontiers();
+    text.delete(0, 1)?;
+    text.insert(0, "J")?;
+    list.insert(0, 0)?;
+    map.insert("a", 2)?;
+    let child = map.insert_container("child", LoroText::new())?;
+    child.insert(0, "child")?;
+    doc.commit();
+    let latest = doc.get_deep_value();
+
+    assert_eq!(
+        doc.get_container_value_at(&text.id(), &v0)?.to_json_value(),
+        json!("Hello")
+    );
+    assert_eq!(
+        doc.get_container_value_at(&list.id(), &v0)?.to_json_value(),
+        json!([1])
+    );
+    assert_eq!(
+        doc.get_container_value_at(&map.id(), &v0)?.to_json_value(),
+        json!({"a": 1})
+    );
+    assert_eq!(
+        doc.get_container_value_at(&child.id(), &v0)?
+            .to_json_value(),
+        json!("")
+    );
+    assert_eq!(
+        doc.get_container_value_at(&text.id(), &doc.oplog_frontiers())?
+            .to_json_value(),
+        json!("Jello")
+    );
+    assert!(matches!(
+        doc.get_container_value_at(&text.id(), &ID::new(2, 0).into()),
+        Err(LoroError::FrontiersNotFound(_))
+    ));
+    let unknown = loro::ContainerID::new_normal(ID::new(3, 0), loro::ContainerType::Text);
+    assert!(matches!(
+        doc.get_container_value_at(&unknown, &v0),
+        Err(LoroError::NotFoundError(_))
+    ));
+
+    // The doc stays at the latest version
+    assert!(!doc.is_detached());
+    assert_eq!(doc.get_deep_value(), latest);
+    text.insert(5, "!")?;
+    assert_eq!(text.to_string(), "Jello!");
+    Ok(())
+}
+
+#[test]
+fn pre_commit_hook_rejects_or_fixes_local_changes() -> LoroResult<()> {
+    use loro::event::Diff;
+    use std::sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc,
+    };
+
+    let doc = LoroDoc::new();
+    let text = doc.get_text("text");
+    let map = doc.get_map("map");
+    text.insert(0, "Hello")?;
+    map.insert("a", 1)?;
+    doc.commit();
+    let before = doc.get_deep_value();
+    let frontiers = doc.oplog_frontiers();
+
+    let events = Arc::new(AtomicUsize::new(0));
+    let events_clone = events.clone();
+    let _sub = doc.subscribe_root(Arc::new(move |_| {
+        events_clone.fetch_add(1, Ordering::SeqCst);
+    }));
+    let counter = map.clone();
+    doc.set_pre_commit_hook(move |change| {
+        if change.diff.get(&counter.id()).is_some() {
+            if let Some(Diff::Map(delta)) = change.diff.get(&counter.id()) {
+                if delta.updated.contains_key("forbidden") {
+                    return Err(LoroError::ArgErr("forbidden key".into()));
+                }
+            }
+            // Keep a count of the changes to the map
+            let n = counter
+                .get("count")
+                .and_then(|v| v.left())
+                .and_then(|v| v.as_i64().copied())
+                .unwrap_or(0);
+            counter.insert("count", n + 1)?;
+        }
+        Ok(())
+    });
+
+    text.insert(5, " world")?;
+    text.delete(0, 1)?;
+    map.insert("forbidden", true)?;
+    let child = map.insert_container("child", LoroText::new())?;
+    child.insert(0, "child")?;
+    assert!(matches!(doc.try_commit(), Err(LoroError::ArgErr(_))));
+    assert_eq!(doc.get_deep_value(), before);
+    assert_eq!(doc.oplog_frontiers(), frontiers);
+    assert_eq!(events.load(Ordering::SeqCst), 0);
+
+    // The doc can still be edited after the rollback
+    text.insert(5, "!")?;
+    map.insert("b", 2)?;
+    doc.try_commit()?;
+    assert_eq!(
+        doc.get_deep_value().to_json_value(),
+        json!({"text": "Hello!", "map": {"a": 1, "b": 2, "count": 1}})
+    );
+    assert_eq!(events.load(Ordering::SeqCst), 1);
+
+    // Implicit commits skip the hook, so the edits are kept
+    map.insert("forbidden", 1)?;
+    let _ = doc.export_from(&Default::default());
+    assert!(map.get("forbidden").is_some());
+
+    doc.remove_pre_commit_hook();
+    map.delete("forbidden")?;
+    doc.try_commit()?;
+    assert!(map.get("forbidden").is_none());
+    Ok(())
+}
+
+#[test]
+fn pre_commit_hook_cannot_commit() -> LoroResult<()> {
+    use std::sync::{Arc, Mutex};
+
+    let doc = Arc::new(LoroDoc::new());
+    let weak = Arc::downgrade(&doc);
+    let results = Arc::new(Mutex::new(Vec::new()));
+    let results_clone = results.clone();
+    doc.set_pre_commit_hook(move |_| {
+        let doc = weak.upgrade().unwrap();
+        doc.get_map("map").insert("by_hook", true)?;
+        results_clone.lock().unwrap().push(doc.try_commit());
+        Ok(())
+    });
+    doc.get_map("map").insert("a", 1)?;
+    doc.try_commit()?;
+    let results = results.lock().unwrap();
+    assert_eq!(results.len(), 1);
+    assert!(matches!(results[0], Err(LoroError::TransactionError(_))));
+    assert_eq!(
+        doc.get_deep_value().to_json_value(),
+        json!({"map": {"a": 1, "by_hook": true}})
+    );
+    Ok(())
+}
+
+#[test]
+fn rejected_commit_removes_the_created_containers() -> LoroResult<()> {
+    use loro::ContainerID;
+    use std::sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc, Mutex,
+    };
+
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let reject = Arc::new(AtomicBool::new(true));
+    let reject_clone = reject.clone();
+    doc.set_pre_commit_hook(move |_| {
+        if reject_clone.load(Ordering::SeqCst) {
+            Err(LoroError::ArgErr("rejected".into()))
+        } else {
+            Ok(())
+        }
+    });
+    let child = doc
+        .get_map("map")
+        .insert_container("child", LoroList::new())?;
+    child.push("stale")?;
+    assert!(doc.try_commit().is_err());
+    assert!(doc.get_map("map").get("child").is_none());
+
+    // The next commit reuses the ids of the rejected ops
+    reject.store(false, Ordering::SeqCst);
+    let paths = Arc::new(Mutex::new(Vec::new()));
+    let paths_clone = paths.clone();
+    let _sub = doc.subscribe_root(Arc::new(move |event| {
+        for e in event.events {
+            let path: Vec<ContainerID> = e.path.iter().map(|(id, _)| id.clone()).collect();
+            paths_clone.lock().unwrap().push((e.target.clone(), path));
+        }
+    }));
+    let list = doc.get_list("list");
+    let new_child = list.insert_container(0, LoroList::new())?;
+    assert_eq!(new_child.id(), child.id());
+    assert!(new_child.is_empty());
+    new_child.push("new")?;
+    doc.try_commit()?;
+    assert_eq!(
+        doc.get_deep_value().to_json_value(),
+        json!({"map": {}, "list": [["new"]]})
+    );
+    let paths = paths.lock().unwrap();
+    let (_, path) = paths
+        .iter()
+        .find(|(target, _)| *target == child.id())
+        .unwrap();
+    assert_eq!(path, &vec![list.id(), child.id()]);
+    Ok(())
+}
+
+#[test]
+fn text_search_and_replace() -> LoroResult<()> {
+    use loro::IndexType;
+    let doc = LoroDoc::new();
+    let text = doc.get_text("text");
+    text.insert(0, "ab 你好ab abab")?;
+    text.mark(0..2, "bold", true)?;
+    assert_eq!(text.search("ab"), vec![0..2, 5..7, 8..10, 10..12]);
+    assert_eq!(text.search("aba"), vec![8..11]);
+    assert_eq!(text.search("你好"), vec![3..5]);
+    assert_eq!(
+        text.with_index_type(IndexType::Utf8).search("你好"),
+        vec![3..9]
+    );
+    assert!(text.search("").is_empty());
+    assert!(text.search("abc").is_empty());
+
+    // Matches across the boundary of styled runs
+    assert_eq!(text.search("b 你"), vec![1..4]);
+
+    assert_eq!(text.replace_all("ab", "x")?, 4);
+    assert_eq!(text.to_string(), "x 你好x xx");
+    assert_eq!(
+        text.to_delta().to_json_value(),
+        json!([
+            { "insert": "x", "attributes": { "bold": true } },
+            { "insert": " 你好x xx" },
+        ])
+    );
+    text.replace(2..4, "")?;
+    assert_eq!(text.to_string(), "x x xx");
+    assert!(matches!(
+        text.replace(5..10, "y"),
+        Err(LoroError::OutOfBound { .. })
+    ));
+    Ok(())
+}
+
+#[test]
+fn text_blame_reports_inserting_peers() -> LoroResult<()> {
+    use loro::IndexType;
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let text_a = doc_a.get_text("text");
+    text_a.insert(0, "Hello")?;
+    doc_a.commit();
+
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    let text_b = doc_b.get_text("text");
+    text_b.insert(5, " 😀world")?;
+    text_b.mark(2..8, "bold", true)?;
+    doc_b.commit();
+
+    text_a.delete(1, 1)?;
+    doc_a.commit();
+    doc_a.import(&doc_b.export_from(&doc_a.oplog_vv()))?;
+    assert_eq!(text_a.to_string(), "Hllo 😀world");
+    assert_eq!(
+        text_a.blame(0..11)?,
+        vec![(0..1, 1, 0), (1..4, 1, 2), (4..11, 2, 5)]
+    );
+    assert_eq!(text_a.blame(2..6)?, vec![(2..4, 1, 3), (4..6, 2, 5)]);
+    assert_eq!(
+        text_a.with_index_type(IndexType::Utf16).blame(4..8)?,
+        vec![(4..8, 2, 5)]
+    );
+    assert!(text_a.blame(3..3)?.is_empty());
+    assert!(matches!(
+        text_a.blame(0..12),
+        Err(LoroError::OutOfBound { .. })
+    ));
+    Ok(())
+}
+
+#[test]
+fn merge_foreign_docs_with_each_strategy() -> LoroResult<()> {
+    use loro::{ContainerID, ForeignMergeStrategy};
+
+    let new_doc = || -> LoroResult<LoroDoc> {
+        let doc = LoroDoc::new();
+        doc.set_peer_id(1)?;
+        Ok(doc)
+    };
+    let a = new_doc()?;
+    a.get_text("notes").insert(0, "a")?;
+    a.get_map("meta").insert("title", "A")?;
+    a.commit();
+    // The ids of `b` are the same as the ids of `a`
+    let b = new_doc()?;
+    b.get_text("notes").insert(0, "b")?;
+    b.get_map("meta").insert("author", "B")?;
+    b.get_list("todo").push(1)?;
+    b.get_list("empty");
+    b.commit();
+
+    let rename = new_doc()?;
+    rename.import(&a.export_snapshot())?;
+    let ans = rename.merge_foreign(&b, None, ForeignMergeStrategy::Rename)?;
+    assert_eq!(ans.len(), 3);
+    assert_eq!(
+        ans[0],
+        (
+            ContainerID::new_root("meta", loro::ContainerType::Map),
+            ContainerID::new_root("meta_1", loro::ContainerType::Map)
+        )
+    );
+    assert_eq!(
+        rename.get_deep_value().to_json_value(),
+        json!({
+            "notes": "a",
+            "meta": {"title": "A"},
+            "notes_1": "b",
+            "meta_1": {"author": "B"},
+            "todo": [1],
+        })
+    );
+
+    let merge = new_doc()?;
+    merge.import(&a.export_snapshot())?;
+    merge.merge_foreign(&b, None, ForeignMergeStrategy::Merge)?;
+    assert_eq!(
+        merge.get_deep_value().to_json_value(),
+        json!({"notes": "ab", "meta": {"title": "A", "author": "B"}, "todo": [1]})
+    );
+
+    let skip = new_doc()?;
+    skip.import(&a.export_snapshot())?;
+    skip.merge_foreign(&b, None, ForeignMergeStrategy::Skip)?;
+    assert_eq!(
+        skip.get_deep_value().to_json_value(),
+        json!({"notes": "a", "meta": {"title": "A"}, "todo": [1]})
+    );
+
+    let mounted = new_doc()?;
+    mounted.import(&a.export_snapshot())?;
+    let mount = mounted.get_map("meta").id();
+    mounted.merge_foreign(&b, Some(&mount), ForeignMergeStrategy::Rename)?;
+    assert_eq!(
+        mounted.get_map("meta").get_deep_value().to_json_value(),
+        json!({"title": "A", "meta": {"author": "B"}, "notes": "b", "todo": [1]})
+    );
+    assert!(matches!(
+        mounted.merge_foreign(
+            &b,
+            Some(&mounted.get_text("notes").id()),
+            Default::default()
+        ),
+        Err(LoroError::ArgErr(_))
+    ));
+
+    // The copied ops don't collide with the existing ones
+    let c = LoroDoc::new();
+    c.import(&rename.export_snapshot())?;
+    assert_eq!(c.get_deep_value(), rename.get_deep_value());
+    a.import(&rename.export_from(&a.oplog_vv()))?;
+    assert_eq!(a.get_deep_value(), rename.get_deep_value());
+    Ok(())
+}
+
+#[test]
+fn memory_usage_breaks_down_history_and_state() -> LoroResult<()> {
+    use loro::ContainerType;
+
+    let doc = LoroDoc::new();
+    assert_eq!(doc.memory_usage().history(), 0);
+    let text = doc.get_text("text");
+    let map = doc.get_map("map");
+    for i in 0..100 {
+        text.insert(0, "Hello")?;
+        map.insert("key", i)?;
+        doc.commit();
+    }
+
+    let before = doc.memory_usage();
+    assert!(before.oplog > 0);
+    assert!(before.dag > 0);
+    assert!(before.op_groups > 0);
+    assert!(before.arena > 0);
+    assert_eq!(before.pending_changes, 0);
+    assert!(before.state[&ContainerType::Text] > 0);
+    assert!(before.state[&ContainerType::Map] > 0);
+    assert_eq!(
+        before.total(),
+        before.history() + before.arena + before.total_state() + before.diff
+    );
+
+    // Deleting the text makes the history larger but not the state
+    text.delete(0, text.len_unicode())?;
+    doc.commit();
+    let after = doc.memory_usage();
+    assert!(after.history() > before.history());
+    assert!(after.state[&ContainerType::Text] <= before.state[&ContainerType::Text]);
+
+    // The updates whose deps are missing are pending
+    let vv = doc.oplog_vv();
+    map.insert("key", "new")?;
+    doc.commit();
+    let other = LoroDoc::new();
+    other.import(&doc.export_from(&vv))?;
+    assert!(other.memory_usage().pending_changes > 0);
+    Ok(())
+}
+
+#[test]
+fn movable_list_set_keeps_element_identity() -> LoroResult<()> {
+    use loro::{
+        cursor::Side,
+        event::{Diff, ListDiffItem},
+    };
+
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let list_a = doc_a.get_movable_list("list");
+    for i in 0..3 {
+        list_a.push(i)?;
+    }
+    doc_a.commit();
+    let cursor = list_a.get_cursor(1, Side::Middle).unwrap();
+    let v0 = doc_a.oplog_frontiers();
+    list_a.set(1, "one")?;
+    doc_a.commit();
+    let v1 = doc_a.oplog_frontiers();
+    assert_eq!(doc_a.get_cursor_pos(&cursor).unwrap().current.pos, 1);
+    match doc_a.diff(&v0, &v1)?.get(&list_a.id()).unwrap() {
+        Diff::List(items) => assert!(
+            matches!(&items[..], [ListDiffItem::Retain { retain: 1 }, ListDiffItem::Set { set }] if set.len() == 1)
+        ),
+        _ => unreachable!(),
+    }
+
+    // Concurrent set and move both take effect
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    let list_b = doc_b.get_movable_list("list");
+    list_a.set(0, "zero")?;
+    list_b.mov(0, 2)?;
+    doc_a.commit();
+    doc_b.commit();
+    doc_a.import(&doc_b.export_from(&doc_a.oplog_vv()))?;
+    doc_b.import(&doc_a.export_from(&doc_b.oplog_vv()))?;
+    assert_eq!(
+        list_a.get_value().to_json_value(),
+        json!(["one", 2, "zero"])
+    );
+    assert_eq!(list_a.get_value(), list_b.get_value());
+
+    // Concurrent sets on the same element converge to the last writer
+    list_a.set(2, "a")?;
+    list_b.set(2, "b")?;
+    doc_a.commit();
+    doc_b.commit();
+    doc_a.import(&doc_b.export_from(&doc_a.oplog_vv()))?;
+    doc_b.import(&doc_a.export_from(&doc_b.oplog_vv()))?;
+    assert_eq!(list_a.get_value().to_json_value(), json!(["one", 2, "b"]));
+    assert_eq!(list_a.get_value(), list_b.get_value());
+
+    // Setting an element that is inserted in the same change is not an in-place update
+    let items = Arc::new(std::sync::Mutex::new(Vec::new()));
+    let items_clone = items.clone();
+    let _sub = doc_a.subscribe(
+        &list_a.id(),
+        Arc::new(move |e| {
+            for c in e.events {
+                if let Diff::List(list) = &c.diff {
+                    items_clone.lock().unwrap().extend(
+                        list.iter()
+                            .map(|item| matches!(item, ListDiffItem::Set { .. })),
+                    );
+                }
+            }
+        }),
+    );
+    list_a.delete(1, 1)?;
+    list_a.insert(1, "new")?;
+    list_a.set(1, "set")?;
+    doc_a.commit();
+    assert_eq!(
+        list_a.get_value().to_json_value(),
+        json!(["one", "set", "b"])
+    );
+    let items = items.lock().unwrap();
+    assert!(!items.is_empty());
+    assert!(items.iter().all(|is_set| !is_set));
+    assert_eq!(list_a.len(), 3);
+    Ok(())
+}
+
+#[test]
+fn get_changes_in_range_with_commit_messages() -> LoroResult<()> {
+    use loro::{CommitOptions, Frontiers};
+
+    let a = LoroDoc::new();
+    a.set_peer_id(1)?;
+    let b = LoroDoc::new();
+    b.set_peer_id(2)?;
+    a.get_text("text").insert(0, "a")?;
+    a.commit_with(CommitOptions::new().commit_msg("first"));
+    let first = a.oplog_frontiers();
+    b.import(&a.export_from(&Default::default()))?;
+    b.get_text("text").insert(1, "b")?;
+    b.commit();
+    a.get_text("text").insert(1, "c")?;
+    a.commit_with(CommitOptions::new().commit_msg("second"));
+    a.import(&b.export_from(&Default::default()))?;
+
+    let changes = a.get_changes_in_range(&Frontiers::default(), &a.oplog_frontiers())?;
+    assert_eq!(changes.len(), 3);
+    assert_eq!(changes[0].id, ID::new(1, 0));
+    assert_eq!(changes[0].message.as_deref(), Some("first"));
+    assert_eq!(changes[1].id, ID::new(1, 1));
+    assert_eq!(changes[1].message.as_deref(), Some("second"));
+    assert_eq!(changes[1].deps, first);
+    assert_eq!(changes[2].id, ID::new(2, 0));
+    assert_eq!(changes[2].message, None);
+    assert_eq!(changes[2].deps, first);
+
+    // Only the changes after `first` are returned
+    let after_first = a.get_changes_in_range(&first, &a.oplog_frontiers())?;
+    assert_eq!(after_first, changes[1..].to_vec());
+
+    // The commit messages are kept in the json updates
+    let c = LoroDoc::new();
+    c.import_json_updates(a.export_json_updates(&Default::default(), &a.oplog_vv()))?;
+    assert_eq!(
+        c.get_changes_in_range(&Frontiers::default(), &c.oplog_frontiers())?,
+        changes
+    );
+
+    assert!(matches!(
+        a.get_changes_in_range(&Frontiers::from_id(ID::new(3, 0)), &a.oplog_frontiers()),
+        Err(LoroError::FrontiersNotFound(_))
+    ));
+    Ok(())
+}
+
+#[test]
+fn commit_message_and_author_survive_export_and_import() -> LoroResult<()> {
+    use loro::{CommitOptions, Frontiers};
+
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let text = doc.get_text("text");
+    text.insert(0, "a")?;
+    doc.commit_with(CommitOptions::new().commit_msg("first").author("Alice"));
+    text.insert(1, "b")?;
+    doc.commit_with(CommitOptions::new().author("Alice"));
+    text.insert(2, "c")?;
+    doc.commit_with(CommitOptions::new().author("Bob"));
+    text.insert(3, "d")?;
+    doc.commit_with(CommitOptions::new().author("Bob"));
+
+    assert_eq!(doc.change_message(ID::new(1, 0)).as_deref(), Some("first"));
+    assert_eq!(doc.change_author(ID::new(1, 0)).as_deref(), Some("Alice"));
+    assert_eq!(doc.change_message(ID::new(1, 1)), None);
+    assert_eq!(doc.change_author(ID::new(1, 3)).as_deref(), Some("Bob"));
+    assert_eq!(doc.change_author(ID::new(2, 0)), None);
+    let changes = doc.get_changes_in_range(&Frontiers::default(), &doc.oplog_frontiers())?;
+    // The commits of Bob are merged
+    assert_eq!(changes.len(), 3);
+    assert_eq!(changes[2].len, 2);
+
+    let from_updates = LoroDoc::new();
+    from_updates.import(&doc.export_from(&Default::default()))?;
+    let from_snapshot = LoroDoc::new();
+    from_snapshot.import(&doc.export_snapshot())?;
+    for new_doc in [from_updates, from_snapshot] {
+        assert_eq!(
+            new_doc.get_changes_in_range(&Frontiers::default(), &new_doc.oplog_frontiers())?,
+            changes
+        );
+    }
+
+    // The changes without metadata are encoded as before
+    let plain = LoroDoc::new();
+    plain.get_text("text").insert(0, "a")?;
+    plain.commit();
+    let new_doc = LoroDoc::new();
+    new_doc.import(&plain.export_from(&Default::default()))?;
+    assert_eq!(new_doc.change_message(ID::new(plain.peer_id(), 0)), None);
+    assert_eq!(new_doc.change_author(ID::new(plain.peer_id(), 0)), None);
+    Ok(())
+}
+
+#[test]
+fn validate_doc_after_fork_and_import() -> LoroResult<()> {
+    use loro::Frontiers;
+
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let map = doc.get_map("map");
+    let list = map.insert_container("list", LoroList::new())?;
+    list.insert(0, 1)?;
+    doc.commit();
+    let fork = doc.fork();
+    fork.get_map("map").insert("key", "value")?;
+    fork.commit();
+    list.insert(1, 2)?;
+    doc.commit();
+    doc.import(&fork.export_from(&doc.oplog_vv()))?;
+    fork.import(&doc.export_from(&fork.oplog_vv()))?;
+    assert!(doc.validate().is_empty());
+    assert!(fork.validate().is_empty());
+
+    doc.checkout(&Frontiers::from_id(ID::new(1, 0)))?;
+    assert!(doc.validate().is_empty());
+    assert!(doc.repair().is_empty());
+    doc.attach();
+    assert_eq!(doc.get_deep_value(), fork.get_deep_value());
+    Ok(())
+}
+
+#[test]
+fn list_iter_yields_values_and_containers_lazily() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    let list = doc.get_list("list");
+    for i in 0..1000 {
+        list.push(i)?;
+    }
+    let map = list.insert_container(500, LoroMap::new())?;
+    map.insert("key", "value")?;
+
+    let mut count = 0;
+    for (i, v) in list.iter().enumerate() {
+        if i == 500 {
+            assert_eq!(v.right().unwrap().id(), map.id());
+        } else {
+            let expected = (if i < 500 { i } else { i - 1 }) as i64;
+            assert_eq!(v.left(), Some(expected.into()));
+        }
+        count += 1;
+    }
+    assert_eq!(count, list.len());
+    Ok(())
+}
+
+#[test]
+fn peek_snapshot_meta_and_previews() -> LoroResult<()> {
+    use loro::{ContainerID, ContainerType, LoroValue};
+
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    doc.get_text("title").insert(0, "Notes")?;
+    let meta_map = doc.get_map("meta");
+    meta_map.insert("size", 3)?;
+    let tags = meta_map.insert_container("tags", LoroList::new())?;
+    tags.push("a")?;
+    doc.get_list("items").push(1)?;
+    doc.commit();
+    // The changes of another peer depend on the first ones
+    let other = doc.fork();
+    other.set_peer_id(2)?;
+    other.get_text("title").insert(5, "!")?;
+    other.get_movable_list("order").push("x")?;
+    other.commit();
+    doc.import(&other.export_from(&doc.oplog_vv()))?;
+
+    let title = ContainerID::new_root("title", ContainerType::Text);
+    let meta = ContainerID::new_root("meta", ContainerType::Map);
+    let order = ContainerID::new_root("order", ContainerType::MovableList);
+    let missing = ContainerID::new_root("missing", ContainerType::Text);
+    let snapshot = doc.export_snapshot();
+    let peeked = LoroDoc::peek(&snapshot, &[title.clone(), meta.clone(), missing.clone()])?;
+    assert!(peeked.meta.is_snapshot);
+    let blob_meta = LoroDoc::decode_import_blob_meta(&snapshot)?;
+    assert_eq!(peeked.meta.partial_end_vv, blob_meta.partial_end_vv);
+    assert_eq!(peeked.meta.change_num, blob_meta.change_num);
+    assert_eq!(peeked.meta.end_timestamp, blob_meta.end_timestamp);
+    assert_eq!(peeked.container_num, 5);
+    assert_eq!(peeked.previews[&title], LoroValue::from("Notes!"));
+    // The values are shallow
+    assert_eq!(peeked.previews[&meta], doc.get_map("meta").get_value());
+    assert!(!peeked.previews.contains_key(&missing));
+    // The movable lists are decoded with the history
+    let peeked = LoroDoc::peek(&snapshot, &[order.clone()])?;
+    assert_eq!(
+        peeked.previews[&order],
+        doc.get_movable_list("order").get_value()
+    );
+
+    // The previews are only decoded from snapshots
+    let peeked = LoroDoc::peek(&doc.export_from(&Default::default()), &[title])?;
+    assert!(!peeked.meta.is_snapshot);
+    assert_eq!(peeked.container_num, 5);
+    assert!(peeked.previews.is_empty());
+    Ok(())
+}
+
+#[test]
+fn apply_delta_in_one_change() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    let text = doc.get_text("text");
+    text.insert(0, "Hello World!")?;
+    text.mark(0..5, "bold", true)?;
+    doc.commit();
+    let events = Arc::new(std::sync::Mutex::new(Vec::new()));
+    let events_clone = events.clone();
+    let _sub = doc.subscribe_root(Arc::new(move |e| {
+        for c in e.events {
+            if let loro::event::Diff::Text(delta) = &c.diff {
+                events_clone.lock().unwrap().push(delta.clone());
+            }
+        }
+    }));
+
+    let delta: Vec<TextDelta> = serde_json::from_value(json!([
+        { "retain": 5 },
+        // It would inherit the bold style if it's inserted by `insert`
+        { "insert": "," },
+        { "retain": 1 },
+        { "delete": 5 },
+        { "insert": "Alice", "attributes": { "italic": true } },
+    ]))
+    .unwrap();
+    text.apply_delta(&delta)?;
+    doc.commit();
+    assert_eq!(events.lock().unwrap().len(), 1);
+    assert_eq!(
+        text.to_delta().to_json_value(),
+        json!([
+            { "insert": "Hello", "attributes": { "bold": true } },
+            { "insert": ", " },
+            { "insert": "Alice", "attributes": { "italic": true } },
+            { "insert": "!" },
+        ])
+    );
+
+    // An invalid delta doesn't change the text
+    let ops = doc.len_ops();
+    let out_of_bound: Vec<TextDelta> = serde_json::from_value(json!([
+        { "insert": "Hi" },
+        { "retain": 20 },
+        { "delete": 1 },
+    ]))
+    .unwrap();
+    assert!(matches!(
+        text.apply_delta(&out_of_bound),
+        Err(LoroError::OutOfBound { .. })
+    ));
+    let mark_out_of_bound: Vec<TextDelta> = serde_json::from_value(json!([
+        { "insert": "x" },
+        { "retain": 20, "attributes": { "bold": true } },
+    ]))
+    .unwrap();
+    assert!(matches!(
+        text.apply_delta(&mark_out_of_bound),
+        Err(LoroError::OutOfBound { .. })
+    ));
+    let missing_config: Vec<TextDelta> = serde_json::from_value(json!([
+        { "insert": "Hi" },
+        { "retain": 2, "attributes": { "unknown": true } },
+    ]))
+    .unwrap();
+    assert!(matches!(
+        text.apply_delta(&missing_config),
+        Err(LoroError::StyleConfigMissing(_))
+    ));
+    doc.commit();
+    assert_eq!(doc.len_ops(), ops);
+    assert_eq!(text.to_string(), "Hello, Alice!");
+    Ok(())
+}
+
+#[test]
+fn mark_with_expand_is_kept_per_mark() -> LoroResult<()> {
+    use loro::ExpandType;
+
+    let doc_a = LoroDoc::new();
+    doc_a.set_peer_id(1)?;
+    let text_a = doc_a.get_text("text");
+    text_a.insert(0, "Hello World")?;
+    // "bold" is configured to expand after by default
+    text_a.mark_with_expand(0..5, "bold", true, ExpandType::None)?;
+    text_a.mark_with_expand(6..11, "bold", true, ExpandType::Before)?;
+    doc_a.commit();
+    let doc_b = LoroDoc::new();
+    doc_b.set_peer_id(2)?;
+    doc_b.import(&doc_a.export_snapshot())?;
+    let text_b = doc_b.get_text("text");
+
+    // Concurrent inserts at the boundaries of the marks
+    text_a.insert(5, ",")?;
+    text_b.insert(11, "!")?;
+    text_b.insert(6, "my ")?;
+    doc_a.import(&doc_b.export_from(&Default::default()))?;
+    doc_b.import(&doc_a.export_from(&Default::default()))?;
+    let expected = json!([
+        { "insert": "Hello", "attributes": { "bold": true } },
+        { "insert": ", " },
+        { "insert": "my World", "attributes": { "bold": true } },
+        { "insert": "!" },
+    ]);
+    assert_eq!(text_a.to_delta().to_json_value(), expected);
+    assert_eq!(text_b.to_delta().to_json_value(), expected);
+
+    // The expand type survives the encoding
+    let doc_c = LoroDoc::new();
+    doc_c.import(&doc_a.export_snapshot())?;
+    let text_c = doc_c.get_text("text");
+    text_c.insert(text_c.len_unicode(), "?")?;
+    text_c.insert(7, "oh ")?;
+    assert_eq!(text_c.to_string(), "Hello, oh my World!?");
+    assert_eq!(
+        text_c.to_delta().to_json_value(),
+        json!([
+            { "insert": "Hello", "attributes": { "bold": true } },
+            { "insert": ", " },
+            { "insert": "oh my World", "attributes": { "bold": true } },
+            { "insert": "!?" },
+        ])
+    );
+    Ok(())
+}
+
+#[test]
+fn subscribe_local_ops_to_replicate() -> LoroResult<()> {
+    use loro::JsonSchema;
+
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let updates: Arc<std::sync::Mutex<Vec<JsonSchema>>> = Default::default();
+    let updates_cp = updates.clone();
+    let sub = doc.subscribe_local_ops(Arc::new(move |ops| {
+        updates_cp.lock().unwrap().push(ops.clone());
+    }));
+
+    let text = doc.get_text("text");
+    text.insert(0, "Hello")?;
+    doc.commit();
+    doc.get_map("map").insert("key", 1)?;
+    text.delete(0, 1)?;
+    doc.commit();
+    // Empty commits and imported changes are not reported
+    doc.commit();
+    let other = LoroDoc::new();
+    other.set_peer_id(2)?;
+    other.get_list("list").push(1)?;
+    other.commit();
+    doc.import(&other.export_from(&Default::default()))?;
+
+    let replica = LoroDoc::new();
+    {
+        let updates = updates.lock().unwrap();
+        assert_eq!(updates.len(), 2);
+        assert_eq!(updates[0].peers, vec![1]);
+        assert_eq!(updates[0].changes.len(), 1);
+        assert_eq!(updates[0].changes[0].ops.len(), 1);
+        assert_eq!(updates[1].changes[0].id.counter, 5);
+        assert_eq!(updates[1].changes[0].ops.len(), 2);
+        for ops in updates.iter() {
+            replica.import_json_updates(ops.clone())?;
+        }
+    }
+    assert_eq!(
+        replica.get_deep_value().to_json_value(),
+        json!({"text": "ello", "map": {"key": 1}})
+    );
+
+    doc.unsubscribe(sub);
+    text.insert(0, "H")?;
+    doc.commit();
+    assert_eq!(updates.lock().unwrap().len(), 2);
+    Ok(())
+}
+
+#[test]
+fn with_version_restores_the_doc() -> LoroResult<()> {
+    use loro::Frontiers;
+
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let text = doc.get_text("text");
+    text.insert(0, "a")?;
+    doc.commit();
+    let v1 = doc.oplog_frontiers();
+    text.insert(1, "b")?;
+    doc.commit();
+    let v2 = doc.oplog_frontiers();
+    text.insert(2, "c")?;
+
+    // Nested calls restore the version of the outer call
+    let values = doc.with_version(&v2, |doc| -> LoroResult<_> {
+        let inner = doc.with_version(&v1, |doc| doc.get_text("text").to_string())?;
+        assert!(doc.is_detached());
+        assert_eq!(doc.state_frontiers(), v2);
+        Ok((inner, doc.get_text("text").to_string()))
+    })??;
+    assert_eq!(values, ("a".to_string(), "ab".to_string()));
+    assert!(!doc.is_detached());
+    assert_eq!(text.to_string(), "abc");
+
+    // The doc is restored after a panic
+    let result = std::panic::catch_unwind(std::panic::AssertUnwindSafe(|| {
+        doc.with_version(&v1, |_| panic!("oops")).unwrap();
+    }));
+    assert!(result.is_err());
+    assert!(!doc.is_detached());
+    assert_eq!(text.to_string(), "abc");
+
+    // A detached doc is checked out to its version again
+    doc.checkout(&v1)?;
+    doc.with_version(&v2, |doc| {
+        assert_eq!(doc.get_text("text").to_string(), "ab")
+    })?;
+    assert!(doc.is_detached());
+    assert_eq!(doc.state_frontiers(), v1);
+    doc.attach();
+
+    let missing = Frontiers::from(ID::new(2, 0));
+    assert!(matches!(
+        doc.with_version(&missing, |_| unreachable!()),
+        Err(LoroError::FrontiersNotFound(_))
+    ));
+    assert!(!doc.is_detached());
+    Ok(())
+}
+
+#[test]
+fn tree_move_out_of_deleted_parent_is_a_move_event() -> LoroResult<()> {
+    let doc = LoroDoc::new();
+    doc.set_peer_id(1)?;
+    let tree = doc.get_tree("tree");
+    let d = tree.create(None)?;
+    let p = tree.create(None)?;
+    let n = tree.create(d)?;
+    doc.commit();
+    let base = doc.export_snapshot();
+    let base_vv = doc.oplog_vv();
+
+    let other = LoroDoc::new();
+    other.set_peer_id(2)?;
+    other.import(&base)?;
+    // Delete the old parent concurrently, before the move in lamport order
+    tree.delete(d)?;
+    doc.commit();
+    other.get_map("map").insert("key", "value")?;
+    other.get_tree("tree").mov(n, p)?;
+    other.commit();
+    doc.import(&other.export_from(&base_vv))?;
+
+    let receiver = LoroDoc::new();
+    receiver.import(&base)?;
+    let events = Arc::new(std::sync::Mutex::new(Vec::new()));
+    let events_clone = events.clone();
+    let _sub = receiver.subscribe_root(Arc::new(move |e| {
+        for c in e.events {
+            if let loro::event::Diff::Tree(diff) = &c.diff {
+                events_clone
+                    .lock()
+                    .unwrap()
+                    .extend(diff.diff.iter().map(|x| (x.target, x.action.clone())));
+            }
+        }
+    }));
+    receiver.import(&doc.export_from(&base_vv))?;
+    assert_eq!(receiver.get_deep_value(), doc.get_deep_value());
+
+    let events = events.lock().unwrap();
+    assert_eq!(events.len(), 2);
+    assert_eq!(events[0].0, n);
+    assert!(matches!(
+        &events[0].1,
+        loro::TreeExternalDiff::Move { parent: Some(parent), index: 0, old_parent, old_index: 0, .. }
+            if *parent == p && old_parent.into_node().ok() == Some(d)
+    ));
+    assert_eq!(events[1].0, d);
+    assert!(matches!(
+        &events[1].1,
+        loro::TreeExternalDiff::Delete { old_index: 0, .. }
+    ));
+    Ok(())
+}
@@ -191,6 +191,13 @@ export function getType<T>(
 declare module "loro-wasm" {
   interface Loro {
     subscribe(listener: Listener): number;
+    /**
+     * Calculate the diff between two versions.
+     *
+     * Applying the diff on the state at `from` turns it into the state at `to`.
+     * The current state of the doc is not changed and no event is emitted.
+     */
+    diff(from: OpId[], to: OpId[]): { target: ContainerID; diff: Diff }[];
   }
 
   interface UndoManager {
@@ -647,6 +654,11 @@ declare module "loro-wasm" {
     getAllStates(): Record<PeerID, T>;
     setLocalState(value: T): void;
     removeOutdated(): PeerID[];
+    subscribe(
+      listener: (
+        change: { added: PeerID[]; updated: PeerID[]; removed: PeerID[] },
+      ) => void,
+    ): number;
   }
 }
 
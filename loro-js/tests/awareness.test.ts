@@ -95,6 +95,27 @@ describe("Awareness", () => {
     expect(i).toBeGreaterThanOrEqual(3);
   });
 
+  it("subscribe", async () => {
+    const a = new AwarenessWasm("1", 30_000);
+    const b = new AwarenessWasm("2", 30_000);
+    const changes: unknown[] = [];
+    const sub = b.subscribe((change) => {
+      changes.push(change);
+    });
+    a.setLocalState("a");
+    b.apply(a.encode(["1"]));
+    b.setLocalState("b");
+    await new Promise((r) => setTimeout(r, 1));
+    expect(changes).toStrictEqual([
+      { added: ["1"], updated: [], removed: [] },
+      { added: ["2"], updated: [], removed: [] },
+    ]);
+    expect(b.unsubscribe(sub)).toBe(true);
+    b.setLocalState("c");
+    await new Promise((r) => setTimeout(r, 1));
+    expect(changes.length).toBe(2);
+  });
+
   it("consistency", () => {
     const a = new AwarenessWasm("1", 10);
     const b = new AwarenessWasm("2", 10);
@@ -197,6 +197,27 @@ describe("movable list", () => {
     expect(calledTimes).toBe(1);
   });
 
+  it("reports set as a set delta", async () => {
+    const doc = new Loro();
+    const list = doc.getMovableList("list");
+    list.push("a");
+    list.push("b");
+    doc.commit();
+    let diff: ListDiff | undefined;
+    list.subscribe((event) => {
+      diff = event.events[0].diff as ListDiff;
+    });
+    list.set(1, "c");
+    doc.commit();
+    await new Promise((r) => setTimeout(r, 1));
+    expect(diff).toStrictEqual(
+      {
+        "type": "list",
+        "diff": [{ retain: 1 }, { set: ["c"] }],
+      } as ListDiff,
+    );
+  });
+
   it("has the right type", () => {
     const doc = new Loro<
       { list: LoroMovableList<LoroMap<{ name: string }>> }